@@ -49,6 +49,9 @@ do
     rm -f $GOPATH/bin/keygen
     # Build
     gox -osarch="${plat}/${arc}" -ldflags "-s -w" -output $GOPATH/bin/keygen ./keygen > /dev/null
+    # Template linter is database-independent too
+    rm -f $GOPATH/bin/templ-lint
+    gox -osarch="${plat}/${arc}" -ldflags "-s -w" -output $GOPATH/bin/templ-lint ./templ-lint > /dev/null
 
     for dbtag in "${dbtags[@]}"
     do
@@ -113,6 +116,7 @@ do
         cp $GOPATH/bin/tinode.exe ./releases/tmp
         cp $GOPATH/bin/init-db.exe ./releases/tmp
         cp $GOPATH/bin/keygen.exe ./releases/tmp
+        cp $GOPATH/bin/templ-lint.exe ./releases/tmp
 
         # Remove possibly existing archive.
         rm -f ./releases/${version}/tinode-${dbtag}."${plat}-${arc}".zip
@@ -130,6 +134,7 @@ do
         cp $GOPATH/bin/tinode ./releases/tmp
         cp $GOPATH/bin/init-db ./releases/tmp
         cp $GOPATH/bin/keygen ./releases/tmp
+        cp $GOPATH/bin/templ-lint ./releases/tmp
 
         # Remove possibly existing archive.
         rm -f ./releases/${version}/tinode-${dbtag}."${plat2}-${arc}".tar.gz
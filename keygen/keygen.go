@@ -5,24 +5,34 @@ import (
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"strings"
+	"time"
 )
 
 // Generate API key
-// Composition:
+// Version 1 composition:
 //  [1:algorithm version][4:deprecated (used to be application ID)][2:key sequence][1:isRoot][16:signature] = 24 bytes
 // convertible to base64 without padding
+// Version 2 composition:
+//  [1:algorithm version][2:key sequence][1:isRoot][4:expires][2:scopes][2:N][N:restrictions][16:signature]
 // All integers are little-endian
 func main() {
 	var version = flag.Int("sequence", 1, "Sequential number of the API key")
 	var isRoot = flag.Int("isroot", 0, "Is this a root API key?")
 	var apikey = flag.String("validate", "", "API key to validate")
 	var hmacSalt = flag.String("salt", "auto", "HMAC salt, 32 random bytes base64 encoded or 'auto' to generate salt")
+	var expires = flag.String("expires", "", "Expiration date of the key, YYYY-MM-DD or RFC 3339; the key never expires if blank")
+	var scopes = flag.String("scopes", "all", "Comma-separated list of permitted operations: account, upload, write; 'all' or 'read'")
+	var restrict = flag.String("restrict", "", "Comma-separated list of allowed origins and IP addresses or CIDR ranges")
+	var legacy = flag.Bool("legacy", false, "Generate version 1 key without expiration, scopes and restrictions")
 
 	flag.Parse()
 
@@ -32,8 +42,10 @@ func main() {
 			os.Exit(1)
 		}
 		os.Exit(validate(*apikey, *hmacSalt))
-	} else {
+	} else if *legacy {
 		os.Exit(generate(*version, *isRoot, *hmacSalt))
+	} else {
+		os.Exit(generateV2(*version, *isRoot, *hmacSalt, *expires, *scopes, *restrict))
 	}
 }
 
@@ -50,31 +62,104 @@ const (
 	APIKEY_SIGNATURE = 16
 	// APIKEY_LENGTH is total length of the key
 	APIKEY_LENGTH = APIKEY_VERSION + APIKEY_APPID + APIKEY_SEQUENCE + APIKEY_WHO + APIKEY_SIGNATURE
-)
 
-func generate(sequence, isRoot int, hmacSaltB64 string) int {
+	// APIKEY_EXPIRES is expiration time of the key, version 2
+	APIKEY_EXPIRES = 4
+	// APIKEY_SCOPES is a bitmap of permitted operations, version 2
+	APIKEY_SCOPES = 2
+	// APIKEY_RESTR_LEN is length of the list of restrictions, version 2
+	APIKEY_RESTR_LEN = 2
+	// APIKEY_V2_HEADER is the length of the fixed part of version 2 key
+	APIKEY_V2_HEADER = APIKEY_VERSION + APIKEY_SEQUENCE + APIKEY_WHO + APIKEY_EXPIRES + APIKEY_SCOPES + APIKEY_RESTR_LEN
+)
 
-	var data [APIKEY_LENGTH]byte
-	var hmacSalt []byte
+// Names of scopes in the order of bits.
+var scopeNames = []string{"account", "upload", "write"}
 
+func parseSalt(hmacSaltB64 string) ([]byte, error) {
 	if hmacSaltB64 == "auto" {
-		hmacSalt = make([]byte, 32)
+		hmacSalt := make([]byte, 32)
 		_, err := rand.Read(hmacSalt)
-		if err != nil {
-			log.Println("Error: Failed to generate HMAC salt", err)
-			return 1
+		return hmacSalt, err
+	}
+
+	hmacSalt, err := base64.URLEncoding.DecodeString(hmacSaltB64)
+	if err != nil {
+		// Try standard base64 decoding
+		hmacSalt, err = base64.StdEncoding.DecodeString(hmacSaltB64)
+	}
+	return hmacSalt, err
+}
+
+func parseScopes(scopes string) (uint16, error) {
+	var bits uint16
+	for _, name := range strings.Split(scopes, ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		switch name {
+		case "all":
+			bits |= 1<<uint(len(scopeNames)) - 1
+		case "read", "":
+		default:
+			found := false
+			for i, sname := range scopeNames {
+				if name == sname {
+					bits |= 1 << uint(i)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return 0, fmt.Errorf("unknown scope '%s'", name)
+			}
 		}
-	} else {
-		var err error
-		hmacSalt, err = base64.URLEncoding.DecodeString(hmacSaltB64)
-		if err != nil {
-			// Try standard base64 decoding
-			hmacSalt, err = base64.StdEncoding.DecodeString(hmacSaltB64)
+	}
+	return bits, nil
+}
+
+func scopesToString(bits uint16) string {
+	var names []string
+	for i, sname := range scopeNames {
+		if bits&(1<<uint(i)) != 0 {
+			names = append(names, sname)
 		}
-		if err != nil {
-			log.Println("Error: Failed to decode HMAC salt", err)
-			return 1
+	}
+	if len(names) == 0 {
+		return "read"
+	}
+	return strings.Join(names, ",")
+}
+
+func parseRestrictions(restrict string) (string, error) {
+	if restrict == "" {
+		return "", nil
+	}
+	var items []string
+	for _, item := range strings.Split(restrict, ",") {
+		item = strings.TrimSpace(item)
+		if strings.Contains(item, "://") {
+			items = append(items, strings.ToLower(item))
+			continue
 		}
+		if strings.Contains(item, "/") {
+			if _, _, err := net.ParseCIDR(item); err != nil {
+				return "", err
+			}
+		} else if net.ParseIP(item) == nil {
+			return "", fmt.Errorf("invalid IP address '%s'", item)
+		}
+		items = append(items, item)
+	}
+	return strings.Join(items, ","), nil
+}
+
+func generate(sequence, isRoot int, hmacSaltB64 string) int {
+
+	var data [APIKEY_LENGTH]byte
+
+	hmacSalt, err := parseSalt(hmacSaltB64)
+	if err != nil {
+		log.Println("Error: Failed to obtain HMAC salt", err)
+		return 1
 	}
 	// Make sure the salt is base64std encoded: tinode.conf requires std encoding.
 	hmacSaltB64 = base64.StdEncoding.EncodeToString(hmacSalt)
@@ -105,6 +190,75 @@ func generate(sequence, isRoot int, hmacSaltB64 string) int {
 	return 0
 }
 
+func generateV2(sequence, isRoot int, hmacSaltB64, expires, scopes, restrict string) int {
+	hmacSalt, err := parseSalt(hmacSaltB64)
+	if err != nil {
+		log.Println("Error: Failed to obtain HMAC salt", err)
+		return 1
+	}
+	hmacSaltB64 = base64.StdEncoding.EncodeToString(hmacSalt)
+
+	var expiresAt time.Time
+	if expires != "" {
+		if expiresAt, err = time.Parse(time.RFC3339, expires); err != nil {
+			if expiresAt, err = time.Parse("2006-01-02", expires); err != nil {
+				log.Println("Error: Invalid expiration date", err)
+				return 1
+			}
+		}
+	}
+
+	scopeBits, err := parseScopes(scopes)
+	if err != nil {
+		log.Println("Error: Invalid scopes", err)
+		return 1
+	}
+
+	restr, err := parseRestrictions(restrict)
+	if err != nil {
+		log.Println("Error: Invalid restrictions", err)
+		return 1
+	}
+
+	data := make([]byte, APIKEY_V2_HEADER+len(restr)+APIKEY_SIGNATURE)
+	data[0] = 2
+	offset := APIKEY_VERSION
+	binary.LittleEndian.PutUint16(data[offset:], uint16(sequence))
+	offset += APIKEY_SEQUENCE
+	data[offset] = uint8(isRoot)
+	offset += APIKEY_WHO
+	if !expiresAt.IsZero() {
+		binary.LittleEndian.PutUint32(data[offset:], uint32(expiresAt.Unix()))
+	}
+	offset += APIKEY_EXPIRES
+	binary.LittleEndian.PutUint16(data[offset:], scopeBits)
+	offset += APIKEY_SCOPES
+	binary.LittleEndian.PutUint16(data[offset:], uint16(len(restr)))
+	copy(data[APIKEY_V2_HEADER:], restr)
+
+	hasher := hmac.New(sha256.New, hmacSalt)
+	hasher.Write(data[:APIKEY_V2_HEADER+len(restr)])
+	copy(data[APIKEY_V2_HEADER+len(restr):], hasher.Sum(nil)[:APIKEY_SIGNATURE])
+
+	var strIsRoot string
+	if isRoot == 1 {
+		strIsRoot = "ROOT"
+	} else {
+		strIsRoot = "ordinary"
+	}
+
+	strExpires := "never"
+	if !expiresAt.IsZero() {
+		strExpires = expiresAt.UTC().Format(time.RFC3339)
+	}
+
+	fmt.Printf("API key v%d seq%d [%s] scopes [%s] expires [%s] restricted to [%s]: %s\nUsed HMAC salt: %s\n",
+		2, sequence, strIsRoot, scopesToString(scopeBits), strExpires, restr,
+		base64.RawURLEncoding.EncodeToString(data), hmacSaltB64)
+
+	return 0
+}
+
 func validate(apikey string, hmacSaltB64 string) int {
 	var version uint8
 	var deprecated uint32
@@ -123,14 +277,22 @@ func validate(apikey string, hmacSaltB64 string) int {
 		return 1
 	}
 
-	if declen := base64.URLEncoding.DecodedLen(len(apikey)); declen != APIKEY_LENGTH {
-		log.Printf("Error: Invalid key length %d, expecting %d", declen, APIKEY_LENGTH)
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(apikey, "="))
+	if err != nil {
+		log.Println("Error: Failed to decode key as base64-URL-encoded", err)
+		return 1
+	}
+	if len(data) == 0 {
+		log.Println("Error: Empty key")
 		return 1
 	}
 
-	data, err := base64.URLEncoding.DecodeString(apikey)
-	if err != nil {
-		log.Println("Error: Failed to decode key as base64-URL-encoded", err)
+	if data[0] == 2 {
+		return validateV2(data, hmacSalt)
+	}
+
+	if len(data) != APIKEY_LENGTH {
+		log.Printf("Error: Invalid key length %d, expecting %d", len(data), APIKEY_LENGTH)
 		return 1
 	}
 
@@ -164,3 +326,49 @@ func validate(apikey string, hmacSaltB64 string) int {
 	fmt.Printf("Valid v%d seq%d, [%s]\n", version, sequence, strIsRoot)
 	return 0
 }
+
+func validateV2(data, hmacSalt []byte) int {
+	if len(data) < APIKEY_V2_HEADER+APIKEY_SIGNATURE {
+		log.Printf("Error: Invalid key length %d", len(data))
+		return 1
+	}
+	restrLen := int(binary.LittleEndian.Uint16(data[APIKEY_V2_HEADER-APIKEY_RESTR_LEN:]))
+	if len(data) != APIKEY_V2_HEADER+restrLen+APIKEY_SIGNATURE {
+		log.Printf("Error: Invalid key length %d, expecting %d", len(data), APIKEY_V2_HEADER+restrLen+APIKEY_SIGNATURE)
+		return 1
+	}
+
+	hasher := hmac.New(sha256.New, hmacSalt)
+	hasher.Write(data[:APIKEY_V2_HEADER+restrLen])
+	signature := hasher.Sum(nil)[:APIKEY_SIGNATURE]
+	if !bytes.Equal(data[APIKEY_V2_HEADER+restrLen:], signature) {
+		log.Println("Error: Invalid signature ", data, signature)
+		return 1
+	}
+
+	offset := APIKEY_VERSION
+	sequence := binary.LittleEndian.Uint16(data[offset:])
+	offset += APIKEY_SEQUENCE
+	isRoot := data[offset]
+	offset += APIKEY_WHO
+	expires := binary.LittleEndian.Uint32(data[offset:])
+	offset += APIKEY_EXPIRES
+	scopeBits := binary.LittleEndian.Uint16(data[offset:])
+
+	strIsRoot := "ordinary"
+	if isRoot == 1 {
+		strIsRoot = "ROOT"
+	}
+	strExpires := "never"
+	if expires != 0 {
+		expiresAt := time.Unix(int64(expires), 0).UTC()
+		strExpires = expiresAt.Format(time.RFC3339)
+		if expiresAt.Before(time.Now()) {
+			strExpires += ", EXPIRED"
+		}
+	}
+
+	fmt.Printf("Valid v%d seq%d, [%s] scopes [%s] expires [%s] restricted to [%s]\n", 2, sequence, strIsRoot,
+		scopesToString(scopeBits), strExpires, string(data[APIKEY_V2_HEADER:APIKEY_V2_HEADER+restrLen]))
+	return 0
+}
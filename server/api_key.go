@@ -9,11 +9,19 @@
 package main
 
 import (
-	"bytes"
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"hash"
 	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
 )
 
 // Singned AppID. Composition:
@@ -35,36 +43,239 @@ const (
 	apikeyLength = apikeyVersion + apikeyAppID + apikeySequence + apikeyWho + apikeySignature
 )
 
-// Client signature validation
-//   key: client's secret key
-// Returns application id, key type
-func checkAPIKey(apikey string) (isValid, isRoot bool) {
+// Scoped API key, version 2. Composition:
+//   [1:algorithm version][2:key sequence][1:isRoot][4:expires][2:scopes][2:N][N:restrictions][16:signature]
+// The 'expires' is a Unix timestamp in seconds, 0 means the key never expires. The 'restrictions' is
+// a comma-separated list of allowed origins and IP addresses or CIDR ranges. The signature is a truncated
+// HMAC-SHA256. The key is base64-URL encoded.
+const (
+	// apikeyV2Expires is the expiration time of the key.
+	apikeyV2Expires = 4
+	// apikeyV2Scopes is the bitmap of operations permitted by the key.
+	apikeyV2Scopes = 2
+	// apikeyV2RestrLen is the length of the list of restrictions.
+	apikeyV2RestrLen = 2
+	// apikeyV2Header is the length of the fixed part of the key preceding restrictions.
+	apikeyV2Header = apikeyVersion + apikeySequence + apikeyWho + apikeyV2Expires + apikeyV2Scopes + apikeyV2RestrLen
+)
+
+// apiKeyScope is a bitmap of operations permitted by an API key.
+type apiKeyScope uint16
+
+const (
+	// apiScopeAccount permits creation of new accounts.
+	apiScopeAccount apiKeyScope = 1 << iota
+	// apiScopeUpload permits uploading of files.
+	apiScopeUpload
+	// apiScopeWrite permits publishing messages and modifying topics, subscriptions and accounts.
+	// Keys without this scope are read-only.
+	apiScopeWrite
+
+	// apiScopeAll permits everything. Legacy keys have all scopes.
+	apiScopeAll = apiScopeAccount | apiScopeUpload | apiScopeWrite
+)
+
+// apiKey is a validated API key.
+type apiKey struct {
+	sequence uint16
+	isRoot   bool
+	// Zero time means the key never expires.
+	expires time.Time
+	scopes  apiKeyScope
+	// Allowed values of the Origin header, empty if any origin is allowed.
+	origins []string
+	// Allowed client IP ranges, empty if any IP is allowed.
+	ips []*net.IPNet
+}
+
+// Check if the key permits all of the given operations.
+func (k *apiKey) allows(scope apiKeyScope) bool {
+	return k.scopes&scope == scope
+}
 
-	if declen := base64.URLEncoding.DecodedLen(len(apikey)); declen != apikeyLength {
-		return
+// requiredAPIScope returns the scope an API key must have to permit the client message.
+func requiredAPIScope(msg *ClientComMessage) apiKeyScope {
+	switch {
+	case msg.Pub != nil, msg.Set != nil, msg.Del != nil:
+		return apiScopeWrite
+	case msg.Sub != nil:
+		// Subscription may create a topic or modify the topic and the subscription. Subscribing to
+		// 'usrXXX' may create a p2p topic. Subscribing to other topics the user has not joined yet
+		// creates a subscription, which is checked by the topic.
+		if msg.Sub.Set != nil || strings.HasPrefix(msg.Sub.Topic, "new") || strings.HasPrefix(msg.Sub.Topic, "nch") ||
+			strings.HasPrefix(msg.Sub.Topic, "usr") {
+			return apiScopeWrite
+		}
+	case msg.Acc != nil:
+		if strings.HasPrefix(msg.Acc.User, "new") {
+			return apiScopeAccount
+		}
+		return apiScopeWrite
+	case msg.Note != nil:
+		// Read and received notifications update the subscription, typing notifications don't.
+		if msg.Note.What == "read" || msg.Note.What == "recv" {
+			return apiScopeWrite
+		}
 	}
+	return 0
+}
+
+// Check the signature of the key with all active salts.
+func apiKeySignatureValid(data, signature []byte, newHash func() hash.Hash) bool {
+	for _, salt := range globals.apiKeySalts {
+		hasher := hmac.New(newHash, salt)
+		hasher.Write(data)
+		if hmac.Equal(signature, hasher.Sum(nil)[:apikeySignature]) {
+			return true
+		}
+	}
+	return false
+}
 
-	data, err := base64.URLEncoding.DecodeString(apikey)
+// Parse the list of restrictions into origins and IP ranges.
+func parseAPIKeyRestrictions(restr string) (origins []string, ips []*net.IPNet, ok bool) {
+	if restr == "" {
+		return nil, nil, true
+	}
+	for _, item := range strings.Split(restr, ",") {
+		if strings.Contains(item, "://") {
+			origins = append(origins, strings.ToLower(item))
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			// Single IP address.
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, nil, false
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			ips = append(ips, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, nil, false
+		}
+		ips = append(ips, ipnet)
+	}
+	return origins, ips, true
+}
+
+// Client signature validation
+//   key: client's secret key
+// Returns parsed key or nil if the key is invalid.
+func parseAPIKey(apikey string) *apiKey {
+	// Legacy keys are padding-free, but padding may be present in longer keys.
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(apikey, "="))
 	if err != nil {
 		log.Println("failed to decode.base64 appid ", err)
-		return
+		return nil
 	}
-	if data[0] != 1 {
-		log.Println("unknown appid signature algorithm ", data[0])
-		return
+	if len(data) == 0 {
+		return nil
 	}
 
-	hasher := hmac.New(md5.New, globals.apiKeySalt)
-	hasher.Write(data[:apikeyVersion+apikeyAppID+apikeySequence+apikeyWho])
-	check := hasher.Sum(nil)
-	if !bytes.Equal(data[apikeyVersion+apikeyAppID+apikeySequence+apikeyWho:], check) {
-		log.Println("invalid apikey signature")
-		return
+	switch data[0] {
+	case 1:
+		if len(data) != apikeyLength {
+			return nil
+		}
+		if !apiKeySignatureValid(data[:apikeyVersion+apikeyAppID+apikeySequence+apikeyWho],
+			data[apikeyVersion+apikeyAppID+apikeySequence+apikeyWho:], md5.New) {
+			log.Println("invalid apikey signature")
+			return nil
+		}
+		return &apiKey{
+			sequence: binary.LittleEndian.Uint16(data[apikeyVersion+apikeyAppID:]),
+			isRoot:   data[apikeyVersion+apikeyAppID+apikeySequence] == 1,
+			scopes:   apiScopeAll,
+		}
+
+	case 2:
+		if len(data) < apikeyV2Header+apikeySignature {
+			return nil
+		}
+		restrLen := int(binary.LittleEndian.Uint16(data[apikeyV2Header-apikeyV2RestrLen:]))
+		if len(data) != apikeyV2Header+restrLen+apikeySignature {
+			return nil
+		}
+		if !apiKeySignatureValid(data[:apikeyV2Header+restrLen], data[apikeyV2Header+restrLen:], sha256.New) {
+			log.Println("invalid apikey signature")
+			return nil
+		}
+
+		offset := apikeyVersion
+		key := &apiKey{sequence: binary.LittleEndian.Uint16(data[offset:])}
+		offset += apikeySequence
+		key.isRoot = data[offset] == 1
+		offset += apikeyWho
+		if expires := binary.LittleEndian.Uint32(data[offset:]); expires != 0 {
+			key.expires = time.Unix(int64(expires), 0).UTC()
+		}
+		offset += apikeyV2Expires
+		key.scopes = apiKeyScope(binary.LittleEndian.Uint16(data[offset:]))
+
+		var ok bool
+		key.origins, key.ips, ok = parseAPIKeyRestrictions(string(data[apikeyV2Header : apikeyV2Header+restrLen]))
+		if !ok {
+			log.Println("invalid apikey restrictions")
+			return nil
+		}
+		return key
 	}
 
-	isRoot = (data[apikeyVersion+apikeyAppID+apikeySequence] == 1)
+	log.Println("unknown appid signature algorithm ", data[0])
+	return nil
+}
+
+// checkAPIKey validates the API key of the request: signature, expiration time, origin and client IP.
+// Returns the key on success or nil if the key is missing or invalid.
+func checkAPIKey(req *http.Request) *apiKey {
+	key := parseAPIKey(getAPIKey(req))
+	if key == nil {
+		return nil
+	}
+
+	if !key.expires.IsZero() && key.expires.Before(time.Now()) {
+		log.Println("expired apikey, seq", key.sequence)
+		return nil
+	}
+
+	if len(key.origins) > 0 {
+		origin := strings.ToLower(req.Header.Get("Origin"))
+		var found bool
+		for _, allowed := range key.origins {
+			if allowed == origin {
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Println("apikey not allowed for origin", origin)
+			return nil
+		}
+	}
 
-	isValid = true
+	if len(key.ips) > 0 {
+		addr := auth.RemoteIP(lpRemoteAddr(req))
+		ip := net.ParseIP(addr)
+		var found bool
+		if ip != nil {
+			for _, ipnet := range key.ips {
+				if ipnet.Contains(ip) {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			log.Println("apikey not allowed for address", addr)
+			return nil
+		}
+	}
 
-	return
+	return key
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"hash"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testAPIKeySalt = []byte("test-api-key-salt-0123456789abcdef")
+
+func signTestAPIKey(data, salt []byte, newHash func() hash.Hash) string {
+	hasher := hmac.New(newHash, salt)
+	hasher.Write(data)
+	return base64.RawURLEncoding.EncodeToString(append(data, hasher.Sum(nil)[:apikeySignature]...))
+}
+
+func makeTestAPIKeyV1(seq uint16, isRoot bool, salt []byte) string {
+	data := make([]byte, apikeyVersion+apikeyAppID+apikeySequence+apikeyWho)
+	data[0] = 1
+	binary.LittleEndian.PutUint16(data[apikeyVersion+apikeyAppID:], seq)
+	if isRoot {
+		data[apikeyVersion+apikeyAppID+apikeySequence] = 1
+	}
+	return signTestAPIKey(data, salt, md5.New)
+}
+
+func makeTestAPIKeyV2(seq uint16, expires time.Time, scopes apiKeyScope, restr string, salt []byte) string {
+	data := make([]byte, apikeyV2Header, apikeyV2Header+len(restr))
+	data[0] = 2
+	binary.LittleEndian.PutUint16(data[apikeyVersion:], seq)
+	if !expires.IsZero() {
+		binary.LittleEndian.PutUint32(data[apikeyVersion+apikeySequence+apikeyWho:], uint32(expires.Unix()))
+	}
+	binary.LittleEndian.PutUint16(data[apikeyVersion+apikeySequence+apikeyWho+apikeyV2Expires:], uint16(scopes))
+	binary.LittleEndian.PutUint16(data[apikeyV2Header-apikeyV2RestrLen:], uint16(len(restr)))
+	data = append(data, restr...)
+	return signTestAPIKey(data, salt, sha256.New)
+}
+
+func TestParseAPIKey(t *testing.T) {
+	oldSalt := []byte("old-api-key-salt-0123456789abcdef")
+	globals.apiKeySalts = [][]byte{testAPIKeySalt, oldSalt}
+	defer func() { globals.apiKeySalts = nil }()
+
+	validV2 := makeTestAPIKeyV2(7, time.Time{}, apiScopeUpload, "", testAPIKeySalt)
+	// Corrupt the signature.
+	tampered := []byte(validV2)
+	tampered[len(tampered)-1] ^= 1
+
+	cases := []struct {
+		name     string
+		key      string
+		valid    bool
+		sequence uint16
+		isRoot   bool
+		scopes   apiKeyScope
+		origins  int
+		ips      int
+	}{
+		{"v1", makeTestAPIKeyV1(3, false, testAPIKeySalt), true, 3, false, apiScopeAll, 0, 0},
+		{"v1 root", makeTestAPIKeyV1(4, true, testAPIKeySalt), true, 4, true, apiScopeAll, 0, 0},
+		{"v1 old salt", makeTestAPIKeyV1(5, false, oldSalt), true, 5, false, apiScopeAll, 0, 0},
+		{"v1 unknown salt", makeTestAPIKeyV1(5, false, []byte("unknown")), false, 0, false, 0, 0, 0},
+		{"v2", validV2, true, 7, false, apiScopeUpload, 0, 0},
+		{"v2 old salt", makeTestAPIKeyV2(8, time.Time{}, apiScopeAll, "", oldSalt), true, 8, false, apiScopeAll, 0, 0},
+		{"v2 restrictions", makeTestAPIKeyV2(9, time.Time{}, apiScopeWrite,
+			"https://example.com,10.0.0.0/8,192.168.1.1,::1", testAPIKeySalt), true, 9, false, apiScopeWrite, 1, 3},
+		{"v2 invalid restrictions", makeTestAPIKeyV2(9, time.Time{}, apiScopeWrite, "not-an-ip", testAPIKeySalt),
+			false, 0, false, 0, 0, 0},
+		{"v2 tampered", string(tampered), false, 0, false, 0, 0, 0},
+		{"empty", "", false, 0, false, 0, 0, 0},
+		{"garbage", "!!!", false, 0, false, 0, 0, 0},
+		{"unknown version", base64.RawURLEncoding.EncodeToString([]byte{9, 1, 2, 3}), false, 0, false, 0, 0, 0},
+	}
+
+	for _, tc := range cases {
+		key := parseAPIKey(tc.key)
+		if !tc.valid {
+			if key != nil {
+				t.Errorf("%s: expected invalid key, got %+v", tc.name, key)
+			}
+			continue
+		}
+		if key == nil {
+			t.Errorf("%s: expected valid key", tc.name)
+			continue
+		}
+		if key.sequence != tc.sequence || key.isRoot != tc.isRoot || key.scopes != tc.scopes {
+			t.Errorf("%s: got seq=%d root=%v scopes=%d, expected seq=%d root=%v scopes=%d", tc.name,
+				key.sequence, key.isRoot, key.scopes, tc.sequence, tc.isRoot, tc.scopes)
+		}
+		if len(key.origins) != tc.origins || len(key.ips) != tc.ips {
+			t.Errorf("%s: got %d origins and %d IP ranges, expected %d and %d", tc.name,
+				len(key.origins), len(key.ips), tc.origins, tc.ips)
+		}
+	}
+}
+
+func TestCheckAPIKey(t *testing.T) {
+	globals.apiKeySalts = [][]byte{testAPIKeySalt}
+	defer func() { globals.apiKeySalts = nil }()
+
+	restricted := makeTestAPIKeyV2(1, time.Time{}, apiScopeAll, "https://example.com,10.0.0.0/8", testAPIKeySalt)
+	cases := []struct {
+		name   string
+		key    string
+		origin string
+		addr   string
+		valid  bool
+	}{
+		{"no expiration", makeTestAPIKeyV2(1, time.Time{}, apiScopeAll, "", testAPIKeySalt), "", "1.2.3.4:1000", true},
+		{"not expired", makeTestAPIKeyV2(1, time.Now().Add(time.Hour), apiScopeAll, "", testAPIKeySalt),
+			"", "1.2.3.4:1000", true},
+		{"expired", makeTestAPIKeyV2(1, time.Now().Add(-time.Hour), apiScopeAll, "", testAPIKeySalt),
+			"", "1.2.3.4:1000", false},
+		{"allowed origin and address", restricted, "https://EXAMPLE.com", "10.1.2.3:1000", true},
+		{"wrong origin", restricted, "https://example.org", "10.1.2.3:1000", false},
+		{"wrong address", restricted, "https://example.com", "11.1.2.3:1000", false},
+	}
+
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", "/v0/channels", nil)
+		req.Header.Set("X-Tinode-APIKey", tc.key)
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		req.RemoteAddr = tc.addr
+		if key := checkAPIKey(req); (key != nil) != tc.valid {
+			t.Errorf("%s: expected valid=%v, got %+v", tc.name, tc.valid, key)
+		}
+	}
+}
+
+func TestRequiredAPIScope(t *testing.T) {
+	cases := []struct {
+		name  string
+		msg   *ClientComMessage
+		scope apiKeyScope
+	}{
+		{"pub", &ClientComMessage{Pub: &MsgClientPub{Topic: "grpabc"}}, apiScopeWrite},
+		{"set", &ClientComMessage{Set: &MsgClientSet{Topic: "me"}}, apiScopeWrite},
+		{"del", &ClientComMessage{Del: &MsgClientDel{Topic: "grpabc"}}, apiScopeWrite},
+		{"get", &ClientComMessage{Get: &MsgClientGet{Topic: "grpabc"}}, 0},
+		{"leave", &ClientComMessage{Leave: &MsgClientLeave{Topic: "grpabc"}}, 0},
+		{"sub existing", &ClientComMessage{Sub: &MsgClientSub{Topic: "grpabc"}}, 0},
+		{"sub with get", &ClientComMessage{Sub: &MsgClientSub{Topic: "grpabc", Get: &MsgGetQuery{}}}, 0},
+		{"sub with set", &ClientComMessage{Sub: &MsgClientSub{Topic: "grpabc", Set: &MsgSetQuery{}}}, apiScopeWrite},
+		{"sub new topic", &ClientComMessage{Sub: &MsgClientSub{Topic: "new123"}}, apiScopeWrite},
+		{"sub new channel", &ClientComMessage{Sub: &MsgClientSub{Topic: "nch123"}}, apiScopeWrite},
+		{"sub p2p", &ClientComMessage{Sub: &MsgClientSub{Topic: "usrabc"}}, apiScopeWrite},
+		{"sub existing p2p", &ClientComMessage{Sub: &MsgClientSub{Topic: "p2pabc"}}, 0},
+		{"sub me", &ClientComMessage{Sub: &MsgClientSub{Topic: "me"}}, 0},
+		{"acc new", &ClientComMessage{Acc: &MsgClientAcc{User: "new123"}}, apiScopeAccount},
+		{"acc update", &ClientComMessage{Acc: &MsgClientAcc{User: "usrabc"}}, apiScopeWrite},
+		{"note kp", &ClientComMessage{Note: &MsgClientNote{Topic: "grpabc", What: "kp"}}, 0},
+		{"note read", &ClientComMessage{Note: &MsgClientNote{Topic: "grpabc", What: "read"}}, apiScopeWrite},
+		{"note recv", &ClientComMessage{Note: &MsgClientNote{Topic: "grpabc", What: "recv"}}, apiScopeWrite},
+	}
+
+	readOnly := &apiKey{scopes: apiScopeUpload}
+	full := &apiKey{scopes: apiScopeAll}
+	for _, tc := range cases {
+		scope := requiredAPIScope(tc.msg)
+		if scope != tc.scope {
+			t.Errorf("%s: expected scope %d, got %d", tc.name, tc.scope, scope)
+		}
+		if readOnly.allows(scope) != (scope == 0) {
+			t.Errorf("%s: read-only key allows=%v", tc.name, readOnly.allows(scope))
+		}
+		if !full.allows(scope) {
+			t.Errorf("%s: key with all scopes denied", tc.name)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Package audit contains interfaces to be implemented by audit log sinks and the
+// functions to record and query security-related events.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// Audited actions.
+const (
+	// Login attempt.
+	ActLogin = "login"
+	// Request to reset a secret, such as a password.
+	ActReset = "reset"
+	// Account creation.
+	ActCreate = "create"
+	// Change of account state, e.g. suspension.
+	ActState = "state"
+	// Confirmation of a credential, such as email.
+	ActCred = "cred"
+)
+
+// OutcomeOK is the outcome of a successful action.
+const OutcomeOK = "ok"
+
+// Sink is an interface which must be implemented by audit log sinks.
+type Sink interface {
+	// Init initializes the sink.
+	Init(jsonconf string) error
+
+	// IsReady checks if the sink is initialized.
+	IsReady() bool
+
+	// Write returns a channel that the server will use to send events to.
+	// The event will be dropped if the channel blocks.
+	Write() chan<- *t.AuditEvent
+
+	// Query returns events matching the query, newest first.
+	// Returns types.ErrUnsupported if the sink cannot be queried.
+	Query(query *t.AuditQuery) ([]t.AuditEvent, error)
+
+	// Stop terminates the sink's worker.
+	Stop()
+}
+
+type configType struct {
+	Name   string          `json:"name"`
+	Config json.RawMessage `json:"config"`
+}
+
+var sinks map[string]Sink
+
+// Register an audit sink. Sinks implemented outside of this repository can be registered
+// the same way by importing them into the server.
+func Register(name string, sink Sink) {
+	if sinks == nil {
+		sinks = make(map[string]Sink)
+	}
+
+	if sink == nil {
+		panic("Register: audit sink is nil")
+	}
+	if _, dup := sinks[name]; dup {
+		panic("Register: called twice for sink " + name)
+	}
+	sinks[name] = sink
+}
+
+// Init initializes registered sinks.
+func Init(jsconfig string) error {
+	if jsconfig == "" {
+		return nil
+	}
+
+	var config []configType
+	if err := json.Unmarshal([]byte(jsconfig), &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	for _, cc := range config {
+		if sink := sinks[cc.Name]; sink != nil {
+			if err := sink.Init(string(cc.Config)); err != nil {
+				return err
+			}
+		} else {
+			log.Println("audit: unknown sink", cc.Name)
+		}
+	}
+
+	return nil
+}
+
+// Log sends an event to all active sinks.
+func Log(ev *t.AuditEvent) {
+	if sinks == nil {
+		return
+	}
+
+	if ev.CreatedAt.IsZero() {
+		ev.CreatedAt = t.TimeNow()
+	}
+
+	for _, sink := range sinks {
+		if !sink.IsReady() {
+			continue
+		}
+
+		// Each sink gets its own copy because sinks may modify the event.
+		evCopy := *ev
+		// Write without delay or skip.
+		select {
+		case sink.Write() <- &evCopy:
+		default:
+			log.Println("audit: event dropped", ev.Action, ev.User)
+		}
+	}
+}
+
+// Query returns events matching the query from the first active sink which supports queries.
+func Query(query *t.AuditQuery) ([]t.AuditEvent, error) {
+	for _, sink := range sinks {
+		if !sink.IsReady() {
+			continue
+		}
+
+		events, err := sink.Query(query)
+		if err == t.ErrUnsupported {
+			continue
+		}
+		return events, err
+	}
+
+	return nil, t.ErrUnsupported
+}
+
+// Stop all sinks.
+func Stop() {
+	if sinks == nil {
+		return
+	}
+
+	for _, sink := range sinks {
+		if sink.IsReady() {
+			// Will potentially block
+			sink.Stop()
+		}
+	}
+}
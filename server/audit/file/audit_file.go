@@ -0,0 +1,184 @@
+// Package file implements an audit sink which appends events to a file as JSON lines.
+package file
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/tinode/chat/server/audit"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+var sink fileSink
+
+// How much to buffer the input channel.
+const defaultBuffer = 64
+
+// Maximum number of events returned by a query if limit is not set.
+const defaultQueryLimit = 1024
+
+type fileSink struct {
+	initialized bool
+	path        string
+	input       chan *t.AuditEvent
+	stop        chan bool
+
+	// Guards the file against concurrent writing and reading.
+	lock sync.Mutex
+	file *os.File
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	Buffer  int  `json:"buffer"`
+	// Path to the file to append events to.
+	Path string `json:"path"`
+}
+
+// Init initializes the sink.
+func (*fileSink) Init(jsonconf string) error {
+	if sink.initialized {
+		return errors.New("already initialized")
+	}
+
+	var config configType
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	sink.initialized = true
+
+	if !config.Enabled {
+		return nil
+	}
+
+	if config.Path == "" {
+		return errors.New("audit file: path not specified")
+	}
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+
+	var err error
+	sink.file, err = os.OpenFile(config.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	sink.path = config.Path
+
+	sink.input = make(chan *t.AuditEvent, config.Buffer)
+	sink.stop = make(chan bool, 1)
+
+	go func() {
+		for {
+			select {
+			case ev := <-sink.input:
+				if ev.Id == "" {
+					ev.Id = store.GetUidString()
+				}
+				data, err := json.Marshal(ev)
+				if err != nil {
+					log.Println("audit file: failed to serialize event", err)
+					continue
+				}
+				sink.lock.Lock()
+				_, err = sink.file.Write(append(data, '\n'))
+				sink.lock.Unlock()
+				if err != nil {
+					log.Println("audit file: failed to write event", err)
+				}
+			case <-sink.stop:
+				sink.lock.Lock()
+				sink.file.Close()
+				sink.lock.Unlock()
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// IsReady checks if the sink is initialized.
+func (*fileSink) IsReady() bool {
+	return sink.input != nil
+}
+
+// Write returns a channel that the server will use to send events to.
+func (*fileSink) Write() chan<- *t.AuditEvent {
+	return sink.input
+}
+
+// matches checks if the event satisfies the query.
+func matches(ev *t.AuditEvent, query *t.AuditQuery) bool {
+	if query.User != "" && query.User != ev.User {
+		return false
+	}
+	if query.Action != "" && query.Action != ev.Action {
+		return false
+	}
+	if !query.Since.IsZero() && ev.CreatedAt.Before(query.Since) {
+		return false
+	}
+	if !query.Before.IsZero() && !ev.CreatedAt.Before(query.Before) {
+		return false
+	}
+	return true
+}
+
+// Query scans the file and returns events matching the query, newest first.
+func (*fileSink) Query(query *t.AuditQuery) ([]t.AuditEvent, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	file, err := os.Open(sink.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []t.AuditEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var ev t.AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			// Skip corrupted lines.
+			continue
+		}
+		if matches(&ev, query) {
+			events = append(events, ev)
+			// Events are appended in chronological order, keep only the most recent ones.
+			if len(events) > limit {
+				events = events[1:]
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].CreatedAt.After(events[j].CreatedAt)
+	})
+	return events, nil
+}
+
+// Stop terminates the sink's worker and closes the file.
+func (*fileSink) Stop() {
+	sink.stop <- true
+}
+
+func init() {
+	audit.Register("file", &sink)
+}
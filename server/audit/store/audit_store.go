@@ -0,0 +1,93 @@
+// Package store implements an audit sink which saves events to the database
+// through the store adapter.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/tinode/chat/server/audit"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+var sink storeSink
+
+// How much to buffer the input channel.
+const defaultBuffer = 64
+
+type storeSink struct {
+	initialized bool
+	input       chan *t.AuditEvent
+	stop        chan bool
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	Buffer  int  `json:"buffer"`
+}
+
+// Init initializes the sink.
+func (storeSink) Init(jsonconf string) error {
+	if sink.initialized {
+		return errors.New("already initialized")
+	}
+
+	var config configType
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	sink.initialized = true
+
+	if !config.Enabled {
+		return nil
+	}
+
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+
+	sink.input = make(chan *t.AuditEvent, config.Buffer)
+	sink.stop = make(chan bool, 1)
+
+	go func() {
+		for {
+			select {
+			case ev := <-sink.input:
+				if err := store.Audit.Add(ev); err != nil {
+					log.Println("audit store: failed to save event", err)
+				}
+			case <-sink.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// IsReady checks if the sink is initialized.
+func (storeSink) IsReady() bool {
+	return sink.input != nil
+}
+
+// Write returns a channel that the server will use to send events to.
+func (storeSink) Write() chan<- *t.AuditEvent {
+	return sink.input
+}
+
+// Query returns events matching the query, newest first.
+func (storeSink) Query(query *t.AuditQuery) ([]t.AuditEvent, error) {
+	return store.Audit.GetAll(query)
+}
+
+// Stop terminates the sink's worker.
+func (storeSink) Stop() {
+	sink.stop <- true
+}
+
+func init() {
+	audit.Register("store", &sink)
+}
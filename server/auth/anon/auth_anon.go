@@ -35,7 +35,7 @@ func (authenticator) UpdateRecord(rec *auth.Rec, secret []byte) (*auth.Rec, erro
 }
 
 // Authenticate is not supported. This authenticator is used only at account creation time.
-func (authenticator) Authenticate(secret []byte) (*auth.Rec, []byte, error) {
+func (authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.Rec, []byte, error) {
 	return nil, nil, types.ErrUnsupported
 }
 
@@ -59,6 +59,11 @@ func (authenticator) DelRecords(uid types.Uid) error {
 	return nil
 }
 
+// UnlockRecords is a noop: anonymous authenticator does not lock out users.
+func (authenticator) UnlockRecords(uid types.Uid) (bool, error) {
+	return false, nil
+}
+
 // RestrictedTags returns tag namespaces restricted by this authenticator (none for anonymous).
 func (authenticator) RestrictedTags() ([]string, error) {
 	return nil, nil
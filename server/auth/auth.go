@@ -4,7 +4,9 @@ package auth
 import (
 	"encoding/json"
 	"errors"
+	"net"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/tinode/chat/server/store/types"
@@ -181,6 +183,21 @@ func (f *Feature) UnmarshalJSON(b []byte) error {
 	return f.UnmarshalText(b[1 : len(b)-1])
 }
 
+// RemoteIP extracts the IP address of the client from the remote address of the session. The address is
+// either the address of the socket with a port or, if the server is configured to use it, the value of the
+// X-Forwarded-For header. The last address in X-Forwarded-For is the one added by the proxy in front of the
+// server, the addresses before it are supplied by the client and cannot be trusted.
+func RemoteIP(remoteAddr string) string {
+	if idx := strings.LastIndex(remoteAddr, ","); idx >= 0 {
+		remoteAddr = remoteAddr[idx+1:]
+	}
+	remoteAddr = strings.TrimSpace(remoteAddr)
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
 // Rec is an authentication record.
 type Rec struct {
 	// User ID
@@ -219,9 +236,10 @@ type AuthHandler interface {
 	// Authenticate: given a user-provided authentication secret (such as "login:password"), either
 	// return user's record (ID, time when the secret expires, etc), or issue a challenge to
 	// continue the authentication process to the next step, or return an error code.
+	// The remoteAddr is the address of the client making the request; it may be empty.
 	// store.Users.GetAuthRecord("scheme", "unique")
 	// Returns: user auth record, challenge, error.
-	Authenticate(secret []byte) (*Rec, []byte, error)
+	Authenticate(secret []byte, remoteAddr string) (*Rec, []byte, error)
 
 	// AsTag converts search token into prefixed tag or an empty string if it
 	// cannot be represented as a prefixed tag.
@@ -237,6 +255,11 @@ type AuthHandler interface {
 	// DelRecords deletes (or disables) all authentication records for the given user.
 	DelRecords(uid types.Uid) error
 
+	// UnlockRecords clears temporary lockouts caused by failed authentication attempts
+	// for the given user.
+	// Returns: true if any lockouts were cleared, error.
+	UnlockRecords(uid types.Uid) (bool, error)
+
 	// RestrictedTags returns the tag namespaces (prefixes) which are restricted by this authenticator.
 	RestrictedTags() ([]string, error)
 
@@ -0,0 +1,20 @@
+package auth
+
+import "testing"
+
+func TestRemoteIP(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"203.0.113.7:54321":                    "203.0.113.7",
+		"[2001:db8::1]:443":                    "2001:db8::1",
+		"203.0.113.7":                          "203.0.113.7",
+		"2001:db8::1":                          "2001:db8::1",
+		"198.51.100.1":                         "198.51.100.1",
+		"198.51.100.1, 203.0.113.7":            "203.0.113.7",
+		"10.0.0.1,198.51.100.1 , 203.0.113.7 ": "203.0.113.7",
+		"":                                     "",
+	} {
+		if got := RemoteIP(addr); got != expected {
+			t.Errorf("RemoteIP(%q)=%q, expected %q", addr, got, expected)
+		}
+	}
+}
@@ -2,12 +2,15 @@
 package basic
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"log"
 	"regexp"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/tinode/chat/server/auth"
 	"github.com/tinode/chat/server/store"
@@ -22,6 +25,17 @@ const (
 	defaultMaxLoginLength = 32
 
 	defaultMinPasswordLength = 3
+
+	// Lockout after this many consecutive failed attempts to log into the same account.
+	defaultLockoutMaxFailures = 5
+	// Lockout after this many consecutive failed attempts made from the same IP address.
+	defaultLockoutIPMaxFailures = 50
+	// The first lockout lasts this long, each subsequent failure doubles it.
+	defaultLockoutDelay = 10 * time.Second
+	// The lockout never lasts longer than this.
+	defaultLockoutMaxDelay = time.Hour
+	// Count of failures is reset if there were no failed attempts for this long.
+	defaultLockoutResetAfter = 24 * time.Hour
 )
 
 // Token suitable as a login: starts with a Unicode letter (class L) and contains Unicode letters (L),
@@ -35,6 +49,24 @@ type authenticator struct {
 
 	minPasswordLength int
 	minLoginLength    int
+
+	// Password policy.
+	maxPasswordLength int
+	requireLower      bool
+	requireUpper      bool
+	requireDigit      bool
+	requireSpecial    bool
+	denySubstrings    []string
+	denyLogin         bool
+	// List of SHA-1 hashes of breached passwords.
+	breached *breachedList
+
+	// Lockout parameters. Lockout is disabled if lockoutMaxFailures is zero.
+	lockoutMaxFailures   int
+	lockoutIPMaxFailures int
+	lockoutDelay         time.Duration
+	lockoutMaxDelay      time.Duration
+	lockoutResetAfter    time.Duration
 }
 
 func (a *authenticator) checkLoginPolicy(uname string) error {
@@ -46,14 +78,79 @@ func (a *authenticator) checkLoginPolicy(uname string) error {
 	return nil
 }
 
-func (a *authenticator) checkPasswordPolicy(password string) error {
-	if len([]rune(password)) < a.minPasswordLength {
-		return types.ErrPolicy
+func passwordPolicyError(rule string) error {
+	return &types.PolicyError{What: "password", Rule: rule}
+}
+
+// checkPasswordPolicy checks password against configured rules. The uname is the login
+// the password is being set for.
+func (a *authenticator) checkPasswordPolicy(password, uname string) error {
+	length := len([]rune(password))
+	if length < a.minPasswordLength {
+		return passwordPolicyError("min_length")
+	}
+	if a.maxPasswordLength > 0 && length > a.maxPasswordLength {
+		return passwordPolicyError("max_length")
+	}
+
+	var lower, upper, digit, special bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case !unicode.IsLetter(r):
+			special = true
+		}
+	}
+	if a.requireLower && !lower {
+		return passwordPolicyError("lower")
+	}
+	if a.requireUpper && !upper {
+		return passwordPolicyError("upper")
+	}
+	if a.requireDigit && !digit {
+		return passwordPolicyError("digit")
+	}
+	if a.requireSpecial && !special {
+		return passwordPolicyError("special")
+	}
+
+	lowpass := strings.ToLower(password)
+	if a.denyLogin && uname != "" && strings.Contains(lowpass, uname) {
+		return passwordPolicyError("login")
+	}
+	for _, sub := range a.denySubstrings {
+		if strings.Contains(lowpass, sub) {
+			return passwordPolicyError("denylist")
+		}
+	}
+
+	if a.isBreached(password) {
+		return passwordPolicyError("breached")
 	}
 
 	return nil
 }
 
+// isBreached checks if SHA-1 of the password is found in the list of breached passwords.
+func (a *authenticator) isBreached(password string) bool {
+	if a.breached == nil {
+		return false
+	}
+
+	hash := sha1.Sum([]byte(password))
+	found, err := a.breached.contains(strings.ToUpper(hex.EncodeToString(hash[:])))
+	if err != nil {
+		// Don't block password changes if the list is unavailable.
+		log.Println("auth_basic: failed to search breached password list:", err)
+	}
+	return found
+}
+
 func parseSecret(bsecret []byte) (uname, password string, err error) {
 	secret := string(bsecret)
 
@@ -78,11 +175,47 @@ func (a *authenticator) Init(jsonconf json.RawMessage, name string) error {
 		return errors.New("auth_basic: already initialized as " + a.name + "; " + name)
 	}
 
+	type lockoutConfig struct {
+		// Disable lockout of accounts and IP addresses after repeated failures.
+		Disabled bool `json:"disabled"`
+		// Number of consecutive failures for the same login before it's locked out.
+		MaxFailures int `json:"max_failures"`
+		// Number of consecutive failures from the same IP address before it's locked out.
+		IPMaxFailures int `json:"ip_max_failures"`
+		// Duration of the first lockout in seconds. It doubles with every subsequent failure.
+		Delay int `json:"delay"`
+		// Maximum duration of a lockout in seconds.
+		MaxDelay int `json:"max_delay"`
+		// Count of failures is reset after this many seconds without failures. Records of failures
+		// are deleted after a week without failures regardless.
+		ResetAfter int `json:"reset_after"`
+	}
+
+	type passwordPolicyConfig struct {
+		// Maximum password length in characters, 0 means unlimited.
+		MaxLength int `json:"max_length"`
+		// Password must contain at least one character of the given class.
+		RequireLower   bool `json:"require_lower"`
+		RequireUpper   bool `json:"require_upper"`
+		RequireDigit   bool `json:"require_digit"`
+		RequireSpecial bool `json:"require_special"`
+		// Password must not contain any of these substrings, case-insensitive.
+		DenySubstrings []string `json:"deny_substrings"`
+		// Password must not contain the login.
+		DenyLogin bool `json:"deny_login"`
+		// Path to the list of SHA-1 hashes of breached passwords: either a directory of range files
+		// named by the 5 hex digit prefix of the hash, or a single file sorted by hash.
+		BreachedList string `json:"breached_list"`
+	}
+
 	type configType struct {
 		// AddToTags indicates that the user name should be used as a searchable tag.
-		AddToTags         bool `json:"add_to_tags"`
-		MinPasswordLength int  `json:"min_password_length"`
-		MinLoginLength    int  `json:"min_login_length"`
+		AddToTags         bool                  `json:"add_to_tags"`
+		MinPasswordLength int                   `json:"min_password_length"`
+		MinLoginLength    int                   `json:"min_login_length"`
+		PasswordPolicy    *passwordPolicyConfig `json:"password_policy"`
+		// Lockout after repeated failures, disabled if missing.
+		Lockout *lockoutConfig `json:"lockout"`
 	}
 
 	var config configType
@@ -103,9 +236,163 @@ func (a *authenticator) Init(jsonconf json.RawMessage, name string) error {
 		a.minLoginLength = defaultMinLoginLength
 	}
 
+	if policy := config.PasswordPolicy; policy != nil {
+		a.maxPasswordLength = policy.MaxLength
+		if a.maxPasswordLength > 0 && a.maxPasswordLength < a.minPasswordLength {
+			return errors.New("auth_basic: password_policy.max_length is less than min_password_length")
+		}
+		a.requireLower = policy.RequireLower
+		a.requireUpper = policy.RequireUpper
+		a.requireDigit = policy.RequireDigit
+		a.requireSpecial = policy.RequireSpecial
+		for _, sub := range policy.DenySubstrings {
+			if sub = strings.ToLower(sub); sub != "" {
+				a.denySubstrings = append(a.denySubstrings, sub)
+			}
+		}
+		a.denyLogin = policy.DenyLogin
+		if policy.BreachedList != "" {
+			breached, err := openBreachedList(policy.BreachedList)
+			if err != nil {
+				return errors.New("auth_basic: failed to load breached password list: " + err.Error())
+			}
+			a.breached = breached
+		}
+	}
+
+	// Lockout is enabled only if configured: it adds a DB write to every login attempt.
+	if lockout := config.Lockout; lockout != nil && !lockout.Disabled {
+		a.lockoutMaxFailures = lockout.MaxFailures
+		if a.lockoutMaxFailures <= 0 {
+			a.lockoutMaxFailures = defaultLockoutMaxFailures
+		}
+		a.lockoutIPMaxFailures = lockout.IPMaxFailures
+		if a.lockoutIPMaxFailures <= 0 {
+			a.lockoutIPMaxFailures = defaultLockoutIPMaxFailures
+		}
+		a.lockoutDelay = time.Duration(lockout.Delay) * time.Second
+		if a.lockoutDelay <= 0 {
+			a.lockoutDelay = defaultLockoutDelay
+		}
+		a.lockoutMaxDelay = time.Duration(lockout.MaxDelay) * time.Second
+		if a.lockoutMaxDelay <= 0 {
+			a.lockoutMaxDelay = defaultLockoutMaxDelay
+		}
+		if a.lockoutMaxDelay < a.lockoutDelay {
+			a.lockoutMaxDelay = a.lockoutDelay
+		}
+		a.lockoutResetAfter = time.Duration(lockout.ResetAfter) * time.Second
+		if a.lockoutResetAfter <= 0 {
+			a.lockoutResetAfter = defaultLockoutResetAfter
+		}
+	}
+
 	return nil
 }
 
+// lockoutDuration returns the duration of the lockout after the given number of failures over the limit.
+func (a *authenticator) lockoutDuration(over int) time.Duration {
+	delay := a.lockoutMaxDelay
+	// Don't shift too far to avoid an overflow.
+	if over < 32 {
+		if d := a.lockoutDelay << uint(over); d > 0 && d < delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// countAttempt counts the attempt in the lockout record: returns the updated record or types.ErrLockedOut
+// if the key is locked out. The attempt is counted as failed before the password is checked so concurrent
+// attempts cannot exceed the limit. The key is locked out when the count reaches maxFailures.
+func (a *authenticator) countAttempt(lockout *types.AuthLockout, maxFailures int, addr string,
+	now time.Time) (*types.AuthLockout, error) {
+
+	if lockout != nil && now.Before(lockout.LockedUntil) {
+		return nil, types.ErrLockedOut
+	}
+	if lockout == nil || now.Sub(lockout.UpdatedAt) > a.lockoutResetAfter {
+		lockout = &types.AuthLockout{}
+		lockout.CreatedAt = now
+	}
+	lockout.UpdatedAt = now
+	lockout.Failures++
+	lockout.Addr = addr
+
+	if over := lockout.Failures - maxFailures; over >= 0 {
+		lockout.LockedUntil = now.Add(a.lockoutDuration(over))
+	}
+	return lockout, nil
+}
+
+// uncountAttempt reverts countAttempt for a successful attempt. Returns nil if there is nothing to revert.
+func uncountAttempt(lockout *types.AuthLockout, maxFailures int) *types.AuthLockout {
+	if lockout == nil || lockout.Failures <= 0 {
+		return nil
+	}
+	lockout.Failures--
+	if lockout.Failures < maxFailures {
+		// The lockout was caused by this attempt.
+		lockout.LockedUntil = time.Time{}
+	}
+	return lockout
+}
+
+// attempt registers an attempt to authenticate with the login of an existing account, if uname is not
+// empty, and from the IP address. Returns types.ErrLockedOut if either is locked out.
+func (a *authenticator) attempt(uname, ip string, now time.Time) error {
+	if a.lockoutMaxFailures <= 0 {
+		return nil
+	}
+
+	if ip != "" {
+		lockout, err := store.Users.UpdateAuthLockout(a.name, "ip:"+ip,
+			func(lockout *types.AuthLockout) (*types.AuthLockout, error) {
+				return a.countAttempt(lockout, a.lockoutIPMaxFailures, "", now)
+			})
+		if err != nil {
+			return err
+		}
+		if !lockout.LockedUntil.IsZero() {
+			log.Println("auth_basic: locked out", lockout.Id, "until", lockout.LockedUntil)
+		}
+	}
+
+	if uname != "" {
+		lockout, err := store.Users.UpdateAuthLockout(a.name, "login:"+uname,
+			func(lockout *types.AuthLockout) (*types.AuthLockout, error) {
+				return a.countAttempt(lockout, a.lockoutMaxFailures, ip, now)
+			})
+		if err != nil {
+			// The IP address is not released: the attempt was made.
+			return err
+		}
+		if !lockout.LockedUntil.IsZero() {
+			log.Println("auth_basic: locked out", lockout.Id, "until", lockout.LockedUntil)
+		}
+	}
+	return nil
+}
+
+// succeeded clears the count of failures of the login and reverts the attempt counted for the IP address.
+func (a *authenticator) succeeded(uname, ip string) {
+	if a.lockoutMaxFailures <= 0 {
+		return
+	}
+
+	if err := store.Users.DelAuthLockout(a.name, "login:"+uname); err != nil {
+		log.Println("auth_basic: failed to clear lockout", err)
+	}
+	if ip != "" {
+		if _, err := store.Users.UpdateAuthLockout(a.name, "ip:"+ip,
+			func(lockout *types.AuthLockout) (*types.AuthLockout, error) {
+				return uncountAttempt(lockout, a.lockoutIPMaxFailures), nil
+			}); err != nil {
+			log.Println("auth_basic: failed to update lockout", err)
+		}
+	}
+}
+
 // AddRecord adds a basic authentication record to DB.
 func (a *authenticator) AddRecord(rec *auth.Rec, secret []byte) (*auth.Rec, error) {
 	uname, password, err := parseSecret(secret)
@@ -117,7 +404,7 @@ func (a *authenticator) AddRecord(rec *auth.Rec, secret []byte) (*auth.Rec, erro
 		return nil, err
 	}
 
-	if err = a.checkPasswordPolicy(password); err != nil {
+	if err = a.checkPasswordPolicy(password, uname); err != nil {
 		return nil, err
 	}
 
@@ -176,7 +463,7 @@ func (a *authenticator) UpdateRecord(rec *auth.Rec, secret []byte) (*auth.Rec, e
 		return nil, types.ErrDuplicate
 	}
 
-	if err = a.checkPasswordPolicy(password); err != nil {
+	if err = a.checkPasswordPolicy(password, uname); err != nil {
 		return nil, err
 	}
 
@@ -209,31 +496,45 @@ func (a *authenticator) UpdateRecord(rec *auth.Rec, secret []byte) (*auth.Rec, e
 }
 
 // Authenticate checks login and password.
-func (a *authenticator) Authenticate(secret []byte) (*auth.Rec, []byte, error) {
+func (a *authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.Rec, []byte, error) {
 	uname, password, err := parseSecret(secret)
 	if err != nil {
 		return nil, nil, err
 	}
+
+	now := time.Now()
+	ip := auth.RemoteIP(remoteAddr)
+
 	uid, authLvl, passhash, expires, err := store.Users.GetAuthUniqueRecord(a.name, uname)
 	log.Printf("mabing: (a *authenticator) Authenticate(...), a.name = %v, uname = %v, uid = %v",a.name,uname, uid)
 	if err != nil {
 		return nil, nil, err
 	}
 	if uid.IsZero() {
-		// Invalid login.
+		// Invalid login. Failures are counted for existing accounts only to avoid creating
+		// records for arbitrary user names.
+		if err = a.attempt("", ip, now); err != nil {
+			return nil, nil, err
+		}
 		return nil, nil, types.ErrFailed
 	}
-	if !expires.IsZero() && expires.Before(time.Now()) {
+	if !expires.IsZero() && expires.Before(now) {
 		// The record has expired
 		return nil, nil, types.ErrExpired
 	}
 
+	if err = a.attempt(uname, ip, now); err != nil {
+		return nil, nil, err
+	}
+
 	err = bcrypt.CompareHashAndPassword(passhash, []byte(password))
 	if err != nil {
-		// Invalid password
+		// Invalid password. The failure is already counted.
 		return nil, nil, types.ErrFailed
 	}
 
+	a.succeeded(uname, ip)
+
 	var lifetime time.Duration
 	if !expires.IsZero() {
 		lifetime = time.Until(expires)
@@ -291,6 +592,30 @@ func (a *authenticator) DelRecords(uid types.Uid) error {
 	return store.Users.DelAuthRecords(uid, a.name)
 }
 
+// UnlockRecords clears the lockout of the user's login and of the address the last attempt
+// to log in was made from.
+func (a *authenticator) UnlockRecords(uid types.Uid) (bool, error) {
+	login, _, _, _, err := store.Users.GetAuthRecord(uid, a.name)
+	if err != nil {
+		return false, err
+	}
+	if login == "" {
+		return false, nil
+	}
+
+	lockout, err := store.Users.GetAuthLockout(a.name, "login:"+login)
+	if err != nil || lockout == nil {
+		return false, err
+	}
+
+	if lockout.Addr != "" {
+		if err = store.Users.DelAuthLockout(a.name, "ip:"+lockout.Addr); err != nil {
+			return false, err
+		}
+	}
+	return true, store.Users.DelAuthLockout(a.name, "login:"+login)
+}
+
 // RestrictedTags returns tag namespaces (prefixes) restricted by this adapter.
 func (a *authenticator) RestrictedTags() ([]string, error) {
 	var prefix []string
@@ -0,0 +1,295 @@
+package basic
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+func newLockoutAuthenticator() *authenticator {
+	return &authenticator{
+		name:                 "basic",
+		lockoutMaxFailures:   3,
+		lockoutIPMaxFailures: 10,
+		lockoutDelay:         10 * time.Second,
+		lockoutMaxDelay:      time.Minute,
+		lockoutResetAfter:    time.Hour,
+	}
+}
+
+func TestLockoutConfig(t *testing.T) {
+	a := &authenticator{}
+	if err := a.Init([]byte(`{}`), "basic"); err != nil {
+		t.Fatal(err)
+	}
+	if a.lockoutMaxFailures != 0 || a.lockoutIPMaxFailures != 0 {
+		t.Error("lockout enabled without config")
+	}
+
+	a = &authenticator{}
+	if err := a.Init([]byte(`{"lockout":{"ip_max_failures":20}}`), "basic"); err != nil {
+		t.Fatal(err)
+	}
+	if a.lockoutMaxFailures != defaultLockoutMaxFailures || a.lockoutIPMaxFailures != 20 {
+		t.Error("lockout config not applied", a.lockoutMaxFailures, a.lockoutIPMaxFailures)
+	}
+
+	a = &authenticator{}
+	if err := a.Init([]byte(`{"lockout":{"disabled":true}}`), "basic"); err != nil {
+		t.Fatal(err)
+	}
+	if a.lockoutMaxFailures != 0 {
+		t.Error("disabled lockout enabled")
+	}
+}
+
+func TestLockoutDuration(t *testing.T) {
+	a := newLockoutAuthenticator()
+	expect := map[int]time.Duration{
+		0:   10 * time.Second,
+		1:   20 * time.Second,
+		2:   40 * time.Second,
+		3:   time.Minute,
+		40:  time.Minute,
+		100: time.Minute,
+	}
+	for over, delay := range expect {
+		if got := a.lockoutDuration(over); got != delay {
+			t.Errorf("lockoutDuration(%d) = %s, expected %s", over, got, delay)
+		}
+	}
+}
+
+func TestCountAttempt(t *testing.T) {
+	a := newLockoutAuthenticator()
+	now := time.Now()
+
+	var lockout *types.AuthLockout
+	var err error
+	for i := 1; i <= a.lockoutMaxFailures; i++ {
+		if lockout, err = a.countAttempt(lockout, a.lockoutMaxFailures, "10.0.0.1", now); err != nil {
+			t.Fatalf("attempt %d: unexpected error %v", i, err)
+		}
+		if lockout.Failures != i {
+			t.Fatalf("attempt %d: failures=%d", i, lockout.Failures)
+		}
+		if lockout.Addr != "10.0.0.1" {
+			t.Fatalf("attempt %d: addr=%q", i, lockout.Addr)
+		}
+	}
+	// The last permitted attempt locks the key out in advance.
+	if !lockout.LockedUntil.Equal(now.Add(a.lockoutDelay)) {
+		t.Fatalf("expected lockout until %s, got %s", now.Add(a.lockoutDelay), lockout.LockedUntil)
+	}
+
+	// Concurrent attempts are rejected while the key is locked out.
+	if _, err = a.countAttempt(lockout, a.lockoutMaxFailures, "", now.Add(time.Second)); err != types.ErrLockedOut {
+		t.Fatalf("expected ErrLockedOut, got %v", err)
+	}
+
+	// One more attempt is permitted when the lockout expires. It doubles the lockout.
+	later := lockout.LockedUntil
+	copied := *lockout
+	if lockout, err = a.countAttempt(&copied, a.lockoutMaxFailures, "", later); err != nil {
+		t.Fatalf("unexpected error after lockout expired: %v", err)
+	}
+	if lockout.Failures != a.lockoutMaxFailures+1 || !lockout.LockedUntil.Equal(later.Add(2*a.lockoutDelay)) {
+		t.Fatalf("unexpected record after lockout expired: %+v", lockout)
+	}
+
+	// The count is reset after a period without failures.
+	reset := lockout.LockedUntil.Add(a.lockoutResetAfter + time.Second)
+	if lockout, err = a.countAttempt(lockout, a.lockoutMaxFailures, "", reset); err != nil {
+		t.Fatalf("unexpected error after reset: %v", err)
+	}
+	if lockout.Failures != 1 || !lockout.LockedUntil.IsZero() || !lockout.CreatedAt.Equal(reset) {
+		t.Fatalf("count was not reset: %+v", lockout)
+	}
+}
+
+func TestUncountAttempt(t *testing.T) {
+	a := newLockoutAuthenticator()
+	now := time.Now()
+
+	if uncountAttempt(nil, a.lockoutIPMaxFailures) != nil {
+		t.Error("expected nil for missing record")
+	}
+
+	// The successful attempt which locked the address out releases the lockout.
+	lockout := &types.AuthLockout{Failures: a.lockoutIPMaxFailures - 1}
+	lockout.UpdatedAt = now
+	lockout, _ = a.countAttempt(lockout, a.lockoutIPMaxFailures, "", now)
+	if lockout.LockedUntil.IsZero() {
+		t.Fatal("expected the address to be locked out")
+	}
+	lockout = uncountAttempt(lockout, a.lockoutIPMaxFailures)
+	if lockout.Failures != a.lockoutIPMaxFailures-1 || !lockout.LockedUntil.IsZero() {
+		t.Errorf("lockout was not released: %+v", lockout)
+	}
+
+	// Lockout caused by other attempts is kept.
+	lockout = &types.AuthLockout{Failures: a.lockoutIPMaxFailures + 1, LockedUntil: now.Add(time.Minute)}
+	lockout = uncountAttempt(lockout, a.lockoutIPMaxFailures)
+	if lockout.Failures != a.lockoutIPMaxFailures || lockout.LockedUntil.IsZero() {
+		t.Errorf("lockout was released: %+v", lockout)
+	}
+}
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	a := &authenticator{
+		minPasswordLength: 6,
+		maxPasswordLength: 12,
+		requireLower:      true,
+		requireUpper:      true,
+		requireDigit:      true,
+		requireSpecial:    true,
+		denySubstrings:    []string{"tinode"},
+		denyLogin:         true,
+	}
+
+	cases := []struct {
+		password string
+		uname    string
+		rule     string
+	}{
+		{"Ab1!", "", "min_length"},
+		{"Abcdefgh1!xyz", "", "max_length"},
+		{"ABCDEF1!", "", "lower"},
+		{"abcdef1!", "", "upper"},
+		{"Abcdef!!", "", "digit"},
+		{"Abcdef12", "", "special"},
+		{"xAlice1!", "alice", "login"},
+		{"xAlice1!", "", ""},
+		{"Tinode12!", "", "denylist"},
+		{"Abcdef1!", "alice", ""},
+		{"Пароль1!", "", ""},
+	}
+	for _, tc := range cases {
+		err := a.checkPasswordPolicy(tc.password, tc.uname)
+		if tc.rule == "" {
+			if err != nil {
+				t.Errorf("'%s': unexpected error %v", tc.password, err)
+			}
+			continue
+		}
+		perr, ok := err.(*types.PolicyError)
+		if !ok || perr.What != "password" || perr.Rule != tc.rule {
+			t.Errorf("'%s': expected rule '%s', got %v", tc.password, tc.rule, err)
+		}
+	}
+}
+
+// breachedHashes returns sorted uppercase SHA-1 hashes of the breached passwords and of generated passwords.
+func breachedHashes(breached []string) []string {
+	var hashes []string
+	for _, password := range breached {
+		hash := sha1.Sum([]byte(password))
+		hashes = append(hashes, strings.ToUpper(hex.EncodeToString(hash[:])))
+	}
+	for i := 0; i < 1000; i++ {
+		hash := sha1.Sum([]byte("generated-" + strconv.Itoa(i)))
+		hashes = append(hashes, strings.ToUpper(hex.EncodeToString(hash[:])))
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+func checkBreached(t *testing.T, a *authenticator, breached []string) {
+	for _, password := range breached {
+		if !a.isBreached(password) {
+			t.Errorf("'%s' expected to be breached", password)
+		}
+		if perr, ok := a.checkPasswordPolicy(password, "").(*types.PolicyError); !ok || perr.Rule != "breached" {
+			t.Errorf("'%s' expected to violate 'breached' rule", password)
+		}
+	}
+	// Passwords not on the list are accepted.
+	for _, password := range []string{"password1", "correct horse battery staple", "generated-1000"} {
+		if a.isBreached(password) {
+			t.Errorf("'%s' unexpectedly breached", password)
+		}
+	}
+}
+
+func TestBreachedSortedFile(t *testing.T) {
+	breached := []string{"password", "123456", "qwerty", "generated-0", "generated-999"}
+	hashes := breachedHashes(breached)
+
+	file, err := ioutil.TempFile("", "breached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	for i, hash := range hashes {
+		// Counts of different lengths, CRLF line endings and no newline at the end.
+		line := hash + ":" + strconv.Itoa(i*i)
+		if i < len(hashes)-1 {
+			line += "\r\n"
+		}
+		file.WriteString(line)
+	}
+	file.Close()
+
+	bl, err := openBreachedList(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &authenticator{minPasswordLength: 3, breached: bl}
+	checkBreached(t, a, breached)
+
+	// Every hash is found, including the first and the last.
+	for _, hash := range hashes {
+		if found, err := bl.contains(hash); !found || err != nil {
+			t.Fatal("hash not found", hash, err)
+		}
+	}
+
+	// The file must contain full hashes.
+	for _, line := range []string{"5BAA6", "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD", "XBAA61E4C9B93F3F0682250B6CF8331B7EE68FD8"} {
+		if err := ioutil.WriteFile(file.Name(), []byte(line+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openBreachedList(file.Name()); err == nil {
+			t.Errorf("'%s' expected to be rejected", line)
+		}
+	}
+}
+
+func TestBreachedRangeFiles(t *testing.T) {
+	breached := []string{"password", "123456", "qwerty"}
+
+	dir, err := ioutil.TempDir("", "breached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ranges := make(map[string][]string)
+	for _, hash := range breachedHashes(breached) {
+		prefix := hash[:breachedPrefixLength]
+		// Suffixes in lower case to check case-insensitive comparison.
+		ranges[prefix] = append(ranges[prefix], strings.ToLower(hash[breachedPrefixLength:])+":1")
+	}
+	for prefix, lines := range ranges {
+		err := ioutil.WriteFile(filepath.Join(dir, prefix+".txt"), []byte(strings.Join(lines, "\n")), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bl, err := openBreachedList(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &authenticator{minPasswordLength: 3, breached: bl}
+	checkBreached(t, a, breached)
+}
@@ -0,0 +1,169 @@
+package basic
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Length of the hash prefix which names a range file.
+	breachedPrefixLength = 5
+	// Length of the hex-encoded SHA-1 hash.
+	breachedHashLength = sha1.Size * 2
+)
+
+// breachedList is a list of SHA-1 hashes of breached passwords which is searched on disk. The list
+// is too large to be loaded into memory. It's either
+//   - a directory of range files, as produced by the k-anonymity range API: the file "5BAA6.txt"
+//     contains lines "SUFFIX[:COUNT]" where SUFFIX is the remaining 35 hex digits of the hash, or
+//   - a single file of lines "HASH[:COUNT]" sorted by hash, which is searched by binary search.
+type breachedList struct {
+	path string
+	dir  bool
+}
+
+// openBreachedList checks the format of the list of breached passwords.
+func openBreachedList(path string) (*breachedList, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &breachedList{path: path, dir: true}, nil
+	}
+
+	// Check the first line of the sorted file.
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if key := breachedKey(line); !isHex(key, breachedHashLength) {
+		return nil, errors.New("invalid SHA-1 hash '" + key + "'")
+	}
+	return &breachedList{path: path}, nil
+}
+
+// contains checks if the hash of the password is on the list. Hash is uppercase hex SHA-1.
+func (bl *breachedList) contains(hash string) (bool, error) {
+	if bl.dir {
+		return bl.searchRange(hash[:breachedPrefixLength], hash[breachedPrefixLength:])
+	}
+	return bl.searchSorted(hash)
+}
+
+// searchRange scans the range file of the hash prefix for the suffix.
+func (bl *breachedList) searchRange(prefix, suffix string) (bool, error) {
+	file, err := os.Open(filepath.Join(bl.path, prefix+".txt"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// No hashes with this prefix.
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if breachedKey(scanner.Text()) == suffix {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// searchSorted finds the hash in the sorted file by binary search over byte offsets.
+func (bl *breachedList) searchSorted(hash string) (bool, error) {
+	file, err := os.Open(bl.path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	// Invariant: lo is the start of a line, all lines which start before lo are less than the hash,
+	// and no line which starts at or after hi is equal to the hash.
+	lo, hi := int64(0), info.Size()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		line, next, err := lineAfter(file, mid, info.Size())
+		if err != nil {
+			return false, err
+		}
+		if next < 0 {
+			// No line starts at or after mid.
+			hi = mid
+			continue
+		}
+		switch key := breachedKey(line); {
+		case key == hash:
+			return true, nil
+		case key < hash:
+			lo = next
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+// lineAfter reads the first line which starts at or after the offset. Returns the line and the offset
+// of the next line, or -1 if there is no such line.
+func lineAfter(file *os.File, offset, size int64) (string, int64, error) {
+	start := offset
+	if start > 0 {
+		// Include the preceding byte: the line starts at offset if the preceding byte is a newline.
+		start--
+	}
+	reader := bufio.NewReader(io.NewSectionReader(file, start, size-start))
+	if offset > 0 {
+		skipped, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return "", -1, nil
+		}
+		if err != nil {
+			return "", -1, err
+		}
+		start += int64(len(skipped))
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", -1, err
+	}
+	if line == "" {
+		return "", -1, nil
+	}
+	return line, start + int64(len(line)), nil
+}
+
+// breachedKey extracts the uppercase hash or hash suffix from the "HASH:COUNT" line.
+func breachedKey(line string) string {
+	if idx := strings.IndexByte(line, ':'); idx >= 0 {
+		line = line[:idx]
+	}
+	return strings.ToUpper(strings.TrimSpace(line))
+}
+
+// isHex checks if the string consists of exactly length hex digits.
+func isHex(str string, length int) bool {
+	if len(str) != length {
+		return false
+	}
+	_, err := hex.DecodeString(str)
+	return err == nil
+}
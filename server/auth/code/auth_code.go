@@ -0,0 +1,314 @@
+// Package code implements passwordless authentication by a single-use code sent to
+// a validated credential, such as email.
+package code
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Code is valid for this long after being issued.
+	defaultExpireIn = 15 * time.Minute
+	// Number of digits in the code.
+	defaultCodeLength = 6
+	// Number of attempts to enter the code before it's invalidated.
+	defaultMaxRetries = 3
+	// A new code cannot be requested sooner than this.
+	defaultResendAfter = time.Minute
+
+	minCodeLength = 4
+	maxCodeLength = 12
+)
+
+// authenticator is the type to map authentication methods to.
+type authenticator struct {
+	name        string
+	lifetime    time.Duration
+	codeLength  int
+	maxRetries  int
+	resendAfter time.Duration
+}
+
+// Init initializes the code authenticator.
+func (a *authenticator) Init(jsonconf json.RawMessage, name string) error {
+	if name == "" {
+		return errors.New("auth_code: authenticator name cannot be blank")
+	}
+
+	if a.name != "" {
+		return errors.New("auth_code: already initialized as " + a.name + "; " + name)
+	}
+
+	type configType struct {
+		// Lifetime of the code in seconds.
+		ExpireIn int `json:"expire_in"`
+		// Number of digits in the code.
+		CodeLength int `json:"code_length"`
+		// Number of attempts to enter the code before it's invalidated.
+		MaxRetries int `json:"max_retries"`
+		// Minimum interval between requests for a new code in seconds.
+		ResendAfter int `json:"resend_after"`
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("auth_code: failed to parse config: " + err.Error() + "(" + string(jsonconf) + ")")
+	}
+
+	a.lifetime = time.Duration(config.ExpireIn) * time.Second
+	if a.lifetime <= 0 {
+		a.lifetime = defaultExpireIn
+	}
+	a.codeLength = config.CodeLength
+	if a.codeLength == 0 {
+		a.codeLength = defaultCodeLength
+	}
+	if a.codeLength < minCodeLength || a.codeLength > maxCodeLength {
+		return errors.New("auth_code: invalid code_length")
+	}
+	a.maxRetries = config.MaxRetries
+	if a.maxRetries <= 0 {
+		a.maxRetries = defaultMaxRetries
+	}
+	a.resendAfter = time.Duration(config.ResendAfter) * time.Second
+	if a.resendAfter <= 0 {
+		a.resendAfter = defaultResendAfter
+	}
+	if a.resendAfter > a.lifetime {
+		return errors.New("auth_code: resend_after exceeds expire_in")
+	}
+	a.name = name
+
+	return nil
+}
+
+// parseSecret splits the secret of the form "method:value:code", e.g. "email:jdoe@example.com:123456".
+func parseSecret(bsecret []byte) (method, value, code string, err error) {
+	secret := string(bsecret)
+
+	first := strings.Index(secret, ":")
+	last := strings.LastIndex(secret, ":")
+	if first <= 0 || last == first || last == len(secret)-1 {
+		err = types.ErrMalformed
+		return
+	}
+
+	method = secret[:first]
+	value = secret[first+1 : last]
+	code = secret[last+1:]
+	return
+}
+
+// genCode generates a random numeric code with the given number of digits.
+func genCode(length int) (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < length; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	num, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	code := num.String()
+	return strings.Repeat("0", length-len(code)) + code, nil
+}
+
+// invalidate deletes the code and the count of failed attempts to enter it.
+func (a *authenticator) invalidate(uid types.Uid) {
+	if err := store.Users.DelAuthRecords(uid, a.name); err != nil {
+		log.Println("auth_code: failed to delete code", err)
+	}
+	if err := store.Users.DelAuthLockout(a.name, "uid:"+uid.UserId()); err != nil {
+		log.Println("auth_code: failed to delete retry count", err)
+	}
+}
+
+// revoke deletes the code after too many failed attempts. The count of attempts is kept until a new code
+// is issued: attempts in flight which have already read the code must still be counted against the limit.
+func (a *authenticator) revoke(uid types.Uid) {
+	if err := store.Users.DelAuthRecords(uid, a.name); err != nil {
+		log.Println("auth_code: failed to delete code", err)
+	}
+}
+
+// AddRecord is not supported. Codes are issued by the password reset process.
+func (authenticator) AddRecord(rec *auth.Rec, secret []byte) (*auth.Rec, error) {
+	return nil, types.ErrUnsupported
+}
+
+// UpdateRecord is not supported. Codes are issued by the password reset process.
+func (authenticator) UpdateRecord(rec *auth.Rec, secret []byte) (*auth.Rec, error) {
+	return nil, types.ErrUnsupported
+}
+
+// Authenticate checks the code sent to the user's credential. The code can be used only once.
+func (a *authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.Rec, []byte, error) {
+	if a.name == "" {
+		return nil, nil, types.ErrUnsupported
+	}
+
+	method, value, code, err := parseSecret(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uid, err := store.Users.GetByCred(method, value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if uid.IsZero() {
+		// Unknown credential.
+		return nil, nil, types.ErrFailed
+	}
+
+	_, _, codehash, expires, err := store.Users.GetAuthRecord(uid, a.name)
+	if err != nil && err != types.ErrNotFound {
+		return nil, nil, err
+	}
+	if len(codehash) == 0 {
+		// No code was issued.
+		return nil, nil, types.ErrFailed
+	}
+	if expires.Before(time.Now()) {
+		a.invalidate(uid)
+		return nil, nil, types.ErrExpired
+	}
+
+	// Count the attempt before checking the code so that parallel guesses cannot exceed the limit.
+	now := types.TimeNow()
+	retries, err := store.Users.UpdateAuthLockout(a.name, "uid:"+uid.UserId(),
+		func(retries *types.AuthLockout) (*types.AuthLockout, error) {
+			if retries == nil {
+				retries = &types.AuthLockout{}
+				retries.CreatedAt = now
+			}
+			retries.UpdatedAt = now
+			retries.Failures++
+			return retries, nil
+		})
+	if err != nil {
+		return nil, nil, err
+	}
+	if retries.Failures > a.maxRetries {
+		// Concurrent attempts have used up the limit.
+		a.revoke(uid)
+		return nil, nil, types.ErrFailed
+	}
+
+	if err = bcrypt.CompareHashAndPassword(codehash, []byte(code)); err != nil {
+		// Invalid code. Invalidate the code when too many attempts were made.
+		if retries.Failures >= a.maxRetries {
+			a.revoke(uid)
+		}
+		return nil, nil, types.ErrFailed
+	}
+
+	// The code is valid. Make sure it cannot be used again.
+	a.invalidate(uid)
+
+	return &auth.Rec{
+		Uid:       uid,
+		AuthLevel: auth.LevelAuth,
+		Lifetime:  0,
+		Features:  0,
+		State:     types.StateUndefined}, nil, nil
+}
+
+// AsTag is not supported, will produce an empty string.
+func (authenticator) AsTag(token string) string {
+	return ""
+}
+
+// IsUnique is not supported, will produce an error.
+func (authenticator) IsUnique(secret []byte) (bool, error) {
+	return false, types.ErrUnsupported
+}
+
+// GenSecret is not supported, generates an error. Use GetResetParams to issue a code.
+func (authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
+	return nil, time.Time{}, types.ErrUnsupported
+}
+
+// DelRecords deletes the outstanding code of the given user, if any.
+func (a *authenticator) DelRecords(uid types.Uid) error {
+	if a.name == "" {
+		return nil
+	}
+	if err := store.Users.DelAuthLockout(a.name, "uid:"+uid.UserId()); err != nil {
+		return err
+	}
+	return store.Users.DelAuthRecords(uid, a.name)
+}
+
+// UnlockRecords is a noop: code authenticator does not lock out users.
+func (authenticator) UnlockRecords(uid types.Uid) (bool, error) {
+	return false, nil
+}
+
+// RestrictedTags returns tag namespaces restricted by this authenticator (none for code).
+func (authenticator) RestrictedTags() ([]string, error) {
+	return nil, nil
+}
+
+// GetResetParams issues a new single-use code for the given user. The code is returned
+// as the "code" parameter and must be delivered to the user by the validator.
+func (a *authenticator) GetResetParams(uid types.Uid) (map[string]interface{}, error) {
+	if a.name == "" {
+		return nil, types.ErrUnsupported
+	}
+
+	now := types.TimeNow()
+	unique, _, _, expires, err := store.Users.GetAuthRecord(uid, a.name)
+	if err != nil && err != types.ErrNotFound {
+		// Some adapters report a missing record as an error, others return an empty record.
+		return nil, err
+	}
+	if unique != "" && now.Before(expires.Add(-a.lifetime).Add(a.resendAfter)) {
+		// The previous code was issued too recently.
+		return nil, types.ErrRateLimited
+	}
+
+	code, err := genCode(a.codeLength)
+	if err != nil {
+		return nil, err
+	}
+	codehash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	expires = now.Add(a.lifetime)
+	if unique != "" {
+		err = store.Users.UpdateAuthRecord(uid, auth.LevelAuth, a.name, uid.UserId(), codehash, expires)
+	} else {
+		err = store.Users.AddAuthRecord(uid, auth.LevelAuth, a.name, uid.UserId(), codehash, expires)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// New code, new count of attempts.
+	if err = store.Users.DelAuthLockout(a.name, "uid:"+uid.UserId()); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"code":    code,
+		"expires": expires,
+	}, nil
+}
+
+func init() {
+	store.RegisterAuthScheme("code", &authenticator{})
+}
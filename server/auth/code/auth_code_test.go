@@ -0,0 +1,331 @@
+package code
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	adapter "github.com/tinode/chat/server/db"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+type authRecord struct {
+	unique  string
+	secret  []byte
+	expires time.Time
+}
+
+// memAdapter keeps credentials, auth records and counts of attempts in memory. Methods which are not
+// used by the authenticator are not implemented.
+type memAdapter struct {
+	adapter.Adapter
+	sync.Mutex
+	open bool
+	// Return an empty record instead of ErrNotFound for missing auth records, like the MySQL adapter.
+	emptyNotFound bool
+	creds         map[string]types.Uid
+	records       map[types.Uid]*authRecord
+	lockouts      map[string]*types.AuthLockout
+}
+
+func (a *memAdapter) GetName() string                   { return "mem" }
+func (a *memAdapter) IsOpen() bool                      { return a.open }
+func (a *memAdapter) SetMaxResults(val int) error       { return nil }
+func (a *memAdapter) Open(config json.RawMessage) error { a.open = true; return nil }
+func (a *memAdapter) CheckDbVersion() error             { return nil }
+
+func (a *memAdapter) UserGetByCred(method, value string) (types.Uid, error) {
+	a.Lock()
+	defer a.Unlock()
+	return a.creds[method+":"+value], nil
+}
+
+func (a *memAdapter) AuthGetRecord(uid types.Uid, scheme string) (string, auth.Level, []byte, time.Time, error) {
+	a.Lock()
+	defer a.Unlock()
+	rec := a.records[uid]
+	if rec == nil {
+		if a.emptyNotFound {
+			return "", 0, nil, time.Time{}, nil
+		}
+		return "", 0, nil, time.Time{}, types.ErrNotFound
+	}
+	return rec.unique, auth.LevelAuth, rec.secret, rec.expires, nil
+}
+
+func (a *memAdapter) AuthAddRecord(uid types.Uid, scheme, unique string, authLvl auth.Level, secret []byte,
+	expires time.Time) error {
+	a.Lock()
+	defer a.Unlock()
+	if a.records[uid] != nil {
+		return types.ErrDuplicate
+	}
+	a.records[uid] = &authRecord{unique: unique, secret: secret, expires: expires}
+	return nil
+}
+
+func (a *memAdapter) AuthUpdRecord(uid types.Uid, scheme, unique string, authLvl auth.Level, secret []byte,
+	expires time.Time) error {
+	a.Lock()
+	defer a.Unlock()
+	a.records[uid] = &authRecord{unique: unique, secret: secret, expires: expires}
+	return nil
+}
+
+func (a *memAdapter) AuthDelScheme(uid types.Uid, scheme string) error {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.records, uid)
+	return nil
+}
+
+func (a *memAdapter) AuthLockoutGet(key string) (*types.AuthLockout, error) {
+	a.Lock()
+	defer a.Unlock()
+	if rec := a.lockouts[key]; rec != nil {
+		copied := *rec
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+func (a *memAdapter) AuthLockoutReplace(old, lockout *types.AuthLockout) (bool, error) {
+	a.Lock()
+	defer a.Unlock()
+	current := a.lockouts[lockout.Id]
+	if (old == nil) != (current == nil) ||
+		old != nil && (!old.UpdatedAt.Equal(current.UpdatedAt) || old.Failures != current.Failures) {
+		return false, nil
+	}
+	saved := *lockout
+	a.lockouts[lockout.Id] = &saved
+	return true, nil
+}
+
+func (a *memAdapter) AuthLockoutDel(key string) error {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.lockouts, key)
+	return nil
+}
+
+var mem = &memAdapter{
+	creds:    make(map[string]types.Uid),
+	records:  make(map[types.Uid]*authRecord),
+	lockouts: make(map[string]*types.AuthLockout),
+}
+
+func TestMain(m *testing.M) {
+	store.RegisterAdapter(mem)
+	if err := store.Open(1, json.RawMessage(`{"uid_key":"la6YsO+bNX/+XIkOqc5Svw=="}`)); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestAuthenticator creates an authenticator and a user with the given email.
+func newTestAuthenticator(t *testing.T, uid types.Uid, email string) *authenticator {
+	a := &authenticator{}
+	if err := a.Init(json.RawMessage(`{"max_retries":3,"resend_after":60,"expire_in":900}`), "code"); err != nil {
+		t.Fatal(err)
+	}
+	mem.Lock()
+	mem.creds["email:"+email] = uid
+	mem.Unlock()
+	return a
+}
+
+// issue issues a new code for the user.
+func issue(t *testing.T, a *authenticator, uid types.Uid) string {
+	params, err := a.GetResetParams(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := params["code"].(string)
+	if len(code) != defaultCodeLength {
+		t.Fatal("invalid code", params["code"])
+	}
+	return code
+}
+
+func login(a *authenticator, email, code string) (*auth.Rec, error) {
+	rec, _, err := a.Authenticate([]byte("email:"+email+":"+code), "203.0.113.7")
+	return rec, err
+}
+
+// wrongCode returns a code which differs from the given one.
+func wrongCode(code string) string {
+	if code[0] == '0' {
+		return "1" + code[1:]
+	}
+	return "0" + code[1:]
+}
+
+func TestSingleUse(t *testing.T) {
+	uid := types.Uid(1001)
+	a := newTestAuthenticator(t, uid, "alice@example.com")
+
+	// No code issued yet.
+	if _, err := login(a, "alice@example.com", "123456"); err != types.ErrFailed {
+		t.Error("login without a code:", err)
+	}
+
+	code := issue(t, a, uid)
+	if _, err := login(a, "bob@example.com", code); err != types.ErrFailed {
+		t.Error("login with unknown credential:", err)
+	}
+	if _, _, err := a.Authenticate([]byte("alice@example.com"), ""); err != types.ErrMalformed {
+		t.Error("malformed secret:", err)
+	}
+
+	rec, err := login(a, "alice@example.com", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Uid != uid || rec.AuthLevel != auth.LevelAuth {
+		t.Error("auth record", rec)
+	}
+
+	// The code cannot be used again.
+	if _, err := login(a, "alice@example.com", code); err != types.ErrFailed {
+		t.Error("code reused:", err)
+	}
+}
+
+func TestEmptyNotFound(t *testing.T) {
+	uid := types.Uid(1002)
+	a := newTestAuthenticator(t, uid, "carol@example.com")
+
+	mem.Lock()
+	mem.emptyNotFound = true
+	mem.Unlock()
+	defer func() {
+		mem.Lock()
+		mem.emptyNotFound = false
+		mem.Unlock()
+	}()
+
+	if _, err := login(a, "carol@example.com", "123456"); err != types.ErrFailed {
+		t.Error("login without a code:", err)
+	}
+	code := issue(t, a, uid)
+	if _, err := login(a, "carol@example.com", code); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	uid := types.Uid(1003)
+	a := newTestAuthenticator(t, uid, "dave@example.com")
+
+	code := issue(t, a, uid)
+	mem.Lock()
+	mem.records[uid].expires = time.Now().Add(-time.Second)
+	mem.Unlock()
+
+	if _, err := login(a, "dave@example.com", code); err != types.ErrExpired {
+		t.Error("expected expired code, got", err)
+	}
+	// The expired code is deleted.
+	if _, err := login(a, "dave@example.com", code); err != types.ErrFailed {
+		t.Error("expired code not deleted:", err)
+	}
+}
+
+func TestRetryLimit(t *testing.T) {
+	uid := types.Uid(1004)
+	a := newTestAuthenticator(t, uid, "erin@example.com")
+
+	code := issue(t, a, uid)
+	for i := 0; i < a.maxRetries; i++ {
+		if _, err := login(a, "erin@example.com", wrongCode(code)); err != types.ErrFailed {
+			t.Fatal("attempt", i, err)
+		}
+	}
+	// The code is revoked after too many attempts, even the correct one fails.
+	if _, err := login(a, "erin@example.com", code); err != types.ErrFailed {
+		t.Error("code not revoked:", err)
+	}
+
+	// Concurrent guesses cannot exceed the limit.
+	mem.Lock()
+	delete(mem.records, uid)
+	delete(mem.lockouts, "code:uid:"+uid.UserId())
+	mem.Unlock()
+	code = issue(t, a, uid)
+
+	const guesses = 10
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	checked := 0
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := login(a, "erin@example.com", wrongCode(code)); err != types.ErrFailed {
+				t.Error("concurrent guess:", err)
+			}
+			lock.Lock()
+			checked++
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	mem.Lock()
+	failures := mem.lockouts["code:uid:"+uid.UserId()]
+	_, hasCode := mem.records[uid]
+	mem.Unlock()
+	if hasCode {
+		t.Error("code not revoked after concurrent guesses")
+	}
+	if failures == nil || failures.Failures < a.maxRetries {
+		t.Error("attempts not counted", failures)
+	}
+	if checked != guesses {
+		t.Error("guesses", checked)
+	}
+}
+
+func TestResendThrottle(t *testing.T) {
+	uid := types.Uid(1005)
+	a := newTestAuthenticator(t, uid, "frank@example.com")
+
+	first := issue(t, a, uid)
+	if _, err := a.GetResetParams(uid); err != types.ErrRateLimited {
+		t.Fatal("expected rate limit, got", err)
+	}
+
+	// A wrong guess is counted against the first code.
+	if _, err := login(a, "frank@example.com", wrongCode(first)); err != types.ErrFailed {
+		t.Fatal(err)
+	}
+
+	// Move the time of issue back past the resend interval.
+	mem.Lock()
+	mem.records[uid].expires = mem.records[uid].expires.Add(-a.resendAfter - time.Second)
+	mem.Unlock()
+
+	second := issue(t, a, uid)
+	mem.Lock()
+	_, counted := mem.lockouts["code:uid:"+uid.UserId()]
+	mem.Unlock()
+	if counted {
+		t.Error("count of attempts not reset for the new code")
+	}
+
+	// Only the new code is valid.
+	if first != second {
+		if _, err := login(a, "frank@example.com", first); err != types.ErrFailed {
+			t.Error("replaced code accepted:", err)
+		}
+	}
+	if _, err := login(a, "frank@example.com", second); err != nil {
+		t.Error(err)
+	}
+}
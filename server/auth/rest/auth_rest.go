@@ -170,7 +170,7 @@ func (a *authenticator) UpdateRecord(rec *auth.Rec, secret []byte) (*auth.Rec, e
 }
 
 // Authenticate: get user record by provided secret
-func (a *authenticator) Authenticate(secret []byte) (*auth.Rec, []byte, error) {
+func (a *authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.Rec, []byte, error) {
 	resp, err := a.callEndpoint("auth", nil, secret)
 	if err != nil {
 		return nil, nil, err
@@ -248,6 +248,11 @@ func (a *authenticator) DelRecords(uid types.Uid) error {
 	return err
 }
 
+// UnlockRecords is not supported: lockouts, if any, are managed by the authentication server.
+func (a *authenticator) UnlockRecords(uid types.Uid) (bool, error) {
+	return false, nil
+}
+
 // RestrictedTags returns tag namespaces (prefixes, such as prefix:login) restricted by the server.
 func (a *authenticator) RestrictedTags() ([]string, error) {
 	if a.rTagNS != nil {
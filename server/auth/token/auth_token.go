@@ -83,7 +83,7 @@ func (authenticator) UpdateRecord(rec *auth.Rec, secret []byte) (*auth.Rec, erro
 }
 
 // Authenticate checks validity of provided token.
-func (ta *authenticator) Authenticate(token []byte) (*auth.Rec, []byte, error) {
+func (ta *authenticator) Authenticate(token []byte, remoteAddr string) (*auth.Rec, []byte, error) {
 	var tl tokenLayout
 	dataSize := binary.Size(&tl)
 	if len(token) < dataSize+sha256.Size {
@@ -171,6 +171,11 @@ func (authenticator) DelRecords(uid types.Uid) error {
 	return nil
 }
 
+// UnlockRecords is a noop: token authenticator does not lock out users.
+func (authenticator) UnlockRecords(uid types.Uid) (bool, error) {
+	return false, nil
+}
+
 // RestrictedTags returns tag namespaces restricted by this authenticator (none for token).
 func (authenticator) RestrictedTags() ([]string, error) {
 	return nil, nil
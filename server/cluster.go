@@ -126,6 +126,10 @@ type ClusterSess struct {
 
 	// Background session
 	Background bool
+
+	// Operations not permitted by the API key of the session. Denied scopes are sent instead of the
+	// permitted ones so the zero value received from nodes which don't send it permits everything.
+	APIScopesDenied apiKeyScope
 }
 
 // ClusterSessUpdate represents a request to update a session.
@@ -470,6 +474,7 @@ func (c *Cluster) TopicMaster(msg *ClusterReq, rejected *bool) error {
 			proxyReq:    msg.ReqType,
 			background:  msg.Sess.Background,
 			uid:         msg.Sess.Uid,
+			apiScopes:   apiScopeAll &^ msg.Sess.APIScopesDenied,
 		}
 	}
 
@@ -786,17 +791,18 @@ func (c *Cluster) makeClusterReq(reqType ProxyReqType, payload interface{}, topi
 		}
 
 		req.Sess = &ClusterSess{
-			Uid:         uid,
-			AuthLvl:     sess.authLvl,
-			RemoteAddr:  sess.remoteAddr,
-			UserAgent:   sess.userAgent,
-			Ver:         sess.ver,
-			Lang:        sess.lang,
-			CountryCode: sess.countryCode,
-			DeviceID:    sess.deviceID,
-			Platform:    sess.platf,
-			Sid:         sess.sid,
-			Background:  sess.background}
+			Uid:             uid,
+			AuthLvl:         sess.authLvl,
+			RemoteAddr:      sess.remoteAddr,
+			UserAgent:       sess.userAgent,
+			Ver:             sess.ver,
+			Lang:            sess.lang,
+			CountryCode:     sess.countryCode,
+			DeviceID:        sess.deviceID,
+			Platform:        sess.platf,
+			Sid:             sess.sid,
+			Background:      sess.background,
+			APIScopesDenied: apiScopeAll &^ sess.apiScopes}
 	}
 	return req
 }
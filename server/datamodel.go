@@ -55,6 +55,30 @@ type MsgSetSub struct {
 
 	// Access mode change, either Given or Want depending on context
 	Mode string `json:"mode,omitempty"`
+
+	// Push notification preferences. Own subscription only.
+	Notify *MsgNotifyPrefs `json:"notify,omitempty"`
+}
+
+// MsgNotifyPrefs is a set of user's push notification preferences for a topic.
+// Used in {set sub} and returned in {meta sub}. An empty object clears all preferences.
+type MsgNotifyPrefs struct {
+	// Pushes are muted until this time.
+	MutedUntil *time.Time `json:"muted,omitempty"`
+	// Visible pushes are sent only for messages which mention the user.
+	MentionsOnly bool `json:"mentions,omitempty"`
+	// Daily period when pushes are delivered silently.
+	Quiet *MsgQuietHours `json:"quiet,omitempty"`
+}
+
+// MsgQuietHours is a daily period of time for silent pushes. Wraps around midnight if From is after To.
+type MsgQuietHours struct {
+	// Start of the period as "HH:MM".
+	From string `json:"from"`
+	// End of the period as "HH:MM".
+	To string `json:"to"`
+	// IANA time zone name, like "America/New_York". Default: UTC.
+	TZ string `json:"tz,omitempty"`
 }
 
 // MsgSetDesc is a C2S in set.what == "desc", acc, sub message
@@ -182,6 +206,7 @@ const (
 	constMsgMetaTags
 	constMsgMetaDel
 	constMsgMetaCred
+	constMsgMetaQuota
 )
 
 const (
@@ -209,6 +234,8 @@ func parseMsgClientMeta(params string) int {
 			bits |= constMsgMetaDel
 		case "cred":
 			bits |= constMsgMetaCred
+		case "quota":
+			bits |= constMsgMetaQuota
 		default:
 			// ignore unknown
 		}
@@ -463,6 +490,10 @@ type MsgTopicSub struct {
 	Public interface{} `json:"public,omitempty"`
 	// User's own private data per topic
 	Private interface{} `json:"private,omitempty"`
+	// User's own push notification preferences for the topic
+	Notify *MsgNotifyPrefs `json:"notify,omitempty"`
+	// Count of user's unread messages which mention the user
+	Mentions int `json:"mentions,omitempty"`
 
 	// Response to non-'me' topic
 
@@ -674,6 +705,8 @@ type MsgServerMeta struct {
 	Tags []string `json:"tags,omitempty"`
 	// Account credentials, 'me' only.
 	Cred []*MsgCredServer `json:"cred,omitempty"`
+	// Storage used by uploaded files, 'me' and group topics only.
+	Quota *MsgQuota `json:"quota,omitempty"`
 }
 
 // Deep-shallow copy of meta message. Deep copy of Id and Topic fields, shallow copy of payload.
@@ -709,9 +742,21 @@ func (src *MsgServerMeta) describe() string {
 		x, _ := json.Marshal(src.Cred)
 		s += " cred=[" + string(x) + "]"
 	}
+	if src.Quota != nil {
+		x, _ := json.Marshal(src.Quota)
+		s += " quota=" + string(x)
+	}
 	return s
 }
 
+// MsgQuota reports usage of storage by uploaded files of a user or a topic.
+type MsgQuota struct {
+	// Total size of files in bytes.
+	Used int64 `json:"used"`
+	// Maximum total size of files in bytes, 0 or missing if unlimited.
+	Limit int64 `json:"limit,omitempty"`
+}
+
 // MsgServerInfo is the server-side copy of MsgClientNote with From added (non-authoritative).
 type MsgServerInfo struct {
 	Topic string `json:"topic"`
@@ -1100,6 +1145,36 @@ func ErrAuthFailed(id, topic string, serverTs, incomingReqTs time.Time) *ServerC
 		Timestamp: serverTs}, Id: id, Timestamp: incomingReqTs}
 }
 
+// ErrTooManyRequests request rejected because similar requests are made too frequently (429).
+func ErrTooManyRequests(id, topic string, serverTs, incomingReqTs time.Time) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusTooManyRequests, // 429
+		Text:      "too many requests",
+		Topic:     topic,
+		Timestamp: serverTs}, Id: id, Timestamp: incomingReqTs}
+}
+
+// ErrDailyLimitExceeded request rejected because the daily limit on similar requests is reached (429).
+func ErrDailyLimitExceeded(id, topic string, serverTs, incomingReqTs time.Time) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusTooManyRequests, // 429
+		Text:      "daily limit exceeded",
+		Topic:     topic,
+		Timestamp: serverTs}, Id: id, Timestamp: incomingReqTs}
+}
+
+// ErrAuthLockedOut authentication is temporarily disabled after too many failed attempts (423).
+func ErrAuthLockedOut(id, topic string, serverTs, incomingReqTs time.Time) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusLocked, // 423
+		Text:      "locked out",
+		Topic:     topic,
+		Timestamp: serverTs}, Id: id, Timestamp: incomingReqTs}
+}
+
 // ErrAuthUnknownScheme authentication scheme is unrecognized or invalid (401).
 func ErrAuthUnknownScheme(id, topic string, ts time.Time) *ServerComMessage {
 	return &ServerComMessage{Ctrl: &MsgServerCtrl{
@@ -1233,6 +1308,16 @@ func ErrInvalidResponse(id, topic string, serverTs, incomingReqTs time.Time) *Se
 		Timestamp: serverTs}, Id: id, Timestamp: incomingReqTs}
 }
 
+// ErrCodeExpired validation code has expired, a new one must be requested (410).
+func ErrCodeExpired(id, topic string, serverTs, incomingReqTs time.Time) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusGone, // 410
+		Text:      "validation code expired",
+		Topic:     topic,
+		Timestamp: serverTs}, Id: id, Timestamp: incomingReqTs}
+}
+
 // ErrAlreadyAuthenticated invalid attempt to authenticate an already authenticated session
 // Switching users is not supported (409).
 func ErrAlreadyAuthenticated(id, topic string, ts time.Time) *ServerComMessage {
@@ -1304,6 +1389,16 @@ func ErrTooLarge(id, topic string, ts time.Time) *ServerComMessage {
 		Timestamp: ts}, Id: id, Timestamp: ts}
 }
 
+// ErrQuotaExceeded the file does not fit into the storage quota (413).
+func ErrQuotaExceeded(id, topic string, serverTs, incomingReqTs time.Time) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusRequestEntityTooLarge, // 413
+		Text:      "quota exceeded",
+		Topic:     topic,
+		Timestamp: serverTs}, Id: id, Timestamp: incomingReqTs}
+}
+
 // ErrPolicy request violates a policy (e.g. password is too weak or too many subscribers) (422).
 func ErrPolicy(id, topic string, ts time.Time) *ServerComMessage {
 	return ErrPolicyExplicitTs(id, topic, ts, ts)
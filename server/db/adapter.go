@@ -85,6 +85,18 @@ type Adapter interface {
 	AuthDelAllRecords(uid t.Uid) (int, error)
 	// AuthUpdRecord modifies an authentication record.
 	AuthUpdRecord(user t.Uid, scheme, unique string, authLvl auth.Level, secret []byte, expires time.Time) error
+	// AuthLockoutGet returns a record of failed authentication attempts for the given key or nil if not found.
+	AuthLockoutGet(key string) (*t.AuthLockout, error)
+	// AuthLockoutUpsert creates or updates a record of failed authentication attempts.
+	AuthLockoutUpsert(lockout *t.AuthLockout) error
+	// AuthLockoutReplace saves a record of failed authentication attempts unless it was changed since it
+	// was read as old. If old is nil, the record is created unless it already exists. Returns false if
+	// the record was changed.
+	AuthLockoutReplace(old, lockout *t.AuthLockout) (bool, error)
+	// AuthLockoutDel deletes a record of failed authentication attempts.
+	AuthLockoutDel(key string) error
+	// AuthLockoutDelExpired deletes records which were not updated since olderThan and are not locked.
+	AuthLockoutDelExpired(olderThan time.Time) error
 
 	// Topic management
 
@@ -163,10 +175,51 @@ type Adapter interface {
 	FileStartUpload(fd *t.FileDef) error
 	// FileFinishUpload marks file upload as completed, successfully or otherwise.
 	FileFinishUpload(fid string, status int, size int64) (*t.FileDef, error)
+	// FileUpdate updates fields of a file record.
+	FileUpdate(fid string, update map[string]interface{}) error
 	// FileGet fetches a record of a specific file
 	FileGet(fid string) (*t.FileDef, error)
 	// FileDeleteUnused deletes records where UseCount is zero. If olderThan is non-zero, deletes
 	// unused records with UpdatedAt before olderThan.
 	// Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
 	FileDeleteUnused(olderThan time.Time, limit int) ([]string, error)
+	// FileUsageByUser returns the total size of files uploaded by the user, including unfinished uploads.
+	FileUsageByUser(uid t.Uid) (int64, error)
+	// FileUsageByTopic returns the total size of files attached to messages in the topic.
+	FileUsageByTopic(topic string) (int64, error)
+
+	// Storage quotas
+
+	// QuotaGet returns the quota of a user or a topic or nil if the quota is not set.
+	QuotaGet(id string) (*t.Quota, error)
+	// QuotaUpsert creates or updates the quota of a user or a topic.
+	QuotaUpsert(quota *t.Quota) error
+	// QuotaDel deletes the quota of a user or a topic.
+	QuotaDel(id string) error
+
+	// Audit log
+
+	// AuditAdd saves an audit event.
+	AuditAdd(ev *t.AuditEvent) error
+	// AuditGetAll returns audit events matching the query, newest first.
+	AuditGetAll(query *t.AuditQuery) ([]t.AuditEvent, error)
+
+	// Outbox of messages to external services
+
+	// OutboxAdd queues a message for delivery.
+	OutboxAdd(msg *t.OutboxMessage) error
+	// OutboxGetDue returns up to limit live messages of the given channel which are due for delivery
+	// at the given time, oldest first.
+	OutboxGetDue(channel string, now time.Time, limit int) ([]t.OutboxMessage, error)
+	// OutboxClaim postpones the next delivery attempt to 'until' unless the message was changed since it was
+	// read, i.e. claimed by another process. Returns true if the message was claimed.
+	OutboxClaim(msg *t.OutboxMessage, until time.Time) (bool, error)
+	// OutboxUpdate saves the outcome of a failed delivery attempt.
+	OutboxUpdate(msg *t.OutboxMessage) error
+	// OutboxDelete deletes a message.
+	OutboxDelete(id string) error
+	// OutboxCount returns the number of live messages of the given channel.
+	OutboxCount(channel string) (int, error)
+	// OutboxDelDead deletes dead messages of the given channel which were given up on before olderThan.
+	OutboxDelDead(channel string, olderThan time.Time) error
 }
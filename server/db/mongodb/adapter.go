@@ -40,7 +40,7 @@ const (
 	defaultHost     = "localhost:27017"
 	defaultDatabase = "tinode"
 
-	adpVersion  = 111
+	adpVersion  = 117
 	adapterName = "mongodb"
 
 	defaultMaxResults = 1024
@@ -365,6 +365,25 @@ func (a *adapter) CreateDb(reset bool) error {
 			Collection: "fileuploads",
 			Field:      "usecount",
 		},
+
+		// Log of security-related events. See types.AuditEvent.
+		// Index on 'auditlog.createdat' to select events by time.
+		{
+			Collection: "auditlog",
+			Field:      "createdat",
+		},
+		// Compound index of 'user - createdat' to select events of the given user.
+		{
+			Collection: "auditlog",
+			IndexOpts:  mdb.IndexModel{Keys: auditUserIndex},
+		},
+
+		// Queue of messages to external services. See types.OutboxMessage.
+		// Compound index of 'channel - dead - nextattemptat' to select messages due for delivery.
+		{
+			Collection: "outbox",
+			IndexOpts:  mdb.IndexModel{Keys: outboxDueIndex},
+		},
 	}
 
 	var err error
@@ -478,6 +497,78 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 111 {
+		// Perform database upgrade from version 111 to version 112.
+
+		// Collection "authlockouts" is created with the first write. Nothing to do besides bumping the version.
+
+		if err := bumpVersion(a, 112); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 112 {
+		// Perform database upgrade from version 112 to version 113.
+
+		// Indexes on the log of security-related events.
+		if _, err := a.db.Collection("auditlog").Indexes().CreateOne(a.ctx,
+			mdb.IndexModel{Keys: b.M{"createdat": 1}}); err != nil {
+			return err
+		}
+		if _, err := a.db.Collection("auditlog").Indexes().CreateOne(a.ctx,
+			mdb.IndexModel{Keys: auditUserIndex}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 113); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 113 {
+		// Perform database upgrade from version 113 to version 114.
+
+		// Index on the queue of messages to external services.
+		if _, err := a.db.Collection("outbox").Indexes().CreateOne(a.ctx,
+			mdb.IndexModel{Keys: outboxDueIndex}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 114); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 114 {
+		// Perform database upgrade from version 114 to version 115.
+
+		// Subscriptions have an optional Notify field which requires no migration.
+
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 115 {
+		// Perform database upgrade from version 115 to version 116.
+
+		// Subscriptions have an optional Mentions field which requires no migration.
+
+		if err := bumpVersion(a, 116); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 116 {
+		// Perform database upgrade from version 116 to version 117.
+
+		// Collection "quotas" is created with the first write. Nothing to do besides bumping the version.
+
+		if err := bumpVersion(a, 117); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -1161,6 +1252,58 @@ func (a *adapter) AuthUpdRecord(uid t.Uid, scheme, unique string,
 	return err
 }
 
+// AuthLockoutGet returns a record of failed authentication attempts for the given key.
+func (a *adapter) AuthLockoutGet(key string) (*t.AuthLockout, error) {
+	var lockout t.AuthLockout
+	err := a.db.Collection("authlockouts").FindOne(a.ctx, b.M{"_id": key}).Decode(&lockout)
+	if err != nil {
+		if err == mdb.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &lockout, nil
+}
+
+// AuthLockoutUpsert creates or updates a record of failed authentication attempts.
+func (a *adapter) AuthLockoutUpsert(lockout *t.AuthLockout) error {
+	_, err := a.db.Collection("authlockouts").ReplaceOne(a.ctx, b.M{"_id": lockout.Id}, lockout,
+		mdbopts.Replace().SetUpsert(true))
+	return err
+}
+
+// AuthLockoutReplace saves a record of failed authentication attempts unless it was changed since it was read.
+func (a *adapter) AuthLockoutReplace(old, lockout *t.AuthLockout) (bool, error) {
+	if old == nil {
+		_, err := a.db.Collection("authlockouts").InsertOne(a.ctx, lockout)
+		if isDuplicateErr(err) {
+			// Created by someone else.
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	res, err := a.db.Collection("authlockouts").ReplaceOne(a.ctx,
+		b.M{"_id": lockout.Id, "updatedat": old.UpdatedAt, "failures": old.Failures}, lockout)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// AuthLockoutDel deletes a record of failed authentication attempts.
+func (a *adapter) AuthLockoutDel(key string) error {
+	_, err := a.db.Collection("authlockouts").DeleteOne(a.ctx, b.M{"_id": key})
+	return err
+}
+
+// AuthLockoutDelExpired deletes records which were not updated since olderThan and are not locked.
+func (a *adapter) AuthLockoutDelExpired(olderThan time.Time) error {
+	_, err := a.db.Collection("authlockouts").DeleteMany(a.ctx,
+		b.M{"updatedat": b.M{"$lt": olderThan}, "lockeduntil": b.M{"$lt": t.TimeNow()}})
+	return err
+}
+
 // Topic management
 
 func (a *adapter) undeleteSubscription(sub *t.Subscription) error {
@@ -2185,6 +2328,14 @@ func (a *adapter) FileFinishUpload(fid string, status int, size int64) (*t.FileD
 	return a.FileGet(fid)
 }
 
+// FileUpdate updates fields of a file record.
+func (a *adapter) FileUpdate(fid string, update map[string]interface{}) error {
+	_, err := a.db.Collection("fileuploads").UpdateOne(a.ctx,
+		b.M{"_id": fid},
+		b.M{"$set": normalizeUpdateMap(update)})
+	return err
+}
+
 // FileGet fetches a record of a specific file
 func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 	var fd t.FileDef
@@ -2199,6 +2350,80 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 	return &fd, nil
 }
 
+// FileUsageByUser returns the total size of files uploaded by the user, including unfinished uploads.
+func (a *adapter) FileUsageByUser(uid t.Uid) (int64, error) {
+	return a.fileTotalSize(b.M{"user": uid.String(), "status": b.M{"$ne": t.UploadFailed}})
+}
+
+// FileUsageByTopic returns the total size of files attached to messages in the topic.
+func (a *adapter) FileUsageByTopic(topic string) (int64, error) {
+	fileIds, err := a.db.Collection("messages").Distinct(a.ctx, "attachments",
+		b.M{"topic": topic, "attachments": b.M{"$exists": true}})
+	if err != nil {
+		return 0, err
+	}
+	if len(fileIds) == 0 {
+		return 0, nil
+	}
+	return a.fileTotalSize(b.M{"_id": b.M{"$in": fileIds}})
+}
+
+// fileTotalSize returns the total size of file records matching the filter.
+func (a *adapter) fileTotalSize(filter b.M) (int64, error) {
+	pipeline := b.A{
+		b.M{"$match": filter},
+		// Records created before variants were counted have no variantsize.
+		b.M{"$group": b.M{"_id": nil, "total": b.M{"$sum": b.M{"$add": b.A{"$size",
+			b.M{"$ifNull": b.A{"$variantsize", 0}}}}}}},
+	}
+	cur, err := a.db.Collection("fileuploads").Aggregate(a.ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(a.ctx)
+
+	var result []struct {
+		Id    interface{} `bson:"_id"`
+		Total int64       `bson:"total"`
+	}
+	if err = cur.All(a.ctx, &result); err != nil {
+		return 0, err
+	}
+	if len(result) == 0 {
+		return 0, nil
+	}
+	return result[0].Total, nil
+}
+
+// QuotaGet returns the quota of a user or a topic.
+func (a *adapter) QuotaGet(id string) (*t.Quota, error) {
+	var quota t.Quota
+	err := a.db.Collection("quotas").FindOne(a.ctx, b.M{"_id": id}).Decode(&quota)
+	if err != nil {
+		if err == mdb.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &quota, nil
+}
+
+// QuotaUpsert creates or updates the quota of a user or a topic.
+func (a *adapter) QuotaUpsert(quota *t.Quota) error {
+	_, err := a.db.Collection("quotas").UpdateOne(a.ctx, b.M{"_id": quota.Id},
+		b.M{
+			"$set":         b.M{"updatedat": quota.UpdatedAt, "limit": quota.Limit},
+			"$setOnInsert": b.M{"createdat": quota.CreatedAt}},
+		mdbopts.Update().SetUpsert(true))
+	return err
+}
+
+// QuotaDel deletes the quota of a user or a topic.
+func (a *adapter) QuotaDel(id string) error {
+	_, err := a.db.Collection("quotas").DeleteOne(a.ctx, b.M{"_id": id})
+	return err
+}
+
 // FileDeleteUnused deletes records where UseCount is zero. If olderThan is non-zero, deletes
 // unused records with UpdatedAt before olderThan.
 // Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
@@ -2234,6 +2459,57 @@ func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, er
 	return locations, err
 }
 
+// Compound index of audit events by user and time. The order of keys matters, hence bson.D.
+var auditUserIndex = b.D{{Key: "user", Value: 1}, {Key: "createdat", Value: -1}}
+
+// AuditAdd saves an audit event.
+func (a *adapter) AuditAdd(ev *t.AuditEvent) error {
+	_, err := a.db.Collection("auditlog").InsertOne(a.ctx, ev)
+	return err
+}
+
+// AuditGetAll returns audit events matching the query, newest first.
+func (a *adapter) AuditGetAll(query *t.AuditQuery) ([]t.AuditEvent, error) {
+	filter := b.M{}
+	if query.User != "" {
+		filter["user"] = query.User
+	}
+	if query.Action != "" {
+		filter["action"] = query.Action
+	}
+	if !query.Since.IsZero() || !query.Before.IsZero() {
+		timeFilter := b.M{}
+		if !query.Since.IsZero() {
+			timeFilter["$gte"] = query.Since
+		}
+		if !query.Before.IsZero() {
+			timeFilter["$lt"] = query.Before
+		}
+		filter["createdat"] = timeFilter
+	}
+	limit := a.maxResults
+	if query.Limit > 0 && query.Limit < limit {
+		limit = query.Limit
+	}
+	findOpts := mdbopts.Find().SetSort(b.M{"createdat": -1}).SetLimit(int64(limit))
+
+	cur, err := a.db.Collection("auditlog").Find(a.ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var events []t.AuditEvent
+	for cur.Next(a.ctx) {
+		var ev t.AuditEvent
+		if err = cur.Decode(&ev); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, cur.Err()
+}
+
 // Given a filter query against 'messages' collection, decrement corresponding use counter in 'fileuploads' table.
 func (a *adapter) fileDecrementUseCounter(ctx context.Context, msgFilter b.M) error {
 	// Copy msgFilter
@@ -2351,3 +2627,81 @@ func isDuplicateErr(err error) bool {
 	msg := err.Error()
 	return strings.Contains(msg, "duplicate key error")
 }
+
+// Compound index of outbox messages due for delivery. The order of keys matters, hence bson.D.
+var outboxDueIndex = b.D{{Key: "channel", Value: 1}, {Key: "dead", Value: 1}, {Key: "nextattemptat", Value: 1}}
+
+// OutboxAdd queues a message for delivery.
+func (a *adapter) OutboxAdd(msg *t.OutboxMessage) error {
+	_, err := a.db.Collection("outbox").InsertOne(a.ctx, msg)
+	return err
+}
+
+// OutboxGetDue returns messages of the given channel which are due for delivery, oldest first.
+func (a *adapter) OutboxGetDue(channel string, now time.Time, limit int) ([]t.OutboxMessage, error) {
+	filter := b.M{"channel": channel, "dead": false, "nextattemptat": b.M{"$lte": now}}
+	findOpts := mdbopts.Find().SetSort(b.M{"nextattemptat": 1}).SetLimit(int64(limit))
+
+	cur, err := a.db.Collection("outbox").Find(a.ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var msgs []t.OutboxMessage
+	for cur.Next(a.ctx) {
+		var msg t.OutboxMessage
+		if err = cur.Decode(&msg); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, cur.Err()
+}
+
+// OutboxClaim postpones the next delivery attempt unless the message was changed since it was read.
+func (a *adapter) OutboxClaim(msg *t.OutboxMessage, until time.Time) (bool, error) {
+	res, err := a.db.Collection("outbox").UpdateOne(a.ctx,
+		b.M{"_id": msg.Id, "nextattemptat": msg.NextAttemptAt, "dead": false},
+		b.M{"$set": b.M{"nextattemptat": until, "updatedat": t.TimeNow()}})
+	if err != nil {
+		return false, err
+	}
+	if res.ModifiedCount > 0 {
+		msg.NextAttemptAt = until
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+// OutboxUpdate saves the outcome of a failed delivery attempt.
+func (a *adapter) OutboxUpdate(msg *t.OutboxMessage) error {
+	_, err := a.db.Collection("outbox").UpdateOne(a.ctx, b.M{"_id": msg.Id},
+		b.M{"$set": b.M{
+			"updatedat":     msg.UpdatedAt,
+			"content":       msg.Content,
+			"attempts":      msg.Attempts,
+			"nextattemptat": msg.NextAttemptAt,
+			"dead":          msg.Dead,
+			"lasterror":     msg.LastError,
+		}})
+	return err
+}
+
+// OutboxDelete deletes a message.
+func (a *adapter) OutboxDelete(id string) error {
+	_, err := a.db.Collection("outbox").DeleteOne(a.ctx, b.M{"_id": id})
+	return err
+}
+
+// OutboxCount returns the number of live messages of the given channel.
+func (a *adapter) OutboxCount(channel string) (int, error) {
+	count, err := a.db.Collection("outbox").CountDocuments(a.ctx, b.M{"channel": channel, "dead": false})
+	return int(count), err
+}
+
+// OutboxDelDead deletes dead messages of the given channel which were given up on before olderThan.
+func (a *adapter) OutboxDelDead(channel string, olderThan time.Time) error {
+	_, err := a.db.Collection("outbox").DeleteMany(a.ctx,
+		b.M{"channel": channel, "dead": true, "nextattemptat": b.M{"$lt": olderThan}})
+	return err
+}
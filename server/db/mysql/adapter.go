@@ -17,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // adapter holds MySQL connection data.
@@ -35,7 +36,7 @@ const (
 	defaultDSN      = "root:@tcp(localhost:3306)/tinode?parseTime=true"
 	defaultDatabase = "tinode"
 
-	adpVersion = 111
+	adpVersion = 119
 
 	adapterName = "mysql"
 
@@ -287,6 +288,21 @@ func (a *adapter) CreateDb(reset bool) error {
 		return err
 	}
 
+	// Records of failed authentication attempts.
+	if _, err = tx.Exec(
+		`CREATE TABLE authlockouts(
+			id          VARCHAR(128) NOT NULL,
+			createdat   DATETIME(3) NOT NULL,
+			updatedat   DATETIME(3) NOT NULL,
+			failures    INT NOT NULL DEFAULT 0,
+			lockeduntil DATETIME(3),
+			addr        VARCHAR(64) NOT NULL DEFAULT '',
+			PRIMARY KEY(id),
+			INDEX authlockouts_updatedat(updatedat)
+		)`); err != nil {
+		return err
+	}
+
 	// Topics
 	if _, err = tx.Exec(
 		`CREATE TABLE topics(
@@ -346,6 +362,8 @@ func (a *adapter) CreateDb(reset bool) error {
 			modewant  CHAR(8),
 			modegiven CHAR(8),
 			private   JSON,
+			notify    JSON,
+			mentions  JSON,
 			PRIMARY KEY(id),
 			FOREIGN KEY(userid) REFERENCES users(id),
 			UNIQUE INDEX subscriptions_topic_userid(topic, userid),
@@ -418,14 +436,28 @@ func (a *adapter) CreateDb(reset bool) error {
 	// Don't add FOREIGN KEY on userid. It's not needed and it will break user deletion.
 	if _, err = tx.Exec(
 		`CREATE TABLE fileuploads(
-			id        BIGINT NOT NULL,
+			id          BIGINT NOT NULL,
+			createdat   DATETIME(3) NOT NULL,
+			updatedat   DATETIME(3) NOT NULL,
+			userid      BIGINT NOT NULL,
+			status      INT NOT NULL,
+			mimetype    VARCHAR(255) NOT NULL,
+			size        BIGINT NOT NULL,
+			variantsize BIGINT NOT NULL DEFAULT 0,
+			location    VARCHAR(2048) NOT NULL,
+			PRIMARY KEY(id),
+			INDEX fileuploads_userid(userid)
+		)`); err != nil {
+		return err
+	}
+
+	// Storage quotas of users and topics which override the defaults.
+	if _, err = tx.Exec(
+		`CREATE TABLE quotas(
+			id        VARCHAR(32) NOT NULL,
 			createdat DATETIME(3) NOT NULL,
 			updatedat DATETIME(3) NOT NULL,
-			userid    BIGINT NOT NULL,
-			status    INT NOT NULL,
-			mimetype  VARCHAR(255) NOT NULL,
-			size      BIGINT NOT NULL,
-			location  VARCHAR(2048) NOT NULL,
+			sizelimit BIGINT NOT NULL,
 			PRIMARY KEY(id)
 		)`); err != nil {
 		return err
@@ -445,6 +477,44 @@ func (a *adapter) CreateDb(reset bool) error {
 		return err
 	}
 
+	// Log of security-related events.
+	if _, err = tx.Exec(
+		`CREATE TABLE auditlog(
+			id         BIGINT NOT NULL,
+			createdat  DATETIME(3) NOT NULL,
+			action     VARCHAR(32) NOT NULL,
+			userid     BIGINT NOT NULL DEFAULT 0,
+			scheme     VARCHAR(32) NOT NULL DEFAULT '',
+			remoteaddr VARCHAR(255) NOT NULL DEFAULT '',
+			useragent  VARCHAR(255) NOT NULL DEFAULT '',
+			outcome    VARCHAR(64) NOT NULL,
+			params     JSON,
+			PRIMARY KEY(id),
+			INDEX auditlog_createdat(createdat),
+			INDEX auditlog_userid_createdat(userid, createdat)
+		)`); err != nil {
+		return err
+	}
+
+	// Queue of messages to external services.
+	if _, err = tx.Exec(
+		`CREATE TABLE outbox(
+			id            BIGINT NOT NULL,
+			createdat     DATETIME(3) NOT NULL,
+			updatedat     DATETIME(3) NOT NULL,
+			channel       VARCHAR(16) NOT NULL,
+			recipient     VARCHAR(255) NOT NULL,
+			content       MEDIUMBLOB NOT NULL,
+			attempts      INT NOT NULL DEFAULT 0,
+			nextattemptat DATETIME(3) NOT NULL,
+			dead          TINYINT NOT NULL DEFAULT 0,
+			lasterror     VARCHAR(255) NOT NULL DEFAULT '',
+			PRIMARY KEY(id),
+			INDEX outbox_channel_dead_nextattemptat(channel, dead, nextattemptat)
+		)`); err != nil {
+		return err
+	}
+
 	if _, err = tx.Exec(
 		`CREATE TABLE kvmeta(` +
 			"`key`   CHAR(32)," +
@@ -590,6 +660,159 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 111 {
+		// Perform database upgrade from version 111 to version 112.
+
+		// Records of failed authentication attempts.
+		if _, err := a.db.Exec(
+			`CREATE TABLE authlockouts(
+				id          VARCHAR(128) NOT NULL,
+				createdat   DATETIME(3) NOT NULL,
+				updatedat   DATETIME(3) NOT NULL,
+				failures    INT NOT NULL DEFAULT 0,
+				lockeduntil DATETIME(3),
+				PRIMARY KEY(id)
+			)`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 112); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 112 {
+		// Perform database upgrade from version 112 to version 113.
+
+		// Log of security-related events.
+		if _, err := a.db.Exec(
+			`CREATE TABLE auditlog(
+				id         BIGINT NOT NULL,
+				createdat  DATETIME(3) NOT NULL,
+				action     VARCHAR(32) NOT NULL,
+				userid     BIGINT NOT NULL DEFAULT 0,
+				scheme     VARCHAR(32) NOT NULL DEFAULT '',
+				remoteaddr VARCHAR(255) NOT NULL DEFAULT '',
+				useragent  VARCHAR(255) NOT NULL DEFAULT '',
+				outcome    VARCHAR(64) NOT NULL,
+				params     JSON,
+				PRIMARY KEY(id),
+				INDEX auditlog_createdat(createdat),
+				INDEX auditlog_userid_createdat(userid, createdat)
+			)`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 113); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 113 {
+		// Perform database upgrade from version 113 to version 114.
+
+		// Queue of messages to external services.
+		if _, err := a.db.Exec(
+			`CREATE TABLE outbox(
+				id            BIGINT NOT NULL,
+				createdat     DATETIME(3) NOT NULL,
+				updatedat     DATETIME(3) NOT NULL,
+				channel       VARCHAR(16) NOT NULL,
+				recipient     VARCHAR(255) NOT NULL,
+				content       MEDIUMBLOB NOT NULL,
+				attempts      INT NOT NULL DEFAULT 0,
+				nextattemptat DATETIME(3) NOT NULL,
+				dead          TINYINT NOT NULL DEFAULT 0,
+				lasterror     VARCHAR(255) NOT NULL DEFAULT '',
+				PRIMARY KEY(id),
+				INDEX outbox_channel_dead_nextattemptat(channel, dead, nextattemptat)
+			)`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 114); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 114 {
+		// Perform database upgrade from version 114 to version 115.
+
+		// Per-subscription push notification preferences.
+		if _, err := a.db.Exec("ALTER TABLE subscriptions ADD notify JSON"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 115 {
+		// Perform database upgrade from version 115 to version 116.
+
+		// Unread messages which mention the user.
+		if _, err := a.db.Exec("ALTER TABLE subscriptions ADD mentions JSON"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 116); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 116 {
+		// Perform database upgrade from version 116 to version 117.
+
+		// Storage quotas of users and topics.
+		if _, err := a.db.Exec(
+			`CREATE TABLE quotas(
+				id        VARCHAR(32) NOT NULL,
+				createdat DATETIME(3) NOT NULL,
+				updatedat DATETIME(3) NOT NULL,
+				sizelimit BIGINT NOT NULL,
+				PRIMARY KEY(id)
+			)`); err != nil {
+			return err
+		}
+
+		// Usage of storage is calculated by user.
+		if _, err := a.db.Exec("ALTER TABLE fileuploads ADD INDEX fileuploads_userid(userid)"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 117); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 117 {
+		// Perform database upgrade from version 117 to version 118.
+
+		// Address of the last login attempt and purging of expired records.
+		if _, err := a.db.Exec("ALTER TABLE authlockouts ADD addr VARCHAR(64) NOT NULL DEFAULT '', " +
+			"ADD INDEX authlockouts_updatedat(updatedat)"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 118); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 118 {
+		// Perform database upgrade from version 118 to version 119.
+
+		// Thumbnails and other variants of files count towards storage quotas.
+		if _, err := a.db.Exec("ALTER TABLE fileuploads ADD variantsize BIGINT NOT NULL DEFAULT 0 AFTER size"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 119); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -790,6 +1013,78 @@ func (a *adapter) AuthGetUniqueRecord(unique string) (t.Uid, auth.Level, []byte,
 	return store.EncodeUid(record.Userid), record.Authlvl, record.Secret, expires, nil
 }
 
+// AuthLockoutGet returns a record of failed authentication attempts for the given key.
+func (a *adapter) AuthLockoutGet(key string) (*t.AuthLockout, error) {
+	var lockout t.AuthLockout
+	var lockedUntil *time.Time
+	err := a.db.QueryRowx("SELECT id,createdat,updatedat,failures,lockeduntil,addr FROM authlockouts WHERE id=?", key).
+		Scan(&lockout.Id, &lockout.CreatedAt, &lockout.UpdatedAt, &lockout.Failures, &lockedUntil, &lockout.Addr)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		return nil, err
+	}
+	if lockedUntil != nil {
+		lockout.LockedUntil = *lockedUntil
+	}
+	return &lockout, nil
+}
+
+// AuthLockoutUpsert creates or updates a record of failed authentication attempts.
+func (a *adapter) AuthLockoutUpsert(lockout *t.AuthLockout) error {
+	var lockedUntil *time.Time
+	if !lockout.LockedUntil.IsZero() {
+		lockedUntil = &lockout.LockedUntil
+	}
+	_, err := a.db.Exec("INSERT INTO authlockouts(id,createdat,updatedat,failures,lockeduntil,addr) VALUES(?,?,?,?,?,?) "+
+		"ON DUPLICATE KEY UPDATE updatedat=VALUES(updatedat),failures=VALUES(failures),lockeduntil=VALUES(lockeduntil),"+
+		"addr=VALUES(addr)",
+		lockout.Id, lockout.CreatedAt, lockout.UpdatedAt, lockout.Failures, lockedUntil, lockout.Addr)
+	return err
+}
+
+// AuthLockoutReplace saves a record of failed authentication attempts unless it was changed since it was read.
+func (a *adapter) AuthLockoutReplace(old, lockout *t.AuthLockout) (bool, error) {
+	var lockedUntil *time.Time
+	if !lockout.LockedUntil.IsZero() {
+		lockedUntil = &lockout.LockedUntil
+	}
+
+	if old == nil {
+		_, err := a.db.Exec("INSERT INTO authlockouts(id,createdat,updatedat,failures,lockeduntil,addr) VALUES(?,?,?,?,?,?)",
+			lockout.Id, lockout.CreatedAt, lockout.UpdatedAt, lockout.Failures, lockedUntil, lockout.Addr)
+		if isDupe(err) {
+			// Created by someone else.
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	res, err := a.db.Exec("UPDATE authlockouts SET createdat=?,updatedat=?,failures=?,lockeduntil=?,addr=? "+
+		"WHERE id=? AND updatedat=? AND failures=?",
+		lockout.CreatedAt, lockout.UpdatedAt, lockout.Failures, lockedUntil, lockout.Addr,
+		lockout.Id, old.UpdatedAt, old.Failures)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+// AuthLockoutDel deletes a record of failed authentication attempts.
+func (a *adapter) AuthLockoutDel(key string) error {
+	_, err := a.db.Exec("DELETE FROM authlockouts WHERE id=?", key)
+	return err
+}
+
+// AuthLockoutDelExpired deletes records which were not updated since olderThan and are not locked.
+func (a *adapter) AuthLockoutDelExpired(olderThan time.Time) error {
+	_, err := a.db.Exec("DELETE FROM authlockouts WHERE updatedat<? AND (lockeduntil IS NULL OR lockeduntil<?)",
+		olderThan, t.TimeNow())
+	return err
+}
+
 // UserGet fetches a single user by user id. If user is not found it returns (nil, nil)
 func (a *adapter) UserGet(uid t.Uid) (*t.User, error) {
 	var user t.User
@@ -1258,7 +1553,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 	log.Printf("mabing: (a *adapter) TopicsForUser(...), uid = %+v, keepDeleted = %+v, opts = %+v", uid,keepDeleted,opts)
 	// Fetch user's subscriptions
 	q := `SELECT createdat,updatedat,deletedat,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE userid=?`
+		readseqid,modewant,modegiven,private,notify,mentions FROM subscriptions WHERE userid=?`
 	args := []interface{}{store.DecodeUid(uid)}
 	if !keepDeleted {
 		// Filter out deleted rows.
@@ -1421,7 +1716,7 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 
 	// Fetch all subscribed users. The number of users is not large
 	q := `SELECT s.createdat,s.updatedat,s.deletedat,s.userid,s.topic,s.delid,s.recvseqid,
-		s.readseqid,s.modewant,s.modegiven,u.public,s.private
+		s.readseqid,s.modewant,s.modegiven,u.public,s.private,s.notify,s.mentions
 		FROM subscriptions AS s JOIN users AS u ON s.userid=u.id 
 		WHERE s.topic=?`
 	args := []interface{}{topic}
@@ -1473,7 +1768,7 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 			&sub.CreatedAt, &sub.UpdatedAt, &sub.DeletedAt,
 			&sub.User, &sub.Topic, &sub.DelId, &sub.RecvSeqId,
 			&sub.ReadSeqId, &sub.ModeWant, &sub.ModeGiven,
-			&public, &sub.Private); err != nil {
+			&public, &sub.Private, &sub.Notify, &sub.Mentions); err != nil {
 			break
 		}
 
@@ -1647,7 +1942,7 @@ func (a *adapter) TopicOwnerChange(topic string, newOwner t.Uid) error {
 func (a *adapter) SubscriptionGet(topic string, user t.Uid) (*t.Subscription, error) {
 	var sub t.Subscription
 	err := a.db.Get(&sub, `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE topic=? AND userid=?`,
+		readseqid,modewant,modegiven,private,notify,mentions FROM subscriptions WHERE topic=? AND userid=?`,
 		topic, store.DecodeUid(user))
 
 	if err != nil {
@@ -1682,7 +1977,7 @@ func (a *adapter) SubsLastSeen(topic string, user t.Uid, lastSeen map[string]tim
 // TODO: this is used only for presence notifications, no need to load Private either.
 func (a *adapter) SubsForUser(forUser t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
 	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE userid=?`
+		readseqid,modewant,modegiven,private,notify,mentions FROM subscriptions WHERE userid=?`
 
 	args := []interface{}{store.DecodeUid(forUser)}
 	if !keepDeleted {
@@ -1731,7 +2026,7 @@ func (a *adapter) SubsForUser(forUser t.Uid, keepDeleted bool, opts *t.QueryOpt)
 // the latter does not.
 func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
 	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE topic=?`
+		readseqid,modewant,modegiven,private,notify,mentions FROM subscriptions WHERE topic=?`
 
 	args := []interface{}{topic}
 	if !keepDeleted {
@@ -2674,6 +2969,19 @@ func (a *adapter) FileFinishUpload(fid string, status int, size int64) (*t.FileD
 	return fd, err
 }
 
+// FileUpdate updates fields of a file record.
+func (a *adapter) FileUpdate(fid string, update map[string]interface{}) error {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return t.ErrMalformed
+	}
+
+	cols, args := updateByMap(update)
+	args = append(args, store.DecodeUid(id))
+	_, err := a.db.Exec("UPDATE fileuploads SET "+strings.Join(cols, ",")+" WHERE id=?", args...)
+	return err
+}
+
 // FileGet fetches a record of a specific file
 func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 	id := t.ParseUid(fid)
@@ -2682,7 +2990,7 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 	}
 
 	var fd t.FileDef
-	err := a.db.Get(&fd, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,location "+
+	err := a.db.Get(&fd, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,variantsize,location "+
 		"FROM fileuploads WHERE id=?", store.DecodeUid(id))
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -2698,6 +3006,51 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 
 }
 
+// FileUsageByUser returns the total size of files uploaded by the user, including unfinished uploads.
+func (a *adapter) FileUsageByUser(uid t.Uid) (int64, error) {
+	var size int64
+	err := a.db.Get(&size, "SELECT COALESCE(SUM(size+variantsize),0) FROM fileuploads WHERE userid=? AND status!=?",
+		store.DecodeUid(uid), t.UploadFailed)
+	return size, err
+}
+
+// FileUsageByTopic returns the total size of files attached to messages in the topic.
+func (a *adapter) FileUsageByTopic(topic string) (int64, error) {
+	var size int64
+	err := a.db.Get(&size, "SELECT COALESCE(SUM(size+variantsize),0) FROM fileuploads WHERE id IN "+
+		"(SELECT fml.fileid FROM filemsglinks AS fml INNER JOIN messages AS m ON m.id=fml.msgid WHERE m.topic=?)",
+		topic)
+	return size, err
+}
+
+// QuotaGet returns the quota of a user or a topic.
+func (a *adapter) QuotaGet(id string) (*t.Quota, error) {
+	var quota t.Quota
+	err := a.db.QueryRowx("SELECT id,createdat,updatedat,sizelimit FROM quotas WHERE id=?", id).
+		Scan(&quota.Id, &quota.CreatedAt, &quota.UpdatedAt, &quota.Limit)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		return nil, err
+	}
+	return &quota, nil
+}
+
+// QuotaUpsert creates or updates the quota of a user or a topic.
+func (a *adapter) QuotaUpsert(quota *t.Quota) error {
+	_, err := a.db.Exec("INSERT INTO quotas(id,createdat,updatedat,sizelimit) VALUES(?,?,?,?) "+
+		"ON DUPLICATE KEY UPDATE updatedat=VALUES(updatedat),sizelimit=VALUES(sizelimit)",
+		quota.Id, quota.CreatedAt, quota.UpdatedAt, quota.Limit)
+	return err
+}
+
+// QuotaDel deletes the quota of a user or a topic.
+func (a *adapter) QuotaDel(id string) error {
+	_, err := a.db.Exec("DELETE FROM quotas WHERE id=?", id)
+	return err
+}
+
 // FileDeleteUnused deletes file upload records.
 func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, error) {
 	tx, err := a.db.Begin()
@@ -2754,6 +3107,160 @@ func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, er
 	return locations, tx.Commit()
 }
 
+// AuditAdd saves an audit event.
+func (a *adapter) AuditAdd(ev *t.AuditEvent) error {
+	var params []byte
+	if len(ev.Params) > 0 {
+		params = toJSON(ev.Params)
+	}
+	// Values are truncated to column widths: strict SQL mode rejects longer strings.
+	_, err := a.db.Exec("INSERT INTO auditlog(id,createdat,action,userid,scheme,remoteaddr,useragent,outcome,params)"+
+		" VALUES(?,?,?,?,?,?,?,?,?)",
+		store.DecodeUid(t.ParseUid(ev.Id)), ev.CreatedAt, truncateString(ev.Action, 32),
+		store.DecodeUid(t.ParseUid(ev.User)), truncateString(ev.Scheme, 32), truncateString(ev.RemoteAddr, 255),
+		truncateString(ev.UserAgent, 255), truncateString(ev.Outcome, 64), params)
+	return err
+}
+
+// AuditGetAll returns audit events matching the query, newest first.
+func (a *adapter) AuditGetAll(query *t.AuditQuery) ([]t.AuditEvent, error) {
+	q := "SELECT id,createdat,action,userid,scheme,remoteaddr,useragent,outcome,params FROM auditlog WHERE 1=1"
+	var args []interface{}
+	if query.User != "" {
+		q += " AND userid=?"
+		args = append(args, store.DecodeUid(t.ParseUid(query.User)))
+	}
+	if query.Action != "" {
+		q += " AND action=?"
+		args = append(args, query.Action)
+	}
+	if !query.Since.IsZero() {
+		q += " AND createdat>=?"
+		args = append(args, query.Since)
+	}
+	if !query.Before.IsZero() {
+		q += " AND createdat<?"
+		args = append(args, query.Before)
+	}
+	limit := a.maxResults
+	if query.Limit > 0 && query.Limit < limit {
+		limit = query.Limit
+	}
+	q += " ORDER BY createdat DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := a.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []t.AuditEvent
+	for rows.Next() {
+		var ev t.AuditEvent
+		var id, userid int64
+		var params []byte
+		if err = rows.Scan(&id, &ev.CreatedAt, &ev.Action, &userid, &ev.Scheme, &ev.RemoteAddr,
+			&ev.UserAgent, &ev.Outcome, &params); err != nil {
+			break
+		}
+		ev.Id = store.EncodeUid(id).String()
+		if userid != 0 {
+			ev.User = store.EncodeUid(userid).String()
+		}
+		if len(params) > 0 {
+			json.Unmarshal(params, &ev.Params)
+		}
+		events = append(events, ev)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return events, err
+}
+
+// OutboxAdd queues a message for delivery.
+func (a *adapter) OutboxAdd(msg *t.OutboxMessage) error {
+	_, err := a.db.Exec("INSERT INTO outbox(id,createdat,updatedat,channel,recipient,content,attempts,nextattemptat,"+
+		"dead,lasterror) VALUES(?,?,?,?,?,?,?,?,?,?)",
+		store.DecodeUid(t.ParseUid(msg.Id)), msg.CreatedAt, msg.UpdatedAt, msg.Channel, msg.To, msg.Content,
+		msg.Attempts, msg.NextAttemptAt, msg.Dead, msg.LastError)
+	return err
+}
+
+// OutboxGetDue returns messages of the given channel which are due for delivery, oldest first.
+func (a *adapter) OutboxGetDue(channel string, now time.Time, limit int) ([]t.OutboxMessage, error) {
+	rows, err := a.db.Query("SELECT id,createdat,updatedat,channel,recipient,content,attempts,nextattemptat,"+
+		"dead,lasterror FROM outbox WHERE channel=? AND dead=0 AND nextattemptat<=? ORDER BY nextattemptat ASC LIMIT ?",
+		channel, now, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []t.OutboxMessage
+	for rows.Next() {
+		var msg t.OutboxMessage
+		var id int64
+		if err = rows.Scan(&id, &msg.CreatedAt, &msg.UpdatedAt, &msg.Channel, &msg.To, &msg.Content,
+			&msg.Attempts, &msg.NextAttemptAt, &msg.Dead, &msg.LastError); err != nil {
+			break
+		}
+		msg.Id = store.EncodeUid(id).String()
+		msgs = append(msgs, msg)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return msgs, err
+}
+
+// OutboxClaim postpones the next delivery attempt unless the message was changed since it was read.
+func (a *adapter) OutboxClaim(msg *t.OutboxMessage, until time.Time) (bool, error) {
+	res, err := a.db.Exec("UPDATE outbox SET nextattemptat=?,updatedat=? WHERE id=? AND nextattemptat=? AND dead=0",
+		until, t.TimeNow(), store.DecodeUid(t.ParseUid(msg.Id)), msg.NextAttemptAt)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		msg.NextAttemptAt = until
+	}
+	return count > 0, nil
+}
+
+// OutboxUpdate saves the outcome of a failed delivery attempt.
+func (a *adapter) OutboxUpdate(msg *t.OutboxMessage) error {
+	_, err := a.db.Exec("UPDATE outbox SET updatedat=?,content=?,attempts=?,nextattemptat=?,dead=?,lasterror=? WHERE id=?",
+		msg.UpdatedAt, msg.Content, msg.Attempts, msg.NextAttemptAt, msg.Dead, msg.LastError,
+		store.DecodeUid(t.ParseUid(msg.Id)))
+	return err
+}
+
+// OutboxDelete deletes a message.
+func (a *adapter) OutboxDelete(id string) error {
+	_, err := a.db.Exec("DELETE FROM outbox WHERE id=?", store.DecodeUid(t.ParseUid(id)))
+	return err
+}
+
+// OutboxCount returns the number of live messages of the given channel.
+func (a *adapter) OutboxCount(channel string) (int, error) {
+	var count int
+	err := a.db.Get(&count, "SELECT COUNT(*) FROM outbox WHERE channel=? AND dead=0", channel)
+	return count, err
+}
+
+// OutboxDelDead deletes dead messages of the given channel which were given up on before olderThan.
+func (a *adapter) OutboxDelDead(channel string, olderThan time.Time) error {
+	_, err := a.db.Exec("DELETE FROM outbox WHERE channel=? AND dead=1 AND nextattemptat<?", channel, olderThan)
+	return err
+}
+
 // Helper functions
 
 // Check if MySQL error is a Error Code: 1062. Duplicate entry ... for key ...
@@ -2794,6 +3301,14 @@ func toJSON(src interface{}) []byte {
 	return jval
 }
 
+// truncateString shortens the string to at most maxLen characters to fit into a VARCHAR column.
+func truncateString(str string, maxLen int) string {
+	if utf8.RuneCountInString(str) <= maxLen {
+		return str
+	}
+	return string([]rune(str)[:maxLen])
+}
+
 // Deserialize JSON data from DB.
 func fromJSON(src interface{}) interface{} {
 	if src == nil {
@@ -72,6 +72,17 @@ CREATE TABLE auth(
 	UNIQUE INDEX auth_uname (uname)
 );
 
+# Records of failed authentication attempts, keyed by login or IP address.
+CREATE TABLE authlockouts(
+	id			VARCHAR(128) NOT NULL,
+	createdat	DATETIME(3) NOT NULL,
+	updatedat	DATETIME(3) NOT NULL,
+	failures	INT NOT NULL DEFAULT 0,
+	lockeduntil	DATETIME(3),
+	
+	PRIMARY KEY(id)
+);
+
 
 # Topics
 CREATE TABLE topics(
@@ -210,4 +221,38 @@ CREATE TABLE filemsglinks(
 	PRIMARY KEY(id),
 	FOREIGN KEY(fileid) REFERENCES fileuploads(id) ON DELETE CASCADE,
 	FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE
-);
\ No newline at end of file
+);
+
+# Log of security-related events: logins, password resets, etc.
+CREATE TABLE auditlog(
+	id			BIGINT NOT NULL,
+	createdat	DATETIME(3) NOT NULL,
+	action		VARCHAR(32) NOT NULL,
+	userid		BIGINT NOT NULL DEFAULT 0,
+	scheme		VARCHAR(32) NOT NULL DEFAULT '',
+	remoteaddr	VARCHAR(255) NOT NULL DEFAULT '',
+	useragent	VARCHAR(255) NOT NULL DEFAULT '',
+	outcome		VARCHAR(64) NOT NULL,
+	params		JSON,
+	
+	PRIMARY KEY(id),
+	INDEX auditlog_createdat(createdat),
+	INDEX auditlog_userid_createdat(userid, createdat)
+);
+
+# Queue of messages to external services, e.g. emails.
+CREATE TABLE outbox(
+	id				BIGINT NOT NULL,
+	createdat		DATETIME(3) NOT NULL,
+	updatedat		DATETIME(3) NOT NULL,
+	channel			VARCHAR(16) NOT NULL,
+	recipient		VARCHAR(255) NOT NULL,
+	content			MEDIUMBLOB NOT NULL,
+	attempts		INT NOT NULL DEFAULT 0,
+	nextattemptat	DATETIME(3) NOT NULL,
+	dead			TINYINT NOT NULL DEFAULT 0,
+	lasterror		VARCHAR(255) NOT NULL DEFAULT '',
+	
+	PRIMARY KEY(id),
+	INDEX outbox_channel_dead_nextattemptat(channel, dead, nextattemptat)
+);
@@ -32,7 +32,7 @@ const (
 	defaultHost     = "localhost:28015"
 	defaultDatabase = "tinode"
 
-	adpVersion = 111
+	adpVersion = 117
 
 	adapterName = "rethinkdb"
 
@@ -274,6 +274,16 @@ func (a *adapter) CreateDb(reset bool) error {
 		return err
 	}
 
+	// Records of failed authentication attempts. The primary key is the key being tracked.
+	if _, err := rdb.DB(a.dbName).TableCreate("authlockouts", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	// Storage quotas of users and topics. The primary key is the user or topic ID.
+	if _, err := rdb.DB(a.dbName).TableCreate("quotas", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+
 	// Subscription to a topic. The primary key is a Topic:User string
 	if _, err := rdb.DB(a.dbName).TableCreate("subscriptions", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
 		return err
@@ -370,6 +380,16 @@ func (a *adapter) CreateDb(reset bool) error {
 		return err
 	}
 
+	// Log of security-related events.
+	if err := createAuditLog(a); err != nil {
+		return err
+	}
+
+	// Queue of messages to external services.
+	if err := createOutbox(a); err != nil {
+		return err
+	}
+
 	// Record current DB version.
 	if _, err := rdb.DB(a.dbName).Table("kvmeta").Insert(
 		map[string]interface{}{"key": "version", "value": adpVersion}).RunWrite(a.conn); err != nil {
@@ -511,6 +531,78 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 111 {
+		// Perform database upgrade from version 111 to version 112.
+
+		// Records of failed authentication attempts.
+		if _, err := rdb.DB(a.dbName).TableCreate("authlockouts", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 112); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 112 {
+		// Perform database upgrade from version 112 to version 113.
+
+		// Log of security-related events.
+		if err := createAuditLog(a); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 113); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 113 {
+		// Perform database upgrade from version 113 to version 114.
+
+		// Queue of messages to external services.
+		if err := createOutbox(a); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 114); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 114 {
+		// Perform database upgrade from version 114 to version 115.
+
+		// Subscriptions have an optional Notify field which requires no migration.
+
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 115 {
+		// Perform database upgrade from version 115 to version 116.
+
+		// Subscriptions have an optional Mentions field which requires no migration.
+
+		if err := bumpVersion(a, 116); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 116 {
+		// Perform database upgrade from version 116 to version 117.
+
+		// Storage quotas of users and topics.
+		if _, err := rdb.DB(a.dbName).TableCreate("quotas", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 117); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -519,6 +611,25 @@ func (a *adapter) UpgradeDb() error {
 }
 
 // Create system topic 'sys'.
+// Create table for the log of security-related events.
+func createAuditLog(a *adapter) error {
+	if _, err := rdb.DB(a.dbName).TableCreate("auditlog", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index on CreatedAt to select events by time.
+	if _, err := rdb.DB(a.dbName).Table("auditlog").IndexCreate("CreatedAt").RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Compound index on User + CreatedAt to select events of a user.
+	if _, err := rdb.DB(a.dbName).Table("auditlog").IndexCreateFunc("User_CreatedAt",
+		func(row rdb.Term) interface{} {
+			return []interface{}{row.Field("User"), row.Field("CreatedAt")}
+		}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	return nil
+}
+
 func createSystemTopic(a *adapter) error {
 	now := t.TimeNow()
 	_, err := rdb.DB(a.dbName).Table("topics").Insert(&t.Topic{
@@ -678,6 +789,102 @@ func (a *adapter) AuthGetUniqueRecord(unique string) (t.Uid, auth.Level, []byte,
 	return t.ParseUid(record.Userid), record.AuthLvl, record.Secret, record.Expires, nil
 }
 
+// AuthLockoutGet returns a record of failed authentication attempts for the given key.
+func (a *adapter) AuthLockoutGet(key string) (*t.AuthLockout, error) {
+	cursor, err := rdb.DB(a.dbName).Table("authlockouts").Get(key).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return nil, nil
+	}
+
+	var lockout t.AuthLockout
+	if err = cursor.One(&lockout); err != nil {
+		return nil, err
+	}
+	return &lockout, nil
+}
+
+// AuthLockoutUpsert creates or updates a record of failed authentication attempts.
+func (a *adapter) AuthLockoutUpsert(lockout *t.AuthLockout) error {
+	_, err := rdb.DB(a.dbName).Table("authlockouts").Insert(lockout, rdb.InsertOpts{Conflict: "replace"}).
+		RunWrite(a.conn)
+	return err
+}
+
+// AuthLockoutReplace saves a record of failed authentication attempts unless it was changed since it was read.
+func (a *adapter) AuthLockoutReplace(old, lockout *t.AuthLockout) (bool, error) {
+	if old == nil {
+		_, err := rdb.DB(a.dbName).Table("authlockouts").Insert(lockout).RunWrite(a.conn)
+		if rdb.IsConflictErr(err) {
+			// Created by someone else.
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	resp, err := rdb.DB(a.dbName).Table("authlockouts").Get(lockout.Id).
+		Replace(func(row rdb.Term) interface{} {
+			return rdb.Branch(row.Field("UpdatedAt").Eq(old.UpdatedAt).And(row.Field("Failures").Eq(old.Failures)),
+				lockout, row)
+		}).RunWrite(a.conn)
+	if err != nil {
+		return false, err
+	}
+	return resp.Replaced > 0, nil
+}
+
+// AuthLockoutDel deletes a record of failed authentication attempts.
+func (a *adapter) AuthLockoutDel(key string) error {
+	_, err := rdb.DB(a.dbName).Table("authlockouts").Get(key).Delete().RunWrite(a.conn)
+	return err
+}
+
+// AuthLockoutDelExpired deletes records which were not updated since olderThan and are not locked.
+func (a *adapter) AuthLockoutDelExpired(olderThan time.Time) error {
+	_, err := rdb.DB(a.dbName).Table("authlockouts").
+		Filter(rdb.Row.Field("UpdatedAt").Lt(olderThan).And(rdb.Row.Field("LockedUntil").Lt(t.TimeNow()))).
+		Delete().RunWrite(a.conn)
+	return err
+}
+
+// QuotaGet returns the quota of a user or a topic.
+func (a *adapter) QuotaGet(id string) (*t.Quota, error) {
+	cursor, err := rdb.DB(a.dbName).Table("quotas").Get(id).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return nil, nil
+	}
+
+	var quota t.Quota
+	if err = cursor.One(&quota); err != nil {
+		return nil, err
+	}
+	return &quota, nil
+}
+
+// QuotaUpsert creates or updates the quota of a user or a topic.
+func (a *adapter) QuotaUpsert(quota *t.Quota) error {
+	_, err := rdb.DB(a.dbName).Table("quotas").Insert(quota,
+		rdb.InsertOpts{Conflict: func(id, oldQuota, newQuota rdb.Term) interface{} {
+			return newQuota.Merge(map[string]interface{}{"CreatedAt": oldQuota.Field("CreatedAt")})
+		}}).RunWrite(a.conn)
+	return err
+}
+
+// QuotaDel deletes the quota of a user or a topic.
+func (a *adapter) QuotaDel(id string) error {
+	_, err := rdb.DB(a.dbName).Table("quotas").Get(id).Delete().RunWrite(a.conn)
+	return err
+}
+
 // UserGet fetches a single user by user id. If user is not found it returns (nil, nil)
 func (a *adapter) UserGet(uid t.Uid) (*t.User, error) {
 	cursor, err := rdb.DB(a.dbName).Table("users").GetAll(uid.String()).
@@ -2244,6 +2451,12 @@ func (a *adapter) FileFinishUpload(fid string, status int, size int64) (*t.FileD
 	return a.FileGet(fid)
 }
 
+// FileUpdate updates fields of a file record.
+func (a *adapter) FileUpdate(fid string, update map[string]interface{}) error {
+	_, err := rdb.DB(a.dbName).Table("fileuploads").Get(fid).Update(update).RunWrite(a.conn)
+	return err
+}
+
 // FileGet fetches a record of a specific file
 func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 	cursor, err := rdb.DB(a.dbName).Table("fileuploads").Get(fid).Run(a.conn)
@@ -2265,6 +2478,46 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 
 }
 
+// FileUsageByUser returns the total size of files uploaded by the user, including unfinished uploads.
+func (a *adapter) FileUsageByUser(uid t.Uid) (int64, error) {
+	return a.fileTotalSize(rdb.DB(a.dbName).Table("fileuploads").GetAllByIndex("User", uid.String()).
+		Filter(rdb.Row.Field("Status").Ne(t.UploadFailed)))
+}
+
+// FileUsageByTopic returns the total size of files attached to messages in the topic.
+func (a *adapter) FileUsageByTopic(topic string) (int64, error) {
+	return a.fileTotalSize(rdb.DB(a.dbName).Table("fileuploads").GetAll(
+		rdb.Args(
+			rdb.DB(a.dbName).Table("messages").Between(
+				[]interface{}{topic, rdb.MinVal},
+				[]interface{}{topic, rdb.MaxVal},
+				rdb.BetweenOpts{Index: "Topic_SeqId"}).
+				// Fetch messages with attachments only
+				Filter(rdb.Row.HasFields("Attachments")).
+				// Flatten arrays
+				ConcatMap(func(row rdb.Term) interface{} { return row.Field("Attachments") }).
+				Distinct().
+				CoerceTo("array"))))
+}
+
+// fileTotalSize returns the total size of file records selected by the query.
+func (a *adapter) fileTotalSize(query rdb.Term) (int64, error) {
+	cursor, err := query.Sum(func(row rdb.Term) interface{} {
+		// Records created before variants were counted have no VariantSize.
+		return row.Field("Size").Add(row.Field("VariantSize").Default(0))
+	}).Run(a.conn)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	var size int64
+	if err = cursor.One(&size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
 // FileDeleteUnused deletes orphaned file uploads.
 func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, error) {
 	q := rdb.DB(a.dbName).Table("fileuploads").GetAllByIndex("UseCount", 0)
@@ -2296,6 +2549,156 @@ func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, er
 	return locations, err
 }
 
+// AuditAdd saves an audit event.
+func (a *adapter) AuditAdd(ev *t.AuditEvent) error {
+	_, err := rdb.DB(a.dbName).Table("auditlog").Insert(ev).RunWrite(a.conn)
+	return err
+}
+
+// AuditGetAll returns audit events matching the query, newest first.
+func (a *adapter) AuditGetAll(query *t.AuditQuery) ([]t.AuditEvent, error) {
+	var lower, upper interface{} = rdb.MinVal, rdb.MaxVal
+	if !query.Since.IsZero() {
+		lower = query.Since
+	}
+	if !query.Before.IsZero() {
+		upper = query.Before
+	}
+
+	var q rdb.Term
+	if query.User != "" {
+		q = rdb.DB(a.dbName).Table("auditlog").
+			Between([]interface{}{query.User, lower}, []interface{}{query.User, upper},
+				rdb.BetweenOpts{Index: "User_CreatedAt"}).
+			OrderBy(rdb.OrderByOpts{Index: rdb.Desc("User_CreatedAt")})
+	} else {
+		q = rdb.DB(a.dbName).Table("auditlog").
+			Between(lower, upper, rdb.BetweenOpts{Index: "CreatedAt"}).
+			OrderBy(rdb.OrderByOpts{Index: rdb.Desc("CreatedAt")})
+	}
+	if query.Action != "" {
+		q = q.Filter(rdb.Row.Field("Action").Eq(query.Action))
+	}
+	limit := a.maxResults
+	if query.Limit > 0 && query.Limit < limit {
+		limit = query.Limit
+	}
+
+	cursor, err := q.Limit(limit).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var events []t.AuditEvent
+	if err = cursor.All(&events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Create table for the queue of messages to external services.
+func createOutbox(a *adapter) error {
+	if _, err := rdb.DB(a.dbName).TableCreate("outbox", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Compound index on Channel + Dead + NextAttemptAt to select messages due for delivery.
+	if _, err := rdb.DB(a.dbName).Table("outbox").IndexCreateFunc("Channel_Dead_NextAttemptAt",
+		func(row rdb.Term) interface{} {
+			return []interface{}{row.Field("Channel"), row.Field("Dead"), row.Field("NextAttemptAt")}
+		}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	return nil
+}
+
+// OutboxAdd queues a message for delivery.
+func (a *adapter) OutboxAdd(msg *t.OutboxMessage) error {
+	_, err := rdb.DB(a.dbName).Table("outbox").Insert(msg).RunWrite(a.conn)
+	return err
+}
+
+// OutboxGetDue returns messages of the given channel which are due for delivery, oldest first.
+func (a *adapter) OutboxGetDue(channel string, now time.Time, limit int) ([]t.OutboxMessage, error) {
+	cursor, err := rdb.DB(a.dbName).Table("outbox").
+		Between([]interface{}{channel, false, rdb.MinVal}, []interface{}{channel, false, now},
+			rdb.BetweenOpts{Index: "Channel_Dead_NextAttemptAt", RightBound: "closed"}).
+		OrderBy(rdb.OrderByOpts{Index: "Channel_Dead_NextAttemptAt"}).
+		Limit(limit).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var msgs []t.OutboxMessage
+	if err = cursor.All(&msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// OutboxClaim postpones the next delivery attempt unless the message was changed since it was read.
+func (a *adapter) OutboxClaim(msg *t.OutboxMessage, until time.Time) (bool, error) {
+	resp, err := rdb.DB(a.dbName).Table("outbox").Get(msg.Id).
+		Update(func(row rdb.Term) interface{} {
+			return rdb.Branch(row.Field("NextAttemptAt").Eq(msg.NextAttemptAt).And(row.Field("Dead").Not()),
+				map[string]interface{}{"NextAttemptAt": until, "UpdatedAt": t.TimeNow()},
+				map[string]interface{}{})
+		}).RunWrite(a.conn)
+	if err != nil {
+		return false, err
+	}
+	if resp.Replaced > 0 {
+		msg.NextAttemptAt = until
+	}
+	return resp.Replaced > 0, nil
+}
+
+// OutboxUpdate saves the outcome of a failed delivery attempt.
+func (a *adapter) OutboxUpdate(msg *t.OutboxMessage) error {
+	_, err := rdb.DB(a.dbName).Table("outbox").Get(msg.Id).
+		Update(map[string]interface{}{
+			"UpdatedAt":     msg.UpdatedAt,
+			"Content":       msg.Content,
+			"Attempts":      msg.Attempts,
+			"NextAttemptAt": msg.NextAttemptAt,
+			"Dead":          msg.Dead,
+			"LastError":     msg.LastError,
+		}).RunWrite(a.conn)
+	return err
+}
+
+// OutboxDelete deletes a message.
+func (a *adapter) OutboxDelete(id string) error {
+	_, err := rdb.DB(a.dbName).Table("outbox").Get(id).Delete().RunWrite(a.conn)
+	return err
+}
+
+// OutboxCount returns the number of live messages of the given channel.
+func (a *adapter) OutboxCount(channel string) (int, error) {
+	cursor, err := rdb.DB(a.dbName).Table("outbox").
+		Between([]interface{}{channel, false, rdb.MinVal}, []interface{}{channel, false, rdb.MaxVal},
+			rdb.BetweenOpts{Index: "Channel_Dead_NextAttemptAt"}).
+		Count().Run(a.conn)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	var count int
+	err = cursor.One(&count)
+	return count, err
+}
+
+// OutboxDelDead deletes dead messages of the given channel which were given up on before olderThan.
+func (a *adapter) OutboxDelDead(channel string, olderThan time.Time) error {
+	_, err := rdb.DB(a.dbName).Table("outbox").
+		Between([]interface{}{channel, true, rdb.MinVal}, []interface{}{channel, true, olderThan},
+			rdb.BetweenOpts{Index: "Channel_Dead_NextAttemptAt"}).
+		Delete().RunWrite(a.conn)
+	return err
+}
+
 // Given a select query against 'messages' table, decrement corresponding use counter in 'fileuploads' table.
 func (a *adapter) fileDecrementUseCounter(msgQuery rdb.Term) error {
 	/*
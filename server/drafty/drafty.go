@@ -1,10 +1,12 @@
-// Package drafty contains utilities for conversion from Drafty to plain text.
+// Package drafty contains utilities for conversion from Drafty to plain text and for extracting
+// data from Drafty documents.
 package drafty
 
 import (
 	"errors"
 	"sort"
 	"strings"
+	"unicode"
 	"unicode/utf8"
 )
 
@@ -41,19 +43,82 @@ var tags = map[string]spanfmt{
 // If content is plain string, then it's returned unchanged. If content is not recognized
 // as either Drafy (as a map[string]interface{}) or as a string, an error is returned.
 func ToPlainText(content interface{}) (string, error) {
+	txt, spans, err := parse(content)
+	if err != nil || spans == nil {
+		return txt, err
+	}
+	line := []rune(txt)
+	return forEach(line, 0, len(line), spans, formatter), nil
+}
+
+// Preview converts message payload from Drafty format to a short plain text suitable for
+// notifications: formatting is dropped, line breaks and other whitespace are collapsed into
+// single spaces, images and file attachments are replaced by the given placeholders. The result
+// is clipped to maxLength runes.
+func Preview(content interface{}, maxLength int, image, file string) (string, error) {
+	txt, spans, err := parse(content)
+	if err != nil {
+		return "", err
+	}
+	if spans != nil {
+		line := []rune(txt)
+		txt = forEach(line, 0, len(line), spans, func(tp string, data map[string]interface{}, value string) string {
+			switch tp {
+			case "BR":
+				return " "
+			case "IM":
+				return " " + image + " "
+			case "EX":
+				return " " + file + " "
+			default:
+				return value
+			}
+		})
+	}
+
+	// Collapse whitespace and drop control characters.
+	var runes []rune
+	space := true
+	for _, r := range txt {
+		if unicode.IsSpace(r) {
+			if !space {
+				runes = append(runes, ' ')
+			}
+			space = true
+			continue
+		}
+		if !unicode.IsPrint(r) {
+			continue
+		}
+		runes = append(runes, r)
+		space = false
+	}
+	if space && len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+	}
+
+	if maxLength > 0 && len(runes) > maxLength {
+		return strings.TrimRightFunc(string(runes[:maxLength]), unicode.IsSpace) + "…", nil
+	}
+	return string(runes), nil
+}
+
+// parse extracts text and sorted formatting spans from the content. Spans are nil if
+// the content is unformatted.
+func parse(content interface{}) (string, []*span, error) {
 	if content == nil {
-		return "", nil
+		return "", nil, nil
 	}
 
 	var drafty map[string]interface{}
 
 	switch data := content.(type) {
 	case string:
-		return data, nil
+		return data, nil, nil
 	case map[string]interface{}:
 		drafty = data
 	default:
-		return "", errUnrecognizedContent
+		return "", nil, errUnrecognizedContent
 	}
 
 	txt, txtOK := drafty["txt"].(string)
@@ -62,19 +127,19 @@ func ToPlainText(content interface{}) (string, error) {
 
 	// At least one must be set.
 	if !txtOK && !fmtOK && !entOK {
-		return "", errUnrecognizedContent
+		return "", nil, errUnrecognizedContent
 	}
 
 	if fmt == nil {
 		if txtOK {
-			return txt, nil
+			return txt, nil, nil
 		}
-		return "", errUnrecognizedContent
+		return "", nil, errUnrecognizedContent
 	}
 
 	textLen := utf8.RuneCountInString(txt)
 
-	var spans []*span
+	spans := []*span{}
 	for i := range fmt {
 		s := span{}
 		f, _ := fmt[i].(map[string]interface{})
@@ -88,14 +153,14 @@ func ToPlainText(content interface{}) (string, error) {
 		tmp, _ = f["len"].(float64)
 		s.end = s.at + int(tmp)
 		if s.end > textLen || s.end < s.at {
-			return "", errInvalidContent
+			return "", nil, errInvalidContent
 		}
 		tmp, _ = f["key"].(float64)
 		s.key = int(tmp)
 		// Denormalize entities into spans.
 		if s.tp == "" && entOK {
 			if s.key < 0 || s.key >= len(ent) {
-				return "", errInvalidContent
+				return "", nil, errInvalidContent
 			}
 
 			e, _ := ent[s.key].(map[string]interface{})
@@ -106,7 +171,7 @@ func ToPlainText(content interface{}) (string, error) {
 			s.tp, _ = e["tp"].(string)
 		}
 		if s.tp == "" && s.at == 0 && s.end == 0 && s.key == 0 {
-			return "", errUnrecognizedContent
+			return "", nil, errUnrecognizedContent
 		}
 		spans = append(spans, &s)
 	}
@@ -120,10 +185,11 @@ func ToPlainText(content interface{}) (string, error) {
 		return spans[i].at < spans[j].at
 	})
 
-	return forEach([]rune(txt), 0, textLen, spans), nil
+	return txt, spans, nil
 }
 
-func forEach(line []rune, start, end int, spans []*span) string {
+func forEach(line []rune, start, end int, spans []*span,
+	format func(tp string, data map[string]interface{}, value string) string) string {
 	// Process ranges calling formatter for each range.
 	var result []string
 	for i := 0; i < len(spans); i++ {
@@ -131,13 +197,13 @@ func forEach(line []rune, start, end int, spans []*span) string {
 
 		if sp.at < 0 {
 			// Attachment
-			result = append(result, formatter(sp.tp, sp.data, ""))
+			result = append(result, format(sp.tp, sp.data, ""))
 			continue
 		}
 
 		// Add un-styled range before the styled span starts.
 		if start < sp.at {
-			result = append(result, formatter("", nil, string(line[start:sp.at])))
+			result = append(result, format("", nil, string(line[start:sp.at])))
 			start = sp.at
 		}
 		// Get all spans which are within current span.
@@ -149,16 +215,16 @@ func forEach(line []rune, start, end int, spans []*span) string {
 
 		tag := tags[sp.tp]
 		if tag.isVoid {
-			result = append(result, formatter(sp.tp, sp.data, ""))
+			result = append(result, format(sp.tp, sp.data, ""))
 		} else {
-			result = append(result, formatter(sp.tp, sp.data, forEach(line, start, sp.end, subspans)))
+			result = append(result, format(sp.tp, sp.data, forEach(line, start, sp.end, subspans, format)))
 		}
 		start = sp.end
 	}
 
 	// Add the last unformatted range.
 	if start < end {
-		result = append(result, formatter("", nil, string(line[start:end])))
+		result = append(result, format("", nil, string(line[start:end])))
 	}
 
 	return strings.Join(result, "")
@@ -188,3 +254,29 @@ func formatter(tp string, data map[string]interface{}, value string) string {
 		return value
 	}
 }
+
+// Mentions returns a list of unique user IDs mentioned in the Drafty content, such as "usrAbCdEf".
+// Only mentions which are visible in the text are counted: entities not referenced by formatting
+// and mentions formatted as attachments are ignored. Plain text content and content which cannot
+// be parsed contain no mentions.
+func Mentions(content interface{}) []string {
+	_, spans, err := parse(content)
+	if err != nil {
+		return nil
+	}
+
+	var mentions []string
+	seen := make(map[string]bool)
+	for _, sp := range spans {
+		if sp.tp != "MN" || sp.at < 0 || sp.end <= sp.at {
+			continue
+		}
+		val, _ := sp.data["val"].(string)
+		if val == "" || seen[val] {
+			continue
+		}
+		seen[val] = true
+		mentions = append(mentions, val)
+	}
+	return mentions
+}
@@ -89,3 +89,85 @@ func TestToPlainText(t *testing.T) {
 		}
 	}
 }
+
+func TestMentions(t *testing.T) {
+	inputs := []string{
+		`{
+			"txt":"Hi @alice and @bob, and @alice again",
+			"fmt":[{"at":3,"len":6},{"at":14,"len":4,"key":1},{"at":24,"len":6}],
+			"ent":[{"tp":"MN","data":{"val":"usrAlice"}},{"tp":"MN","data":{"val":"usrBob"}}]
+		}`,
+		`{
+			"txt":"https://api.tinode.co/ #hashtag",
+			"fmt":[{"len":22},{"at":23,"len":8,"key":1}],
+			"ent":[{"tp":"LN","data":{"url":"https://api.tinode.co/"}},{"tp":"HT","data":{"val":"hashtag"}}]
+		}`,
+		`"Hi @alice"`,
+		`{
+			"txt":"Hi @alice",
+			"fmt":[{"at":3,"len":6,"key":1},{"at":-1,"key":2}],
+			"ent":[{"tp":"MN","data":{"val":"usrHidden"}},{"tp":"MN","data":{"val":"usrAlice"}},{"tp":"MN","data":{"val":"usrAttached"}}]
+		}`,
+	}
+	expect := [][]string{
+		{"usrAlice", "usrBob"},
+		nil,
+		nil,
+		{"usrAlice"},
+	}
+
+	for i := range inputs {
+		var val interface{}
+		json.Unmarshal([]byte(inputs[i]), &val)
+		res := Mentions(val)
+		if len(res) != len(expect[i]) {
+			t.Errorf("%d output %v does not match %v", i, res, expect[i])
+			continue
+		}
+		for j := range res {
+			if res[j] != expect[i][j] {
+				t.Errorf("%d output %v does not match %v", i, res, expect[i])
+				break
+			}
+		}
+	}
+}
+
+func TestPreview(t *testing.T) {
+	inputs := []string{
+		`{
+			"txt":"This text is formatted and deleted too",
+			"fmt":[{"at":5,"len":4,"tp":"ST"},{"at":13,"len":9,"tp":"EM"},{"at":35,"len":3,"tp":"ST"},{"at":27,"len":11,"tp":"DL"}]
+		}`,
+		`{
+			"ent":[{"data":{"mime":"image/jpeg","name":"hello.jpg","val":"<38992, bytes: ...>"},"tp":"EX"}],
+			"fmt":[{"at":-1, "key":0}]
+		}`,
+		`{
+			"ent":[{"data":{"height":213,"mime":"image/jpeg","name":"roses.jpg","val":"<38992, bytes: ...>","width":638},"tp":"IM"}],
+			"fmt":[{"at":5,"len":1},{"at":4,"len":1,"tp":"BR"}],
+			"txt":"Look  "
+		}`,
+		`"  Multi\nline\t\u0007text  "`,
+		`"мультибайтовый юникод"`,
+	}
+	expect := []string{
+		"This text is formatted…",
+		"[file]",
+		"Look [image]",
+		"Multi line text",
+		"мультибайтовый юникод",
+	}
+
+	for i := range inputs {
+		var val interface{}
+		json.Unmarshal([]byte(inputs[i]), &val)
+		res, err := Preview(val, 22, "[image]", "[file]")
+		if err != nil {
+			t.Error(err)
+		}
+		if res != expect[i] {
+			t.Errorf("%d output '%s' does not match '%s'", i, res, expect[i])
+		}
+	}
+}
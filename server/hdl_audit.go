@@ -0,0 +1,150 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Recording of security-related events and the handler of audit log queries.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/audit"
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Login names recorded in audit events are truncated to this many characters.
+const maxAuditLoginLength = 64
+
+// auditEvent records a security-related event. The session may be nil if the event is not
+// caused by a client request.
+func auditEvent(s *Session, action string, uid types.Uid, scheme string, err error, params map[string]string) {
+	ev := &types.AuditEvent{
+		Action:  action,
+		Scheme:  scheme,
+		Outcome: audit.OutcomeOK,
+		Params:  params,
+	}
+	if !uid.IsZero() {
+		ev.User = uid.String()
+	}
+	if s != nil {
+		ev.RemoteAddr = s.remoteAddr
+		ev.UserAgent = s.userAgent
+	}
+	if err != nil {
+		ev.Outcome = err.Error()
+	}
+	audit.Log(ev)
+}
+
+// auditLoginParams returns parameters of a login event: the login name the client attempted
+// to log in with. The login name is only known for the "basic" scheme. The password is not recorded.
+func auditLoginParams(scheme string, secret []byte) map[string]string {
+	if strings.ToLower(scheme) != "basic" {
+		return nil
+	}
+	splitAt := bytes.IndexByte(secret, ':')
+	if splitAt <= 0 {
+		return nil
+	}
+	uname := []rune(strings.ToLower(string(secret[:splitAt])))
+	if len(uname) > maxAuditLoginLength {
+		uname = uname[:maxAuditLoginLength]
+	}
+	return map[string]string{"uname": string(uname)}
+}
+
+// serveAudit returns audit events to root users. Query parameters:
+//
+//	user=usrXXX, action=login, since=<RFC3339 time>, before=<RFC3339 time>, limit=N.
+func serveAudit(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+		if err != nil {
+			log.Println("audit query:", err)
+		}
+	}
+
+	if req.Method != http.MethodGet {
+		writeHttpResponse(ErrOperationNotAllowed("", "", now), errors.New("method '"+req.Method+"' not allowed"))
+		return
+	}
+
+	// Check for API key presence
+	if checkAPIKey(req) == nil {
+		writeHttpResponse(ErrAPIKeyRequired(now), nil)
+		return
+	}
+
+	uid, authLvl, challenge, err := authHttpRequest(req)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if challenge != nil {
+		writeHttpResponse(InfoChallenge("", now, challenge), nil)
+		return
+	}
+	if uid.IsZero() {
+		writeHttpResponse(ErrAuthRequired("", "", now, now), nil)
+		return
+	}
+	if authLvl != auth.LevelRoot {
+		writeHttpResponse(ErrPermissionDenied("", "", now), nil)
+		return
+	}
+
+	query := types.AuditQuery{Action: req.FormValue("action")}
+	if user := req.FormValue("user"); user != "" {
+		uid := types.ParseUserId(user)
+		if uid.IsZero() {
+			writeHttpResponse(ErrMalformed("", "", now), errors.New("invalid user "+user))
+			return
+		}
+		query.User = uid.String()
+	}
+	if since := req.FormValue("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			writeHttpResponse(ErrMalformed("", "", now), err)
+			return
+		}
+	}
+	if before := req.FormValue("before"); before != "" {
+		if query.Before, err = time.Parse(time.RFC3339, before); err != nil {
+			writeHttpResponse(ErrMalformed("", "", now), err)
+			return
+		}
+	}
+	if limit := req.FormValue("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 0 {
+			writeHttpResponse(ErrMalformed("", "", now), err)
+			return
+		}
+	}
+
+	events, err := audit.Query(&query)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+
+	resp := NoErr("", "", now)
+	resp.Ctrl.Params = map[string]interface{}{"events": events}
+	writeHttpResponse(resp, nil)
+}
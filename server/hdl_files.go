@@ -10,14 +10,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"image"
 	"io"
 	"log"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/tinode/chat/server/media"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 )
@@ -39,13 +42,13 @@ func largeFileServe(wrt http.ResponseWriter, req *http.Request) {
 	}
 
 	// Check for API key presence
-	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+	if checkAPIKey(req) == nil {
 		writeHttpResponse(ErrAPIKeyRequired(now), nil)
 		return
 	}
 
 	// Check authorization: either auth information or SID must be present
-	uid, challenge, err := authHttpRequest(req)
+	uid, _, challenge, err := authHttpRequest(req)
 	if err != nil {
 		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
 		return
@@ -94,6 +97,11 @@ func largeFileServe(wrt http.ResponseWriter, req *http.Request) {
 func largeFileUpload(wrt http.ResponseWriter, req *http.Request) {
 	log.Println("Upload request", req.RequestURI)
 
+	if req.Method == http.MethodOptions || req.Header.Get("Tus-Resumable") != "" {
+		largeFileUploadResumable(wrt, req)
+		return
+	}
+
 	now := types.TimeNow()
 	enc := json.NewEncoder(wrt)
 	mh := store.GetMediaHandler()
@@ -120,14 +128,15 @@ func largeFileUpload(wrt http.ResponseWriter, req *http.Request) {
 	}
 
 	// Check for API key presence
-	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+	apikey := checkAPIKey(req)
+	if apikey == nil {
 		writeHttpResponse(ErrAPIKeyRequired(now), nil)
 		return
 	}
 
 	msgID := req.FormValue("id")
 	// Check authorization: either auth information or SID must be present
-	uid, challenge, err := authHttpRequest(req)
+	uid, _, challenge, err := authHttpRequest(req)
 	if err != nil {
 		writeHttpResponse(decodeStoreError(err, msgID, "", now, nil), err)
 		return
@@ -141,6 +150,10 @@ func largeFileUpload(wrt http.ResponseWriter, req *http.Request) {
 		writeHttpResponse(ErrAuthRequired(msgID, "", now, now), nil)
 		return
 	}
+	if !apikey.allows(apiScopeUpload) {
+		writeHttpResponse(ErrPermissionDenied(msgID, "", now), errors.New("upload not permitted by API key"))
+		return
+	}
 
 	// Check if uploads are handled elsewhere.
 	if redirTo, err := mh.Redirect(req.Method, req.URL.String()); redirTo != "" {
@@ -156,7 +169,7 @@ func largeFileUpload(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	file, _, err := req.FormFile("file")
+	file, header, err := req.FormFile("file")
 	if err != nil {
 		if strings.Contains(err.Error(), "request body too large") {
 			writeHttpResponse(ErrTooLarge(msgID, "", now), err)
@@ -165,10 +178,17 @@ func largeFileUpload(wrt http.ResponseWriter, req *http.Request) {
 		}
 		return
 	}
+
+	if params, err := checkUploadQuota(uid, header.Size); err != nil {
+		writeHttpResponse(decodeStoreError(err, msgID, "", now, params), err)
+		return
+	}
 	fdef := types.FileDef{}
 	fdef.Id = store.GetUidString()
 	fdef.InitTimes()
 	fdef.User = uid.String()
+	// Reserve the space in the quota while the file is being uploaded.
+	fdef.Size = header.Size
 
 	buff := make([]byte, 512)
 	if _, err = file.Read(buff); err != nil {
@@ -182,15 +202,77 @@ func largeFileUpload(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	url, err := mh.Upload(&fdef, file)
+	// Strip metadata and otherwise transform the file as configured.
+	upload, err := media.Process(file, fdef.MimeType)
+	if err != nil {
+		writeHttpResponse(ErrMalformed(msgID, "", now), err)
+		return
+	}
+
+	url, err := mh.Upload(&fdef, upload)
 	if err != nil {
 		writeHttpResponse(decodeStoreError(err, msgID, "", now, nil), err)
 		return
 	}
 
-	writeHttpResponse(NoErrParams(msgID, "", now, map[string]string{"url": url}), nil)
+	params := map[string]interface{}{"url": url}
+	if strings.HasPrefix(fdef.MimeType, "image/") {
+		largeFileThumbnails(mh, &fdef, upload, params)
+	}
+
+	if params, err := confirmUploadQuota(uid, fdef.Id); err != nil {
+		writeHttpResponse(decodeStoreError(err, msgID, "", now, params), err)
+		return
+	}
+
+	writeHttpResponse(NoErrParams(msgID, "", now, params), nil)
 }
 
+// largeFileThumbnails generates thumbnails of the uploaded image and saves them next to the original.
+// Dimensions of the image and the thumbnails are added to params. The total size of the thumbnails is
+// recorded to count it towards the storage quota. Errors are logged but otherwise ignored: clients get
+// the original image if the thumbnail does not exist.
+func largeFileThumbnails(mh media.Handler, fdef *types.FileDef, file io.ReadSeeker, params map[string]interface{}) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		log.Println("media upload: thumbnails", err)
+		return
+	}
+
+	width, height, thumbs, err := media.MakeThumbnails(file, globals.thumbnailSizes)
+	if width > 0 && height > 0 {
+		params["width"] = width
+		params["height"] = height
+	}
+	if err != nil {
+		if err != image.ErrFormat {
+			log.Println("media upload: thumbnails", fdef.Id, err)
+		}
+		return
+	}
+
+	sizes := make(map[string]interface{}, len(thumbs))
+	var total int64
+	for i := range thumbs {
+		th := &thumbs[i]
+		if err := mh.UploadVariant(fdef, th.Name, th.MimeType, bytes.NewReader(th.Data)); err != nil {
+			log.Println("media upload: failed to save thumbnail", fdef.Id, th.Name, err)
+			continue
+		}
+		sizes[th.Name] = map[string]int{"width": th.Width, "height": th.Height}
+		total += int64(len(th.Data))
+	}
+	if len(sizes) > 0 {
+		params["thumbnails"] = sizes
+		fdef.VariantSize = total
+		if err := store.Files.Update(fdef.Id, map[string]interface{}{"VariantSize": total}); err != nil {
+			log.Println("media upload: failed to record size of thumbnails", fdef.Id, err)
+		}
+	}
+}
+
+// Uploads which are not attached to messages are deleted when they have not been updated for this long.
+const unusedUploadLifetime = time.Hour
+
 func largeFileRunGarbageCollection(period time.Duration, block int) chan<- bool {
 	// Unbuffered stop channel. Whoever stops it must wait for the process to finish.
 	stop := make(chan bool)
@@ -199,7 +281,7 @@ func largeFileRunGarbageCollection(period time.Duration, block int) chan<- bool
 		for {
 			select {
 			case <-gcTimer:
-				if err := store.Files.DeleteUnused(time.Now().Add(-time.Hour), block); err != nil {
+				if err := store.Files.DeleteUnused(time.Now().Add(-unusedUploadLifetime), block); err != nil {
 					log.Println("media gc:", err)
 				}
 			case <-stop:
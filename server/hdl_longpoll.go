@@ -113,7 +113,8 @@ func serveLongPoll(wrt http.ResponseWriter, req *http.Request) {
 
 	enc := json.NewEncoder(wrt)
 
-	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+	apikey := checkAPIKey(req)
+	if apikey == nil {
 		wrt.WriteHeader(http.StatusForbidden)
 		enc.Encode(ErrAPIKeyRequired(now))
 		return
@@ -141,6 +142,7 @@ func serveLongPoll(wrt http.ResponseWriter, req *http.Request) {
 		var count int
 		sess, count = globals.sessionStore.NewSession(wrt, "")
 		sess.remoteAddr = lpRemoteAddr(req)
+		sess.apiScopes = apikey.scopes
 		log.Println("longPoll: session started", sess.sid, sess.remoteAddr, count)
 
 		wrt.WriteHeader(http.StatusCreated)
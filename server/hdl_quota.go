@@ -0,0 +1,245 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Storage quotas of users and topics and the handler of quota management.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Default storage quotas.
+type quotaConfig struct {
+	// Maximum total size of files uploaded by a user in bytes, 0 means unlimited.
+	User int64 `json:"user"`
+	// Maximum total size of files attached to messages in a group topic in bytes, 0 means unlimited.
+	Topic int64 `json:"topic"`
+}
+
+// quotaLimit returns the quota of a user or a topic set by an administrator or the default.
+func quotaLimit(id string, defaultLimit int64) (int64, error) {
+	quota, err := store.Files.GetQuota(id)
+	if err != nil {
+		return 0, err
+	}
+	if quota != nil {
+		return quota.Limit, nil
+	}
+	return defaultLimit, nil
+}
+
+// userStorageQuota returns the quota and the usage of storage by the user.
+func userStorageQuota(uid types.Uid) (*MsgQuota, error) {
+	limit, err := quotaLimit(uid.UserId(), globals.userQuota)
+	if err != nil {
+		return nil, err
+	}
+	used, err := store.Files.UsageByUser(uid)
+	if err != nil {
+		return nil, err
+	}
+	return &MsgQuota{Used: used, Limit: limit}, nil
+}
+
+// topicStorageQuota returns the quota and the usage of storage by the group topic.
+func topicStorageQuota(topic string) (*MsgQuota, error) {
+	limit, err := quotaLimit(topic, globals.topicQuota)
+	if err != nil {
+		return nil, err
+	}
+	used, err := store.Files.UsageByTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+	return &MsgQuota{Used: used, Limit: limit}, nil
+}
+
+// quotaExceeded returns params describing the quota if adding size bytes exceeds it, nil otherwise.
+func quotaExceeded(what string, quota *MsgQuota, size int64) map[string]interface{} {
+	if quota.Limit > 0 && quota.Used+size > quota.Limit {
+		return map[string]interface{}{"what": what, "used": quota.Used, "limit": quota.Limit}
+	}
+	return nil
+}
+
+// checkUploadQuota checks if a file of the given size fits into the quota of the user. If it does not,
+// types.ErrQuotaExceeded is returned with params describing the exceeded quota.
+func checkUploadQuota(uid types.Uid, size int64) (map[string]interface{}, error) {
+	limit, err := quotaLimit(uid.UserId(), globals.userQuota)
+	if err != nil || limit == 0 {
+		return nil, err
+	}
+
+	used, err := store.Files.UsageByUser(uid)
+	if err != nil {
+		return nil, err
+	}
+	if params := quotaExceeded("user", &MsgQuota{Used: used, Limit: limit}, size); params != nil {
+		return params, types.ErrQuotaExceeded
+	}
+	return nil, nil
+}
+
+// confirmUploadQuota checks the quota of the user again once the upload is recorded. Concurrent uploads
+// may all pass checkUploadQuota before any of them is recorded. Once recorded, each upload is included
+// in the usage, so at least one of the uploads which don't fit together is rejected here. The rejected
+// upload is marked as failed to release the space, the file is deleted by garbage collection.
+func confirmUploadQuota(uid types.Uid, fid string) (map[string]interface{}, error) {
+	params, err := checkUploadQuota(uid, 0)
+	if err != nil {
+		if _, ferr := store.Files.FinishUpload(fid, false, 0); ferr != nil {
+			log.Println("quota: failed to release upload", fid, ferr)
+		}
+	}
+	return params, err
+}
+
+// checkAttachmentsQuota checks if files attached to a message fit into the quota of the group topic.
+// If they do not, types.ErrQuotaExceeded is returned with params describing the exceeded quota.
+func checkAttachmentsQuota(topic string, head map[string]interface{}) (map[string]interface{}, error) {
+	urls, _ := head["attachments"].([]interface{})
+	mh := store.GetMediaHandler()
+	if len(urls) == 0 || mh == nil {
+		return nil, nil
+	}
+
+	limit, err := quotaLimit(topic, globals.topicQuota)
+	if err != nil || limit == 0 {
+		return nil, err
+	}
+
+	var size int64
+	for _, val := range urls {
+		url, _ := val.(string)
+		fid := mh.GetIdFromUrl(url)
+		if fid.IsZero() {
+			continue
+		}
+		fdef, err := store.Files.Get(fid.String())
+		if err != nil {
+			return nil, err
+		}
+		if fdef != nil {
+			size += fdef.Size
+		}
+	}
+
+	used, err := store.Files.UsageByTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+	if params := quotaExceeded("topic", &MsgQuota{Used: used, Limit: limit}, size); params != nil {
+		return params, types.ErrQuotaExceeded
+	}
+	return nil, nil
+}
+
+// serveQuota lets root users view and change storage quotas. Query parameters:
+//
+//	user=usrXXX or topic=grpXXX, limit=N for POST.
+//
+// GET returns the quota and the usage, POST sets the quota, DELETE restores the default quota.
+func serveQuota(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+		if err != nil {
+			log.Println("quota:", err)
+		}
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodPost && req.Method != http.MethodDelete {
+		writeHttpResponse(ErrOperationNotAllowed("", "", now), errors.New("method '"+req.Method+"' not allowed"))
+		return
+	}
+
+	// Check for API key presence
+	if checkAPIKey(req) == nil {
+		writeHttpResponse(ErrAPIKeyRequired(now), nil)
+		return
+	}
+
+	uid, authLvl, challenge, err := authHttpRequest(req)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if challenge != nil {
+		writeHttpResponse(InfoChallenge("", now, challenge), nil)
+		return
+	}
+	if uid.IsZero() {
+		writeHttpResponse(ErrAuthRequired("", "", now, now), nil)
+		return
+	}
+	if authLvl != auth.LevelRoot {
+		writeHttpResponse(ErrPermissionDenied("", "", now), nil)
+		return
+	}
+
+	var id string
+	var getQuota func() (*MsgQuota, error)
+	if user := req.FormValue("user"); user != "" {
+		quid := types.ParseUserId(user)
+		if quid.IsZero() {
+			writeHttpResponse(ErrMalformed("", "", now), errors.New("invalid user "+user))
+			return
+		}
+		id = quid.UserId()
+		getQuota = func() (*MsgQuota, error) { return userStorageQuota(quid) }
+	} else if topic := req.FormValue("topic"); topic != "" {
+		if types.GetTopicCat(topic) != types.TopicCatGrp {
+			writeHttpResponse(ErrMalformed("", "", now), errors.New("invalid topic "+topic))
+			return
+		}
+		id = topic
+		getQuota = func() (*MsgQuota, error) { return topicStorageQuota(topic) }
+	} else {
+		writeHttpResponse(ErrMalformed("", "", now), errors.New("missing user or topic"))
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+		limit, err := strconv.ParseInt(req.FormValue("limit"), 10, 64)
+		if err != nil || limit < 0 {
+			writeHttpResponse(ErrMalformed("", "", now), errors.New("invalid limit"))
+			return
+		}
+		err = store.Files.SetQuota(id, limit)
+		if err != nil {
+			writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+			return
+		}
+		log.Println("quota: set", id, limit, "by", uid.UserId())
+	case http.MethodDelete:
+		if err = store.Files.DelQuota(id); err != nil {
+			writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+			return
+		}
+		log.Println("quota: reset", id, "by", uid.UserId())
+	}
+
+	quota, err := getQuota()
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	writeHttpResponse(NoErrParams("", "", now, quota), nil)
+}
@@ -0,0 +1,361 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Handler of resumable file uploads compatible with the tus protocol:
+ *    https://tus.io/protocols/resumable-upload.html
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Supported version of the tus protocol.
+	tusVersion = "1.0.0"
+	// Supported extensions of the tus protocol.
+	tusExtensions = "creation,termination,expiration"
+	// Content type of PATCH requests.
+	tusContentType = "application/offset+octet-stream"
+)
+
+// Uploads which are being modified by PATCH or DELETE requests. Concurrent modifications of the same
+// upload are rejected. The lock is local to the process: in a cluster, requests for the same upload
+// must be routed to the same node, e.g. by a load balancer with sticky routing by the URL of the upload.
+// The fs media handler requires it anyway because chunks are saved to the local disk of the node.
+var tusBusy = struct {
+	sync.Mutex
+	uploads map[string]bool
+}{uploads: make(map[string]bool)}
+
+// largeFileUploadResumable handles resumable uploads: POST to the upload endpoint creates an upload,
+// HEAD to the URL of the upload returns the number of bytes received so far, PATCH appends a chunk,
+// DELETE cancels the upload. The state of the upload is kept in the file record with the UploadStarted
+// status. Once all bytes are received, the file is processed like a regular upload.
+func largeFileUploadResumable(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	mh := store.GetMediaHandler()
+
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		// Gorilla CompressHandler requires Content-Type to be set.
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+
+		log.Println("media upload (resumable):", req.Method, msg.Ctrl.Code, msg.Ctrl.Text, "/", err)
+	}
+
+	// Discovery of server capabilities. Does not require authentication.
+	if req.Method == http.MethodOptions {
+		wrt.Header().Set("Tus-Resumable", tusVersion)
+		wrt.Header().Set("Tus-Version", tusVersion)
+		wrt.Header().Set("Tus-Extension", tusExtensions)
+		if globals.maxFileUploadSize > 0 {
+			wrt.Header().Set("Tus-Max-Size", strconv.FormatInt(globals.maxFileUploadSize, 10))
+		}
+		wrt.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	wrt.Header().Set("Tus-Resumable", tusVersion)
+	wrt.Header().Set("Cache-Control", "no-store")
+
+	if req.Header.Get("Tus-Resumable") != tusVersion {
+		wrt.Header().Set("Tus-Version", tusVersion)
+		wrt.WriteHeader(http.StatusPreconditionFailed)
+		log.Println("media upload (resumable): unsupported protocol version", req.Header.Get("Tus-Resumable"))
+		return
+	}
+
+	// Check for API key presence
+	apikey := checkAPIKey(req)
+	if apikey == nil {
+		writeHttpResponse(ErrAPIKeyRequired(now), nil)
+		return
+	}
+
+	// Check authorization: either auth information or SID must be present
+	uid, _, challenge, err := authHttpRequest(req)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if challenge != nil {
+		writeHttpResponse(InfoChallenge("", now, challenge), nil)
+		return
+	}
+	if uid.IsZero() {
+		// Not authenticated
+		writeHttpResponse(ErrAuthRequired("", "", now, now), nil)
+		return
+	}
+	if !apikey.allows(apiScopeUpload) {
+		writeHttpResponse(ErrPermissionDenied("", "", now), errors.New("upload not permitted by API key"))
+		return
+	}
+
+	if req.Method == http.MethodPost {
+		// Create a new upload.
+		statsInc("FileUploadsTotal", 1)
+
+		length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length <= 0 {
+			writeHttpResponse(ErrMalformed("", "", now), errors.New("invalid Upload-Length"))
+			return
+		}
+		if globals.maxFileUploadSize > 0 && length > globals.maxFileUploadSize {
+			writeHttpResponse(ErrTooLarge("", "", now), nil)
+			return
+		}
+
+		meta := tusMetadata(req.Header.Get("Upload-Metadata"))
+		if params, err := checkUploadQuota(uid, length); err != nil {
+			writeHttpResponse(decodeStoreError(err, "", "", now, params), err)
+			return
+		}
+
+		fdef := types.FileDef{}
+		fdef.Id = store.GetUidString()
+		fdef.InitTimes()
+		fdef.User = uid.String()
+		fdef.Size = length
+		// The content is not available yet. Use the type declared by the client until
+		// the upload is completed and the actual type is detected.
+		fdef.MimeType = "application/octet-stream"
+		if filetype := meta["filetype"]; filetype != "" {
+			if mt, _, err := mime.ParseMediaType(filetype); err == nil {
+				fdef.MimeType = mt
+			}
+		}
+
+		if err = mh.StartChunkedUpload(&fdef); err != nil {
+			writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+			return
+		}
+		// The declared length is reserved in the quota by the record of the upload.
+		if params, err := confirmUploadQuota(uid, fdef.Id); err != nil {
+			writeHttpResponse(decodeStoreError(err, "", "", now, params), err)
+			return
+		}
+
+		wrt.Header().Set("Location", strings.TrimSuffix(req.URL.Path, "/")+"/"+fdef.Id)
+		setTusExpires(wrt, &fdef)
+		wrt.WriteHeader(http.StatusCreated)
+		log.Println("media upload (resumable): created", fdef.Id, length)
+		return
+	}
+
+	// All other requests refer to an existing upload.
+	fid := path.Base(req.URL.Path)
+	if types.ParseUid(fid).IsZero() {
+		writeHttpResponse(ErrNotFound("", "", now, now), nil)
+		return
+	}
+	if req.Method == http.MethodPatch || req.Method == http.MethodDelete {
+		if !tusLock(fid) {
+			writeHttpResponse(ErrCommandOutOfSequence("", "", now), errors.New("upload is locked by another request"))
+			return
+		}
+		defer tusUnlock(fid)
+	}
+	fdef, err := store.Files.Get(fid)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if fdef == nil || fdef.User != uid.String() {
+		writeHttpResponse(ErrNotFound("", "", now, now), nil)
+		return
+	}
+	if fdef.Status == types.UploadFailed {
+		writeHttpResponse(ErrGone("", "", now), nil)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodHead:
+		offset := fdef.Size
+		if fdef.Status == types.UploadStarted {
+			if offset, err = mh.ChunkedUploadOffset(fdef); err != nil {
+				writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+				return
+			}
+			setTusExpires(wrt, fdef)
+		}
+		wrt.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		wrt.Header().Set("Upload-Length", strconv.FormatInt(fdef.Size, 10))
+		wrt.WriteHeader(http.StatusOK)
+
+	case http.MethodPatch:
+		if fdef.Status != types.UploadStarted {
+			writeHttpResponse(ErrCommandOutOfSequence("", "", now), errors.New("upload already completed"))
+			return
+		}
+		if req.Header.Get("Content-Type") != tusContentType {
+			writeHttpResponse(ErrMalformed("", "", now), errors.New("invalid Content-Type"))
+			return
+		}
+		offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			writeHttpResponse(ErrMalformed("", "", now), errors.New("invalid Upload-Offset"))
+			return
+		}
+		current, err := mh.ChunkedUploadOffset(fdef)
+		if err != nil {
+			writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+			return
+		}
+		if offset != current {
+			writeHttpResponse(ErrCommandOutOfSequence("", "", now), errors.New("offset mismatch"))
+			return
+		}
+		remaining := fdef.Size - offset
+		if req.ContentLength > remaining {
+			writeHttpResponse(ErrTooLarge("", "", now), errors.New("chunk exceeds Upload-Length"))
+			return
+		}
+
+		offset, err = mh.UploadChunk(fdef, offset, http.MaxBytesReader(wrt, req.Body, remaining))
+		// Keep the upload alive even if the chunk was received partially.
+		if fd, err := store.Files.KeepUpload(fdef.Id, fdef.Size); err == nil {
+			fdef = fd
+		} else {
+			log.Println("media upload (resumable): failed to update record", fdef.Id, err)
+		}
+		if err != nil {
+			if err == types.ErrMalformed {
+				writeHttpResponse(ErrCommandOutOfSequence("", "", now), errors.New("offset mismatch"))
+			} else if strings.Contains(err.Error(), "request body too large") {
+				writeHttpResponse(ErrTooLarge("", "", now), err)
+			} else {
+				writeHttpResponse(ErrUnknown("", "", now), err)
+			}
+			return
+		}
+
+		wrt.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		if offset < fdef.Size {
+			setTusExpires(wrt, fdef)
+			wrt.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// All bytes are received. Process the file like a regular upload and report the result.
+		params := map[string]interface{}{}
+		var processErr error
+		url, err := mh.FinishChunkedUpload(fdef, func(file io.ReadSeeker) (io.ReadSeeker, error) {
+			// Don't trust the type declared by the client.
+			buff := make([]byte, 512)
+			n, err := io.ReadFull(file, buff)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return nil, err
+			}
+			if _, err = file.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			fdef.MimeType = http.DetectContentType(buff[:n])
+			if err = store.Files.Update(fdef.Id, map[string]interface{}{"MimeType": fdef.MimeType}); err != nil {
+				return nil, err
+			}
+
+			upload, err := media.Process(file, fdef.MimeType)
+			if err != nil {
+				processErr = err
+				return nil, err
+			}
+			if strings.HasPrefix(fdef.MimeType, "image/") {
+				largeFileThumbnails(mh, fdef, upload, params)
+			}
+			_, err = upload.Seek(0, io.SeekStart)
+			return upload, err
+		})
+		if processErr != nil {
+			writeHttpResponse(ErrMalformed("", "", now), processErr)
+			return
+		}
+		if err != nil {
+			writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+			return
+		}
+		// Thumbnails could push the usage over the quota.
+		if params, err := confirmUploadQuota(uid, fdef.Id); err != nil {
+			writeHttpResponse(decodeStoreError(err, "", "", now, params), err)
+			return
+		}
+		params["url"] = url
+		writeHttpResponse(NoErrParams("", "", now, params), nil)
+
+	case http.MethodDelete:
+		if fdef.Status != types.UploadStarted {
+			writeHttpResponse(ErrOperationNotAllowed("", "", now), errors.New("upload already completed"))
+			return
+		}
+		// The stored chunks are deleted by garbage collection.
+		if _, err = store.Files.FinishUpload(fdef.Id, false, 0); err != nil {
+			writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+			return
+		}
+		wrt.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeHttpResponse(ErrOperationNotAllowed("", "", now), errors.New("method '"+req.Method+"' not allowed"))
+	}
+}
+
+// tusMetadata parses the Upload-Metadata header: comma-separated pairs of keys and base64-encoded values.
+func tusMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 {
+			continue
+		}
+		var value []byte
+		if len(parts) > 1 {
+			value, _ = base64.StdEncoding.DecodeString(parts[1])
+		}
+		meta[parts[0]] = string(value)
+	}
+	return meta
+}
+
+// tusLock marks the upload as being modified. Returns false if it's already being modified by another request.
+func tusLock(fid string) bool {
+	tusBusy.Lock()
+	defer tusBusy.Unlock()
+	if tusBusy.uploads[fid] {
+		return false
+	}
+	tusBusy.uploads[fid] = true
+	return true
+}
+
+// tusUnlock releases the upload locked by tusLock.
+func tusUnlock(fid string) {
+	tusBusy.Lock()
+	delete(tusBusy.uploads, fid)
+	tusBusy.Unlock()
+}
+
+// setTusExpires reports when the unfinished upload will be deleted by garbage collection.
+func setTusExpires(wrt http.ResponseWriter, fdef *types.FileDef) {
+	wrt.Header().Set("Upload-Expires", fdef.UpdatedAt.Add(unusedUploadLifetime).UTC().Format(http.TimeFormat))
+}
@@ -145,7 +145,8 @@ var upgrader = websocket.Upgrader{
 func serveWebSocket(wrt http.ResponseWriter, req *http.Request) {
 	now := time.Now().UTC().Round(time.Millisecond)
 
-	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+	apikey := checkAPIKey(req)
+	if apikey == nil {
 		wrt.WriteHeader(http.StatusForbidden)
 		json.NewEncoder(wrt).Encode(ErrAPIKeyRequired(now))
 		log.Println("ws: Missing, invalid or expired API key")
@@ -169,6 +170,7 @@ func serveWebSocket(wrt http.ResponseWriter, req *http.Request) {
 	}
 
 	sess, count := globals.sessionStore.NewSession(ws, "")
+	sess.apiScopes = apikey.scopes
 	if globals.useXForwardedFor {
 		sess.remoteAddr = req.Header.Get("X-Forwarded-For")
 	}
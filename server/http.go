@@ -25,6 +25,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/tinode/chat/server/auth"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 )
@@ -328,24 +329,26 @@ func getHttpAuth(req *http.Request) (method, secret string) {
 }
 
 // Authenticate non-websocket HTTP request
-func authHttpRequest(req *http.Request) (types.Uid, []byte, error) {
+func authHttpRequest(req *http.Request) (types.Uid, auth.Level, []byte, error) {
 	var uid types.Uid
+	var authLvl auth.Level
 	if authMethod, secret := getHttpAuth(req); authMethod != "" {
 		decodedSecret := make([]byte, base64.StdEncoding.DecodedLen(len(secret)))
 		n, err := base64.StdEncoding.Decode(decodedSecret, []byte(secret))
 		if err != nil {
-			return uid, nil, types.ErrMalformed
+			return uid, authLvl, nil, types.ErrMalformed
 		}
 
 		if authhdl := store.GetLogicalAuthHandler(authMethod); authhdl != nil {
-			rec, challenge, err := authhdl.Authenticate(decodedSecret[:n])
+			rec, challenge, err := authhdl.Authenticate(decodedSecret[:n], lpRemoteAddr(req))
 			if err != nil {
-				return uid, nil, err
+				return uid, authLvl, nil, err
 			}
 			if challenge != nil {
-				return uid, challenge, nil
+				return uid, authLvl, challenge, nil
 			}
 			uid = rec.Uid
+			authLvl = rec.AuthLevel
 		} else {
 			log.Println("fileUpload: auth data is present but handler is not found", authMethod)
 		}
@@ -354,7 +357,8 @@ func authHttpRequest(req *http.Request) (types.Uid, []byte, error) {
 		sess := globals.sessionStore.Get(req.FormValue("sid"))
 		if sess != nil {
 			uid = sess.uid
+			authLvl = sess.authLvl
 		}
 	}
-	return uid, nil, nil
+	return uid, authLvl, nil, nil
 }
@@ -11,11 +11,13 @@ package main
 
 import (
 	"log"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/push"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 )
@@ -486,6 +488,7 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *ClientComMessage, rea
 
 				// Notify subscribers that the group topic is gone.
 				presSubsOfflineOffline(msg.Original, tcat, subs, "gone", &presParams{}, sess.sid)
+				usersPush(pushForDelTopicOffline(msg.Original, subs))
 			}
 
 			sess.queueOut(NoErrReply(msg, now))
@@ -512,6 +515,23 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *ClientComMessage, rea
 	return nil
 }
 
+// Prepares a silent push notification to subscribers of a deleted topic which is not loaded into memory.
+func pushForDelTopicOffline(topic string, subs []types.Subscription) *push.Receipt {
+	receipt := push.Receipt{
+		To: make(map[types.Uid]push.Recipient, len(subs)),
+		Payload: push.Payload{
+			What:      push.ActDelTopic,
+			Silent:    true,
+			Topic:     topic,
+			Timestamp: types.TimeNow()}}
+
+	for i := range subs {
+		receipt.To[types.ParseUid(subs[i].User)] = push.Recipient{}
+	}
+
+	return &receipt
+}
+
 // Terminate all topics associated with the given user:
 // * all p2p topics with the given user
 // * group topics where the given user is the owner.
@@ -677,12 +697,14 @@ func replyOfflineTopicGetSub(sess *Session, msg *ClientComMessage) {
 		if types.GetTopicCat(msg.RcptTo) != types.TopicCatFnd {
 			sub.Private = ssub.Private
 		}
+		sub.Notify = storeNotify2msgNotify(ssub.Notify)
 		sub.User = types.ParseUid(ssub.User).UserId()
 
 		if (ssub.ModeGiven & ssub.ModeWant).IsReader() && (ssub.ModeWant & ssub.ModeGiven).IsJoiner() {
 			sub.DelId = ssub.DelId
 			sub.ReadSeqId = ssub.ReadSeqId
 			sub.RecvSeqId = ssub.RecvSeqId
+			sub.Mentions = len(trimMentions(ssub.Mentions, ssub.ReadSeqId))
 		}
 	}
 
@@ -696,7 +718,8 @@ func replyOfflineTopicGetSub(sess *Session, msg *ClientComMessage) {
 func replyOfflineTopicSetSub(sess *Session, msg *ClientComMessage) {
 	now := types.TimeNow()
 
-	if (msg.Set.Desc == nil || msg.Set.Desc.Private == nil) && (msg.Set.Sub == nil || msg.Set.Sub.Mode == "") {
+	if (msg.Set.Desc == nil || msg.Set.Desc.Private == nil) &&
+		(msg.Set.Sub == nil || (msg.Set.Sub.Mode == "" && msg.Set.Sub.Notify == nil)) {
 		sess.queueOut(InfoNotModifiedReply(msg, now))
 		return
 	}
@@ -757,6 +780,18 @@ func replyOfflineTopicSetSub(sess *Session, msg *ClientComMessage) {
 		}
 	}
 
+	if msg.Set.Sub != nil && msg.Set.Sub.Notify != nil {
+		notify, err := msgNotify2storeNotify(msg.Set.Sub.Notify)
+		if err != nil {
+			log.Println("replyOfflineTopicSetSub notify:", err)
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return
+		}
+		if !reflect.DeepEqual(notify, sub.Notify) {
+			update["Notify"] = notify
+		}
+	}
+
 	if len(update) > 0 {
 		err = store.Subs.Update(msg.RcptTo, asUid, update, true)
 		if err != nil {
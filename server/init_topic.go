@@ -281,6 +281,8 @@ func initTopicP2P(t *Topic, sreg *sessionJoin) error {
 				topicName: types.ParseUid(subs[(i+1)%2].User).UserId(),
 
 				private:   subs[i].Private,
+				notify:    subs[i].Notify,
+				mentions:  subs[i].Mentions,
 				modeWant:  subs[i].ModeWant,
 				modeGiven: subs[i].ModeGiven,
 				delID:     subs[i].DelId,
@@ -466,6 +468,8 @@ func initTopicP2P(t *Topic, sreg *sessionJoin) error {
 		userData.delID = sub1.DelId
 		userData.readID = sub1.ReadSeqId
 		userData.recvID = sub1.RecvSeqId
+		userData.notify = sub1.Notify
+		userData.mentions = sub1.Mentions
 		t.perUser[userID1] = userData
 
 		t.perUser[userID2] = perUserData{
@@ -476,6 +480,8 @@ func initTopicP2P(t *Topic, sreg *sessionJoin) error {
 			delID:     sub2.DelId,
 			readID:    sub2.ReadSeqId,
 			recvID:    sub2.RecvSeqId,
+			notify:    sub2.Notify,
+			mentions:  sub2.Mentions,
 		}
 	}
 
@@ -688,6 +694,8 @@ func (t *Topic) loadSubscribers() error {
 			readID:    sub.ReadSeqId,
 			recvID:    sub.RecvSeqId,
 			private:   sub.Private,
+			notify:    sub.Notify,
+			mentions:  sub.Mentions,
 			modeWant:  sub.ModeWant,
 			modeGiven: sub.ModeGiven}
 
@@ -27,10 +27,16 @@ import (
 	// For stripping comments from JSON config
 	jcr "github.com/tinode/jsonco"
 
+	// Audit log sinks
+	"github.com/tinode/chat/server/audit"
+	_ "github.com/tinode/chat/server/audit/file"
+	_ "github.com/tinode/chat/server/audit/store"
+
 	// Authenticators
 	"github.com/tinode/chat/server/auth"
 	_ "github.com/tinode/chat/server/auth/anon"
 	_ "github.com/tinode/chat/server/auth/basic"
+	_ "github.com/tinode/chat/server/auth/code"
 	_ "github.com/tinode/chat/server/auth/rest"
 	_ "github.com/tinode/chat/server/auth/token"
 
@@ -41,18 +47,25 @@ import (
 
 	// Push notifications
 	"github.com/tinode/chat/server/push"
+	_ "github.com/tinode/chat/server/push/apns"
 	_ "github.com/tinode/chat/server/push/fcm"
+	_ "github.com/tinode/chat/server/push/http"
+	_ "github.com/tinode/chat/server/push/mqtt"
 	_ "github.com/tinode/chat/server/push/stdout"
 	_ "github.com/tinode/chat/server/push/tnpg"
+	_ "github.com/tinode/chat/server/push/webpush"
 
 	"github.com/tinode/chat/server/store"
 
 	// Credential validators
+	"github.com/tinode/chat/server/validate"
+	_ "github.com/tinode/chat/server/validate/captcha"
 	_ "github.com/tinode/chat/server/validate/email"
 	_ "github.com/tinode/chat/server/validate/tel"
 	"google.golang.org/grpc"
 
 	// File upload handlers
+	"github.com/tinode/chat/server/media"
 	_ "github.com/tinode/chat/server/media/fs"
 	_ "github.com/tinode/chat/server/media/s3"
 )
@@ -85,6 +98,9 @@ const (
 	// maxTagLength is the maximum length of a tag in runes. Longer tags are trimmed.
 	maxTagLength = 96
 
+	// maxUnreadMentions is the maximum number of unread mentions tracked per subscription.
+	maxUnreadMentions = 100
+
 	// Delay before updating a User Agent
 	uaTimerDelay = time.Second * 5
 
@@ -139,14 +155,16 @@ var globals struct {
 	statsUpdate chan *varUpdate
 	// Users cache communication channel.
 	usersUpdate chan *UserCacheReq
+	// Channel for persisting unread mentions.
+	mentionsUpdate chan *mentionsUpdate
 
 	// Credential validators.
 	validators map[string]credValidator
 	// Validators required for each auth level.
 	authValidators map[auth.Level][]string
 
-	// Salt used for signing API key.
-	apiKeySalt []byte
+	// Salts used for validating API keys.
+	apiKeySalts [][]byte
 	// Tag namespaces (prefixes) which are immutable to the client.
 	immutableTagNS map[string]bool
 	// Tag namespaces which are immutable on User and partially mutable on Topic:
@@ -167,6 +185,11 @@ var globals struct {
 
 	// Maximum allowed upload size.
 	maxFileUploadSize int64
+	// Thumbnails generated for uploaded images: name of the size -> maximum width and height.
+	thumbnailSizes map[string]int
+	// Default storage quotas of users and group topics, 0 means unlimited.
+	userQuota  int64
+	topicQuota int64
 
 	// Prioritise X-Forwarded-For header as the source of IP address of the client.
 	useXForwardedFor bool
@@ -193,6 +216,13 @@ type mediaConfig struct {
 	GcPeriod int `json:"gc_period"`
 	// Number of entries to delete in one pass
 	GcBlockSize int `json:"gc_block_size"`
+	// Thumbnails to generate for uploaded images: name of the size -> maximum width and height in pixels.
+	Thumbnails map[string]int `json:"thumbnails"`
+	// Processing of uploaded files: MIME type -> names of processors, e.g. "strip_metadata".
+	// Overrides the defaults for the listed MIME types, an empty list disables processing.
+	Processing map[string][]string `json:"processing"`
+	// Default limits on the total size of uploaded files.
+	Quota *quotaConfig `json:"quota"`
 	// Individual handler config params to pass to handlers unchanged.
 	Handlers map[string]json.RawMessage `json:"handlers"`
 }
@@ -222,6 +252,8 @@ type configType struct {
 	StaticData string `json:"static_data"`
 	// Salt used in signing API keys
 	APIKeySalt []byte `json:"api_key_salt"`
+	// Additional salts accepted when validating API keys, e.g. old salts during rotation.
+	APIKeySalts [][]byte `json:"api_key_salts"`
 	// Maximum message size allowed from client. Intended to prevent malicious client from sending
 	// very large files inband (does not affect out of band uploads).
 	MaxMessageSize int `json:"max_message_size"`
@@ -246,6 +278,9 @@ type configType struct {
 	Plugin    json.RawMessage             `json:"plugins"`
 	Store     json.RawMessage             `json:"store_config"`
 	Push      json.RawMessage             `json:"push"`
+	PushQueue json.RawMessage             `json:"push_queue"`
+	PushL10n  json.RawMessage             `json:"push_l10n"`
+	Audit     json.RawMessage             `json:"audit"`
 	TLS       json.RawMessage             `json:"tls"`
 	Auth      map[string]json.RawMessage  `json:"auth_config"`
 	Validator map[string]*validatorConfig `json:"acc_validation"`
@@ -360,8 +395,8 @@ func main() {
 		log.Println("All done, good bye")
 	}()
 
-	// API key signing secret
-	globals.apiKeySalt = config.APIKeySalt
+	// API key signing secrets: the primary one first, then additional active salts.
+	globals.apiKeySalts = append([][]byte{config.APIKeySalt}, config.APIKeySalts...)
 
 	err = store.InitAuthLogicalNames(config.Auth["logical_names"])
 	if err != nil {
@@ -393,6 +428,10 @@ func main() {
 		}
 	}
 
+	// Let validators report metrics.
+	validate.StatsRegisterInt = statsRegisterInt
+	validate.StatsInc = statsInc
+
 	// Process validators.
 	for name, vconf := range config.Validator {
 		// Check if validator is restrictive. If so, add validator name to the list of restricted tags.
@@ -495,6 +534,22 @@ func main() {
 			config.Media = nil
 		} else {
 			globals.maxFileUploadSize = config.Media.MaxFileUploadSize
+			for name, size := range config.Media.Thumbnails {
+				if !media.IsValidVariant(name) || size <= 0 {
+					log.Fatalf("Invalid thumbnail size '%s': %d", name, size)
+				}
+			}
+			globals.thumbnailSizes = config.Media.Thumbnails
+			if err = media.InitProcessing(config.Media.Processing); err != nil {
+				log.Fatalf("Invalid upload processing config: %s", err)
+			}
+			if config.Media.Quota != nil {
+				if config.Media.Quota.User < 0 || config.Media.Quota.Topic < 0 {
+					log.Fatal("Invalid storage quota")
+				}
+				globals.userQuota = config.Media.Quota.User
+				globals.topicQuota = config.Media.Quota.Topic
+			}
 			if config.Media.Handlers != nil {
 				var conf string
 				if params := config.Media.Handlers[config.Media.UseHandler]; params != nil {
@@ -515,15 +570,42 @@ func main() {
 		}
 	}
 
+	// Let push handlers report metrics.
+	push.StatsRegisterInt = statsRegisterInt
+	push.StatsInc = statsInc
+
+	err = push.InitL10n(string(config.PushL10n))
+	if err != nil {
+		log.Fatal("Failed to load push notification templates:", err)
+	}
 	err = push.Init(string(config.Push))
 	if err != nil {
 		log.Fatal("Failed to initialize push notifications:", err)
 	}
+	err = push.InitQueue(string(config.PushQueue))
+	if err != nil {
+		log.Fatal("Failed to initialize push queue:", err)
+	}
 	defer func() {
 		push.Stop()
 		log.Println("Stopped push notifications")
 	}()
 
+	err = audit.Init(string(config.Audit))
+	if err != nil {
+		log.Fatal("Failed to initialize audit log:", err)
+	}
+	defer func() {
+		audit.Stop()
+		log.Println("Stopped audit log")
+	}()
+
+	stopLockoutsGc := authLockoutRunGarbageCollection(authLockoutGcPeriod)
+	defer func() {
+		stopLockoutsGc <- true
+		log.Println("Stopped lockouts garbage collector")
+	}()
+
 	// Keep inactive LP sessions for 15 seconds
 	globals.sessionStore = NewSessionStore(idleSessionTimeout + 15*time.Second)
 	// The hub (the main message router)
@@ -544,6 +626,7 @@ func main() {
 
 	// Initialize users cache
 	usersInit()
+	mentionsInit()
 
 	// Set up gRPC server, if one is configured
 	if *listenGrpc == "" {
@@ -613,11 +696,15 @@ func main() {
 	mux.HandleFunc(config.ApiPath+"v0/channels", serveWebSocket)
 	// Handle long polling clients. Enable compression.
 	mux.Handle(config.ApiPath+"v0/channels/lp", gh.CompressHandler(http.HandlerFunc(serveLongPoll)))
+	// Serve audit log to root users.
+	mux.Handle(config.ApiPath+"v0/audit", gh.CompressHandler(http.HandlerFunc(serveAudit)))
 	if config.Media != nil {
 		// Handle uploads of large files.
 		mux.Handle(config.ApiPath+"v0/file/u/", gh.CompressHandler(http.HandlerFunc(largeFileUpload)))
 		// Serve large files.
 		mux.Handle(config.ApiPath+"v0/file/s/", gh.CompressHandler(http.HandlerFunc(largeFileServe)))
+		// Manage storage quotas by root users.
+		mux.Handle(config.ApiPath+"v0/quota", gh.CompressHandler(http.HandlerFunc(serveQuota)))
 		log.Println("Large media handling enabled", config.Media.UseHandler)
 	}
 
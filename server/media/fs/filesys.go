@@ -9,6 +9,7 @@ import (
 	"io"
 	"log"
 	"mime"
+	"net/http"
 	"os"
 	"path/filepath"
 
@@ -91,19 +92,152 @@ func (fh *fshandler) Upload(fdef *types.FileDef, file io.ReadSeeker) (string, er
 		return "", err
 	}
 
+	location := fdef.Location
 	fdef, err = store.Files.FinishUpload(fdef.Id, true, size)
 	if err != nil {
+		os.Remove(location)
+		return "", err
+	}
+
+	return fh.fileUrl(fdef), nil
+}
+
+// StartChunkedUpload creates an empty file for a resumable upload. Chunks are appended to it as they arrive.
+func (fh *fshandler) StartChunkedUpload(fdef *types.FileDef) error {
+	fdef.Location = filepath.Join(fh.fileUploadLocation, fdef.Uid().String32())
+
+	outfile, err := os.Create(fdef.Location)
+	if err != nil {
+		log.Println("Upload: failed to create file", fdef.Location, err)
+		return err
+	}
+	outfile.Close()
+
+	if err = store.Files.StartUpload(fdef); err != nil {
 		os.Remove(fdef.Location)
+		log.Println("failed to create file record", fdef.Id, err)
+		return err
+	}
+	return nil
+}
+
+// UploadChunk appends a chunk to the file of a resumable upload.
+func (fh *fshandler) UploadChunk(fdef *types.FileDef, offset int64, chunk io.Reader) (int64, error) {
+	outfile, err := os.OpenFile(fdef.Location, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer outfile.Close()
+
+	info, err := outfile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() != offset {
+		return info.Size(), types.ErrMalformed
+	}
+
+	// Bytes written before an error are kept: the client resumes from the new offset.
+	size, err := io.Copy(outfile, chunk)
+	return offset + size, err
+}
+
+// ChunkedUploadOffset returns the size of the file of a resumable upload.
+func (fh *fshandler) ChunkedUploadOffset(fdef *types.FileDef) (int64, error) {
+	info, err := os.Stat(fdef.Location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = types.ErrNotFound
+		}
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// FinishChunkedUpload completes a resumable upload. The file is replaced if processing changes it.
+func (fh *fshandler) FinishChunkedUpload(fdef *types.FileDef,
+	process func(io.ReadSeeker) (io.ReadSeeker, error)) (string, error) {
+
+	location := fdef.Location
+	info, err := os.Stat(location)
+	if err == nil && info.Size() != fdef.Size {
+		// The received data does not match the declared size.
+		err = types.ErrMalformed
+	}
+	var size int64
+	if err == nil {
+		size, err = fh.processFile(location, process)
+	}
+	if err != nil {
+		store.Files.FinishUpload(fdef.Id, false, 0)
+		os.Remove(location)
 		return "", err
 	}
 
-	fname := fdef.Id
-	ext, _ := mime.ExtensionsByType(fdef.MimeType)
-	if len(ext) > 0 {
-		fname += ext[0]
+	fdef, err = store.Files.FinishUpload(fdef.Id, true, size)
+	if err != nil {
+		os.Remove(location)
+		return "", err
 	}
 
-	return fh.serveURL + fname, nil
+	return fh.fileUrl(fdef), nil
+}
+
+// processFile passes the file through the process function and saves the result in place of the file.
+// Returns the new size of the file.
+func (fh *fshandler) processFile(location string, process func(io.ReadSeeker) (io.ReadSeeker, error)) (int64, error) {
+	file, err := os.Open(location)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := process(file)
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+	if result == io.ReadSeeker(file) {
+		// Unchanged.
+		size, err := file.Seek(0, io.SeekEnd)
+		file.Close()
+		return size, err
+	}
+
+	// Write to a temporary file first so the original is not lost on failure.
+	tmpLocation := location + ".tmp"
+	outfile, err := os.Create(tmpLocation)
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+	size, err := io.Copy(outfile, result)
+	outfile.Close()
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmpLocation, location)
+	}
+	if err != nil {
+		os.Remove(tmpLocation)
+		return 0, err
+	}
+	return size, nil
+}
+
+// UploadVariant saves a derived version of the file, such as a thumbnail, next to the original.
+func (fh *fshandler) UploadVariant(fdef *types.FileDef, variant, mimeType string, file io.ReadSeeker) error {
+	location := variantLocation(fdef.Location, variant)
+	outfile, err := os.Create(location)
+	if err != nil {
+		log.Println("Upload: failed to create file", location, err)
+		return err
+	}
+
+	_, err = io.Copy(outfile, file)
+	outfile.Close()
+	if err != nil {
+		os.Remove(location)
+	}
+	return err
 }
 
 // Download processes request for file download.
@@ -120,6 +254,24 @@ func (fh *fshandler) Download(url string) (*types.FileDef, media.ReadSeekCloser,
 		return nil, nil, err
 	}
 
+	if variant := media.GetVariantFromUrl(url); variant != "" {
+		if file, err := os.Open(variantLocation(fd.Location, variant)); err == nil {
+			// Variants may have a different type than the original.
+			buff := make([]byte, 512)
+			n, _ := file.Read(buff)
+			if _, err = file.Seek(0, io.SeekStart); err == nil {
+				vd := *fd
+				vd.MimeType = http.DetectContentType(buff[:n])
+				if info, err := file.Stat(); err == nil {
+					vd.Size = info.Size()
+				}
+				return &vd, file, nil
+			}
+			file.Close()
+		}
+		// The variant does not exist. Serve the original.
+	}
+
 	file, err := os.Open(fd.Location)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -132,18 +284,36 @@ func (fh *fshandler) Download(url string) (*types.FileDef, media.ReadSeekCloser,
 	return fd, file, nil
 }
 
-// Delete deletes files from storage by provided slice of locations.
+// Delete deletes files and their variants from storage by provided slice of locations.
 func (fh *fshandler) Delete(locations []string) error {
 	for _, loc := range locations {
-		if err, _ := os.Remove(loc).(*os.PathError); err != nil {
-			if err != os.ErrNotExist {
-				log.Println("fs: error deleting file", loc, err)
+		variants, _ := filepath.Glob(variantLocation(loc, "*"))
+		for _, path := range append(variants, loc) {
+			if err, _ := os.Remove(path).(*os.PathError); err != nil {
+				if err != os.ErrNotExist {
+					log.Println("fs: error deleting file", path, err)
+				}
 			}
 		}
 	}
 	return nil
 }
 
+// variantLocation returns location of a derived version of the file.
+func variantLocation(location, variant string) string {
+	return location + "-" + variant
+}
+
+// fileUrl returns the download URL of the file.
+func (fh *fshandler) fileUrl(fdef *types.FileDef) string {
+	fname := fdef.Id
+	ext, _ := mime.ExtensionsByType(fdef.MimeType)
+	if len(ext) > 0 {
+		fname += ext[0]
+	}
+	return fh.serveURL + fname
+}
+
 // GetIdFromUrl converts an attahment URL to a file UID.
 func (fh *fshandler) GetIdFromUrl(url string) types.Uid {
 	return media.GetIdFromUrl(url, fh.serveURL)
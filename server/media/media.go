@@ -3,6 +3,7 @@ package media
 
 import (
 	"io"
+	"net/url"
 	"path"
 	"strings"
 
@@ -28,10 +29,30 @@ type Handler interface {
 	// Upload processes request for file upload.
 	Upload(fdef *types.FileDef, file io.ReadSeeker) (string, error)
 
-	// Download processes request for file download.
+	// UploadVariant saves a derived version of an uploaded file, such as a thumbnail, next to the original.
+	UploadVariant(fdef *types.FileDef, variant, mimeType string, file io.ReadSeeker) error
+
+	// StartChunkedUpload begins a resumable upload of fdef.Size bytes: assigns file location
+	// and records the upload as started.
+	StartChunkedUpload(fdef *types.FileDef) error
+
+	// UploadChunk appends a chunk to the resumable upload. The offset must be equal to the number of
+	// bytes received so far. Returns the new number of received bytes. Bytes received before an error
+	// may be kept.
+	UploadChunk(fdef *types.FileDef, offset int64, chunk io.Reader) (int64, error)
+
+	// ChunkedUploadOffset returns the number of bytes of the resumable upload received so far.
+	ChunkedUploadOffset(fdef *types.FileDef) (int64, error)
+
+	// FinishChunkedUpload assembles the received chunks into the file, marks the upload as completed
+	// and returns the download URL. The content is passed through the process function before it's saved.
+	FinishChunkedUpload(fdef *types.FileDef, process func(io.ReadSeeker) (io.ReadSeeker, error)) (string, error)
+
+	// Download processes request for file download. The variant of the file is requested by the 'size'
+	// query parameter. The original is returned if the variant does not exist.
 	Download(url string) (*types.FileDef, ReadSeekCloser, error)
 
-	// Delete deletes file from storage.
+	// Delete deletes files and their variants from storage.
 	Delete(locations []string) error
 
 	// GetIdFromUrl extracts file ID from download URL.
@@ -40,6 +61,8 @@ type Handler interface {
 
 // GetIdFromUrl is a helper method for extracting file ID from a URL.
 func GetIdFromUrl(url string, serveUrl string) types.Uid {
+	// Strip query parameters.
+	url = strings.SplitN(url, "?", 2)[0]
 	dir, fname := path.Split(path.Clean(url))
 
 	if dir != "" && dir != serveUrl {
@@ -48,3 +71,32 @@ func GetIdFromUrl(url string, serveUrl string) types.Uid {
 
 	return types.ParseUid(strings.Split(fname, ".")[0])
 }
+
+// GetVariantFromUrl is a helper method for extracting the name of the requested variant
+// of the file, such as the thumbnail size, from a URL. Returns an empty string if
+// the original is requested or the name is invalid.
+func GetVariantFromUrl(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	variant := u.Query().Get("size")
+	if !IsValidVariant(variant) {
+		return ""
+	}
+	return variant
+}
+
+// IsValidVariant checks if the name of the variant can be used in file names:
+// it must consist of ASCII letters, digits and underscores.
+func IsValidVariant(variant string) bool {
+	if variant == "" || len(variant) > 32 {
+		return false
+	}
+	for _, c := range variant {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
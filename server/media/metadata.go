@@ -0,0 +1,320 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+var errMalformedImage = errors.New("malformed image")
+
+const (
+	// JPEG markers.
+	jpegSOI  = 0xD8
+	jpegEOI  = 0xD9
+	jpegSOS  = 0xDA
+	jpegAPP0 = 0xE0
+	jpegAPP1 = 0xE1
+	jpegAPP2 = 0xE2
+	// APP14 is used by Adobe to record color transform. It's needed to decode the image correctly.
+	jpegAPP14 = 0xEE
+	jpegAPP15 = 0xEF
+	jpegCOM   = 0xFE
+
+	// EXIF tag of image orientation.
+	exifTagOrientation = 0x0112
+	// Orientation of an image which needs no transformation.
+	orientationNormal = 1
+
+	// WebP VP8X flags.
+	webpFlagXMP  = 0x04
+	webpFlagEXIF = 0x08
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	iccHeader  = []byte("ICC_PROFILE\x00")
+	pngHeader  = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// StripMetadata removes EXIF, XMP and IPTC metadata, such as GPS coordinates and camera details,
+// from JPEG, PNG and WebP images without re-encoding them. Image orientation is preserved as a
+// minimal EXIF record. Color profiles are kept. Images of other types are returned unchanged.
+func StripMetadata(data []byte, mimeType string) ([]byte, error) {
+	switch mimeType {
+	case "image/jpeg":
+		return stripJpeg(data)
+	case "image/png":
+		return stripPng(data)
+	case "image/webp":
+		return stripWebp(data)
+	}
+	return data, nil
+}
+
+// orientation returns EXIF orientation of the image, 1 to 8.
+func orientation(data []byte, mimeType string) int {
+	var exif []byte
+	switch mimeType {
+	case "image/jpeg":
+		forEachJpegSegment(data, func(marker byte, segment []byte) bool {
+			if marker == jpegAPP1 && bytes.HasPrefix(segment[4:], exifHeader) {
+				exif = segment[4:]
+				return false
+			}
+			return marker != jpegSOS
+		})
+	case "image/png":
+		forEachPngChunk(data, func(typ string, chunk []byte) bool {
+			if typ == "eXIf" {
+				exif = chunk[8 : len(chunk)-4]
+				return false
+			}
+			return true
+		})
+	case "image/webp":
+		forEachWebpChunk(data, func(typ string, chunk []byte) bool {
+			if typ == "EXIF" {
+				exif = chunk[8:]
+				return false
+			}
+			return true
+		})
+	}
+	return exifOrientation(exif)
+}
+
+// exifOrientation reads the orientation tag from EXIF data with or without the "Exif" header.
+func exifOrientation(exif []byte) int {
+	exif = bytes.TrimPrefix(exif, exifHeader)
+	if len(exif) < 8 {
+		return orientationNormal
+	}
+
+	var order binary.ByteOrder
+	switch string(exif[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return orientationNormal
+	}
+
+	ifd := int(order.Uint32(exif[4:]))
+	if ifd < 8 || ifd+2 > len(exif) {
+		return orientationNormal
+	}
+	count := int(order.Uint16(exif[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(exif) {
+			break
+		}
+		if order.Uint16(exif[entry:]) == exifTagOrientation {
+			val := int(order.Uint16(exif[entry+8:]))
+			if val >= 1 && val <= 8 {
+				return val
+			}
+			break
+		}
+	}
+	return orientationNormal
+}
+
+// orientationExif creates TIFF-formatted EXIF data which contains just the orientation tag.
+func orientationExif(orient int) []byte {
+	exif := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // Big endian TIFF header, IFD0 at offset 8.
+		0, 1, // One entry.
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orient), 0, 0, // Orientation, SHORT, count 1, value.
+		0, 0, 0, 0, // No next IFD.
+	}
+	return exif
+}
+
+// forEachJpegSegment calls the function for each segment of the JPEG image up to and including the
+// start of scan. The segment includes the marker. Returns the offset where the entropy-coded data
+// starts or -1 if the image is malformed.
+func forEachJpegSegment(data []byte, fn func(marker byte, segment []byte) bool) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != jpegSOI {
+		return -1
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return -1
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			// Fill byte.
+			pos++
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return -1
+		}
+		if !fn(marker, data[pos:end]) || marker == jpegSOS {
+			return end
+		}
+		pos = end
+	}
+	return -1
+}
+
+func stripJpeg(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, jpegSOI)
+	sos := forEachJpegSegment(data, func(marker byte, segment []byte) bool {
+		payload := segment[4:]
+		switch {
+		case marker == jpegAPP1:
+			// EXIF or XMP. Keep orientation only.
+			if bytes.HasPrefix(payload, exifHeader) {
+				if orient := exifOrientation(payload); orient != orientationNormal {
+					exif := append(append([]byte{}, exifHeader...), orientationExif(orient)...)
+					out = append(out, 0xFF, jpegAPP1, byte((len(exif)+2)>>8), byte(len(exif)+2))
+					out = append(out, exif...)
+				}
+			}
+		case marker == jpegAPP2 && !bytes.HasPrefix(payload, iccHeader):
+			// Not a color profile.
+		case marker == jpegCOM:
+		case marker > jpegAPP2 && marker <= jpegAPP15 && marker != jpegAPP14:
+			// IPTC (APP13) and other application data.
+		default:
+			out = append(out, segment...)
+		}
+		return true
+	})
+	if sos < 0 {
+		return nil, errMalformedImage
+	}
+	return append(out, data[sos:]...), nil
+}
+
+// forEachPngChunk calls the function for each chunk of the PNG image. The chunk includes the length,
+// the type and the CRC. Returns false if the image is malformed.
+func forEachPngChunk(data []byte, fn func(typ string, chunk []byte) bool) bool {
+	if !bytes.HasPrefix(data, pngHeader) {
+		return false
+	}
+	pos := len(pngHeader)
+	for pos < len(data) {
+		if pos+12 > len(data) {
+			return false
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) || end < pos {
+			return false
+		}
+		if !fn(string(data[pos+4:pos+8]), data[pos:end]) {
+			return true
+		}
+		pos = end
+	}
+	return true
+}
+
+func stripPng(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, pngHeader...)
+	ok := forEachPngChunk(data, func(typ string, chunk []byte) bool {
+		switch typ {
+		case "eXIf":
+			if orient := exifOrientation(chunk[8 : len(chunk)-4]); orient != orientationNormal {
+				out = appendPngChunk(out, "eXIf", orientationExif(orient))
+			}
+		case "tEXt", "zTXt", "iTXt", "tIME":
+			// Text chunks contain XMP and arbitrary text metadata.
+		default:
+			out = append(out, chunk...)
+		}
+		return true
+	})
+	if !ok {
+		return nil, errMalformedImage
+	}
+	return out, nil
+}
+
+func appendPngChunk(out []byte, typ string, payload []byte) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(len(payload)))
+	out = append(out, buf[:]...)
+	start := len(out)
+	out = append(out, typ...)
+	out = append(out, payload...)
+	binary.BigEndian.PutUint32(buf[:], crc32.ChecksumIEEE(out[start:]))
+	return append(out, buf[:]...)
+}
+
+// forEachWebpChunk calls the function for each chunk of the WebP image. The chunk includes the type,
+// the size and the padding. Returns false if the image is malformed.
+func forEachWebpChunk(data []byte, fn func(typ string, chunk []byte) bool) bool {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return false
+	}
+	pos := 12
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return false
+		}
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size + size&1
+		if size < 0 || end > len(data) || end < pos {
+			return false
+		}
+		if !fn(string(data[pos:pos+4]), data[pos:end]) {
+			return true
+		}
+		pos = end
+	}
+	return true
+}
+
+func stripWebp(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:12]...)
+	vp8x := -1
+	var hasExif bool
+	ok := forEachWebpChunk(data, func(typ string, chunk []byte) bool {
+		switch typ {
+		case "EXIF":
+			if orient := exifOrientation(chunk[8:]); orient != orientationNormal {
+				exif := orientationExif(orient)
+				var buf [4]byte
+				binary.LittleEndian.PutUint32(buf[:], uint32(len(exif)))
+				out = append(out, "EXIF"...)
+				out = append(out, buf[:]...)
+				out = append(out, exif...)
+				hasExif = true
+			}
+		case "XMP ":
+		default:
+			if typ == "VP8X" && len(chunk) > 8 {
+				vp8x = len(out)
+			}
+			out = append(out, chunk...)
+		}
+		return true
+	})
+	if !ok {
+		return nil, errMalformedImage
+	}
+
+	if vp8x >= 0 {
+		// Update flags of the extended format.
+		flags := out[vp8x+8] &^ (webpFlagXMP | webpFlagEXIF)
+		if hasExif {
+			flags |= webpFlagEXIF
+		}
+		out[vp8x+8] = flags
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
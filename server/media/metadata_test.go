@@ -0,0 +1,260 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// Markers of private data which must not survive stripping.
+const (
+	secretGPS  = "GPS 52.5200N 13.4050E"
+	secretXMP  = "<x:xmpmeta>XMP secret</x:xmpmeta>"
+	secretIPTC = "IPTC secret"
+	secretText = "Comment secret"
+	iccProfile = "color profile data"
+)
+
+// testExif creates little-endian TIFF-formatted EXIF data with the orientation tag and an ASCII tag
+// which stands for the GPS data.
+func testExif(orient int) []byte {
+	order := binary.LittleEndian
+	exif := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+	exif = append(exif, 2, 0)
+	entry := make([]byte, 12)
+	// ImageDescription, ASCII, pointing to the string after the IFD.
+	order.PutUint16(entry[0:], 0x010E)
+	order.PutUint16(entry[2:], 2)
+	order.PutUint32(entry[4:], uint32(len(secretGPS)+1))
+	order.PutUint32(entry[8:], 8+2+2*12+4)
+	exif = append(exif, entry...)
+	entry = make([]byte, 12)
+	order.PutUint16(entry[0:], exifTagOrientation)
+	order.PutUint16(entry[2:], 3)
+	order.PutUint32(entry[4:], 1)
+	order.PutUint16(entry[8:], uint16(orient))
+	exif = append(exif, entry...)
+	exif = append(exif, 0, 0, 0, 0)
+	return append(append(exif, secretGPS...), 0)
+}
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		img.Set(x, 0, color.RGBA{255, 0, 0, 255})
+		img.Set(x, 1, color.RGBA{0, 0, 255, 255})
+	}
+	return img
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	return append([]byte{0xFF, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+}
+
+func testJpeg(t *testing.T, orient int) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	data := []byte{0xFF, jpegSOI}
+	data = append(data, jpegSegment(jpegAPP1, append(append([]byte{}, exifHeader...), testExif(orient)...))...)
+	data = append(data, jpegSegment(jpegAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00"+secretXMP))...)
+	data = append(data, jpegSegment(jpegAPP2, []byte(string(iccHeader)+"\x01\x01"+iccProfile))...)
+	data = append(data, jpegSegment(jpegAPP2, []byte("MPF\x00"+secretText))...)
+	data = append(data, jpegSegment(0xED, []byte("Photoshop 3.0\x00"+secretIPTC))...)
+	data = append(data, jpegSegment(jpegCOM, []byte(secretText))...)
+	return append(data, encoded[2:]...)
+}
+
+func pngChunks(t *testing.T, data []byte) []string {
+	var types []string
+	if !forEachPngChunk(data, func(typ string, chunk []byte) bool {
+		types = append(types, typ)
+		return true
+	}) {
+		t.Fatal("malformed PNG")
+	}
+	return types
+}
+
+func testPng(t *testing.T, orient int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	// Insert metadata chunks after IHDR.
+	ihdrEnd := len(pngHeader) + 12 + 13
+	data := append([]byte{}, encoded[:ihdrEnd]...)
+	data = appendPngChunk(data, "iCCP", []byte("sRGB\x00\x00"+iccProfile))
+	data = appendPngChunk(data, "eXIf", testExif(orient))
+	data = appendPngChunk(data, "iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"+secretXMP))
+	data = appendPngChunk(data, "tEXt", []byte("Comment\x00"+secretText))
+	data = appendPngChunk(data, "tIME", []byte{0x07, 0xE4, 1, 2, 3, 4, 5})
+	return append(data, encoded[ihdrEnd:]...)
+}
+
+func webpChunk(typ string, payload []byte) []byte {
+	chunk := []byte(typ)
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(payload)))
+	chunk = append(chunk, size[:]...)
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// testWebp creates an extended WebP file. The image data is not valid, it's not parsed.
+func testWebp(orient int) []byte {
+	// VP8X: ICC, EXIF and XMP flags, 4x2 canvas.
+	vp8x := []byte{0x20 | webpFlagEXIF | webpFlagXMP, 0, 0, 0, 3, 0, 0, 1, 0, 0}
+	data := []byte("RIFF\x00\x00\x00\x00WEBP")
+	data = append(data, webpChunk("VP8X", vp8x)...)
+	data = append(data, webpChunk("ICCP", []byte(iccProfile))...)
+	// Odd-sized image data to check padding.
+	data = append(data, webpChunk("VP8L", []byte{0x2F, 3, 0x40, 0, 0})...)
+	data = append(data, webpChunk("EXIF", testExif(orient))...)
+	data = append(data, webpChunk("XMP ", []byte(secretXMP))...)
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+	return data
+}
+
+func checkNoSecrets(t *testing.T, data []byte) {
+	for _, secret := range []string{secretGPS, secretXMP, secretIPTC, secretText} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("'%s' is not removed", secret)
+		}
+	}
+}
+
+func TestStripJpeg(t *testing.T) {
+	for _, orient := range []int{orientationNormal, 6} {
+		src := testJpeg(t, orient)
+		if got := orientation(src, "image/jpeg"); got != orient {
+			t.Fatalf("fixture orientation %d, expected %d", got, orient)
+		}
+
+		out, err := StripMetadata(src, "image/jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkNoSecrets(t, out)
+		if !bytes.Contains(out, []byte(iccProfile)) {
+			t.Error("ICC profile is removed")
+		}
+		if got := orientation(out, "image/jpeg"); got != orient {
+			t.Errorf("orientation %d, expected %d", got, orient)
+		}
+		hasExif := bytes.Contains(out, exifHeader)
+		if hasExif != (orient != orientationNormal) {
+			t.Errorf("orientation %d: EXIF present %v", orient, hasExif)
+		}
+		img, err := jpeg.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal("stripped image does not decode:", err)
+		}
+		if img.Bounds().Dx() != 4 || img.Bounds().Dy() != 2 {
+			t.Errorf("unexpected image size %v", img.Bounds())
+		}
+	}
+
+	if _, err := StripMetadata([]byte{0xFF, jpegSOI, 0xFF, jpegAPP1, 0x10}, "image/jpeg"); err != errMalformedImage {
+		t.Errorf("expected errMalformedImage, got %v", err)
+	}
+}
+
+func TestStripPng(t *testing.T) {
+	for _, orient := range []int{orientationNormal, 3} {
+		src := testPng(t, orient)
+		if got := orientation(src, "image/png"); got != orient {
+			t.Fatalf("fixture orientation %d, expected %d", got, orient)
+		}
+
+		out, err := StripMetadata(src, "image/png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkNoSecrets(t, out)
+		if got := orientation(out, "image/png"); got != orient {
+			t.Errorf("orientation %d, expected %d", got, orient)
+		}
+
+		expected := "IHDR iCCP IDAT IEND"
+		if orient != orientationNormal {
+			expected = "IHDR iCCP eXIf IDAT IEND"
+		}
+		if chunks := strings.Join(pngChunks(t, out), " "); chunks != expected {
+			t.Errorf("chunks '%s', expected '%s'", chunks, expected)
+		}
+		// The decoder verifies CRCs of the chunks.
+		if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+			t.Fatal("stripped image does not decode:", err)
+		}
+	}
+}
+
+func TestStripWebp(t *testing.T) {
+	for _, orient := range []int{orientationNormal, 8} {
+		src := testWebp(orient)
+		if got := orientation(src, "image/webp"); got != orient {
+			t.Fatalf("fixture orientation %d, expected %d", got, orient)
+		}
+
+		out, err := StripMetadata(src, "image/webp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkNoSecrets(t, out)
+		if !bytes.Contains(out, []byte(iccProfile)) {
+			t.Error("ICC profile is removed")
+		}
+		if got := orientation(out, "image/webp"); got != orient {
+			t.Errorf("orientation %d, expected %d", got, orient)
+		}
+
+		if size := int(binary.LittleEndian.Uint32(out[4:])); size != len(out)-8 {
+			t.Errorf("RIFF size %d, expected %d", size, len(out)-8)
+		}
+		expectedFlags := byte(0x20)
+		if orient != orientationNormal {
+			expectedFlags |= webpFlagEXIF
+		}
+		// VP8X chunk follows the RIFF header, flags are the first byte of its payload.
+		if string(out[12:16]) != "VP8X" || out[20] != expectedFlags {
+			t.Errorf("VP8X flags %#x, expected %#x", out[20], expectedFlags)
+		}
+		// The chunk structure is intact: the padding of the odd-sized chunk is kept.
+		var chunks []string
+		if !forEachWebpChunk(out, func(typ string, chunk []byte) bool {
+			chunks = append(chunks, typ)
+			return true
+		}) {
+			t.Fatal("malformed WebP")
+		}
+		expected := 3
+		if orient != orientationNormal {
+			expected = 4
+		}
+		if len(chunks) != expected {
+			t.Errorf("chunks %q", chunks)
+		}
+	}
+}
+
+func TestStripOtherTypes(t *testing.T) {
+	data := []byte("GIF89a" + secretText)
+	out, err := StripMetadata(data, "image/gif")
+	if err != nil || !bytes.Equal(out, data) {
+		t.Errorf("expected unchanged data, got %q, %v", out, err)
+	}
+}
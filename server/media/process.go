@@ -0,0 +1,74 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// ProcessFunc transforms an uploaded file before it's saved. It returns the new content of the file.
+type ProcessFunc func(data []byte, mimeType string) ([]byte, error)
+
+// Processors available for configuration by name.
+var processors = map[string]ProcessFunc{
+	"strip_metadata": StripMetadata,
+}
+
+// Processing applied to uploaded files by default: MIME type -> names of processors.
+var defaultProcessing = map[string][]string{
+	"image/jpeg": {"strip_metadata"},
+	"image/png":  {"strip_metadata"},
+	"image/webp": {"strip_metadata"},
+}
+
+// Processing of uploaded files by MIME type.
+var processing = map[string][]ProcessFunc{}
+
+func init() {
+	if err := InitProcessing(nil); err != nil {
+		panic(err)
+	}
+}
+
+// InitProcessing configures processing of uploaded files: MIME type -> names of processors
+// applied in order. The configuration overrides the defaults for the listed MIME types,
+// an empty list disables processing of the type.
+func InitProcessing(config map[string][]string) error {
+	result := make(map[string][]ProcessFunc)
+	for _, conf := range []map[string][]string{defaultProcessing, config} {
+		for mimeType, names := range conf {
+			var pipeline []ProcessFunc
+			for _, name := range names {
+				fn := processors[name]
+				if fn == nil {
+					return errors.New("unknown upload processor '" + name + "' for " + mimeType)
+				}
+				pipeline = append(pipeline, fn)
+			}
+			result[mimeType] = pipeline
+		}
+	}
+	processing = result
+	return nil
+}
+
+// Process applies processors configured for the MIME type to the uploaded file. The file is
+// returned unchanged if no processors are configured.
+func Process(file io.ReadSeeker, mimeType string) (io.ReadSeeker, error) {
+	pipeline := processing[mimeType]
+	if len(pipeline) == 0 {
+		return file, nil
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range pipeline {
+		if data, err = fn(data, mimeType); err != nil {
+			return nil, err
+		}
+	}
+	return bytes.NewReader(data), nil
+}
@@ -4,10 +4,14 @@ package s3
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"mime"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -57,6 +61,95 @@ func (rc *readerCounter) Read(buf []byte) (int, error) {
 	return n, err
 }
 
+// chunk is a saved part of a resumable upload.
+type chunk struct {
+	key    string
+	offset int64
+	size   int64
+}
+
+// chunkReader reads chunks of a resumable upload as one file.
+type chunkReader struct {
+	svc    *s3.S3
+	bucket string
+	chunks []chunk
+	size   int64
+
+	// Current position.
+	pos int64
+	// Body of the chunk being read, positioned at pos.
+	body io.ReadCloser
+}
+
+// Read reads the chunks in order, fetching each one when it's reached.
+func (cr *chunkReader) Read(buf []byte) (int, error) {
+	for {
+		if cr.pos >= cr.size {
+			return 0, io.EOF
+		}
+
+		if cr.body == nil {
+			// Find the chunk which contains the current position.
+			i := sort.Search(len(cr.chunks), func(i int) bool {
+				return cr.chunks[i].offset+cr.chunks[i].size > cr.pos
+			})
+			out, err := cr.svc.GetObject(&s3.GetObjectInput{
+				Bucket: aws.String(cr.bucket),
+				Key:    aws.String(cr.chunks[i].key),
+				Range:  aws.String(fmt.Sprintf("bytes=%d-", cr.pos-cr.chunks[i].offset)),
+			})
+			if err != nil {
+				return 0, err
+			}
+			cr.body = out.Body
+		}
+
+		n, err := cr.body.Read(buf)
+		cr.pos += int64(n)
+		if err == io.EOF {
+			// End of the chunk, not of the file.
+			cr.body.Close()
+			cr.body = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Seek sets the position for the next Read.
+func (cr *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cr.pos
+	case io.SeekEnd:
+		offset += cr.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != cr.pos {
+		cr.Close()
+		cr.pos = offset
+	}
+	return cr.pos, nil
+}
+
+// Close releases the chunk being read.
+func (cr *chunkReader) Close() error {
+	if cr.body == nil {
+		return nil
+	}
+	err := cr.body.Close()
+	cr.body = nil
+	return err
+}
+
 // Init initializes the media handler.
 func (ah *awshandler) Init(jsconf string) error {
 	var err error
@@ -158,17 +251,32 @@ func (ah *awshandler) Redirect(method, url string) (string, error) {
 		return "", err
 	}
 
+	key := fid.String32()
+	// Variants have their own content type.
+	contentType := aws.String(fd.MimeType)
+	if variant := media.GetVariantFromUrl(url); variant != "" {
+		// Check if the variant exists, otherwise serve the original.
+		_, err := ah.svc.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(ah.conf.BucketName),
+			Key:    aws.String(variantKey(key, variant)),
+		})
+		if err == nil {
+			key = variantKey(key, variant)
+			contentType = nil
+		}
+	}
+
 	var req *request.Request
 	if method == "GET" {
 		req, _ = ah.svc.GetObjectRequest(&s3.GetObjectInput{
 			Bucket:              aws.String(ah.conf.BucketName),
-			Key:                 aws.String(fid.String32()),
-			ResponseContentType: aws.String(fd.MimeType),
+			Key:                 aws.String(key),
+			ResponseContentType: contentType,
 		})
 	} else if method == "HEAD" {
 		req, _ = ah.svc.HeadObjectRequest(&s3.HeadObjectInput{
 			Bucket: aws.String(ah.conf.BucketName),
-			Key:    aws.String(fid.String32()),
+			Key:    aws.String(key),
 		})
 	}
 
@@ -215,15 +323,138 @@ func (ah *awshandler) Upload(fdef *types.FileDef, file io.ReadSeeker) (string, e
 		return "", err
 	}
 
-	fname := fdef.Id
-	ext, _ := mime.ExtensionsByType(fdef.MimeType)
-	if len(ext) > 0 {
-		fname += ext[0]
+	log.Println("aws upload success ", fdef.Id, "key", key)
+
+	return ah.fileUrl(fdef), nil
+}
+
+// StartChunkedUpload records the start of a resumable upload. Chunks are stored as separate objects
+// until the upload is completed.
+func (ah *awshandler) StartChunkedUpload(fdef *types.FileDef) error {
+	fdef.Location = fdef.Uid().String32()
+
+	if err := store.Files.StartUpload(fdef); err != nil {
+		log.Println("failed to create file record", fdef.Id, err)
+		return err
+	}
+	return nil
+}
+
+// UploadChunk saves a chunk of a resumable upload as an object. The chunk is either saved in full or not at all.
+func (ah *awshandler) UploadChunk(fdef *types.FileDef, offset int64, chunk io.Reader) (int64, error) {
+	_, size, err := ah.listChunks(fdef.Location)
+	if err != nil {
+		return 0, err
+	}
+	if size != offset {
+		return size, types.ErrMalformed
+	}
+	uploader := s3manager.NewUploaderWithClient(ah.svc)
+	rc := readerCounter{reader: chunk}
+	_, err = uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(ah.conf.BucketName),
+		Key:    aws.String(chunkKey(fdef.Location, offset)),
+		Body:   &rc,
+	})
+	if err != nil {
+		return offset, err
+	}
+	return offset + rc.count, nil
+}
+
+// ChunkedUploadOffset returns the total size of the saved chunks of a resumable upload.
+func (ah *awshandler) ChunkedUploadOffset(fdef *types.FileDef) (int64, error) {
+	_, size, err := ah.listChunks(fdef.Location)
+	return size, err
+}
+
+// FinishChunkedUpload joins the chunks of a resumable upload into one object and deletes the chunks.
+func (ah *awshandler) FinishChunkedUpload(fdef *types.FileDef,
+	process func(io.ReadSeeker) (io.ReadSeeker, error)) (string, error) {
+
+	chunks, size, err := ah.listChunks(fdef.Location)
+	if err != nil {
+		return "", err
+	}
+	if size != fdef.Size {
+		// The received data does not match the declared size.
+		store.Files.FinishUpload(fdef.Id, false, 0)
+		return "", types.ErrMalformed
+	}
+
+	cr := &chunkReader{svc: ah.svc, bucket: ah.conf.BucketName, chunks: chunks, size: size}
+	defer cr.Close()
+
+	var file io.ReadSeeker
+	file, err = process(cr)
+	if err == nil {
+		uploader := s3manager.NewUploaderWithClient(ah.svc)
+		rc := readerCounter{reader: file}
+		_, err = uploader.Upload(&s3manager.UploadInput{
+			Bucket: aws.String(ah.conf.BucketName),
+			Key:    aws.String(fdef.Location),
+			Body:   &rc,
+		})
+		size = rc.count
+	}
+	if err != nil {
+		store.Files.FinishUpload(fdef.Id, false, 0)
+		return "", err
+	}
+
+	keys := make([]string, len(chunks))
+	for i := range chunks {
+		keys[i] = chunks[i].key
+	}
+	if err := ah.deleteKeys(keys); err != nil {
+		// The chunks will be deleted together with the file.
+		log.Println("s3: failed to delete chunks of", fdef.Location, err)
+	}
+
+	fdef, err = store.Files.FinishUpload(fdef.Id, true, size)
+	if err != nil {
+		return "", err
 	}
 
-	log.Println("aws upload success ", fname, "key", key, "id", fdef.Id)
+	log.Println("aws chunked upload success ", fdef.Id, "key", fdef.Location)
 
-	return ah.conf.ServeURL + fname, nil
+	return ah.fileUrl(fdef), nil
+}
+
+// listChunks returns saved chunks of a resumable upload ordered by offset and their total size.
+// Chunks which don't follow the previous chunks are ignored: they will be overwritten.
+func (ah *awshandler) listChunks(key string) ([]chunk, int64, error) {
+	var chunks []chunk
+	var size int64
+	prefix := chunkKey(key, -1)
+	err := ah.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(ah.conf.BucketName),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		// Keys are listed in lexicographic order which is the order of offsets because offsets are zero-padded.
+		for _, obj := range page.Contents {
+			offset, err := strconv.ParseInt(strings.TrimPrefix(aws.StringValue(obj.Key), prefix), 10, 64)
+			if err != nil || offset != size {
+				return false
+			}
+			chunks = append(chunks, chunk{key: aws.StringValue(obj.Key), offset: offset, size: aws.Int64Value(obj.Size)})
+			size += aws.Int64Value(obj.Size)
+		}
+		return true
+	})
+	return chunks, size, err
+}
+
+// UploadVariant saves a derived version of the file, such as a thumbnail, next to the original.
+func (ah *awshandler) UploadVariant(fdef *types.FileDef, variant, mimeType string, file io.ReadSeeker) error {
+	uploader := s3manager.NewUploaderWithClient(ah.svc)
+	_, err := uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(ah.conf.BucketName),
+		Key:         aws.String(variantKey(fdef.Location, variant)),
+		ContentType: aws.String(mimeType),
+		Body:        file,
+	})
+	return err
 }
 
 // Download processes request for file download.
@@ -232,10 +463,33 @@ func (ah *awshandler) Download(url string) (*types.FileDef, media.ReadSeekCloser
 	return nil, nil, types.ErrUnsupported
 }
 
-// Delete deletes files from aws by provided slice of locations.
+// Delete deletes files and their variants from aws by provided slice of locations.
 func (ah *awshandler) Delete(locations []string) error {
-	toDelete := make([]s3manager.BatchDeleteObject, len(locations))
-	for i, key := range locations {
+	var keys []string
+	for _, key := range locations {
+		keys = append(keys, key)
+		// Find variants of the file.
+		err := ah.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket: aws.String(ah.conf.BucketName),
+			Prefix: aws.String(variantKey(key, "")),
+		}, func(page *s3.ListObjectsV2Output, last bool) bool {
+			for _, obj := range page.Contents {
+				keys = append(keys, aws.StringValue(obj.Key))
+			}
+			return true
+		})
+		if err != nil {
+			log.Println("s3: failed to list variants of", key, err)
+		}
+	}
+
+	return ah.deleteKeys(keys)
+}
+
+// deleteKeys deletes objects by keys.
+func (ah *awshandler) deleteKeys(keys []string) error {
+	toDelete := make([]s3manager.BatchDeleteObject, len(keys))
+	for i, key := range keys {
 		toDelete[i] = s3manager.BatchDeleteObject{
 			Object: &s3.DeleteObjectInput{
 				Key:    aws.String(key),
@@ -248,6 +502,31 @@ func (ah *awshandler) Delete(locations []string) error {
 	})
 }
 
+// variantKey returns the key of a derived version of the file.
+func variantKey(key, variant string) string {
+	return key + "-" + variant
+}
+
+// chunkKey returns the key of a chunk of a resumable upload which starts at the offset.
+// The prefix of chunk keys is returned if the offset is negative. Chunk keys cannot
+// be confused with variant keys because variant names cannot contain dots.
+func chunkKey(key string, offset int64) string {
+	if offset < 0 {
+		return key + "-chunk."
+	}
+	return fmt.Sprintf("%s-chunk.%020d", key, offset)
+}
+
+// fileUrl returns the download URL of the file.
+func (ah *awshandler) fileUrl(fdef *types.FileDef) string {
+	fname := fdef.Id
+	ext, _ := mime.ExtensionsByType(fdef.MimeType)
+	if len(ext) > 0 {
+		fname += ext[0]
+	}
+	return ah.conf.ServeURL + fname
+}
+
 // GetIdFromUrl converts an attahment URL to a file UID.
 func (ah *awshandler) GetIdFromUrl(url string) types.Uid {
 	return media.GetIdFromUrl(url, ah.conf.ServeURL)
@@ -0,0 +1,211 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+
+	// Register GIF decoder.
+	_ "image/gif"
+)
+
+const (
+	// Images with more pixels are not decoded to protect from decompression bombs. A decoded
+	// image takes about 6 bytes per pixel: the image itself plus its RGBA copy.
+	maxImagePixels = 25 * 1000 * 1000
+	// Maximum number of images decoded at the same time.
+	maxConcurrentDecodes = 2
+	// Quality of JPEG thumbnails.
+	thumbnailJpegQuality = 80
+)
+
+// Semaphore which limits the number of concurrently decoded images and thus the memory they use.
+var decodeSlots = make(chan struct{}, maxConcurrentDecodes)
+
+// Thumbnail is a scaled-down copy of an image.
+type Thumbnail struct {
+	// Name of the size, such as "small".
+	Name     string
+	Width    int
+	Height   int
+	MimeType string
+	Data     []byte
+}
+
+// MakeThumbnails decodes the image and creates scaled-down copies of it which fit into squares
+// of the given sizes: name of the size -> maximum width and height in pixels. Sizes which are not
+// smaller than the image are skipped. Returns dimensions of the original image as it's displayed,
+// i.e. with EXIF orientation applied, and the thumbnails. Thumbnails are rotated according to
+// the orientation because they carry no metadata. Blocks while maxConcurrentDecodes other images
+// are being processed.
+func MakeThumbnails(file io.ReadSeeker, sizes map[string]int) (int, int, []Thumbnail, error) {
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	orient := orientation(data, "image/"+format)
+	// Dimensions of the displayed image.
+	dispWidth, dispHeight := config.Width, config.Height
+	if orient >= 5 {
+		dispWidth, dispHeight = dispHeight, dispWidth
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return dispWidth, dispHeight, nil, errors.New("image is too large")
+	}
+
+	var src *image.RGBA
+	var thumbs []Thumbnail
+	for name, size := range sizes {
+		width, height := fitInto(config.Width, config.Height, size)
+		if width >= config.Width && height >= config.Height {
+			continue
+		}
+
+		if src == nil {
+			decodeSlots <- struct{}{}
+			defer func() { <-decodeSlots }()
+
+			img, _, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				return dispWidth, dispHeight, nil, err
+			}
+			// Convert to RGBA once: it's much faster to scale.
+			src = image.NewRGBA(img.Bounds())
+			draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+		}
+
+		dst := reorient(scaleDown(src, width, height), orient)
+		thumb := Thumbnail{Name: name, Width: dst.Bounds().Dx(), Height: dst.Bounds().Dy()}
+		var buf bytes.Buffer
+		if format == "jpeg" {
+			thumb.MimeType = "image/jpeg"
+			err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: thumbnailJpegQuality})
+		} else {
+			thumb.MimeType = "image/png"
+			err = png.Encode(&buf, dst)
+		}
+		if err != nil {
+			return dispWidth, dispHeight, nil, err
+		}
+		thumb.Data = buf.Bytes()
+		thumbs = append(thumbs, thumb)
+	}
+
+	return dispWidth, dispHeight, thumbs, nil
+}
+
+// fitInto calculates dimensions of the image scaled to fit into a size x size square
+// preserving the aspect ratio.
+func fitInto(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+	if width >= height {
+		height = height * size / width
+		width = size
+	} else {
+		width = width * size / height
+		height = size
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return width, height
+}
+
+// scaleDown resizes the image to the given smaller dimensions by averaging source pixels
+// which fall into each destination pixel.
+func scaleDown(src *image.RGBA, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	bounds := src.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+
+	for y := 0; y < height; y++ {
+		y0 := y * sh / height
+		y1 := (y + 1) * sh / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := x * sw / width
+			x1 := (x + 1) * sw / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				offset := src.PixOffset(bounds.Min.X+x0, bounds.Min.Y+sy)
+				for sx := x0; sx < x1; sx++ {
+					pix := src.Pix[offset : offset+4]
+					r += uint64(pix[0])
+					g += uint64(pix[1])
+					b += uint64(pix[2])
+					a += uint64(pix[3])
+					offset += 4
+					n++
+				}
+			}
+
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset] = uint8(r / n)
+			dst.Pix[offset+1] = uint8(g / n)
+			dst.Pix[offset+2] = uint8(b / n)
+			dst.Pix[offset+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// reorient transforms the image according to EXIF orientation so it's displayed correctly without
+// the metadata.
+func reorient(src *image.RGBA, orient int) *image.RGBA {
+	if orient <= orientationNormal || orient > 8 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orient >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orient {
+			case 2: // Mirrored horizontally.
+				dx, dy = w-1-x, y
+			case 3: // Rotated 180 degrees.
+				dx, dy = w-1-x, h-1-y
+			case 4: // Mirrored vertically.
+				dx, dy = x, h-1-y
+			case 5: // Transposed.
+				dx, dy = y, x
+			case 6: // Rotated 90 degrees clockwise.
+				dx, dy = h-1-y, x
+			case 7: // Transversed.
+				dx, dy = h-1-y, w-1-x
+			case 8: // Rotated 90 degrees counterclockwise.
+				dx, dy = y, w-1-x
+			}
+			si := src.PixOffset(src.Bounds().Min.X+x, src.Bounds().Min.Y+y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
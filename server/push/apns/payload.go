@@ -0,0 +1,161 @@
+package apns
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/push"
+)
+
+// AlertConfig is the configuration of the alert shown to the user.
+type AlertConfig struct {
+	// Common defaults for all push types.
+	alertPayload
+	// Configs for specific push types.
+	Msg alertPayload `json:"msg,omitempty"`
+	Sub alertPayload `json:"sub,omitempty"`
+}
+
+// Alert to be shown for a specific notification type.
+type alertPayload struct {
+	TitleLocKey string `json:"title_loc_key,omitempty"`
+	Title       string `json:"title,omitempty"`
+	BodyLocKey  string `json:"body_loc_key,omitempty"`
+	// Body of the alert. "$content" is replaced with the text of the message.
+	Body  string `json:"body,omitempty"`
+	Sound string `json:"sound,omitempty"`
+}
+
+// forType returns alert settings for the given push type falling back to the common defaults.
+func (ac *AlertConfig) forType(what string) alertPayload {
+	var specific alertPayload
+	if what == push.ActMsg {
+		specific = ac.Msg
+	} else if what == push.ActSub {
+		specific = ac.Sub
+	}
+
+	result := ac.alertPayload
+	if specific.TitleLocKey != "" {
+		result.TitleLocKey = specific.TitleLocKey
+	}
+	if specific.Title != "" {
+		result.Title = specific.Title
+	}
+	if specific.BodyLocKey != "" {
+		result.BodyLocKey = specific.BodyLocKey
+	}
+	if specific.Body != "" {
+		result.Body = specific.Body
+	}
+	if specific.Sound != "" {
+		result.Sound = specific.Sound
+	}
+	return result
+}
+
+// apsAlert is the 'alert' dictionary of APNs payload.
+type apsAlert struct {
+	Title       string `json:"title,omitempty"`
+	TitleLocKey string `json:"title-loc-key,omitempty"`
+	Body        string `json:"body,omitempty"`
+	LocKey      string `json:"loc-key,omitempty"`
+}
+
+// aps is the Apple-defined part of the payload.
+type aps struct {
+	Alert            *apsAlert `json:"alert,omitempty"`
+	Badge            *int      `json:"badge,omitempty"`
+	Sound            string    `json:"sound,omitempty"`
+	ThreadId         string    `json:"thread-id,omitempty"`
+	ContentAvailable int       `json:"content-available,omitempty"`
+	MutableContent   int       `json:"mutable-content,omitempty"`
+}
+
+// payloadToData converts the push payload to custom keys of APNs payload. The keys are the same
+// as of FCM data messages delivered to iOS.
+func payloadToData(pl *push.Payload) (map[string]interface{}, error) {
+	if pl == nil {
+		return nil, errors.New("empty push payload")
+	}
+	data := make(map[string]interface{})
+	data["what"] = pl.What
+	if pl.Silent {
+		data["silent"] = "true"
+	}
+	data["topic"] = pl.Topic
+	data["ts"] = pl.Timestamp.Format(time.RFC3339Nano)
+	data["xfrom"] = pl.From
+	if pl.What == push.ActMsg {
+		content, err := drafty.ToPlainText(pl.Content)
+		if err != nil {
+			return nil, err
+		}
+		// Check byte length first and don't waste time converting short strings.
+		if len(content) > maxMessageLength {
+			runes := []rune(content)
+			if len(runes) > maxMessageLength {
+				content = string(runes[:maxMessageLength]) + "…"
+			}
+		}
+		data["seq"] = strconv.Itoa(pl.SeqId)
+		data["mime"] = pl.ContentType
+		data["content"] = content
+	} else if pl.What == push.ActSub {
+		data["modeWant"] = pl.ModeWant.String()
+		data["modeGiven"] = pl.ModeGiven.String()
+	} else if pl.What == push.ActRead {
+		data["seq"] = strconv.Itoa(pl.SeqId)
+	} else if pl.What == push.ActDelMsg {
+		data["seq"] = strconv.Itoa(pl.SeqId)
+		data["delseq"] = pl.DelSeq
+	} else if pl.What == push.ActDelTopic {
+		// Topic name is sufficient.
+	} else {
+		return nil, errors.New("unknown push type")
+	}
+	return data, nil
+}
+
+// buildPayload creates the APNs payload for one recipient.
+func buildPayload(data map[string]interface{}, alert *alertPayload, unread int, silent bool) map[string]interface{} {
+	badge := unread
+	a := &aps{
+		Badge:          &badge,
+		ThreadId:       data["topic"].(string),
+		MutableContent: 1,
+	}
+
+	if silent {
+		// Let the app update its state without showing anything to the user.
+		a.ContentAvailable = 1
+		a.MutableContent = 0
+	} else {
+		body := alert.Body
+		if body == "$content" {
+			body, _ = data["content"].(string)
+		}
+		a.Alert = &apsAlert{
+			Title:       alert.Title,
+			TitleLocKey: alert.TitleLocKey,
+			Body:        body,
+			LocKey:      alert.BodyLocKey,
+		}
+		a.Sound = alert.Sound
+		if a.Sound == "" {
+			a.Sound = "default"
+		}
+	}
+
+	payload := make(map[string]interface{}, len(data)+1)
+	for key, val := range data {
+		payload[key] = val
+	}
+	if silent {
+		payload["silent"] = "true"
+	}
+	payload["aps"] = a
+	return payload
+}
@@ -0,0 +1,387 @@
+// Package apns implements push notification plugin for Apple Push Notification service.
+// Notifications are sent directly to APNs over HTTP/2 using token-based (.p8) authentication.
+package apns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+
+	"golang.org/x/net/http2"
+)
+
+var handler Handler
+
+const (
+	// Size of the input channel buffer.
+	bufferSize = 1024
+
+	// APNs endpoints.
+	productionEndpoint  = "https://api.push.apple.com"
+	developmentEndpoint = "https://api.sandbox.push.apple.com"
+
+	// Provider tokens must be refreshed no more often than once in 20 minutes
+	// and no less often than once an hour.
+	tokenLifetime = 50 * time.Minute
+
+	// Default time to live of the push, in seconds.
+	defaultTimeToLive = 3600
+
+	// Default timeout of requests to APNs.
+	defaultTimeout = 10 * time.Second
+
+	// Maximum length of a text message in runes. The message is clipped if length is exceeded.
+	maxMessageLength = 80
+
+	// Maximum size of APNs response to read.
+	maxResponseSize = 4096
+)
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input   chan *push.Receipt
+	channel chan *push.ChannelReq
+	stop    chan bool
+	client  *http.Client
+
+	endpoint string
+	keyID    string
+	teamID   string
+	key      *ecdsa.PrivateKey
+
+	// Cached provider token.
+	tokenLock sync.Mutex
+	token     string
+	tokenAt   time.Time
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Path to the .p8 authentication key file.
+	KeyFile string `json:"key_file"`
+	// ID of the key, 10 characters.
+	KeyID string `json:"key_id"`
+	// Apple developer team ID.
+	TeamID string `json:"team_id"`
+	// App bundle ID, used as apns-topic.
+	BundleID string `json:"bundle_id"`
+	// Use production APNs environment, otherwise sandbox (development).
+	Production bool `json:"production"`
+	// Optional APNs endpoint to use instead of Apple's, e.g. for testing.
+	Endpoint string `json:"endpoint,omitempty"`
+	// How long APNs should keep the undelivered notification, in seconds.
+	TimeToLive int `json:"time_to_live,omitempty"`
+	// Request timeout in seconds.
+	Timeout int `json:"timeout,omitempty"`
+	// Configuration of alerts.
+	Alert AlertConfig `json:"alert,omitempty"`
+}
+
+// APNs error response.
+type errorResponse struct {
+	Reason string `json:"reason"`
+}
+
+// Init initializes the push handler
+func (*Handler) Init(jsonconf string) error {
+	var config configType
+	err := json.Unmarshal([]byte(jsonconf), &config)
+	if err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return nil
+	}
+
+	if config.KeyID == "" || config.TeamID == "" || config.BundleID == "" {
+		return errors.New("missing key_id, team_id or bundle_id")
+	}
+	if handler.key, err = loadKey(config.KeyFile); err != nil {
+		return err
+	}
+	handler.keyID = config.KeyID
+	handler.teamID = config.TeamID
+
+	handler.endpoint = config.Endpoint
+	if handler.endpoint == "" {
+		if config.Production {
+			handler.endpoint = productionEndpoint
+		} else {
+			handler.endpoint = developmentEndpoint
+		}
+	}
+	if config.TimeToLive <= 0 {
+		config.TimeToLive = defaultTimeToLive
+	}
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	handler.client = &http.Client{
+		Transport: &http2.Transport{TLSClientConfig: &tls.Config{}},
+		Timeout:   timeout,
+	}
+
+	handler.input = make(chan *push.Receipt, bufferSize)
+	handler.channel = make(chan *push.ChannelReq, bufferSize)
+	handler.stop = make(chan bool, 1)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendNotifications(rcpt, &config)
+			case <-handler.channel:
+				// APNs has no topics. Ignore.
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// loadKey reads the EC private key from the .p8 file.
+func loadKey(path string) (*ecdsa.PrivateKey, error) {
+	if path == "" {
+		return nil, errors.New("missing key_file")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found in " + path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("key in " + path + " is not an EC key")
+	}
+	return ecKey, nil
+}
+
+// leftPad pads the big-endian number with zeros to the given size.
+func leftPad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	out := make([]byte, size)
+	copy(out[size-len(b):], b)
+	return out
+}
+
+// providerToken returns a cached JWT or generates a new one if the cached token is too old or
+// forced is true.
+func (h *Handler) providerToken(forced bool) (string, error) {
+	h.tokenLock.Lock()
+	defer h.tokenLock.Unlock()
+
+	now := time.Now()
+	if !forced && h.token != "" && now.Sub(h.tokenAt) < tokenLifetime {
+		return h.token, nil
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": h.keyID})
+	claims, _ := json.Marshal(map[string]interface{}{"iss": h.teamID, "iat": now.Unix()})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, h.key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	sig := append(leftPad(r.Bytes(), 32), leftPad(s.Bytes(), 32)...)
+
+	h.token = unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+	h.tokenAt = now
+	return h.token, nil
+}
+
+func sendNotifications(rcpt *push.Receipt, config *configType) {
+	if len(rcpt.To) == 0 {
+		return
+	}
+
+	data, err := payloadToData(&rcpt.Payload)
+	if err != nil {
+		log.Println("apns push: could not parse payload;", err)
+		return
+	}
+
+	uids := make([]t.Uid, 0, len(rcpt.To))
+	// Devices which were online in the topic when the message was sent.
+	skipDevices := make(map[string]struct{})
+	for uid, to := range rcpt.To {
+		uids = append(uids, uid)
+		for _, deviceID := range to.Devices {
+			skipDevices[deviceID] = struct{}{}
+		}
+	}
+	devices, count, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		log.Println("apns push: db error", err)
+		return
+	}
+	if count == 0 {
+		return
+	}
+
+	alert := config.Alert.forType(rcpt.Payload.What)
+	for uid, devList := range devices {
+		to := rcpt.To[uid]
+		// Silence the push for user who have received the data interactively
+		// or who does not want to be notified.
+		silent := rcpt.Payload.Silent || to.Delivered > 0 || to.Silent
+		payload, err := json.Marshal(buildPayload(data, &alert, to.Unread, silent))
+		if err != nil {
+			log.Println("apns push: failed to serialize payload", err)
+			return
+		}
+
+		for i := range devList {
+			d := &devList[i]
+			if d.Platform != push.PlatformAPNs {
+				continue
+			}
+			if _, ok := skipDevices[d.DeviceId]; ok {
+				continue
+			}
+			if !sendToDevice(uid, d.DeviceId, rcpt.Payload.Topic, payload, silent, config) {
+				return
+			}
+		}
+	}
+}
+
+// sendToDevice posts one notification to APNs. Returns false to stop sending other notifications.
+func sendToDevice(uid t.Uid, deviceID, topic string, payload []byte, silent bool, config *configType) bool {
+	for attempt := 0; attempt < 2; attempt++ {
+		token, err := handler.providerToken(attempt > 0)
+		if err != nil {
+			log.Println("apns: failed to sign provider token", err)
+			return false
+		}
+
+		req, err := http.NewRequest(http.MethodPost, handler.endpoint+"/3/device/"+deviceID, bytes.NewReader(payload))
+		if err != nil {
+			log.Println("apns: invalid request", uid, err)
+			return true
+		}
+		req.Header.Set("authorization", "bearer "+token)
+		req.Header.Set("apns-topic", config.BundleID)
+		req.Header.Set("apns-expiration", strconv.FormatInt(time.Now().Unix()+int64(config.TimeToLive), 10))
+		if topic != "" {
+			// Show just one notification per topic.
+			req.Header.Set("apns-collapse-id", topic)
+		}
+		if silent {
+			req.Header.Set("apns-push-type", "background")
+			req.Header.Set("apns-priority", "5")
+		} else {
+			req.Header.Set("apns-push-type", "alert")
+			req.Header.Set("apns-priority", "10")
+		}
+
+		resp, err := handler.client.Do(req)
+		if err != nil {
+			log.Println("apns transient failure", err)
+			return false
+		}
+		retry, proceed := handleResponse(resp, uid, deviceID)
+		resp.Body.Close()
+		if !retry {
+			return proceed
+		}
+	}
+	return false
+}
+
+// handleResponse processes APNs response. Returns retry = true if the request should be repeated
+// with a fresh provider token, proceed = false to stop sending other notifications.
+func handleResponse(resp *http.Response, uid t.Uid, deviceID string) (retry, proceed bool) {
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxResponseSize))
+		return false, true
+	}
+
+	var apnsErr errorResponse
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	json.Unmarshal(body, &apnsErr)
+
+	switch apnsErr.Reason {
+	case "Unregistered", "BadDeviceToken", "DeviceTokenNotForTopic":
+		// Token is no longer valid.
+		log.Println("apns: invalid token", uid, apnsErr.Reason)
+		if err := store.Devices.Delete(uid, deviceID); err != nil {
+			log.Println("apns: failed to delete invalid token", err)
+		}
+		return false, true
+	case "ExpiredProviderToken":
+		return true, true
+	case "InvalidProviderToken", "MissingProviderToken", "BadTopic", "TopicDisallowed":
+		// Config errors.
+		log.Println("apns: request failed", resp.StatusCode, apnsErr.Reason)
+		return false, false
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+		// Transient errors. Stop sending this batch.
+		log.Println("apns transient failure", resp.StatusCode, apnsErr.Reason)
+		return false, false
+	}
+
+	// All other errors are treated as non-fatal.
+	log.Println("apns error:", resp.StatusCode, apnsErr.Reason)
+	return false, true
+}
+
+// IsReady checks if the push handler has been initialized.
+func (*Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (*Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Channel returns a channel for subscribing/unsubscribing devices to FCM topics.
+// APNs does not support topics, the requests are ignored.
+func (*Handler) Channel() chan<- *push.ChannelReq {
+	return handler.channel
+}
+
+// Stop shuts down the handler
+func (*Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register("apns", &handler)
+}
@@ -0,0 +1,366 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	adapter "github.com/tinode/chat/server/db"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+
+	"golang.org/x/net/http2"
+)
+
+// memAdapter serves devices from memory. Methods which are not used by the handler are not implemented.
+type memAdapter struct {
+	adapter.Adapter
+	sync.Mutex
+	open    bool
+	devices map[t.Uid][]t.DeviceDef
+	deleted []string
+}
+
+func (a *memAdapter) GetName() string                   { return "mem" }
+func (a *memAdapter) IsOpen() bool                      { return a.open }
+func (a *memAdapter) SetMaxResults(val int) error       { return nil }
+func (a *memAdapter) Open(config json.RawMessage) error { a.open = true; return nil }
+func (a *memAdapter) CheckDbVersion() error             { return nil }
+
+func (a *memAdapter) DeviceGetAll(uids ...t.Uid) (map[t.Uid][]t.DeviceDef, int, error) {
+	a.Lock()
+	defer a.Unlock()
+	result := make(map[t.Uid][]t.DeviceDef)
+	count := 0
+	for _, uid := range uids {
+		if devs, ok := a.devices[uid]; ok {
+			result[uid] = devs
+			count += len(devs)
+		}
+	}
+	return result, count, nil
+}
+
+func (a *memAdapter) DeviceDelete(uid t.Uid, deviceID string) error {
+	a.Lock()
+	defer a.Unlock()
+	var kept []t.DeviceDef
+	for _, d := range a.devices[uid] {
+		if d.DeviceId != deviceID {
+			kept = append(kept, d)
+		}
+	}
+	a.devices[uid] = kept
+	a.deleted = append(a.deleted, deviceID)
+	return nil
+}
+
+var mem = &memAdapter{devices: make(map[t.Uid][]t.DeviceDef)}
+
+func TestMain(m *testing.M) {
+	store.RegisterAdapter(mem)
+	if err := store.Open(1, json.RawMessage(`{"uid_key":"la6YsO+bNX/+XIkOqc5Svw=="}`)); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+// apnsRequest is a request received by the fake APNs server.
+type apnsRequest struct {
+	deviceID string
+	header   http.Header
+	payload  map[string]interface{}
+}
+
+// fakeAPNs is an HTTP/2 TLS server which records requests and responds with the status and reason
+// returned by respond. The attempt is the number of earlier requests to the same device.
+type fakeAPNs struct {
+	sync.Mutex
+	requests []apnsRequest
+	respond  func(deviceID string, attempt int) (int, string)
+}
+
+func (f *fakeAPNs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := apnsRequest{deviceID: strings.TrimPrefix(r.URL.Path, "/3/device/"), header: r.Header}
+	body, _ := ioutil.ReadAll(r.Body)
+	json.Unmarshal(body, &req.payload)
+
+	f.Lock()
+	attempt := 0
+	for _, prev := range f.requests {
+		if prev.deviceID == req.deviceID {
+			attempt++
+		}
+	}
+	f.requests = append(f.requests, req)
+	f.Unlock()
+
+	status, reason := http.StatusOK, ""
+	if f.respond != nil {
+		status, reason = f.respond(req.deviceID, attempt)
+	}
+	w.Header().Set("apns-id", "test-id")
+	w.WriteHeader(status)
+	if reason != "" {
+		json.NewEncoder(w).Encode(&errorResponse{Reason: reason})
+	}
+}
+
+// byDevice returns requests made to the device.
+func (f *fakeAPNs) byDevice(deviceID string) []apnsRequest {
+	f.Lock()
+	defer f.Unlock()
+	var result []apnsRequest
+	for _, req := range f.requests {
+		if req.deviceID == deviceID {
+			result = append(result, req)
+		}
+	}
+	return result
+}
+
+// newTestHandler points the handler at the fake APNs server.
+func newTestHandler(test *testing.T, respond func(deviceID string, attempt int) (int, string)) *fakeAPNs {
+	fake := &fakeAPNs{respond: respond}
+	srv := httptest.NewUnstartedServer(fake)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	test.Cleanup(srv.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		test.Fatal(err)
+	}
+	handler.key = key
+	handler.keyID = "KEY1234567"
+	handler.teamID = "TEAM123456"
+	handler.endpoint = srv.URL
+	handler.token = ""
+	handler.client = &http.Client{
+		Transport: &http2.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		Timeout:   5 * time.Second,
+	}
+	return fake
+}
+
+var testConfig = &configType{
+	BundleID:   "co.tinode.test",
+	TimeToLive: 600,
+	Alert:      AlertConfig{alertPayload: alertPayload{Title: "New message", Body: "$content"}},
+}
+
+func testReceipt(to map[t.Uid]push.Recipient) *push.Receipt {
+	return &push.Receipt{
+		To: to,
+		Payload: push.Payload{
+			What:      push.ActMsg,
+			Topic:     "grpAbcDef",
+			From:      "usrSender",
+			Timestamp: time.Now(),
+			SeqId:     12,
+			Content:   "hello",
+		},
+	}
+}
+
+// verifyToken checks the signature and claims of the provider token.
+func verifyToken(test *testing.T, authorization string) string {
+	token := strings.TrimPrefix(authorization, "bearer ")
+	parts := strings.Split(token, ".")
+	if token == authorization || len(parts) != 3 {
+		test.Fatal("invalid authorization", authorization)
+	}
+
+	var header, claims map[string]interface{}
+	for i, dst := range []*map[string]interface{}{&header, &claims} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			test.Fatal(err)
+		}
+		if err = json.Unmarshal(data, dst); err != nil {
+			test.Fatal(err)
+		}
+	}
+	if header["alg"] != "ES256" || header["kid"] != handler.keyID {
+		test.Error("token header", header)
+	}
+	if claims["iss"] != handler.teamID {
+		test.Error("token claims", claims)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		test.Fatal("invalid signature", parts[2])
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&handler.key.PublicKey, hash[:], r, s) {
+		test.Error("token signature does not verify")
+	}
+	return token
+}
+
+func TestSendNotifications(test *testing.T) {
+	fake := newTestHandler(test, nil)
+
+	const (
+		alice = t.Uid(101)
+		bob   = t.Uid(102)
+	)
+	mem.devices[alice] = []t.DeviceDef{
+		{DeviceId: "alice-ios", Platform: push.PlatformAPNs},
+		{DeviceId: "alice-android", Platform: "android"},
+		{DeviceId: "alice-online", Platform: push.PlatformAPNs},
+	}
+	mem.devices[bob] = []t.DeviceDef{{DeviceId: "bob-ios", Platform: push.PlatformAPNs}}
+
+	sendNotifications(testReceipt(map[t.Uid]push.Recipient{
+		alice: {Unread: 3, Devices: []string{"alice-online"}},
+		bob:   {Unread: 7, Delivered: 1},
+	}), testConfig)
+
+	if len(fake.requests) != 2 {
+		test.Fatal("expected 2 requests, got", len(fake.requests))
+	}
+	for _, deviceID := range []string{"alice-android", "alice-online"} {
+		if len(fake.byDevice(deviceID)) != 0 {
+			test.Error("push sent to", deviceID)
+		}
+	}
+
+	for _, tc := range []struct {
+		deviceID string
+		silent   bool
+		badge    int
+	}{
+		{"alice-ios", false, 3},
+		{"bob-ios", true, 7},
+	} {
+		reqs := fake.byDevice(tc.deviceID)
+		if len(reqs) != 1 {
+			test.Error(tc.deviceID, "requests", len(reqs))
+			continue
+		}
+		req := reqs[0]
+		verifyToken(test, req.header.Get("authorization"))
+
+		pushType, priority := "alert", "10"
+		if tc.silent {
+			pushType, priority = "background", "5"
+		}
+		for name, expected := range map[string]string{
+			"apns-topic":       testConfig.BundleID,
+			"apns-push-type":   pushType,
+			"apns-priority":    priority,
+			"apns-collapse-id": "grpAbcDef",
+		} {
+			if got := req.header.Get(name); got != expected {
+				test.Errorf("%s: %s '%s', expected '%s'", tc.deviceID, name, got, expected)
+			}
+		}
+		expires, _ := strconv.ParseInt(req.header.Get("apns-expiration"), 10, 64)
+		if delta := expires - time.Now().Unix() - int64(testConfig.TimeToLive); delta < -5 || delta > 0 {
+			test.Error(tc.deviceID, "apns-expiration", req.header.Get("apns-expiration"))
+		}
+
+		if req.payload["topic"] != "grpAbcDef" || req.payload["seq"] != "12" || req.payload["content"] != "hello" {
+			test.Error(tc.deviceID, "payload", req.payload)
+		}
+		aps, _ := req.payload["aps"].(map[string]interface{})
+		if badge, _ := aps["badge"].(float64); int(badge) != tc.badge {
+			test.Error(tc.deviceID, "badge", aps["badge"])
+		}
+		alert, _ := aps["alert"].(map[string]interface{})
+		if tc.silent {
+			if alert != nil || aps["content-available"] != 1.0 || req.payload["silent"] != "true" {
+				test.Error(tc.deviceID, "silent push", aps)
+			}
+		} else if alert["title"] != "New message" || alert["body"] != "hello" || aps["sound"] != "default" {
+			test.Error(tc.deviceID, "alert", aps)
+		}
+	}
+}
+
+func TestProviderTokenRejected(test *testing.T) {
+	const user = t.Uid(201)
+	mem.devices[user] = []t.DeviceDef{
+		{DeviceId: "expired-ios", Platform: push.PlatformAPNs},
+		{DeviceId: "next-ios", Platform: push.PlatformAPNs},
+	}
+
+	// Expired token is refreshed and the request is repeated.
+	fake := newTestHandler(test, func(deviceID string, attempt int) (int, string) {
+		if deviceID == "expired-ios" && attempt == 0 {
+			return http.StatusForbidden, "ExpiredProviderToken"
+		}
+		return http.StatusOK, ""
+	})
+	sendNotifications(testReceipt(map[t.Uid]push.Recipient{user: {Unread: 1}}), testConfig)
+
+	reqs := fake.byDevice("expired-ios")
+	if len(reqs) != 2 {
+		test.Fatal("expected 2 requests, got", len(reqs))
+	}
+	if verifyToken(test, reqs[0].header.Get("authorization")) == verifyToken(test, reqs[1].header.Get("authorization")) {
+		test.Error("provider token not refreshed")
+	}
+	if len(fake.byDevice("next-ios")) != 1 {
+		test.Error("push not sent to the next device")
+	}
+
+	// Invalid token is a config error: sending is stopped.
+	fake = newTestHandler(test, func(deviceID string, attempt int) (int, string) {
+		return http.StatusForbidden, "InvalidProviderToken"
+	})
+	sendNotifications(testReceipt(map[t.Uid]push.Recipient{user: {Unread: 1}}), testConfig)
+	if len(fake.requests) != 1 {
+		test.Error("sending not stopped on invalid provider token, requests:", len(fake.requests))
+	}
+}
+
+func TestUnregisteredDevice(test *testing.T) {
+	const user = t.Uid(301)
+	mem.devices[user] = []t.DeviceDef{
+		{DeviceId: "gone-ios", Platform: push.PlatformAPNs},
+		{DeviceId: "valid-ios", Platform: push.PlatformAPNs},
+	}
+
+	fake := newTestHandler(test, func(deviceID string, attempt int) (int, string) {
+		if deviceID == "gone-ios" {
+			return http.StatusGone, "Unregistered"
+		}
+		return http.StatusOK, ""
+	})
+	sendNotifications(testReceipt(map[t.Uid]push.Recipient{user: {Unread: 1}}), testConfig)
+
+	if len(mem.deleted) != 1 || mem.deleted[0] != "gone-ios" {
+		test.Error("deleted devices", mem.deleted)
+	}
+	if len(mem.devices[user]) != 1 || mem.devices[user][0].DeviceId != "valid-ios" {
+		test.Error("devices", mem.devices[user])
+	}
+	// Other devices still get the push.
+	if len(fake.byDevice("valid-ios")) != 1 {
+		test.Error("push not sent to the valid device")
+	}
+}
@@ -1,6 +1,7 @@
 package fcm
 
 import (
+	"encoding/json"
 	"errors"
 	"log"
 	"strconv"
@@ -167,6 +168,17 @@ func payloadToData(pl *push.Payload) (map[string]string, error) {
 	} else if pl.What == push.ActSub {
 		data["modeWant"] = pl.ModeWant.String()
 		data["modeGiven"] = pl.ModeGiven.String()
+	} else if pl.What == push.ActRead {
+		data["seq"] = strconv.Itoa(pl.SeqId)
+	} else if pl.What == push.ActDelMsg {
+		data["seq"] = strconv.Itoa(pl.SeqId)
+		delseq, err := json.Marshal(pl.DelSeq)
+		if err != nil {
+			return nil, err
+		}
+		data["delseq"] = string(delseq)
+	} else if pl.What == push.ActDelTopic {
+		// Topic name is sufficient.
 	} else {
 		return nil, errors.New("unknown push type")
 	}
@@ -226,14 +238,33 @@ func PrepareNotifications(rcpt *push.Receipt, config *AndroidConfig) []MessageDa
 		bodylc = config.getBodyLocKey(rcpt.Payload.What)
 		body = config.getBody(rcpt.Payload.What)
 		if body == "$content" {
-			body = data["content"]
+			// Use the message preview rendered in the language of the device.
+			body = ""
 		}
 		icon = config.getIcon(rcpt.Payload.What)
 		color = config.getColor(rcpt.Payload.What)
 		clickAction = config.getClickAction(rcpt.Payload.What)
 	}
 
-	androidNotification := func(msg *fcm.Message) {
+	// Title and body rendered in the language of the device unless they are set in the config
+	// or are localized by the client using the loc keys.
+	rendered := make(map[string][2]string)
+	localize := func(lang string) (string, string) {
+		if tb, ok := rendered[lang]; ok {
+			return tb[0], tb[1]
+		}
+		ltitle, lbody := rcpt.Payload.Localize(lang, maxMessageLength)
+		if title != "" || titlelc != "" {
+			ltitle = title
+		}
+		if body != "" || bodylc != "" {
+			lbody = body
+		}
+		rendered[lang] = [2]string{ltitle, lbody}
+		return ltitle, lbody
+	}
+
+	androidNotification := func(msg *fcm.Message, title, body string) {
 		// When this notification type is included and the app is not in the foreground
 		// Android won't wake up the app and won't call FirebaseMessagingService:onMessageReceived.
 		// See dicussion: https://github.com/firebase/quickstart-js/issues/71
@@ -255,7 +286,7 @@ func PrepareNotifications(rcpt *push.Receipt, config *AndroidConfig) []MessageDa
 		}
 	}
 
-	apnsNotification := func(msg *fcm.Message) {
+	apnsNotification := func(msg *fcm.Message, title, body string) {
 		msg.APNS = &fcm.APNSConfig{
 			Payload: &fcm.APNSPayload{
 				Aps: &fcm.Aps{
@@ -273,36 +304,86 @@ func PrepareNotifications(rcpt *push.Receipt, config *AndroidConfig) []MessageDa
 		}
 	}
 
+	// Background update without an alert: the app updates its state, i.e. retracts
+	// displayed notifications and updates the badge.
+	apnsSilentNotification := func(msg *fcm.Message) {
+		msg.APNS = &fcm.APNSConfig{
+			Headers: map[string]string{
+				"apns-push-type": "background",
+				"apns-priority":  "5",
+			},
+			Payload: &fcm.APNSPayload{
+				Aps: &fcm.Aps{
+					ContentAvailable: true,
+				},
+			},
+		}
+	}
+
+	// iOS notifications with the same collapse key replace each other if the device is offline.
+	collapseKey := rcpt.Payload.CollapseKey()
+
 	var messages []MessageData
 	for uid, devList := range devices {
 		userData := data
-		if rcpt.To[uid].Delivered > 0 {
-			// Silence the push for user who have received the data interactively.
+		// Silence the push for user who have received the data interactively
+		// or who does not want to be notified.
+		silent := rcpt.Payload.Silent || rcpt.To[uid].Delivered > 0 || rcpt.To[uid].Silent
+		// Let the client highlight notifications which mention the user.
+		mention := rcpt.Payload.IsMentioned(uid)
+		if (silent && !rcpt.Payload.Silent) || mention {
 			userData = clonePayload(data)
-			userData["silent"] = "true"
+			if silent {
+				userData["silent"] = "true"
+			}
+			if mention {
+				userData["mention"] = "true"
+			}
 		}
 		for i := range devList {
 			d := &devList[i]
+			if d.Platform == push.PlatformWebPush || d.Platform == push.PlatformAPNs {
+				// Web Push subscriptions and APNs tokens are not FCM tokens.
+				continue
+			}
 			if _, ok := skipDevices[d.DeviceId]; !ok && d.DeviceId != "" {
 				msg := fcm.Message{
 					Token: d.DeviceId,
 					Data:  userData,
-					Notification: &fcm.Notification{
+				}
+				title, body := localize(d.Lang)
+				if !silent {
+					msg.Notification = &fcm.Notification{
 						Title: title,
 						Body:  body,
-					},
+					}
 				}
 
 				if d.Platform == "android" {
 					msg.Android = &fcm.AndroidConfig{
-						Priority: "high",
+						// FCM keeps at most 4 collapse keys per device, so Android keys must come
+						// from a bounded set: the type of the notification, not the topic.
+						CollapseKey: rcpt.Payload.What,
+						Priority:    "high",
+					}
+					if !silent {
+						androidNotification(&msg, title, body)
 					}
-					androidNotification(&msg)
 				} else if d.Platform == "ios" {
-					apnsNotification(&msg)
+					if silent {
+						apnsSilentNotification(&msg)
+					} else {
+						apnsNotification(&msg, title, body)
+					}
 					// iOS uses Badge to show the total unread message count.
 					badge := rcpt.To[uid].Unread
 					msg.APNS.Payload.Aps.Badge = &badge
+					if len(collapseKey) <= maxApnsCollapseIdLength {
+						if msg.APNS.Headers == nil {
+							msg.APNS.Headers = make(map[string]string)
+						}
+						msg.APNS.Headers["apns-collapse-id"] = collapseKey
+					}
 				}
 				messages = append(messages, MessageData{Uid: uid, DeviceId: d.DeviceId, Message: &msg})
 			}
@@ -313,6 +394,8 @@ func PrepareNotifications(rcpt *push.Receipt, config *AndroidConfig) []MessageDa
 		topic := rcpt.Channel
 		userData := clonePayload(data)
 		userData["topic"] = topic
+		// Language of channel subscribers is unknown.
+		title, body := localize("")
 		msg := fcm.Message{
 			Topic: topic,
 			Data:  userData,
@@ -325,8 +408,8 @@ func PrepareNotifications(rcpt *push.Receipt, config *AndroidConfig) []MessageDa
 		msg.Android = &fcm.AndroidConfig{
 			Priority: "normal",
 		}
-		androidNotification(&msg)
-		apnsNotification(&msg)
+		androidNotification(&msg, title, body)
+		apnsNotification(&msg, title, body)
 		messages = append(messages, MessageData{Message: &msg})
 	}
 
@@ -345,9 +428,39 @@ func DevicesForUser(uid t.Uid) []string {
 		return nil
 	}
 
-	devices := make([]string, count)
-	for i, dd := range ddef[uid] {
-		devices[i] = dd.DeviceId
+	devices := make([]string, 0, count)
+	for _, dd := range ddef[uid] {
+		if dd.Platform != push.PlatformWebPush && dd.Platform != push.PlatformAPNs {
+			devices = append(devices, dd.DeviceId)
+		}
 	}
 	return devices
 }
+
+// RetryRecipients returns recipients of the messages which should be retried. Devices which
+// have already received the notification are added to the list of devices to skip.
+func RetryRecipients(rcpt *push.Receipt, messages []MessageData, retry map[int]bool) map[t.Uid]push.Recipient {
+	to := make(map[t.Uid]push.Recipient)
+	for i := range messages {
+		uid := messages[i].Uid
+		if !retry[i] || uid.IsZero() {
+			// Channel messages are not retried.
+			continue
+		}
+		if _, ok := to[uid]; !ok {
+			r := rcpt.To[uid]
+			r.Devices = append([]string(nil), r.Devices...)
+			to[uid] = r
+		}
+	}
+	for i := range messages {
+		if retry[i] {
+			continue
+		}
+		if r, ok := to[messages[i].Uid]; ok {
+			r.Devices = append(r.Devices, messages[i].DeviceId)
+			to[messages[i].Uid] = r
+		}
+	}
+	return to
+}
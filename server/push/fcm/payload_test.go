@@ -0,0 +1,123 @@
+package fcm
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	adapter "github.com/tinode/chat/server/db"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// memAdapter serves devices from memory. Methods which are not used by the handler are not implemented.
+type memAdapter struct {
+	adapter.Adapter
+	open    bool
+	devices map[t.Uid][]t.DeviceDef
+}
+
+func (a *memAdapter) GetName() string                   { return "mem" }
+func (a *memAdapter) IsOpen() bool                      { return a.open }
+func (a *memAdapter) SetMaxResults(val int) error       { return nil }
+func (a *memAdapter) Open(config json.RawMessage) error { a.open = true; return nil }
+func (a *memAdapter) CheckDbVersion() error             { return nil }
+
+func (a *memAdapter) DeviceGetAll(uids ...t.Uid) (map[t.Uid][]t.DeviceDef, int, error) {
+	result := make(map[t.Uid][]t.DeviceDef)
+	count := 0
+	for _, uid := range uids {
+		if devs, ok := a.devices[uid]; ok {
+			result[uid] = devs
+			count += len(devs)
+		}
+	}
+	return result, count, nil
+}
+
+var mem = &memAdapter{devices: make(map[t.Uid][]t.DeviceDef)}
+
+func TestMain(m *testing.M) {
+	store.RegisterAdapter(mem)
+	if err := store.Open(1, json.RawMessage(`{"uid_key":"la6YsO+bNX/+XIkOqc5Svw=="}`)); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestPrepareNotificationsSilent(test *testing.T) {
+	const (
+		active = t.Uid(101)
+		muted  = t.Uid(102)
+		online = t.Uid(103)
+	)
+	mem.devices[active] = []t.DeviceDef{{DeviceId: "active-android", Platform: "android"},
+		{DeviceId: "active-ios", Platform: "ios"}}
+	mem.devices[muted] = []t.DeviceDef{{DeviceId: "muted-android", Platform: "android"},
+		{DeviceId: "muted-ios", Platform: "ios"}}
+	mem.devices[online] = []t.DeviceDef{{DeviceId: "online-android", Platform: "android"}}
+
+	rcpt := &push.Receipt{
+		To: map[t.Uid]push.Recipient{
+			active: {Unread: 3},
+			muted:  {Unread: 5, Silent: true},
+			online: {Delivered: 1},
+		},
+		Payload: push.Payload{
+			What:      push.ActMsg,
+			Topic:     "grpAbcDef",
+			From:      "usrSender",
+			Timestamp: time.Now(),
+			SeqId:     12,
+			Content:   "hello",
+		},
+	}
+
+	messages := PrepareNotifications(rcpt, &AndroidConfig{Enabled: true})
+	if len(messages) != 5 {
+		test.Fatal("expected 5 messages, got", len(messages))
+	}
+
+	for _, md := range messages {
+		msg := md.Message
+		silent := md.Uid != active
+		if got := msg.Data["silent"] == "true"; got != silent {
+			test.Error(md.DeviceId, "silent data", msg.Data["silent"])
+		}
+		if got := msg.Notification != nil; got == silent {
+			test.Error(md.DeviceId, "notification", msg.Notification)
+		}
+		switch {
+		case msg.Android != nil:
+			if got := msg.Android.Notification != nil; got == silent {
+				test.Error(md.DeviceId, "android notification", msg.Android.Notification)
+			}
+		case msg.APNS != nil:
+			aps := msg.APNS.Payload.Aps
+			if got := aps.Alert != nil; got == silent {
+				test.Error(md.DeviceId, "apns alert", aps.Alert)
+			}
+			pushType := msg.APNS.Headers["apns-push-type"]
+			if silent && pushType != "background" {
+				test.Error(md.DeviceId, "apns-push-type", pushType)
+			}
+			// Badge is updated even if the notification is silent.
+			if aps.Badge == nil || *aps.Badge != rcpt.To[md.Uid].Unread {
+				test.Error(md.DeviceId, "badge", aps.Badge)
+			}
+		default:
+			test.Error(md.DeviceId, "neither android nor apns config")
+		}
+	}
+
+	// A silent receipt is silent for every recipient.
+	rcpt.Payload.Silent = true
+	for _, md := range PrepareNotifications(rcpt, &AndroidConfig{Enabled: true}) {
+		if md.Message.Notification != nil || md.Message.Data["silent"] != "true" {
+			test.Error(md.DeviceId, "visible notification in silent receipt")
+		}
+	}
+}
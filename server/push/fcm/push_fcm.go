@@ -36,6 +36,9 @@ const (
 	// Maximum length of a text message in runes. The message is clipped if length is exceeded.
 	// TODO: implement intelligent clipping of Drafty messages.
 	maxMessageLength = 80
+
+	// Maximum length of the value of apns-collapse-id header in bytes. APNs constant.
+	maxApnsCollapseIdLength = 64
 )
 
 // Handler represents the push handler; implements push.PushHandler interface.
@@ -120,6 +123,9 @@ func sendNotifications(rcpt *push.Receipt, config *configType) {
 	}
 
 	ctx := context.Background()
+	var sent, failed int
+	var cause error
+	retry := make(map[int]bool)
 	for i := 0; i < n; i += pushBatchSize {
 		upper := i + pushBatchSize
 		if upper > n {
@@ -131,16 +137,41 @@ func sendNotifications(rcpt *push.Receipt, config *configType) {
 		}
 		resp, err := handler.client.SendAll(ctx, batch)
 		if err != nil {
-			// Complete failure.
+			// Complete failure. Retry this and all remaining batches later.
 			log.Println("fcm SendAll failed", err)
+			for j := i; j < n; j++ {
+				retry[j] = true
+			}
+			cause = err
 			break
 		}
+		sent += resp.SuccessCount
 
 		// Check for partial failure.
-		if !handlePushErrors(resp, messages[i:upper]) {
+		transient, permanent, err := handlePushErrors(resp, messages[i:upper])
+		for _, j := range transient {
+			retry[i+j] = true
+		}
+		failed += permanent
+		if err != nil {
+			cause = err
+			// Stop processing remaining batches: retry them if the error is transient.
+			for j := upper; j < n; j++ {
+				if len(transient) > 0 {
+					retry[j] = true
+				} else {
+					failed++
+				}
+			}
 			break
 		}
 	}
+
+	push.ReportSent("fcm", sent)
+	push.ReportFailed("fcm", failed)
+	if len(retry) > 0 {
+		push.Requeue("fcm", rcpt, RetryRecipients(rcpt, messages, retry), cause)
+	}
 }
 
 func processSubscription(req *push.ChannelReq) {
@@ -171,19 +202,33 @@ func processSubscription(req *push.ChannelReq) {
 	}
 }
 
-// handlePushError processes errors returned by a call to fcm.SendAll.
-// returns false to stop further processing of other messages.
-func handlePushErrors(response *fcm.BatchResponse, batch []MessageData) bool {
+// handlePushErrors processes errors returned by a call to fcm.SendAll.
+// Returns indexes of messages which failed with transient errors and should be retried,
+// the number of messages which failed permanently, and an error to stop further processing
+// of other messages.
+func handlePushErrors(response *fcm.BatchResponse, batch []MessageData) ([]int, int, error) {
 	if response.FailureCount <= 0 {
-		return true
+		return nil, 0, nil
 	}
 
+	var transient []int
+	var permanent int
+	var stop error
 	for i, resp := range response.Responses {
-		if !handleFcmError(resp.Error, batch[i].Uid, batch[i].DeviceId) {
-			return false
+		if resp.Success {
+			continue
+		}
+		retry, ok := handleFcmError(resp.Error, batch[i].Uid, batch[i].DeviceId)
+		if retry {
+			transient = append(transient, i)
+		} else {
+			permanent++
+		}
+		if !ok {
+			stop = resp.Error
 		}
 	}
-	return true
+	return transient, permanent, stop
 }
 
 func handleSubErrors(response *fcm.TopicManagementResponse, uid types.Uid, devices []string) {
@@ -197,19 +242,22 @@ func handleSubErrors(response *fcm.TopicManagementResponse, uid types.Uid, devic
 	}
 }
 
-func handleFcmError(err error, uid types.Uid, deviceId string) bool {
+// handleFcmError processes an error of sending one message. Returns true as the first value if
+// the error is transient and the message should be retried, false as the second value to stop
+// further processing of other messages.
+func handleFcmError(err error, uid types.Uid, deviceId string) (bool, bool) {
 	if fcm.IsMessageRateExceeded(err) ||
 		fcm.IsServerUnavailable(err) ||
 		fcm.IsInternal(err) ||
 		fcm.IsUnknown(err) {
 		// Transient errors. Stop sending this batch.
 		log.Println("fcm transient failure", err)
-		return false
+		return true, false
 	}
 	if fcm.IsMismatchedCredential(err) || fcm.IsInvalidArgument(err) {
 		// Config errors
 		log.Println("fcm: request failed", err)
-		return false
+		return false, false
 	}
 
 	if fcm.IsRegistrationTokenNotRegistered(err) {
@@ -222,7 +270,7 @@ func handleFcmError(err error, uid types.Uid, deviceId string) bool {
 		// All other errors are treated as non-fatal.
 		log.Println("fcm error:", err)
 	}
-	return true
+	return false, true
 }
 
 // IsReady checks if the push handler has been initialized.
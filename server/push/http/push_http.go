@@ -0,0 +1,413 @@
+// Package http implements push notification plugin which posts notifications to an HTTP endpoint.
+// It can be used to connect custom notification gateways without writing Go code.
+package http
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+var handler Handler
+
+const (
+	// Size of the input channel buffer.
+	bufferSize = 1024
+
+	// Default number of receipts sent in one request.
+	defaultBatchSize = 1
+	// Default time to wait for a batch to fill up, in milliseconds.
+	defaultBatchDelay = 100
+	// Default number of requests sent concurrently.
+	defaultWorkers = 4
+	// Default request timeout.
+	defaultTimeout = 10 * time.Second
+
+	// Maximum size of the response to read.
+	maxResponseSize = 1 << 16
+
+	// Names of HTTP headers with the signature.
+	headerTimestamp = "X-Tinode-Timestamp"
+	headerSignature = "X-Tinode-Signature"
+)
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input   chan *push.Receipt
+	channel chan *push.ChannelReq
+	stop    chan bool
+	// Closed when all requests in flight are completed after stop.
+	done   chan struct{}
+	client *http.Client
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// URL to post notifications to.
+	Url string `json:"url"`
+	// Additional HTTP headers to send, e.g. Authorization.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Secret for HMAC-SHA256 signing of requests. Requests are not signed if the secret is empty.
+	HmacSecret string `json:"hmac_secret,omitempty"`
+	// Maximum number of receipts sent in one request.
+	BatchSize int `json:"batch_size,omitempty"`
+	// How long to wait for a batch to fill up, in milliseconds.
+	BatchDelay int `json:"batch_delay,omitempty"`
+	// Number of requests sent concurrently.
+	Workers int `json:"workers,omitempty"`
+	// Request timeout in seconds.
+	Timeout int `json:"timeout,omitempty"`
+	// Forward channel subscription requests too.
+	Channels bool `json:"channels,omitempty"`
+}
+
+// Device of the recipient.
+type device struct {
+	Id       string `json:"id"`
+	Platform string `json:"platform,omitempty"`
+	Lang     string `json:"lang,omitempty"`
+}
+
+// Recipient of the notification.
+type recipient struct {
+	// User ID 'usrXXX'.
+	User string `json:"user"`
+	// Count of user's sessions which received the message interactively.
+	Delivered int `json:"delivered"`
+	// Count of unread messages.
+	Unread int `json:"unread"`
+	// The notification should not be shown to the user.
+	Silent bool `json:"silent,omitempty"`
+	// All devices of the user except those which received the message interactively.
+	Devices []device `json:"devices,omitempty"`
+}
+
+// Notification is one push.Receipt as it's sent to the endpoint.
+type notification struct {
+	To      []recipient   `json:"to,omitempty"`
+	Channel string        `json:"channel,omitempty"`
+	Payload *push.Payload `json:"payload"`
+}
+
+// Channel subscription request as it's sent to the endpoint.
+type channelRequest struct {
+	User    string   `json:"user"`
+	Channel string   `json:"channel"`
+	Unsub   bool     `json:"unsub"`
+	Devices []device `json:"devices,omitempty"`
+}
+
+// Request body.
+type requestBody struct {
+	Notifications []*notification   `json:"notifications,omitempty"`
+	Channels      []*channelRequest `json:"channels,omitempty"`
+}
+
+// Batch of notifications and channel requests sent in one request.
+type batch struct {
+	body requestBody
+	// Receipts of the notifications in body to retry them on failure.
+	receipts []*push.Receipt
+}
+
+// Response body. All fields are optional.
+type responseBody struct {
+	// Devices which are no longer valid and should be deleted.
+	Invalid []struct {
+		User   string `json:"user"`
+		Device string `json:"device"`
+	} `json:"invalid"`
+}
+
+// Init initializes the push handler
+func (Handler) Init(jsonconf string) error {
+	var config configType
+	err := json.Unmarshal([]byte(jsonconf), &config)
+	if err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return nil
+	}
+
+	if u, err := url.Parse(config.Url); err != nil || !u.IsAbs() {
+		return errors.New("invalid url")
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.BatchDelay <= 0 {
+		config.BatchDelay = defaultBatchDelay
+	}
+	if config.Workers <= 0 {
+		config.Workers = defaultWorkers
+	}
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	handler.client = &http.Client{Timeout: timeout}
+
+	handler.input = make(chan *push.Receipt, bufferSize)
+	handler.channel = make(chan *push.ChannelReq, bufferSize)
+	handler.stop = make(chan bool, 1)
+	handler.done = make(chan struct{})
+
+	go worker(&config)
+
+	return nil
+}
+
+// worker collects notifications into batches and hands them to a fixed pool of senders. When all
+// senders are busy, the worker blocks and new notifications are queued or dropped by the server.
+func worker(config *configType) {
+	batches := make(chan *batch)
+	var wg sync.WaitGroup
+	for i := 0; i < config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				send(b, config)
+			}
+		}()
+	}
+
+	current := &batch{}
+	delay := time.Duration(config.BatchDelay) * time.Millisecond
+	timer := time.NewTimer(delay)
+	timer.Stop()
+	pending := false
+
+	flush := func() {
+		if pending {
+			timer.Stop()
+			pending = false
+		}
+		if len(current.body.Notifications) == 0 && len(current.body.Channels) == 0 {
+			return
+		}
+		batches <- current
+		current = &batch{}
+	}
+	added := func() {
+		if len(current.body.Notifications)+len(current.body.Channels) >= config.BatchSize {
+			flush()
+		} else if !pending {
+			timer.Reset(delay)
+			pending = true
+		}
+	}
+
+	for {
+		select {
+		case rcpt := <-handler.input:
+			if n := prepareNotification(rcpt); n != nil {
+				current.body.Notifications = append(current.body.Notifications, n)
+				current.receipts = append(current.receipts, rcpt)
+				added()
+			}
+		case req := <-handler.channel:
+			if config.Channels {
+				current.body.Channels = append(current.body.Channels, &channelRequest{
+					User:    req.Uid.UserId(),
+					Channel: req.Channel,
+					Unsub:   req.Unsub,
+					Devices: devicesForUsers(req.Uid)[req.Uid],
+				})
+				added()
+			}
+		case <-timer.C:
+			pending = false
+			flush()
+		case <-handler.stop:
+			// Complete requests in flight.
+			flush()
+			close(batches)
+			wg.Wait()
+			close(handler.done)
+			return
+		}
+	}
+}
+
+// devicesForUsers loads devices of the given users.
+func devicesForUsers(uids ...t.Uid) map[t.Uid][]device {
+	all, count, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		log.Println("http push: db error", err)
+		return nil
+	}
+	if count == 0 {
+		return nil
+	}
+
+	result := make(map[t.Uid][]device, len(all))
+	for uid, devs := range all {
+		for _, d := range devs {
+			result[uid] = append(result[uid], device{Id: d.DeviceId, Platform: d.Platform, Lang: d.Lang})
+		}
+	}
+	return result
+}
+
+// prepareNotification converts the receipt to the notification adding device IDs of recipients.
+func prepareNotification(rcpt *push.Receipt) *notification {
+	n := &notification{Channel: rcpt.Channel, Payload: &rcpt.Payload}
+	if len(rcpt.To) == 0 {
+		if rcpt.Channel == "" {
+			return nil
+		}
+		return n
+	}
+
+	uids := make([]t.Uid, 0, len(rcpt.To))
+	for uid := range rcpt.To {
+		uids = append(uids, uid)
+	}
+	devices := devicesForUsers(uids...)
+
+	for uid, to := range rcpt.To {
+		// Skip devices which received the message interactively.
+		skip := make(map[string]bool, len(to.Devices))
+		for _, id := range to.Devices {
+			skip[id] = true
+		}
+		r := recipient{User: uid.UserId(), Delivered: to.Delivered, Unread: to.Unread, Silent: to.Silent}
+		for _, d := range devices[uid] {
+			if !skip[d.Id] {
+				r.Devices = append(r.Devices, d)
+			}
+		}
+		n.To = append(n.To, r)
+	}
+	return n
+}
+
+// sign returns the HMAC-SHA256 signature of the timestamp and the body.
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// send posts the batch to the endpoint. Notifications which failed with a transient error are
+// retried later through the push queue. Channel requests are not retried.
+func send(b *batch, config *configType) {
+	body, err := json.Marshal(&b.body)
+	if err != nil {
+		log.Println("http push: failed to serialize request", err)
+		push.ReportFailed("http", len(b.receipts))
+		return
+	}
+
+	retry, err := post(body, config)
+	if err == nil {
+		push.ReportSent("http", len(b.receipts))
+		return
+	}
+	if !retry {
+		log.Println("http push: request failed, dropping", len(b.receipts), "notifications:", err)
+		push.ReportFailed("http", len(b.receipts))
+		return
+	}
+	for _, rcpt := range b.receipts {
+		push.Requeue("http", rcpt, rcpt.To, err)
+	}
+}
+
+// post makes one attempt to deliver the request. Returns retry = true if the error is transient.
+func post(body []byte, config *configType) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, config.Url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	for key, val := range config.Headers {
+		req.Header.Set(key, val)
+	}
+	if config.HmacSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(headerTimestamp, timestamp)
+		req.Header.Set(headerSignature, sign(config.HmacSecret, timestamp, body))
+	}
+
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		err = fmt.Errorf("endpoint responded %d: %s", resp.StatusCode, string(respBody))
+		// Request timeout, rate limiting and server errors are transient.
+		retry := resp.StatusCode == http.StatusRequestTimeout ||
+			resp.StatusCode == http.StatusTooManyRequests ||
+			resp.StatusCode >= http.StatusInternalServerError
+		return retry, err
+	}
+
+	if len(respBody) > 0 {
+		var result responseBody
+		if err := json.Unmarshal(respBody, &result); err != nil {
+			log.Println("http push: invalid response", err)
+			return false, nil
+		}
+		for _, inv := range result.Invalid {
+			uid := t.ParseUserId(inv.User)
+			if uid.IsZero() || inv.Device == "" {
+				continue
+			}
+			if err := store.Devices.Delete(uid, inv.Device); err != nil {
+				log.Println("http push: failed to delete invalid device", err)
+			}
+		}
+	}
+	return false, nil
+}
+
+// IsReady checks if the push handler has been initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Channel returns a channel for subscribing/unsubscribing devices to channels.
+func (Handler) Channel() chan<- *push.ChannelReq {
+	return handler.channel
+}
+
+// Stop shuts down the handler. It waits for requests in flight to complete.
+func (Handler) Stop() {
+	handler.stop <- true
+	<-handler.done
+}
+
+func init() {
+	push.Register("http", &handler)
+}
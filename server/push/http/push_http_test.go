@@ -0,0 +1,344 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	adapter "github.com/tinode/chat/server/db"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// memAdapter serves devices and keeps the push queue in memory. Methods which are not used by
+// the handler are not implemented.
+type memAdapter struct {
+	adapter.Adapter
+	sync.Mutex
+	open    bool
+	devices map[t.Uid][]t.DeviceDef
+	deleted []string
+	outbox  []t.OutboxMessage
+}
+
+func (a *memAdapter) GetName() string                   { return "mem" }
+func (a *memAdapter) IsOpen() bool                      { return a.open }
+func (a *memAdapter) SetMaxResults(val int) error       { return nil }
+func (a *memAdapter) Open(config json.RawMessage) error { a.open = true; return nil }
+func (a *memAdapter) CheckDbVersion() error             { return nil }
+
+func (a *memAdapter) DeviceGetAll(uids ...t.Uid) (map[t.Uid][]t.DeviceDef, int, error) {
+	a.Lock()
+	defer a.Unlock()
+	result := make(map[t.Uid][]t.DeviceDef)
+	count := 0
+	for _, uid := range uids {
+		if devs, ok := a.devices[uid]; ok {
+			result[uid] = devs
+			count += len(devs)
+		}
+	}
+	return result, count, nil
+}
+
+func (a *memAdapter) DeviceDelete(uid t.Uid, deviceID string) error {
+	a.Lock()
+	defer a.Unlock()
+	a.deleted = append(a.deleted, uid.UserId()+"/"+deviceID)
+	return nil
+}
+
+func (a *memAdapter) OutboxAdd(msg *t.OutboxMessage) error {
+	a.Lock()
+	defer a.Unlock()
+	a.outbox = append(a.outbox, *msg)
+	return nil
+}
+
+func (a *memAdapter) OutboxCount(channel string) (int, error) {
+	a.Lock()
+	defer a.Unlock()
+	return len(a.outbox), nil
+}
+
+// reset clears messages in the outbox and deleted devices.
+func (a *memAdapter) reset() {
+	a.Lock()
+	defer a.Unlock()
+	a.deleted = nil
+	a.outbox = nil
+}
+
+var mem = &memAdapter{devices: make(map[t.Uid][]t.DeviceDef)}
+
+// Values of metrics reported by the handler.
+var stats = struct {
+	sync.Mutex
+	values map[string]int
+}{values: make(map[string]int)}
+
+func stat(name string) int {
+	stats.Lock()
+	defer stats.Unlock()
+	return stats.values[name]
+}
+
+func TestMain(m *testing.M) {
+	store.RegisterAdapter(mem)
+	if err := store.Open(1, json.RawMessage(`{"uid_key":"la6YsO+bNX/+XIkOqc5Svw=="}`)); err != nil {
+		log.Fatal(err)
+	}
+	push.StatsInc = func(name string, val int) {
+		stats.Lock()
+		stats.values[name] += val
+		stats.Unlock()
+	}
+	// Retries are scheduled far enough in the future to not be delivered during the test.
+	if err := push.InitQueue(`{"enabled":true,"initial_backoff":600,"poll_interval":3600}`); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+// endpointRequest is a request received by the fake endpoint.
+type endpointRequest struct {
+	header http.Header
+	raw    []byte
+	body   requestBody
+}
+
+// newTestHandler initializes the handler to post to a fake endpoint. The endpoint responds with
+// the status and body returned by respond. Received requests are sent to the returned channel.
+func newTestHandler(test *testing.T, config map[string]interface{},
+	respond func() (int, string)) <-chan *endpointRequest {
+
+	requests := make(chan *endpointRequest, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &endpointRequest{header: r.Header}
+		req.raw, _ = ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(req.raw, &req.body); err != nil {
+			test.Error("invalid request", err)
+		}
+		requests <- req
+		if respond != nil {
+			status, body := respond()
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}
+	}))
+	test.Cleanup(srv.Close)
+
+	config["enabled"] = true
+	config["url"] = srv.URL
+	config["timeout"] = 5
+	conf, _ := json.Marshal(config)
+	if err := handler.Init(string(conf)); err != nil {
+		test.Fatal(err)
+	}
+	mem.reset()
+	return requests
+}
+
+func receipt(seq int, to ...t.Uid) *push.Receipt {
+	rcpt := &push.Receipt{
+		To: make(map[t.Uid]push.Recipient),
+		Payload: push.Payload{
+			What:      push.ActMsg,
+			Topic:     "grpAbcDef",
+			From:      "usrSender",
+			Timestamp: time.Now(),
+			SeqId:     seq,
+			Content:   "hello",
+		},
+	}
+	for _, uid := range to {
+		rcpt.To[uid] = push.Recipient{Unread: seq}
+	}
+	return rcpt
+}
+
+func nextRequest(test *testing.T, requests <-chan *endpointRequest) *endpointRequest {
+	select {
+	case req := <-requests:
+		return req
+	case <-time.After(5 * time.Second):
+		test.Fatal("request not received")
+	}
+	return nil
+}
+
+func TestBatching(test *testing.T) {
+	const (
+		alice = t.Uid(101)
+		bob   = t.Uid(102)
+	)
+	mem.devices[alice] = []t.DeviceDef{{DeviceId: "alice-phone", Platform: "android", Lang: "en"},
+		{DeviceId: "alice-tablet", Platform: "ios"}}
+	mem.devices[bob] = []t.DeviceDef{{DeviceId: "bob-phone", Platform: "android"}}
+
+	requests := newTestHandler(test, map[string]interface{}{"batch_size": 3, "batch_delay": 50, "workers": 1}, nil)
+
+	first := receipt(1, alice, bob)
+	first.To[alice] = push.Recipient{Unread: 1, Delivered: 1, Devices: []string{"alice-tablet"}}
+	handler.Push() <- first
+	handler.Push() <- receipt(2, alice)
+	handler.Push() <- receipt(3, bob)
+
+	// The batch is sent when it's full.
+	req := nextRequest(test, requests)
+	if len(req.body.Notifications) != 3 {
+		test.Fatal("expected 3 notifications, got", len(req.body.Notifications))
+	}
+	if ct := req.header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		test.Error("content type", ct)
+	}
+	n := req.body.Notifications[0]
+	if n.Payload.SeqId != 1 || n.Payload.Topic != "grpAbcDef" || len(n.To) != 2 {
+		test.Fatal("notification", n)
+	}
+	for _, r := range n.To {
+		switch r.User {
+		case alice.UserId():
+			// Device which received the message interactively is skipped.
+			if r.Delivered != 1 || len(r.Devices) != 1 || r.Devices[0].Id != "alice-phone" ||
+				r.Devices[0].Platform != "android" || r.Devices[0].Lang != "en" {
+				test.Error("recipient", r)
+			}
+		case bob.UserId():
+			if r.Delivered != 0 || len(r.Devices) != 1 || r.Devices[0].Id != "bob-phone" {
+				test.Error("recipient", r)
+			}
+		default:
+			test.Error("unexpected recipient", r.User)
+		}
+	}
+
+	// Incomplete batch is sent after the delay.
+	handler.Push() <- receipt(4, alice)
+	req = nextRequest(test, requests)
+	if len(req.body.Notifications) != 1 || req.body.Notifications[0].Payload.SeqId != 4 {
+		test.Error("delayed batch", req.body.Notifications)
+	}
+
+	handler.Stop()
+	if len(mem.outbox) != 0 {
+		test.Error("notifications queued for retry", len(mem.outbox))
+	}
+}
+
+func TestSigning(test *testing.T) {
+	const secret = "test-secret"
+	requests := newTestHandler(test, map[string]interface{}{
+		"hmac_secret": secret,
+		"headers":     map[string]string{"Authorization": "Bearer test-token"},
+	}, nil)
+
+	handler.Push() <- receipt(1, t.Uid(201))
+	req := nextRequest(test, requests)
+	handler.Stop()
+
+	if auth := req.header.Get("Authorization"); auth != "Bearer test-token" {
+		test.Error("authorization", auth)
+	}
+	timestamp := req.header.Get(headerTimestamp)
+	if ts, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Now().Unix()-ts > 5 {
+		test.Error("timestamp", timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(req.raw)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if sig := req.header.Get(headerSignature); !hmac.Equal([]byte(sig), []byte(expected)) {
+		test.Error("signature", sig, "expected", expected)
+	}
+
+	// Requests are not signed without the secret.
+	requests = newTestHandler(test, map[string]interface{}{}, nil)
+	handler.Push() <- receipt(2, t.Uid(201))
+	req = nextRequest(test, requests)
+	handler.Stop()
+	if req.header.Get(headerSignature) != "" || req.header.Get(headerTimestamp) != "" {
+		test.Error("unsigned request has signature headers")
+	}
+}
+
+func TestTransientFailure(test *testing.T) {
+	const user = t.Uid(301)
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		requests := newTestHandler(test, map[string]interface{}{"batch_size": 2},
+			func() (int, string) { return status, "try later" })
+		failed := stat("PushHttpFailed")
+
+		handler.Push() <- receipt(1, user)
+		handler.Push() <- receipt(2, user)
+		nextRequest(test, requests)
+		handler.Stop()
+
+		// Each notification of the batch is queued for retry.
+		if len(mem.outbox) != 2 {
+			test.Fatal(status, "expected 2 queued notifications, got", len(mem.outbox))
+		}
+		for _, msg := range mem.outbox {
+			if msg.Channel != "push:http" || !msg.NextAttemptAt.After(time.Now()) {
+				test.Error(status, "queued notification", msg.Channel, msg.NextAttemptAt)
+			}
+			var queued struct {
+				Attempt int                       `json:"attempt"`
+				To      map[string]push.Recipient `json:"to"`
+			}
+			json.Unmarshal(msg.Content, &queued)
+			if _, ok := queued.To[user.UserId()]; queued.Attempt != 1 || !ok {
+				test.Error(status, "queued receipt", string(msg.Content))
+			}
+		}
+		if stat("PushHttpFailed") != failed {
+			test.Error(status, "transient failure reported as permanent")
+		}
+	}
+}
+
+func TestPermanentFailure(test *testing.T) {
+	const user = t.Uid(401)
+	requests := newTestHandler(test, map[string]interface{}{"batch_size": 2},
+		func() (int, string) { return http.StatusBadRequest, "bad request" })
+	failed := stat("PushHttpFailed")
+
+	handler.Push() <- receipt(1, user)
+	handler.Push() <- receipt(2, user)
+	nextRequest(test, requests)
+	handler.Stop()
+
+	if len(mem.outbox) != 0 {
+		test.Error("permanent failure queued for retry", len(mem.outbox))
+	}
+	if got := stat("PushHttpFailed") - failed; got != 2 {
+		test.Error("failed notifications", got)
+	}
+
+	// Devices reported as invalid are deleted.
+	requests = newTestHandler(test, map[string]interface{}{}, func() (int, string) {
+		return http.StatusOK, `{"invalid":[{"user":"` + user.UserId() + `","device":"stale"},{"user":"bad","device":"x"}]}`
+	})
+	sent := stat("PushHttpSent")
+	handler.Push() <- receipt(3, user)
+	nextRequest(test, requests)
+	handler.Stop()
+
+	if len(mem.deleted) != 1 || mem.deleted[0] != user.UserId()+"/stale" {
+		test.Error("deleted devices", mem.deleted)
+	}
+	if stat("PushHttpSent")-sent != 1 {
+		test.Error("sent notifications", stat("PushHttpSent")-sent)
+	}
+}
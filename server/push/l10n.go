@@ -0,0 +1,146 @@
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	textt "text/template"
+
+	"github.com/tinode/chat/server/drafty"
+	i18n "golang.org/x/text/language"
+)
+
+// Templates used when localized templates are not configured.
+const defaultTemplates = `
+{{define "msg_title"}}New message{{end}}
+{{define "msg_body"}}{{.Content}}{{end}}
+{{define "sub_title"}}New chat{{end}}
+{{define "sub_body"}}You were invited to a new chat{{end}}
+{{define "image"}}[image]{{end}}
+{{define "file"}}[file]{{end}}
+`
+
+// Configuration of localized notification texts.
+type l10nConfig struct {
+	// List of languages supported by templates.
+	Languages []string `json:"languages"`
+	// Path to templates, e.g. "./templ/push-{{.Language}}.templ".
+	Templ string `json:"templ"`
+}
+
+// Parameters available to templates.
+type templateParams struct {
+	// Plain text preview of the message.
+	Content string
+}
+
+var l10n struct {
+	// Must use index into language array instead of language tags because language.Matcher is brain damaged:
+	// https://github.com/golang/go/issues/24211
+	templates   []*textt.Template
+	langMatcher i18n.Matcher
+}
+
+func init() {
+	l10n.templates = []*textt.Template{textt.Must(textt.New("push").Parse(defaultTemplates))}
+}
+
+// InitL10n loads templates of localized notification texts.
+func InitL10n(jsconfig string) error {
+	var config l10nConfig
+	if jsconfig == "" || jsconfig == "null" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(jsconfig), &config); err != nil {
+		return errors.New("failed to parse push l10n config: " + err.Error())
+	}
+	if config.Templ == "" {
+		return nil
+	}
+
+	path := config.Templ
+	// If a relative path is provided, resolve it relative to the exec file location.
+	if !filepath.IsAbs(path) {
+		if basepath, err := os.Executable(); err == nil {
+			path = filepath.Join(filepath.Dir(basepath), path)
+		}
+	}
+	pt, err := textt.New("path").Parse(path)
+	if err != nil {
+		return err
+	}
+
+	languages := config.Languages
+	if len(languages) == 0 {
+		// No i18n support. Use defaults.
+		languages = []string{""}
+	}
+
+	templates := make([]*textt.Template, len(languages))
+	var langTags []i18n.Tag
+	buffer := bytes.Buffer{}
+	for idx, lang := range languages {
+		buffer.Reset()
+		if err = pt.Execute(&buffer, map[string]interface{}{"Language": lang}); err != nil {
+			return err
+		}
+		if templates[idx], err = textt.ParseFiles(buffer.String()); err != nil {
+			return fmt.Errorf("reading %s: %w", buffer.String(), err)
+		}
+		if lang != "" {
+			tag, err := i18n.Parse(lang)
+			if err != nil {
+				return err
+			}
+			langTags = append(langTags, tag)
+		}
+	}
+
+	l10n.templates = templates
+	if len(langTags) > 0 {
+		l10n.langMatcher = i18n.NewMatcher(langTags)
+	}
+	return nil
+}
+
+// execTemplate renders the named template. Leading and trailing whitespace is removed.
+// An empty string is returned if the template is not defined.
+func execTemplate(templ *textt.Template, name string, params *templateParams) string {
+	if templ.Lookup(name) == nil {
+		return ""
+	}
+	buffer := bytes.Buffer{}
+	if err := templ.ExecuteTemplate(&buffer, name, params); err != nil {
+		log.Println("push: failed to render template", name, err)
+		return ""
+	}
+	return strings.TrimSpace(buffer.String())
+}
+
+// Localize renders the title and the body of the notification in the given language, e.g. "en-US".
+// Message content is rendered as a plain text preview clipped to maxLength runes. Empty strings
+// are returned if the notification has no visible text.
+func (p *Payload) Localize(lang string, maxLength int) (string, string) {
+	templ := l10n.templates[0]
+	if l10n.langMatcher != nil && lang != "" {
+		_, idx := i18n.MatchStrings(l10n.langMatcher, lang)
+		templ = l10n.templates[idx]
+	}
+
+	var params templateParams
+	if p.What == ActMsg {
+		var err error
+		params.Content, err = drafty.Preview(p.Content, maxLength,
+			execTemplate(templ, "image", nil), execTemplate(templ, "file", nil))
+		if err != nil {
+			log.Println("push: failed to render message preview", err)
+		}
+	}
+
+	return execTemplate(templ, p.What+"_title", &params), execTemplate(templ, p.What+"_body", &params)
+}
@@ -0,0 +1,350 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types.
+const (
+	packetConnect    = 1
+	packetConnack    = 2
+	packetPublish    = 3
+	packetPuback     = 4
+	packetPubrec     = 5
+	packetPubrel     = 6
+	packetPubcomp    = 7
+	packetPingreq    = 12
+	packetPingresp   = 13
+	packetDisconnect = 14
+)
+
+// Protocol level of MQTT 3.1.1.
+const protocolLevel = 4
+
+// Maximum value of the remaining length field.
+const maxRemainingLength = 268435455
+
+var errConnectionClosed = errors.New("connection closed")
+
+// Reasons of rejected connections by CONNACK return code.
+var connackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// client is a minimal MQTT 3.1.1 client which can only publish messages.
+type client struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	// Guards writes to conn, packet IDs and waiters.
+	mu     sync.Mutex
+	nextId uint16
+	// Waiters for the final acknowledgement of QoS 1 and 2 messages keyed by packet ID.
+	acks map[uint16]chan struct{}
+
+	// Closed when the connection is lost.
+	done chan struct{}
+	err  error
+}
+
+// dial connects to the broker and performs the MQTT handshake.
+func dial(config *configType, tlsConfig *tls.Config) (*client, error) {
+	dialer := &net.Dialer{Timeout: config.timeout}
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", config.address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", config.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, config)
+}
+
+// newClient performs the MQTT handshake over the connection and starts reading acknowledgements.
+func newClient(conn net.Conn, config *configType) (*client, error) {
+	c := &client{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: config.timeout,
+		acks:    make(map[uint16]chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	conn.SetDeadline(time.Now().Add(config.timeout))
+	if err := c.connect(config); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	go c.readLoop()
+
+	return c, nil
+}
+
+// connect sends CONNECT and waits for CONNACK.
+func (c *client) connect(config *configType) error {
+	var flags byte = 0x02 // Clean session.
+	if config.Username != "" {
+		flags |= 0x80
+		if config.Password != "" {
+			flags |= 0x40
+		}
+	}
+
+	body := appendString(nil, "MQTT")
+	body = append(body, protocolLevel, flags)
+	body = appendUint16(body, uint16(config.KeepAlive))
+	body = appendString(body, config.ClientId)
+	if config.Username != "" {
+		body = appendString(body, config.Username)
+		if config.Password != "" {
+			body = appendString(body, config.Password)
+		}
+	}
+	if err := c.write(packetConnect<<4, body); err != nil {
+		return err
+	}
+
+	header, body, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if header>>4 != packetConnack || len(body) != 2 {
+		return errors.New("unexpected response to CONNECT")
+	}
+	if body[1] != 0 {
+		reason, ok := connackErrors[body[1]]
+		if !ok {
+			reason = fmt.Sprintf("return code %d", body[1])
+		}
+		return errors.New("connection refused: " + reason)
+	}
+	return nil
+}
+
+// delivery is a QoS 1 or 2 message waiting for the final acknowledgement.
+type delivery struct {
+	id  uint16
+	ack chan struct{}
+}
+
+// send writes the message to the connection without waiting for the acknowledgement. Returns nil
+// delivery if qos is 0. Many messages can be sent before waiting for their acknowledgements.
+func (c *client) send(topic string, payload []byte, qos byte, retain bool) (*delivery, error) {
+	header := byte(packetPublish<<4) | qos<<1
+	if retain {
+		header |= 0x01
+	}
+
+	body := appendString(nil, topic)
+	var d *delivery
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if qos > 0 {
+		c.nextId++
+		if c.nextId == 0 {
+			// Zero packet ID is not allowed.
+			c.nextId = 1
+		}
+		d = &delivery{id: c.nextId, ack: make(chan struct{})}
+		c.acks[d.id] = d.ack
+		body = appendUint16(body, d.id)
+	}
+	body = append(body, payload...)
+	if err := c.writeLocked(header, body); err != nil {
+		if d != nil {
+			delete(c.acks, d.id)
+		}
+		return nil, err
+	}
+	return d, nil
+}
+
+// wait waits for the acknowledgement of the sent message until the deadline.
+func (c *client) wait(d *delivery, deadline time.Time) error {
+	if d == nil {
+		return nil
+	}
+
+	// Check the acknowledgement first: it may have arrived after the deadline has passed.
+	select {
+	case <-d.ack:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-d.ack:
+		return nil
+	case <-c.done:
+		return c.err
+	case <-timer.C:
+		c.mu.Lock()
+		delete(c.acks, d.id)
+		c.mu.Unlock()
+		return errors.New("timeout waiting for acknowledgement")
+	}
+}
+
+// ping sends PINGREQ to keep the connection alive.
+func (c *client) ping() error {
+	return c.write(packetPingreq<<4, nil)
+}
+
+// disconnect gracefully closes the connection.
+func (c *client) disconnect() {
+	c.write(packetDisconnect<<4, nil)
+	c.conn.Close()
+	<-c.done
+}
+
+// isClosed checks if the connection is lost.
+func (c *client) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// readLoop reads acknowledgements from the broker until the connection is closed.
+func (c *client) readLoop() {
+	var err error
+	for err == nil {
+		var header byte
+		var body []byte
+		header, body, err = c.readPacket()
+		if err != nil {
+			break
+		}
+
+		switch header >> 4 {
+		case packetPuback, packetPubcomp:
+			if len(body) >= 2 {
+				c.acknowledge(binary.BigEndian.Uint16(body))
+			}
+		case packetPubrec:
+			// Second step of QoS 2 delivery.
+			if len(body) >= 2 {
+				err = c.write(packetPubrel<<4|0x02, body[:2])
+			}
+		case packetPingresp, packetPublish:
+			// Nothing to do: the client does not subscribe to topics.
+		default:
+			err = fmt.Errorf("unexpected packet type %d", header>>4)
+		}
+	}
+
+	c.conn.Close()
+	if err == io.EOF {
+		err = errConnectionClosed
+	}
+	c.err = err
+	close(c.done)
+}
+
+// acknowledge notifies the waiter that the message has been delivered.
+func (c *client) acknowledge(id uint16) {
+	c.mu.Lock()
+	if ack, ok := c.acks[id]; ok {
+		delete(c.acks, id)
+		close(ack)
+	}
+	c.mu.Unlock()
+}
+
+// readPacket reads one control packet: the first byte of the fixed header and the rest of the packet.
+func (c *client) readPacket() (byte, []byte, error) {
+	header, err := c.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Remaining length is encoded as a variable length integer of up to 4 bytes.
+	var length, shift int
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+
+	body := make([]byte, length)
+	if _, err = io.ReadFull(c.reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func (c *client) write(header byte, body []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeLocked(header, body)
+}
+
+// writeLocked writes one control packet. The caller must hold the lock.
+func (c *client) writeLocked(header byte, body []byte) error {
+	if len(body) > maxRemainingLength {
+		return errors.New("packet too large")
+	}
+
+	packet := make([]byte, 0, len(body)+5)
+	packet = append(packet, header)
+	length := len(body)
+	for {
+		b := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+// appendString appends a length-prefixed UTF-8 string.
+func appendString(buf []byte, str string) []byte {
+	buf = appendUint16(buf, uint16(len(str)))
+	return append(buf, str...)
+}
+
+func appendUint16(buf []byte, val uint16) []byte {
+	return append(buf, byte(val>>8), byte(val))
+}
@@ -0,0 +1,255 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeBroker is the broker side of the connection. It reuses the client's packet framing.
+type fakeBroker struct {
+	*client
+	t *testing.T
+}
+
+// packet reads the next packet and checks its type.
+func (b *fakeBroker) packet(typ byte) (byte, []byte) {
+	header, body, err := b.readPacket()
+	if err != nil {
+		b.t.Errorf("broker: failed to read packet: %v", err)
+		return 0, nil
+	}
+	if header>>4 != typ {
+		b.t.Errorf("broker: packet type %d, expected %d", header>>4, typ)
+	}
+	return header, body
+}
+
+func (b *fakeBroker) reply(header byte, body []byte) {
+	if err := b.write(header, body); err != nil {
+		b.t.Errorf("broker: failed to write packet: %v", err)
+	}
+}
+
+// publishPacket reads a PUBLISH packet and parses it.
+func (b *fakeBroker) publishPacket() (qos byte, retain bool, topic string, id uint16, payload []byte) {
+	header, body := b.packet(packetPublish)
+	if len(body) < 2 {
+		b.t.Error("broker: PUBLISH is too short")
+		return
+	}
+	qos = (header >> 1) & 0x03
+	retain = header&0x01 != 0
+	length := int(binary.BigEndian.Uint16(body))
+	topic = string(body[2 : 2+length])
+	payload = body[2+length:]
+	if qos > 0 {
+		id = binary.BigEndian.Uint16(payload)
+		payload = payload[2:]
+	}
+	return
+}
+
+func testConfig() *configType {
+	return &configType{
+		ClientId:  "tinode-test",
+		Username:  "user",
+		Password:  "secret",
+		KeepAlive: 60,
+		timeout:   time.Second,
+	}
+}
+
+// testConnect connects the client to the fake broker. The broker accepts the connection
+// after checking the CONNECT packet.
+func testConnect(t *testing.T) (*client, *fakeBroker) {
+	cliConn, brkConn := net.Pipe()
+	broker := &fakeBroker{
+		client: &client{conn: brkConn, reader: bufio.NewReader(brkConn), timeout: time.Second},
+		t:      t,
+	}
+
+	go func() {
+		_, body := broker.packet(packetConnect)
+		expected := []byte{0, 4, 'M', 'Q', 'T', 'T', protocolLevel, 0x80 | 0x40 | 0x02, 0, 60}
+		expected = appendString(expected, "tinode-test")
+		expected = appendString(expected, "user")
+		expected = appendString(expected, "secret")
+		if !bytes.Equal(body, expected) {
+			t.Errorf("broker: CONNECT %v, expected %v", body, expected)
+		}
+		broker.reply(packetConnack<<4, []byte{0, 0})
+	}()
+
+	c, err := newClient(cliConn, testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, broker
+}
+
+func TestConnectRefused(t *testing.T) {
+	cliConn, brkConn := net.Pipe()
+	broker := &fakeBroker{
+		client: &client{conn: brkConn, reader: bufio.NewReader(brkConn), timeout: time.Second},
+		t:      t,
+	}
+	go func() {
+		broker.packet(packetConnect)
+		broker.reply(packetConnack<<4, []byte{0, 5})
+	}()
+
+	_, err := newClient(cliConn, testConfig())
+	if err == nil || err.Error() != "connection refused: not authorized" {
+		t.Errorf("expected refused connection, got %v", err)
+	}
+}
+
+func TestPublishQoS0Retain(t *testing.T) {
+	c, broker := testConnect(t)
+	defer broker.conn.Close()
+
+	received := make(chan struct{})
+	go func() {
+		qos, retain, topic, _, payload := broker.publishPacket()
+		if qos != 0 || !retain || topic != "tinode/usr1/badge" || string(payload) != `{"unread":3}` {
+			t.Errorf("broker: unexpected PUBLISH qos=%d retain=%v topic=%s payload=%s", qos, retain, topic, payload)
+		}
+		close(received)
+	}()
+
+	d, err := c.send("tinode/usr1/badge", []byte(`{"unread":3}`), 0, true)
+	if err != nil || d != nil {
+		t.Fatalf("QoS 0 send: %v, %v", d, err)
+	}
+	if err = c.wait(d, time.Now().Add(time.Second)); err != nil {
+		t.Error(err)
+	}
+	<-received
+}
+
+func TestPublishQoS1(t *testing.T) {
+	c, broker := testConnect(t)
+	defer broker.conn.Close()
+
+	go func() {
+		qos, retain, topic, id, payload := broker.publishPacket()
+		if qos != 1 || retain || topic != "tinode/usr1" || id == 0 || string(payload) != "hello" {
+			t.Errorf("broker: unexpected PUBLISH qos=%d retain=%v topic=%s id=%d payload=%s",
+				qos, retain, topic, id, payload)
+		}
+		broker.reply(packetPuback<<4, appendUint16(nil, id))
+	}()
+
+	d, err := c.send("tinode/usr1", []byte("hello"), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.wait(d, time.Now().Add(time.Second)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPublishQoS2(t *testing.T) {
+	c, broker := testConnect(t)
+	defer broker.conn.Close()
+
+	go func() {
+		qos, _, _, id, _ := broker.publishPacket()
+		if qos != 2 {
+			t.Errorf("broker: qos=%d, expected 2", qos)
+		}
+		broker.reply(packetPubrec<<4, appendUint16(nil, id))
+		// PUBREL has the reserved flags set to 0010.
+		header, body := broker.packet(packetPubrel)
+		if header != packetPubrel<<4|0x02 || binary.BigEndian.Uint16(body) != id {
+			t.Errorf("broker: unexpected PUBREL %#x %v", header, body)
+		}
+		broker.reply(packetPubcomp<<4, appendUint16(nil, id))
+	}()
+
+	d, err := c.send("tinode/usr1", []byte("hello"), 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.wait(d, time.Now().Add(time.Second)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPublishPipelined(t *testing.T) {
+	c, broker := testConnect(t)
+	defer broker.conn.Close()
+
+	const count = 3
+	go func() {
+		// Acknowledge messages in reverse order after all of them are received.
+		var ids []uint16
+		for i := 0; i < count; i++ {
+			_, _, _, id, _ := broker.publishPacket()
+			ids = append(ids, id)
+		}
+		for i := len(ids) - 1; i >= 0; i-- {
+			broker.reply(packetPuback<<4, appendUint16(nil, ids[i]))
+		}
+	}()
+
+	var deliveries []*delivery
+	for i := 0; i < count; i++ {
+		d, err := c.send("tinode/usr1", []byte("hello"), 1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	deadline := time.Now().Add(time.Second)
+	for _, d := range deliveries {
+		if err := c.wait(d, deadline); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPublishTimeout(t *testing.T) {
+	c, broker := testConnect(t)
+	defer broker.conn.Close()
+
+	go broker.publishPacket()
+
+	d, err := c.send("tinode/usr1", []byte("hello"), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.wait(d, time.Now().Add(50*time.Millisecond)); err == nil {
+		t.Error("expected timeout")
+	}
+	c.mu.Lock()
+	waiters := len(c.acks)
+	c.mu.Unlock()
+	if waiters != 0 {
+		t.Errorf("%d waiters left after timeout", waiters)
+	}
+}
+
+func TestConnectionLost(t *testing.T) {
+	c, broker := testConnect(t)
+
+	go func() {
+		broker.publishPacket()
+		broker.conn.Close()
+	}()
+
+	d, err := c.send("tinode/usr1", []byte("hello"), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.wait(d, time.Now().Add(time.Second)); err != errConnectionClosed {
+		t.Errorf("expected errConnectionClosed, got %v", err)
+	}
+	if !c.isClosed() {
+		t.Error("expected the connection to be closed")
+	}
+}
@@ -0,0 +1,364 @@
+// Package mqtt implements push notification plugin which publishes notifications to an MQTT broker.
+// It's intended for clients which cannot use FCM or APNs, like kiosks and embedded devices:
+// each user's notifications are published to a per-user MQTT topic.
+package mqtt
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+var handler Handler
+
+const (
+	// Size of the input channel buffer.
+	bufferSize = 1024
+
+	// Default prefix of per-user topics.
+	defaultTopicPrefix = "tinode/"
+	// Default keep alive interval.
+	defaultKeepAlive = 60 * time.Second
+	// Default timeout of network operations.
+	defaultTimeout = 10 * time.Second
+	// Maximum delay between attempts to reconnect to the broker.
+	maxReconnectDelay = time.Minute
+
+	// Suffix of the retained topic with the count of unread messages.
+	badgeTopicSuffix = "/badge"
+)
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input   chan *push.Receipt
+	channel chan *push.ChannelReq
+	stop    chan bool
+}
+
+type tlsConfig struct {
+	// Path to the PEM-encoded CA certificate(s) to verify the broker. System CAs are used if empty.
+	CaFile string `json:"ca_file,omitempty"`
+	// Paths to the PEM-encoded client certificate and key for mutual TLS.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// Don't verify the broker's certificate, for testing only.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Broker address, e.g. "tcp://localhost:1883" or "ssl://mqtt.example.com:8883".
+	Broker string `json:"broker"`
+	// Client identifier. A random one is generated if empty.
+	ClientId string `json:"client_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// TLS settings. TLS is used if the broker scheme is "ssl", "tls" or "mqtts" or if this section is present.
+	TLS *tlsConfig `json:"tls,omitempty"`
+	// Quality of service: 0, 1 or 2.
+	QoS byte `json:"qos,omitempty"`
+	// Prefix of per-user topics. Notifications are published to <prefix><user ID>, e.g. "tinode/usrRkDVe0PYDOo".
+	TopicPrefix string `json:"topic_prefix,omitempty"`
+	// Publish the count of unread messages to the retained topic <prefix><user ID>/badge.
+	RetainBadge bool `json:"retain_badge,omitempty"`
+	// Keep alive interval in seconds.
+	KeepAlive int `json:"keep_alive,omitempty"`
+	// Timeout of network operations in seconds.
+	Timeout int `json:"timeout,omitempty"`
+
+	// Broker host:port.
+	address string
+	timeout time.Duration
+}
+
+// Notification as it's published to the user's topic.
+type notification struct {
+	// Count of unread messages.
+	Unread int `json:"unread"`
+	// The notification should not be shown to the user.
+	Silent bool `json:"silent,omitempty"`
+	// The message mentions the user.
+	Mention bool          `json:"mention,omitempty"`
+	Payload *push.Payload `json:"payload"`
+}
+
+// Value of the retained badge topic.
+type badge struct {
+	Unread int `json:"unread"`
+}
+
+// Init initializes the push handler
+func (Handler) Init(jsonconf string) error {
+	var config configType
+	err := json.Unmarshal([]byte(jsonconf), &config)
+	if err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return nil
+	}
+
+	broker, err := url.Parse(config.Broker)
+	if err != nil || broker.Host == "" {
+		return errors.New("invalid broker address")
+	}
+	useTLS := config.TLS != nil
+	port := "1883"
+	switch broker.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts":
+		useTLS = true
+		port = "8883"
+	default:
+		return errors.New("unsupported broker scheme " + broker.Scheme)
+	}
+	if broker.Port() != "" {
+		port = broker.Port()
+	}
+	config.address = net.JoinHostPort(broker.Hostname(), port)
+
+	var tlsConf *tls.Config
+	if useTLS {
+		if tlsConf, err = loadTLSConfig(config.TLS, broker.Hostname()); err != nil {
+			return err
+		}
+	}
+
+	if config.QoS > 2 {
+		return errors.New("invalid qos")
+	}
+	if config.TopicPrefix == "" {
+		config.TopicPrefix = defaultTopicPrefix
+	}
+	if config.ClientId == "" {
+		id := make([]byte, 6)
+		if _, err = rand.Read(id); err != nil {
+			return err
+		}
+		config.ClientId = "tinode-" + hex.EncodeToString(id)
+	}
+	if config.KeepAlive <= 0 {
+		config.KeepAlive = int(defaultKeepAlive / time.Second)
+	}
+	config.timeout = time.Duration(config.Timeout) * time.Second
+	if config.timeout <= 0 {
+		config.timeout = defaultTimeout
+	}
+
+	handler.input = make(chan *push.Receipt, bufferSize)
+	handler.channel = make(chan *push.ChannelReq, bufferSize)
+	handler.stop = make(chan bool, 1)
+
+	go worker(&config, tlsConf)
+
+	return nil
+}
+
+// loadTLSConfig creates TLS configuration for connecting to the broker.
+func loadTLSConfig(config *tlsConfig, serverName string) (*tls.Config, error) {
+	tlsConf := &tls.Config{ServerName: serverName}
+	if config == nil {
+		return tlsConf, nil
+	}
+
+	tlsConf.InsecureSkipVerify = config.InsecureSkipVerify
+	if config.CaFile != "" {
+		pem, err := ioutil.ReadFile(config.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + config.CaFile)
+		}
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
+// worker maintains the connection to the broker and publishes notifications.
+func worker(config *configType, tlsConf *tls.Config) {
+	var conn *client
+	var reconnectAt time.Time
+	reconnectDelay := time.Second
+
+	// connected returns a live connection to the broker, reconnecting if necessary.
+	connected := func() *client {
+		if conn != nil && !conn.isClosed() {
+			return conn
+		}
+		if conn != nil {
+			log.Println("mqtt push: connection lost", conn.err)
+			conn = nil
+		}
+		if time.Now().Before(reconnectAt) {
+			return nil
+		}
+
+		var err error
+		if conn, err = dial(config, tlsConf); err != nil {
+			log.Println("mqtt push: failed to connect to", config.address, err)
+			conn = nil
+			reconnectAt = time.Now().Add(reconnectDelay)
+			if reconnectDelay *= 2; reconnectDelay > maxReconnectDelay {
+				reconnectDelay = maxReconnectDelay
+			}
+			return nil
+		}
+		reconnectDelay = time.Second
+		return conn
+	}
+
+	// Ping the broker at half the keep alive interval to make sure it's not exceeded.
+	ticker := time.NewTicker(time.Duration(config.KeepAlive) * time.Second / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case rcpt := <-handler.input:
+			publish(connected(), rcpt, config)
+		case <-handler.channel:
+			// Clients subscribe to topics on the broker directly.
+		case <-ticker.C:
+			if conn != nil && !conn.isClosed() {
+				if err := conn.ping(); err != nil {
+					log.Println("mqtt push: ping failed", err)
+				}
+			}
+		case <-handler.stop:
+			if conn != nil && !conn.isClosed() {
+				conn.disconnect()
+			}
+			return
+		}
+	}
+}
+
+// Messages published to one recipient.
+type published struct {
+	to         push.Recipient
+	topic      string
+	deliveries []*delivery
+	err        error
+}
+
+// publish sends the receipt to topics of all recipients. Messages to all recipients are sent first,
+// then acknowledgements are collected, so a slow broker delays the receipt by one timeout at most.
+// Recipients which failed with a transient error are retried later.
+func publish(conn *client, rcpt *push.Receipt, config *configType) {
+	if len(rcpt.To) == 0 {
+		return
+	}
+
+	var sent, failed int
+	var cause error
+	retry := make(map[t.Uid]push.Recipient)
+	pending := make(map[t.Uid]*published, len(rcpt.To))
+	// Connection to send messages over: nil when the connection is lost.
+	sender := conn
+	for uid, to := range rcpt.To {
+		if sender == nil {
+			retry[uid] = to
+			cause = errConnectionClosed
+			continue
+		}
+
+		topic := config.TopicPrefix + uid.UserId()
+		msg, err := json.Marshal(&notification{
+			Unread: to.Unread,
+			// Silence the push for users who have received the data interactively
+			// or who do not want to be notified.
+			Silent:  rcpt.Payload.Silent || to.Delivered > 0 || to.Silent,
+			Mention: rcpt.Payload.IsMentioned(uid),
+			Payload: &rcpt.Payload,
+		})
+		if err != nil {
+			log.Println("mqtt push: failed to serialize notification", err)
+			failed++
+			continue
+		}
+
+		p := &published{to: to, topic: topic}
+		pending[uid] = p
+		var d *delivery
+		if d, p.err = sender.send(topic, msg, config.QoS, false); p.err == nil {
+			p.deliveries = append(p.deliveries, d)
+			if config.RetainBadge {
+				msg, _ = json.Marshal(&badge{Unread: to.Unread})
+				if d, p.err = sender.send(topic+badgeTopicSuffix, msg, config.QoS, true); p.err == nil {
+					p.deliveries = append(p.deliveries, d)
+				}
+			}
+		}
+		if p.err != nil && sender.isClosed() {
+			// Don't try other recipients on a dead connection.
+			sender = nil
+		}
+	}
+
+	deadline := time.Now().Add(config.timeout)
+	for uid, p := range pending {
+		for _, d := range p.deliveries {
+			// Wait for all deliveries even after a failure to release their waiters.
+			if err := conn.wait(d, deadline); err != nil && p.err == nil {
+				p.err = err
+			}
+		}
+		if p.err != nil {
+			log.Println("mqtt push: failed to publish to", p.topic, p.err)
+			retry[uid] = p.to
+			cause = p.err
+			continue
+		}
+		sent++
+	}
+
+	push.ReportSent("mqtt", sent)
+	push.ReportFailed("mqtt", failed)
+	if len(retry) > 0 {
+		push.Requeue("mqtt", rcpt, retry, cause)
+	}
+}
+
+// IsReady checks if the push handler has been initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Channel returns a channel for subscribing/unsubscribing devices to channels.
+func (Handler) Channel() chan<- *push.ChannelReq {
+	return handler.channel
+}
+
+// Stop shuts down the handler
+func (Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register("mqtt", &handler)
+}
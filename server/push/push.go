@@ -15,8 +15,21 @@ const (
 	ActMsg = "msg"
 	// New subscription.
 	ActSub = "sub"
+	// Messages were read on another device. Always silent.
+	ActRead = "read"
+	// Messages were deleted. Always silent.
+	ActDelMsg = "del"
+	// Topic was deleted. Always silent.
+	ActDelTopic = "deltopic"
 )
 
+// PlatformWebPush is the platform of devices which are browser Web Push subscriptions.
+// The device ID of such device is a JSON-serialized PushSubscription.
+const PlatformWebPush = "webpush"
+
+// PlatformAPNs is the platform of iOS devices which use APNs device tokens instead of FCM tokens.
+const PlatformAPNs = "apns"
+
 // Recipient is a user targeted by the push.
 type Recipient struct {
 	// Count of user's connections that were live when the packet was dispatched from the server
@@ -25,6 +38,8 @@ type Recipient struct {
 	Devices []string `json:"devices,omitempty"`
 	// Unread count to include in the push
 	Unread int `json:"unread"`
+	// The push must be silent for this recipient, i.e. the user muted the topic.
+	Silent bool `json:"silent,omitempty"`
 }
 
 // Receipt is the push payload with a list of recipients.
@@ -35,6 +50,9 @@ type Receipt struct {
 	Channel string `json:"channel"`
 	// Actual content to be delivered to the client.
 	Payload Payload `json:"payload"`
+
+	// Number of failed delivery attempts when the receipt is retried from the queue.
+	attempt int
 }
 
 // ChannelReq is a request to subscribe/unsubscribe device IDs to channel (FCM topic).
@@ -68,12 +86,45 @@ type Payload struct {
 	ContentType string `json:"mime"`
 	// Actual Data.Content of the message, if requested
 	Content interface{} `json:"content,omitempty"`
+	// Users 'usrXXX' mentioned in the message.
+	Mentions []string `json:"mentions,omitempty"`
 
 	// New subscription notification
 
 	// Access mode when notifying of new subscriptions.
 	ModeWant  t.AccessMode `json:"want,omitempty"`
 	ModeGiven t.AccessMode `json:"given,omitempty"`
+
+	// Message deletion notification
+
+	// Ranges of deleted message IDs.
+	DelSeq []DelRange `json:"delseq,omitempty"`
+}
+
+// DelRange is a range of deleted message IDs [LowId, HiId). HiId is zero if the range contains one ID.
+type DelRange struct {
+	LowId int `json:"low,omitempty"`
+	HiId  int `json:"hi,omitempty"`
+}
+
+// CollapseKey returns the key used to coalesce notifications: when several notifications with the same key
+// are pending delivery, only the newest one is delivered.
+func (p *Payload) CollapseKey() string {
+	if p.What == ActMsg {
+		return p.Topic
+	}
+	return p.What + ":" + p.Topic
+}
+
+// IsMentioned checks if the given user is mentioned in the message.
+func (p *Payload) IsMentioned(uid t.Uid) bool {
+	usr := uid.UserId()
+	for _, m := range p.Mentions {
+		if m == usr {
+			return true
+		}
+	}
+	return false
 }
 
 // Handler is an interface which must be implemented by handlers.
@@ -130,6 +181,9 @@ func Init(jsconfig string) error {
 			if err := hnd.Init(string(cc.Config)); err != nil {
 				return err
 			}
+			if hnd.IsReady() {
+				registerStats(cc.Name)
+			}
 		}
 	}
 
@@ -142,16 +196,13 @@ func Push(msg *Receipt) {
 		return
 	}
 
-	for _, hnd := range handlers {
+	for name, hnd := range handlers {
 		if !hnd.IsReady() {
 			continue
 		}
 
-		// Push without delay or skip
-		select {
-		case hnd.Push() <- msg:
-		default:
-		}
+		// Push without delay, queue or skip.
+		pushTo(name, hnd, msg)
 	}
 }
 
@@ -180,6 +231,8 @@ func Stop() {
 		return
 	}
 
+	stopQueue()
+
 	for _, hnd := range handlers {
 		if hnd.IsReady() {
 			// Will potentially block
@@ -0,0 +1,490 @@
+package push
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Prefix of the outbox channel: the full name is "push:" + handler name.
+	queueChannelPrefix = "push:"
+
+	// Give up on delivering the notification after this many attempts.
+	defaultQueueMaxAttempts = 5
+	// Delay before the first retry. Each subsequent retry doubles it.
+	defaultQueueInitialBackoff = 5 * time.Second
+	// Maximum delay between retries.
+	defaultQueueMaxBackoff = 10 * time.Minute
+	// How often to check the queue for notifications due for delivery.
+	defaultQueuePollInterval = 5 * time.Second
+	// How many notifications to read from the queue at once.
+	defaultQueueBatchSize = 64
+	// Maximum number of notifications pending delivery by one handler.
+	defaultQueueMaxSize = 10000
+	// Notifications which could not be delivered are deleted after this long.
+	defaultQueueDeadTTL = 24 * time.Hour
+	// How often to delete expired undelivered notifications.
+	queuePurgePeriod = time.Hour
+)
+
+// errQueueFull is returned when the handler has too many notifications pending delivery.
+var errQueueFull = errors.New("queue is full")
+
+// Hooks for reporting metrics. The server replaces them with functions which publish
+// the metrics before the push handlers are initialized.
+var (
+	// StatsRegisterInt registers an integer metric.
+	StatsRegisterInt = func(name string) {}
+	// StatsInc increments an integer metric.
+	StatsInc = func(name string, val int) {}
+)
+
+// Configuration of the push queue.
+type queueConfig struct {
+	// Save notifications which could not be handed to a handler or which failed with
+	// a transient error to the database and retry them later.
+	Enabled bool `json:"enabled"`
+	// Give up on delivering the notification after this many attempts.
+	MaxAttempts int `json:"max_attempts"`
+	// Delay before the first retry in seconds. Each subsequent retry doubles it.
+	InitialBackoff int `json:"initial_backoff"`
+	// Maximum delay between retries in seconds.
+	MaxBackoff int `json:"max_backoff"`
+	// How often to check the queue for notifications due for delivery, in seconds.
+	PollInterval int `json:"poll_interval"`
+	// Maximum number of notifications pending delivery by one handler. New notifications
+	// are dropped when the limit is reached.
+	MaxSize int `json:"max_size"`
+	// Delete notifications which could not be delivered after this many seconds.
+	DeadTTL int `json:"dead_ttl"`
+}
+
+// queuedReceipt is a Receipt as it's saved to the database.
+type queuedReceipt struct {
+	// Number of failed delivery attempts.
+	Attempt int `json:"attempt,omitempty"`
+	// Recipients keyed by user ID 'usrXXX'.
+	To      map[string]Recipient `json:"to"`
+	Channel string               `json:"channel,omitempty"`
+	Payload Payload              `json:"payload"`
+}
+
+// queue is a durable queue of push notifications. Notifications are saved to the database and
+// handed to push handlers by a background worker which retries with exponential backoff.
+type queue struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	pollInterval   time.Duration
+	maxSize        int
+	deadTTL        time.Duration
+
+	// Number of notifications pending delivery keyed by handler name. It's refreshed from
+	// the database periodically and incremented when notifications are queued.
+	sizeLock sync.Mutex
+	size     map[string]int
+
+	// Signal to check the queue right away.
+	wake chan struct{}
+	stop chan bool
+}
+
+var pushQueue *queue
+
+// Names of per-handler metrics.
+func statQueued(name string) string  { return statName(name, "Queued") }
+func statSent(name string) string    { return statName(name, "Sent") }
+func statFailed(name string) string  { return statName(name, "Failed") }
+func statDropped(name string) string { return statName(name, "Dropped") }
+
+func statName(name, metric string) string {
+	return "Push" + strings.Title(name) + metric
+}
+
+// registerStats registers metrics of a push handler.
+func registerStats(name string) {
+	StatsRegisterInt(statQueued(name))
+	StatsRegisterInt(statSent(name))
+	StatsRegisterInt(statFailed(name))
+	StatsRegisterInt(statDropped(name))
+}
+
+// ReportSent is called by handlers to report the number of successfully sent notifications.
+func ReportSent(name string, count int) {
+	StatsInc(statSent(name), count)
+}
+
+// ReportFailed is called by handlers to report the number of notifications which failed permanently.
+func ReportFailed(name string, count int) {
+	StatsInc(statFailed(name), count)
+}
+
+// InitQueue initializes the durable queue of push notifications.
+func InitQueue(jsconfig string) error {
+	var config queueConfig
+	if jsconfig != "" && jsconfig != "null" {
+		if err := json.Unmarshal([]byte(jsconfig), &config); err != nil {
+			return errors.New("failed to parse push queue config: " + err.Error())
+		}
+	}
+
+	if !config.Enabled {
+		return nil
+	}
+
+	q := &queue{
+		maxAttempts:    config.MaxAttempts,
+		initialBackoff: time.Duration(config.InitialBackoff) * time.Second,
+		maxBackoff:     time.Duration(config.MaxBackoff) * time.Second,
+		pollInterval:   time.Duration(config.PollInterval) * time.Second,
+		maxSize:        config.MaxSize,
+		deadTTL:        time.Duration(config.DeadTTL) * time.Second,
+		size:           make(map[string]int),
+		wake:           make(chan struct{}, 1),
+		stop:           make(chan bool, 1),
+	}
+	if q.maxAttempts <= 0 {
+		q.maxAttempts = defaultQueueMaxAttempts
+	}
+	if q.initialBackoff <= 0 {
+		q.initialBackoff = defaultQueueInitialBackoff
+	}
+	if q.maxBackoff <= 0 {
+		q.maxBackoff = defaultQueueMaxBackoff
+	}
+	if q.maxBackoff < q.initialBackoff {
+		q.maxBackoff = q.initialBackoff
+	}
+	if q.pollInterval <= 0 {
+		q.pollInterval = defaultQueuePollInterval
+	}
+	if q.maxSize <= 0 {
+		q.maxSize = defaultQueueMaxSize
+	}
+	if q.deadTTL <= 0 {
+		q.deadTTL = defaultQueueDeadTTL
+	}
+
+	pushQueue = q
+	go q.run()
+
+	return nil
+}
+
+// Requeue schedules another attempt to deliver the receipt by the named handler after a transient
+// failure. Only recipients listed in 'to' are retried. Devices listed in Recipient.Devices are skipped,
+// i.e. the handler should add devices which have already received the notification.
+func Requeue(name string, rcpt *Receipt, to map[t.Uid]Recipient, cause error) {
+	if len(to) == 0 {
+		return
+	}
+
+	attempt := rcpt.attempt + 1
+	if pushQueue == nil || attempt >= pushQueue.maxAttempts {
+		log.Println("push: giving up on", name, "notification after", attempt, "attempts:", cause)
+		StatsInc(statFailed(name), len(to))
+		return
+	}
+
+	retry := &Receipt{To: to, Payload: rcpt.Payload, attempt: attempt}
+	if err := pushQueue.enqueue(name, retry, pushQueue.backoff(attempt)); err != nil {
+		log.Println("push: failed to queue", name, "notification for retry:", err)
+		StatsInc(statFailed(name), len(to))
+	}
+}
+
+// enqueue saves the receipt to the database to be delivered by the named handler after the delay.
+func (q *queue) enqueue(name string, rcpt *Receipt, delay time.Duration) error {
+	q.sizeLock.Lock()
+	full := q.size[name] >= q.maxSize
+	q.sizeLock.Unlock()
+	if full {
+		return errQueueFull
+	}
+
+	qr := queuedReceipt{
+		Attempt: rcpt.attempt,
+		To:      make(map[string]Recipient, len(rcpt.To)),
+		Channel: rcpt.Channel,
+		Payload: rcpt.Payload,
+	}
+	for uid, to := range rcpt.To {
+		qr.To[uid.UserId()] = to
+	}
+	content, err := json.Marshal(&qr)
+	if err != nil {
+		return err
+	}
+
+	msg := &t.OutboxMessage{
+		Channel: queueChannelPrefix + name,
+		// Notifications with the same key are coalesced.
+		To:      coalesceKey(&rcpt.Payload),
+		Content: content,
+	}
+	if delay > 0 {
+		msg.NextAttemptAt = t.TimeNow().Add(delay)
+	}
+	if err = store.Outbox.Add(msg); err != nil {
+		return err
+	}
+	StatsInc(statQueued(name), 1)
+
+	q.sizeLock.Lock()
+	q.size[name]++
+	q.sizeLock.Unlock()
+
+	if delay <= 0 {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// backoff calculates the delay before the next attempt after the given number of failed attempts.
+func (q *queue) backoff(attempts int) time.Duration {
+	delay := q.initialBackoff
+	for i := 1; i < attempts && delay < q.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > q.maxBackoff {
+		delay = q.maxBackoff
+	}
+	return delay
+}
+
+func (q *queue) run() {
+	ticker := time.NewTicker(q.pollInterval)
+	defer ticker.Stop()
+	purge := time.NewTicker(queuePurgePeriod)
+	defer purge.Stop()
+
+	q.updateSize()
+	for {
+		select {
+		case <-ticker.C:
+			q.updateSize()
+		case <-q.wake:
+		case <-purge.C:
+			q.purge()
+			continue
+		case <-q.stop:
+			return
+		}
+		for name, hnd := range handlers {
+			if hnd.IsReady() {
+				q.processDue(name, hnd)
+			}
+		}
+	}
+}
+
+// updateSize reads the number of pending notifications from the database. Notifications are queued and
+// delivered by all cluster nodes, so the counts kept locally drift.
+func (q *queue) updateSize() {
+	for name := range handlers {
+		count, err := store.Outbox.Count(queueChannelPrefix + name)
+		if err != nil {
+			log.Println("push queue: failed to count notifications", err)
+			continue
+		}
+		q.sizeLock.Lock()
+		q.size[name] = count
+		q.sizeLock.Unlock()
+	}
+}
+
+// purge deletes notifications which were given up on more than deadTTL ago.
+func (q *queue) purge() {
+	olderThan := t.TimeNow().Add(-q.deadTTL)
+	for name := range handlers {
+		if err := store.Outbox.DelDead(queueChannelPrefix+name, olderThan); err != nil {
+			log.Println("push queue: failed to delete dead notifications", err)
+		}
+	}
+}
+
+// processDue hands notifications which are due for delivery to the handler.
+func (q *queue) processDue(name string, hnd Handler) {
+	for {
+		msgs, err := store.Outbox.GetDue(queueChannelPrefix+name, defaultQueueBatchSize)
+		if err != nil {
+			log.Println("push queue: failed to read notifications", err)
+			return
+		}
+
+		for _, group := range collapse(msgs) {
+			if !q.process(name, hnd, group) {
+				// The handler is busy, try again later.
+				return
+			}
+		}
+
+		if len(msgs) < defaultQueueBatchSize {
+			return
+		}
+	}
+}
+
+// coalesceKey returns the key by which queued notifications are coalesced or an empty string if
+// the notification must be delivered as is. Only the newest message in a topic and the latest read
+// status of a user in a topic are worth delivering. Other notifications carry data which is lost
+// when they are merged, like ranges of deleted messages which also differ between recipients.
+func coalesceKey(pl *Payload) string {
+	switch pl.What {
+	case ActMsg:
+		return pl.CollapseKey()
+	case ActRead:
+		// Read notifications are sent to the reader only.
+		return pl.CollapseKey() + ":" + pl.From
+	}
+	return ""
+}
+
+// collapse groups notifications by coalesce key. Notifications without a key are not grouped.
+// Within each group the newest notification comes first.
+func collapse(msgs []t.OutboxMessage) [][]*t.OutboxMessage {
+	var groups [][]*t.OutboxMessage
+	index := make(map[string]int)
+	for i := range msgs {
+		msg := &msgs[i]
+		idx, found := index[msg.To]
+		if msg.To == "" || !found {
+			index[msg.To] = len(groups)
+			groups = append(groups, []*t.OutboxMessage{msg})
+			continue
+		}
+		if msg.CreatedAt.After(groups[idx][0].CreatedAt) {
+			groups[idx] = append([]*t.OutboxMessage{msg}, groups[idx]...)
+		} else {
+			groups[idx] = append(groups[idx], msg)
+		}
+	}
+	return groups
+}
+
+// process hands a group of coalesced notifications to the handler as one receipt.
+// Returns false if the handler is busy.
+func (q *queue) process(name string, hnd Handler, group []*t.OutboxMessage) bool {
+	// Claim notifications so other cluster nodes don't deliver them too.
+	var claimed []*t.OutboxMessage
+	for _, msg := range group {
+		ok, err := store.Outbox.Claim(msg, t.TimeNow().Add(q.backoff(msg.Attempts+1)))
+		if err != nil {
+			log.Println("push queue: failed to claim notification", msg.Id, err)
+		} else if ok {
+			claimed = append(claimed, msg)
+		}
+	}
+	if len(claimed) == 0 {
+		return true
+	}
+
+	rcpt := merge(name, claimed)
+	if rcpt != nil {
+		select {
+		case hnd.Push() <- rcpt:
+		default:
+			// The handler is still busy.
+			for _, msg := range claimed {
+				msg.Attempts++
+				msg.LastError = "handler busy"
+				if msg.Attempts >= q.maxAttempts {
+					msg.Dead = true
+					StatsInc(statDropped(name), 1)
+					log.Println("push queue: giving up on notification", msg.Id, "for", name)
+				}
+				if err := store.Outbox.Fail(msg); err != nil {
+					log.Println("push queue: failed to update notification", msg.Id, err)
+				}
+			}
+			return false
+		}
+	}
+
+	for _, msg := range claimed {
+		if err := store.Outbox.Delete(msg.Id); err != nil {
+			log.Println("push queue: failed to delete notification", msg.Id, err)
+		}
+	}
+	return true
+}
+
+// merge combines a group of coalesced notifications into one receipt: the payload of the newest
+// notification addressed to recipients of all notifications in the group. Users mentioned in
+// any of the messages remain mentioned. Returns nil if none of the notifications could be parsed.
+func merge(name string, group []*t.OutboxMessage) *Receipt {
+	var rcpt *Receipt
+	for _, msg := range group {
+		var qr queuedReceipt
+		if err := json.Unmarshal(msg.Content, &qr); err != nil {
+			log.Println("push queue: invalid notification", msg.Id, err)
+			StatsInc(statFailed(name), 1)
+			continue
+		}
+		newest := rcpt == nil
+		if newest {
+			rcpt = &Receipt{
+				To:      make(map[t.Uid]Recipient, len(qr.To)),
+				Channel: qr.Channel,
+				Payload: qr.Payload,
+				attempt: qr.Attempt,
+			}
+		}
+		for usr, to := range qr.To {
+			uid := t.ParseUserId(usr)
+			if _, dup := rcpt.To[uid]; dup || uid.IsZero() {
+				continue
+			}
+			if !newest && usr == rcpt.Payload.From {
+				// The sender of the newest message does not need to be notified of the older ones.
+				continue
+			}
+			rcpt.To[uid] = to
+		}
+		if !newest {
+			for _, usr := range qr.Payload.Mentions {
+				uid := t.ParseUserId(usr)
+				if _, ok := rcpt.To[uid]; ok && !rcpt.Payload.IsMentioned(uid) {
+					rcpt.Payload.Mentions = append(rcpt.Payload.Mentions, usr)
+				}
+			}
+		}
+	}
+	return rcpt
+}
+
+// pushTo hands the receipt to the handler. If the handler is busy, the receipt is saved to the
+// queue if the queue is enabled, otherwise it's dropped.
+func pushTo(name string, hnd Handler, rcpt *Receipt) {
+	select {
+	case hnd.Push() <- rcpt:
+		return
+	default:
+	}
+
+	if pushQueue != nil {
+		err := pushQueue.enqueue(name, rcpt, 0)
+		if err == nil {
+			return
+		}
+		log.Println("push: failed to queue", name, "notification:", err)
+	}
+	StatsInc(statDropped(name), 1)
+}
+
+// stopQueue terminates the queue worker.
+func stopQueue() {
+	if pushQueue != nil {
+		pushQueue.stop <- true
+	}
+}
@@ -0,0 +1,120 @@
+package push
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	t "github.com/tinode/chat/server/store/types"
+)
+
+func queued(test *testing.T, id string, created time.Time, pl Payload, to ...string) t.OutboxMessage {
+	qr := queuedReceipt{To: make(map[string]Recipient), Payload: pl}
+	for _, usr := range to {
+		qr.To[usr] = Recipient{}
+	}
+	content, err := json.Marshal(&qr)
+	if err != nil {
+		test.Fatal(err)
+	}
+	msg := t.OutboxMessage{To: coalesceKey(&pl), Content: content}
+	msg.Id = id
+	msg.CreatedAt = created
+	return msg
+}
+
+func TestCoalesceKey(test *testing.T) {
+	cases := []struct {
+		payload Payload
+		key     string
+	}{
+		{Payload{What: ActMsg, Topic: "grpAbc", From: "usrA"}, "grpAbc"},
+		{Payload{What: ActRead, Topic: "grpAbc", From: "usrA"}, "read:grpAbc:usrA"},
+		{Payload{What: ActSub, Topic: "grpAbc"}, ""},
+		{Payload{What: ActDelMsg, Topic: "grpAbc"}, ""},
+		{Payload{What: ActDelTopic, Topic: "grpAbc"}, ""},
+	}
+	for _, tc := range cases {
+		if key := coalesceKey(&tc.payload); key != tc.key {
+			test.Errorf("%s: key '%s', expected '%s'", tc.payload.What, key, tc.key)
+		}
+	}
+}
+
+func TestCollapse(test *testing.T) {
+	now := time.Now()
+	usrA, usrB := t.Uid(1).UserId(), t.Uid(2).UserId()
+
+	msgs := []t.OutboxMessage{
+		// Hard and soft deletion in the same topic.
+		queued(test, "1", now, Payload{What: ActDelMsg, Topic: "grpAbc", SeqId: 10,
+			DelSeq: []DelRange{{LowId: 1, HiId: 5}}}, usrA, usrB),
+		queued(test, "2", now.Add(time.Second), Payload{What: ActDelMsg, Topic: "grpAbc", SeqId: 11,
+			DelSeq: []DelRange{{LowId: 7}}}, usrA),
+		// Reads by different users.
+		queued(test, "3", now, Payload{What: ActRead, Topic: "grpAbc", From: usrA, SeqId: 5}, usrA),
+		queued(test, "4", now, Payload{What: ActRead, Topic: "grpAbc", From: usrB, SeqId: 9}, usrB),
+		// Reads by the same user.
+		queued(test, "5", now.Add(time.Second), Payload{What: ActRead, Topic: "grpAbc", From: usrA, SeqId: 6}, usrA),
+	}
+
+	groups := collapse(msgs)
+	if len(groups) != 4 {
+		test.Fatal("expected 4 groups, got", len(groups))
+	}
+	for _, group := range groups {
+		rcpt := merge("test", group)
+		switch rcpt.Payload.What {
+		case ActDelMsg:
+			if len(group) != 1 {
+				test.Error("deletions coalesced")
+			}
+		case ActRead:
+			usr := rcpt.Payload.From
+			if len(rcpt.To) != 1 {
+				test.Error("read status of", usr, "sent to", rcpt.To)
+			}
+			if _, ok := rcpt.To[t.ParseUserId(usr)]; !ok {
+				test.Error("read status of", usr, "sent to", rcpt.To)
+			}
+			if usr == usrA && (len(group) != 2 || rcpt.Payload.SeqId != 6) {
+				test.Error("reads of the same user not coalesced", len(group), rcpt.Payload.SeqId)
+			}
+		}
+	}
+}
+
+func TestMergeMessages(test *testing.T) {
+	now := time.Now()
+	usrA, usrB, usrC := t.Uid(1).UserId(), t.Uid(2).UserId(), t.Uid(3).UserId()
+
+	msgs := []t.OutboxMessage{
+		queued(test, "1", now, Payload{What: ActMsg, Topic: "grpAbc", From: usrA, SeqId: 1,
+			Mentions: []string{usrB}}, usrB, usrC),
+		queued(test, "2", now.Add(2*time.Second), Payload{What: ActMsg, Topic: "grpAbc", From: usrC, SeqId: 3}, usrA, usrB),
+		queued(test, "3", now.Add(time.Second), Payload{What: ActMsg, Topic: "grpAbc", From: usrB, SeqId: 2,
+			Mentions: []string{usrA}}, usrA, usrC),
+	}
+
+	groups := collapse(msgs)
+	if len(groups) != 1 || len(groups[0]) != 3 {
+		test.Fatal("messages not coalesced", groups)
+	}
+	rcpt := merge("test", groups[0])
+	if rcpt.Payload.SeqId != 3 {
+		test.Error("payload of the newest message expected, got seq", rcpt.Payload.SeqId)
+	}
+	// The sender of the newest message is not notified of the older ones.
+	if _, ok := rcpt.To[t.ParseUserId(usrC)]; ok || len(rcpt.To) != 2 {
+		test.Error("recipients", rcpt.To)
+	}
+	// Mentions in the older messages are kept.
+	for _, usr := range []string{usrA, usrB} {
+		if !rcpt.Payload.IsMentioned(t.ParseUserId(usr)) {
+			test.Error(usr, "not mentioned")
+		}
+	}
+	if rcpt.Payload.IsMentioned(t.ParseUserId(usrC)) {
+		test.Error("sender mentioned")
+	}
+}
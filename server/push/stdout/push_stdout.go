@@ -23,6 +23,14 @@ type stdoutPush struct {
 	stop        chan bool
 }
 
+// notification is a push.Receipt as it's written to stdout.
+type notification struct {
+	// Recipients keyed by user ID 'usrXXX'.
+	To      map[string]push.Recipient `json:"to,omitempty"`
+	Channel string                    `json:"channel,omitempty"`
+	Payload push.Payload              `json:"payload"`
+}
+
 type configType struct {
 	Enabled bool `json:"enabled"`
 	Buffer  int  `json:"buffer"`
@@ -58,8 +66,8 @@ func (stdoutPush) Init(jsonconf string) error {
 	go func() {
 		for {
 			select {
-			case msg := <-handler.input:
-				fmt.Fprintln(os.Stdout, msg)
+			case rcpt := <-handler.input:
+				writeReceipt(rcpt)
 			case msg := <-handler.channel:
 				fmt.Fprintln(os.Stdout, msg)
 			case <-handler.stop:
@@ -71,6 +79,24 @@ func (stdoutPush) Init(jsonconf string) error {
 	return nil
 }
 
+// writeReceipt writes the receipt to stdout as a single line of JSON.
+func writeReceipt(rcpt *push.Receipt) {
+	n := notification{
+		To:      make(map[string]push.Recipient, len(rcpt.To)),
+		Channel: rcpt.Channel,
+		Payload: rcpt.Payload,
+	}
+	for uid, to := range rcpt.To {
+		n.To[uid.UserId()] = to
+	}
+	out, err := json.Marshal(&n)
+	if err != nil {
+		fmt.Fprintln(os.Stdout, rcpt)
+		return
+	}
+	fmt.Fprintln(os.Stdout, string(out))
+}
+
 // IsReady checks if the handler is initialized.
 func (stdoutPush) IsReady() bool {
 	return handler.input != nil
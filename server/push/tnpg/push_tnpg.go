@@ -181,6 +181,20 @@ func postMessage(endpoint string, body interface{}, config *configType) (*batchR
 func sendPushes(rcpt *push.Receipt, config *configType) {
 	messages := fcm.PrepareNotifications(rcpt, nil)
 
+	var sent, failed int
+	var cause error
+	retry := make(map[int]bool)
+	// Marks messages starting with the index 'from' as either transient or permanent failures.
+	giveUp := func(from int, transient bool) {
+		for j := from; j < len(messages); j++ {
+			if transient {
+				retry[j] = true
+			} else {
+				failed++
+			}
+		}
+	}
+
 	n := len(messages)
 	for i := 0; i < n; i += pushBatchSize {
 		upper := i + pushBatchSize
@@ -194,18 +208,41 @@ func sendPushes(rcpt *push.Receipt, config *configType) {
 		resp, err := postMessage(handler.pushUrl, payloads, config)
 		if err != nil {
 			log.Println("tnpg push request failed:", err)
+			cause = err
+			giveUp(i, true)
 			break
 		}
 		if resp.httpCode >= 300 {
 			log.Println("tnpg push rejected:", resp.httpStatus)
+			cause = errors.New(resp.httpStatus)
+			giveUp(i, resp.httpCode >= 500 || resp.httpCode == http.StatusTooManyRequests)
 			break
 		}
 		if resp.FatalCode != "" {
 			log.Println("tnpg push failed:", resp.FatalMessage)
+			cause = errors.New(resp.FatalMessage)
+			giveUp(i, isTransient(resp.FatalCode))
 			break
 		}
+		sent += resp.SuccessCount
+
 		// Check for expired tokens and other errors.
-		handlePushResponse(resp, messages[i:upper])
+		transient, permanent, ok := handlePushResponse(resp, messages[i:upper])
+		for _, j := range transient {
+			retry[i+j] = true
+		}
+		failed += permanent
+		if !ok {
+			cause = errors.New("tnpg push failed")
+			giveUp(upper, len(transient) > 0)
+			break
+		}
+	}
+
+	push.ReportSent("tnpg", sent)
+	push.ReportFailed("tnpg", failed)
+	if len(retry) > 0 {
+		push.Requeue("tnpg", rcpt, fcm.RetryRecipients(rcpt, messages, retry), cause)
 	}
 }
 
@@ -241,32 +278,52 @@ func processSubscription(req *push.ChannelReq, config *configType) {
 	handleSubResponse(resp, req, su.Devices)
 }
 
-func handlePushResponse(batch *batchResponse, messages []fcm.MessageData) {
+// handlePushResponse processes errors of individual messages. Returns indexes of messages which failed
+// with transient errors and should be retried, the number of messages which failed permanently,
+// and false to stop further processing of other messages.
+func handlePushResponse(batch *batchResponse, messages []fcm.MessageData) ([]int, int, bool) {
 	if batch.FailureCount <= 0 {
-		return
+		return nil, 0, true
 	}
 
+	var transient []int
+	var permanent int
+	ok := true
 	for i, resp := range batch.Responses {
 		switch resp.ErrorCode {
 		case "": // no error
 		case messageRateExceeded, quotaExceeded, serverUnavailable, unavailableError, internalError, unknownError:
 			// Transient errors. Stop sending this batch.
 			log.Println("tnpg: transient failure", resp.ErrorMessage)
-			return
+			transient = append(transient, i)
+			ok = false
 		case mismatchedCredential, invalidArgument, senderIDMismatch, thirdPartyAuthError, invalidAPNSCredentials:
 			// Config errors
 			log.Println("tnpg: invalid config", resp.ErrorMessage)
-			return
+			permanent++
+			ok = false
 		case registrationTokenNotRegistered, unregisteredError:
 			// Token is no longer valid.
 			log.Println("tnpg: invalid token", resp.ErrorMessage)
 			if err := store.Devices.Delete(messages[i].Uid, messages[i].DeviceId); err != nil {
 				log.Println("tnpg: failed to delete invalid token", err)
 			}
+			permanent++
 		default:
 			log.Println("tnpg: unrecognized error", resp.ErrorMessage)
+			permanent++
 		}
 	}
+	return transient, permanent, ok
+}
+
+// isTransient checks if the error code means the request may succeed if retried later.
+func isTransient(code string) bool {
+	switch code {
+	case messageRateExceeded, quotaExceeded, serverUnavailable, unavailableError, internalError, unknownError:
+		return true
+	}
+	return false
 }
 
 func handleSubResponse(batch *batchResponse, req *push.ChannelReq, devices []string) {
@@ -0,0 +1,218 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// Record size. The entire payload is sent as a single record.
+	recordSize = 4096
+	// Size of the header: salt(16) + rs(4) + idlen(1) + keyid(65).
+	headerSize = 16 + 4 + 1 + 65
+	// Size of AEAD_AES_128_GCM authentication tag.
+	tagSize = 16
+	// Maximum size of the plaintext which fits into one record with a padding delimiter.
+	maxPlaintextSize = recordSize - headerSize - tagSize - 1
+	// Lifetime of VAPID JWT.
+	vapidTokenLifetime = 12 * time.Hour
+)
+
+// Subscription is the browser PushSubscription as returned by PushSubscription.toJSON().
+type Subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		// User agent public key, base64url-encoded uncompressed P-256 point.
+		P256dh string `json:"p256dh"`
+		// Authentication secret, base64url-encoded.
+		Auth string `json:"auth"`
+	} `json:"keys"`
+}
+
+// parseSubscription parses the device ID of a web push device.
+func parseSubscription(deviceID string) (*Subscription, error) {
+	var sub Subscription
+	if err := json.Unmarshal([]byte(deviceID), &sub); err != nil {
+		return nil, err
+	}
+	if sub.Endpoint == "" || sub.Keys.P256dh == "" || sub.Keys.Auth == "" {
+		return nil, errors.New("incomplete subscription")
+	}
+	if u, err := url.Parse(sub.Endpoint); err != nil || u.Scheme != "https" && u.Scheme != "http" {
+		return nil, errors.New("invalid endpoint")
+	}
+	return &sub, nil
+}
+
+// decodeBase64 decodes base64url with or without padding.
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// leftPad pads the big-endian number with zeros to the given size.
+func leftPad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	out := make([]byte, size)
+	copy(out[size-len(b):], b)
+	return out
+}
+
+// hkdfExpand derives a key of the given length.
+func hkdfExpand(secret, salt, info []byte, length int) ([]byte, error) {
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// encrypt encrypts the plaintext for the subscription using aes128gcm content coding (RFC 8291, RFC 8188).
+func encrypt(sub *Subscription, plaintext []byte) ([]byte, error) {
+	if len(plaintext) > maxPlaintextSize {
+		return nil, errors.New("payload too large")
+	}
+
+	curve := elliptic.P256()
+
+	uaPublic, err := decodeBase64(sub.Keys.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	uaX, uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX == nil {
+		return nil, errors.New("invalid p256dh key")
+	}
+	authSecret, err := decodeBase64(sub.Keys.Auth)
+	if err != nil {
+		return nil, err
+	}
+	if len(authSecret) != 16 {
+		return nil, errors.New("invalid auth secret")
+	}
+
+	// Ephemeral application server key pair.
+	asPrivate, asX, asY, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := elliptic.Marshal(curve, asX, asY)
+
+	sx, _ := curve.ScalarMult(uaX, uaY, asPrivate)
+	ecdhSecret := leftPad(sx.Bytes(), 32)
+
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	// IKM = HKDF(auth_secret, ecdh_secret, "WebPush: info" || 0x00 || ua_public || as_public, 32)
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm, err := hkdfExpand(ecdhSecret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	cek, err := hkdfExpand(ikm, salt, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdfExpand(ikm, salt, []byte("Content-Encoding: nonce\x00"), 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Header: salt || rs || idlen || keyid
+	body := make([]byte, headerSize, headerSize+len(plaintext)+1+tagSize)
+	copy(body, salt)
+	binary.BigEndian.PutUint32(body[16:], recordSize)
+	body[20] = byte(len(asPublic))
+	copy(body[21:], asPublic)
+
+	// The single record is the last one: padding delimiter 0x02.
+	record := append(append([]byte{}, plaintext...), 0x02)
+	return gcm.Seal(body, nonce, record, nil), nil
+}
+
+// vapidKeys is the application server key pair used to sign VAPID tokens (RFC 8292).
+type vapidKeys struct {
+	private *ecdsa.PrivateKey
+	// Base64url-encoded uncompressed public key.
+	public string
+}
+
+// parseVapidKeys decodes the base64url-encoded private key and derives the public key.
+func parseVapidKeys(privateKey string) (*vapidKeys, error) {
+	d, err := decodeBase64(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(d) != 32 {
+		return nil, errors.New("invalid VAPID private key length")
+	}
+
+	curve := elliptic.P256()
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.PublicKey.Curve = curve
+	key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(d)
+
+	return &vapidKeys{
+		private: key,
+		public:  base64.RawURLEncoding.EncodeToString(elliptic.Marshal(curve, key.PublicKey.X, key.PublicKey.Y)),
+	}, nil
+}
+
+// authorization returns the value of the Authorization header for the push service endpoint.
+func (vk *vapidKeys) authorization(endpoint, subject string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(vapidTokenLifetime).Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, vk.private, hash[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS ES256 signature is r || s, each 32 bytes.
+	sig := append(leftPad(r.Bytes(), 32), leftPad(s.Bytes(), 32)...)
+
+	return "vapid t=" + unsigned + "." + base64.RawURLEncoding.EncodeToString(sig) + ", k=" + vk.public, nil
+}
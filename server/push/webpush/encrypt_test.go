@@ -0,0 +1,262 @@
+package webpush
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// userAgent is the receiving side of a push subscription.
+type userAgent struct {
+	private    []byte
+	public     []byte
+	authSecret []byte
+}
+
+func newUserAgent(t *testing.T) *userAgent {
+	curve := elliptic.P256()
+	private, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	if _, err = rand.Read(authSecret); err != nil {
+		t.Fatal(err)
+	}
+	return &userAgent{private: private, public: elliptic.Marshal(curve, x, y), authSecret: authSecret}
+}
+
+func (ua *userAgent) subscription() *Subscription {
+	var sub Subscription
+	sub.Endpoint = "https://push.example.com/send/abc"
+	sub.Keys.P256dh = base64.RawURLEncoding.EncodeToString(ua.public)
+	sub.Keys.Auth = base64.RawURLEncoding.EncodeToString(ua.authSecret)
+	return &sub
+}
+
+// decrypt decrypts the aes128gcm body as the user agent would (RFC 8291 section 3.4, RFC 8188 section 2).
+func (ua *userAgent) decrypt(t *testing.T, body []byte) []byte {
+	curve := elliptic.P256()
+
+	if len(body) < 21 {
+		t.Fatal("body too short", len(body))
+	}
+	salt := body[:16]
+	if rs := binary.BigEndian.Uint32(body[16:20]); rs != recordSize {
+		t.Error("record size", rs)
+	}
+	idlen := int(body[20])
+	if idlen != 65 || len(body) < 21+idlen {
+		t.Fatal("invalid keyid length", idlen)
+	}
+	asPublic := body[21 : 21+idlen]
+	record := body[21+idlen:]
+	if len(record) > recordSize {
+		t.Error("record larger than record size", len(record))
+	}
+
+	asX, asY := elliptic.Unmarshal(curve, asPublic)
+	if asX == nil {
+		t.Fatal("invalid application server key")
+	}
+	sx, _ := curve.ScalarMult(asX, asY, ua.private)
+
+	keyInfo := append([]byte("WebPush: info\x00"), ua.public...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm, err := hkdfExpand(leftPad(sx.Bytes(), 32), ua.authSecret, keyInfo, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cek, err := hkdfExpand(ikm, salt, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := hkdfExpand(ikm, salt, []byte("Content-Encoding: nonce\x00"), 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := gcm.Open(nil, nonce, record, nil)
+	if err != nil {
+		t.Fatal("failed to decrypt:", err)
+	}
+
+	// Strip padding: the last non-zero byte is the delimiter, 0x02 for the last record.
+	i := len(plain) - 1
+	for i >= 0 && plain[i] == 0 {
+		i--
+	}
+	if i < 0 || plain[i] != 0x02 {
+		t.Fatal("missing last record delimiter")
+	}
+	return plain[:i]
+}
+
+func TestEncrypt(t *testing.T) {
+	ua := newUserAgent(t)
+	sub := ua.subscription()
+
+	for _, payload := range [][]byte{
+		[]byte(`{"what":"msg","topic":"grpAbc","seq":"12"}`),
+		{},
+		bytes.Repeat([]byte{'x'}, maxPlaintextSize),
+	} {
+		body, err := encrypt(sub, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ua.decrypt(t, body); !bytes.Equal(got, payload) {
+			t.Errorf("decrypted %q, want %q", got, payload)
+		}
+	}
+
+	// Each message uses a fresh salt and ephemeral key.
+	a, _ := encrypt(sub, []byte("same"))
+	b, _ := encrypt(sub, []byte("same"))
+	if bytes.Equal(a[:headerSize], b[:headerSize]) {
+		t.Error("salt and key reused")
+	}
+
+	if _, err := encrypt(sub, make([]byte, maxPlaintextSize+1)); err == nil {
+		t.Error("oversized payload accepted")
+	}
+
+	bad := ua.subscription()
+	bad.Keys.Auth = base64.RawURLEncoding.EncodeToString([]byte("short"))
+	if _, err := encrypt(bad, nil); err == nil {
+		t.Error("invalid auth secret accepted")
+	}
+	bad = ua.subscription()
+	bad.Keys.P256dh = base64.RawURLEncoding.EncodeToString(make([]byte, 65))
+	if _, err := encrypt(bad, nil); err == nil {
+		t.Error("invalid p256dh accepted")
+	}
+}
+
+func TestParseSubscription(t *testing.T) {
+	sub, err := parseSubscription(`{"endpoint":"https://push.example.com/x","keys":{"p256dh":"BAA","auth":"AAA"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Endpoint != "https://push.example.com/x" || sub.Keys.P256dh != "BAA" || sub.Keys.Auth != "AAA" {
+		t.Error("parsed", sub)
+	}
+
+	for _, deviceID := range []string{
+		"fcm-token",
+		`{"endpoint":"https://push.example.com/x","keys":{"p256dh":"BAA"}}`,
+		`{"endpoint":"ftp://push.example.com/x","keys":{"p256dh":"BAA","auth":"AAA"}}`,
+	} {
+		if _, err := parseSubscription(deviceID); err == nil {
+			t.Error("accepted", deviceID)
+		}
+	}
+}
+
+func TestVapidAuthorization(t *testing.T) {
+	private, _, _, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vk, err := parseVapidKeys(base64.RawURLEncoding.EncodeToString(private))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	auth, err := vk.authorization("https://push.example.com:8443/send/abc?x=1", "mailto:admin@example.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(auth, "vapid t=") {
+		t.Fatal("invalid scheme", auth)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(auth, "vapid t="), ", k=", 2)
+	if len(parts) != 2 {
+		t.Fatal("missing public key", auth)
+	}
+	token, k := parts[0], parts[1]
+	if k != vk.public {
+		t.Error("public key", k)
+	}
+
+	// Verify the signature against the public key sent in the header.
+	curve := elliptic.P256()
+	pubBytes, err := base64.RawURLEncoding.DecodeString(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := elliptic.Unmarshal(curve, pubBytes)
+	if x == nil {
+		t.Fatal("invalid public key")
+	}
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		t.Fatal("invalid JWT", token)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil || len(sig) != 64 {
+		t.Fatal("invalid signature", err, len(sig))
+	}
+	hash := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+	pub := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	if !ecdsa.Verify(pub, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Error("signature does not verify")
+	}
+
+	var header map[string]string
+	decodeSegment(t, segments[0], &header)
+	if header["alg"] != "ES256" || header["typ"] != "JWT" {
+		t.Error("header", header)
+	}
+
+	var claims struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	}
+	decodeSegment(t, segments[1], &claims)
+	if claims.Aud != "https://push.example.com:8443" {
+		t.Error("aud", claims.Aud)
+	}
+	if claims.Exp != now.Add(vapidTokenLifetime).Unix() || claims.Exp > now.Add(24*time.Hour).Unix() {
+		t.Error("exp", claims.Exp)
+	}
+	if claims.Sub != "mailto:admin@example.com" {
+		t.Error("sub", claims.Sub)
+	}
+
+	if _, err := parseVapidKeys(base64.RawURLEncoding.EncodeToString(private[:31])); err == nil {
+		t.Error("short private key accepted")
+	}
+}
+
+func decodeSegment(t *testing.T, segment string, v interface{}) {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
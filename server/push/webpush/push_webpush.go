@@ -0,0 +1,315 @@
+// Package webpush implements push notification plugin for browsers using Web Push protocol (RFC 8030)
+// with message encryption (RFC 8291) and VAPID authentication (RFC 8292).
+package webpush
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+var handler Handler
+
+const (
+	// Size of the input channel buffer.
+	bufferSize = 1024
+
+	// Default time to live of the push at the push service, in seconds.
+	defaultTimeToLive = 3600
+
+	// Default timeout of requests to the push service.
+	defaultTimeout = 10 * time.Second
+
+	// Maximum length of a text message in runes. The message is clipped if length is exceeded.
+	maxMessageLength = 80
+
+	// Maximum size of the push service response to read.
+	maxResponseSize = 4096
+)
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input   chan *push.Receipt
+	channel chan *push.ChannelReq
+	stop    chan bool
+	client  *http.Client
+	vapid   *vapidKeys
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Base64url-encoded VAPID private key, the 32-byte P-256 scalar. The public key is derived from it.
+	VapidPrivateKey string `json:"vapid_private_key"`
+	// Contact of the application server, "mailto:" or "https:" URL.
+	Subject string `json:"subject"`
+	// How long the push service should keep the undelivered push, in seconds.
+	TimeToLive int `json:"time_to_live,omitempty"`
+	// Request timeout in seconds.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// Init initializes the push handler
+func (Handler) Init(jsonconf string) error {
+	var config configType
+	err := json.Unmarshal([]byte(jsonconf), &config)
+	if err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return nil
+	}
+
+	if config.Subject == "" {
+		return errors.New("missing subject")
+	}
+	if handler.vapid, err = parseVapidKeys(config.VapidPrivateKey); err != nil {
+		return err
+	}
+	if config.TimeToLive <= 0 {
+		config.TimeToLive = defaultTimeToLive
+	}
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	handler.client = &http.Client{Timeout: timeout}
+
+	log.Println("webpush: VAPID public key", handler.vapid.public)
+
+	handler.input = make(chan *push.Receipt, bufferSize)
+	handler.channel = make(chan *push.ChannelReq, bufferSize)
+	handler.stop = make(chan bool, 1)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendNotifications(rcpt, &config)
+			case <-handler.channel:
+				// Web Push has no topics. Ignore.
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// payloadToData converts the push payload to the data sent to the browser.
+func payloadToData(pl *push.Payload) (map[string]string, error) {
+	data := make(map[string]string)
+	data["what"] = pl.What
+	if pl.Silent {
+		data["silent"] = "true"
+	}
+	data["topic"] = pl.Topic
+	data["ts"] = pl.Timestamp.Format(time.RFC3339Nano)
+	data["from"] = pl.From
+	if pl.What == push.ActMsg {
+		var err error
+		data["seq"] = strconv.Itoa(pl.SeqId)
+		data["mime"] = pl.ContentType
+		data["content"], err = drafty.ToPlainText(pl.Content)
+		if err != nil {
+			return nil, err
+		}
+
+		// Check byte length first and don't waste time converting short strings.
+		if len(data["content"]) > maxMessageLength {
+			runes := []rune(data["content"])
+			if len(runes) > maxMessageLength {
+				data["content"] = string(runes[:maxMessageLength]) + "…"
+			}
+		}
+	} else if pl.What == push.ActSub {
+		data["modeWant"] = pl.ModeWant.String()
+		data["modeGiven"] = pl.ModeGiven.String()
+	} else if pl.What == push.ActRead {
+		data["seq"] = strconv.Itoa(pl.SeqId)
+	} else if pl.What == push.ActDelMsg {
+		data["seq"] = strconv.Itoa(pl.SeqId)
+		delseq, err := json.Marshal(pl.DelSeq)
+		if err != nil {
+			return nil, err
+		}
+		data["delseq"] = string(delseq)
+	} else if pl.What == push.ActDelTopic {
+		// Topic name is sufficient.
+	} else {
+		return nil, errors.New("unknown push type")
+	}
+	return data, nil
+}
+
+func sendNotifications(rcpt *push.Receipt, config *configType) {
+	if len(rcpt.To) == 0 {
+		return
+	}
+
+	data, err := payloadToData(&rcpt.Payload)
+	if err != nil {
+		log.Println("webpush: could not parse payload;", err)
+		return
+	}
+
+	uids := make([]t.Uid, 0, len(rcpt.To))
+	// Devices which were online in the topic when the message was sent.
+	skipDevices := make(map[string]struct{})
+	for uid, to := range rcpt.To {
+		uids = append(uids, uid)
+		for _, deviceID := range to.Devices {
+			skipDevices[deviceID] = struct{}{}
+		}
+	}
+	devices, count, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		log.Println("webpush: db error", err)
+		return
+	}
+	if count == 0 {
+		return
+	}
+
+	for uid, devList := range devices {
+		userData := data
+		if rcpt.To[uid].Delivered > 0 || rcpt.To[uid].Silent {
+			// Silence the push for user who have received the data interactively
+			// or who does not want to be notified.
+			userData = make(map[string]string, len(data)+1)
+			for key, val := range data {
+				userData[key] = val
+			}
+			userData["silent"] = "true"
+		}
+		payload, err := json.Marshal(userData)
+		if err != nil {
+			log.Println("webpush: failed to serialize payload", err)
+			return
+		}
+
+		for i := range devList {
+			d := &devList[i]
+			if d.Platform != push.PlatformWebPush {
+				continue
+			}
+			if _, ok := skipDevices[d.DeviceId]; ok {
+				continue
+			}
+			if !sendToDevice(uid, d.DeviceId, payload, config) {
+				return
+			}
+		}
+	}
+}
+
+// sendToDevice sends one push to the browser's push service. Returns false if the error is
+// not specific to this device and sending other pushes should be stopped.
+func sendToDevice(uid t.Uid, deviceID string, payload []byte, config *configType) bool {
+	sub, err := parseSubscription(deviceID)
+	if err != nil {
+		log.Println("webpush: invalid subscription", uid, err)
+		deleteDevice(uid, deviceID)
+		return true
+	}
+
+	body, err := encrypt(sub, payload)
+	if err != nil {
+		log.Println("webpush: encryption failed", uid, err)
+		return true
+	}
+
+	auth, err := handler.vapid.authorization(sub.Endpoint, config.Subject, time.Now())
+	if err != nil {
+		log.Println("webpush: failed to sign request", err)
+		return false
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Println("webpush: invalid request", uid, err)
+		return true
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(config.TimeToLive))
+	req.Header.Set("Urgency", "high")
+	req.Header.Set("Authorization", auth)
+
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		// Push services are independent. Keep sending to others.
+		log.Println("webpush: request failed", err)
+		return true
+	}
+	defer resp.Body.Close()
+
+	handlePushResponse(resp, uid, deviceID)
+	return true
+}
+
+// handlePushResponse processes the response of the push service. Expired subscriptions are deleted.
+func handlePushResponse(resp *http.Response, uid t.Uid, deviceID string) {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+
+	switch {
+	case resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices:
+		// Success.
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		// Subscription has expired or was cancelled by the user.
+		log.Println("webpush: subscription expired", uid, resp.StatusCode)
+		deleteDevice(uid, deviceID)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		// VAPID keys do not match the keys used to subscribe.
+		log.Println("webpush: request rejected", resp.StatusCode, string(msg))
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		// Transient errors of this push service.
+		log.Println("webpush transient failure", resp.StatusCode, string(msg))
+	default:
+		log.Println("webpush error:", resp.StatusCode, string(msg))
+	}
+}
+
+func deleteDevice(uid t.Uid, deviceID string) {
+	if err := store.Devices.Delete(uid, deviceID); err != nil {
+		log.Println("webpush: failed to delete subscription", err)
+	}
+}
+
+// IsReady checks if the push handler has been initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Channel returns a channel for subscribing/unsubscribing devices to FCM topics.
+// Web Push does not support topics, the requests are ignored.
+func (Handler) Channel() chan<- *push.ChannelReq {
+	return handler.channel
+}
+
+// Stop shuts down the handler
+func (Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register("webpush", &handler)
+}
@@ -21,6 +21,7 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/tinode/chat/pbx"
+	"github.com/tinode/chat/server/audit"
 	"github.com/tinode/chat/server/auth"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
@@ -88,6 +89,9 @@ type Session struct {
 	// IP address of the client. For long polling this is the IP of the last poll.
 	remoteAddr string
 
+	// Operations permitted by the API key used to establish the session.
+	apiScopes apiKeyScope
+
 	// User agent, a string provived by an authenticated client in {login} packet.
 	userAgent string
 
@@ -96,7 +100,7 @@ type Session struct {
 
 	// Device ID of the client
 	deviceID string
-	// Platform: web, ios, android
+	// Platform: web, webpush, ios, android
 	platf string
 	// Human language of the client
 	lang string
@@ -440,15 +444,30 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 		}
 	}
 
+	// Check if the API key permits the request
+	checkScope := func(m *ClientComMessage, scope apiKeyScope, handler func(*ClientComMessage)) func(*ClientComMessage) {
+		return func(m *ClientComMessage) {
+			if s.apiScopes&scope != scope {
+				log.Println("s.dispatch: operation not permitted by API key", s.sid)
+				if m.Note == nil {
+					// {note} messages are not acknowledged.
+					s.queueOut(ErrPermissionDeniedReply(m, m.Timestamp))
+				}
+				return
+			}
+			handler(m)
+		}
+	}
+
 	switch {
 	case msg.Pub != nil:
-		handler = checkVers(msg, checkUser(msg, s.publish))
+		handler = checkVers(msg, checkUser(msg, checkScope(msg, requiredAPIScope(msg), s.publish)))
 		msg.Id = msg.Pub.Id
 		msg.Original = msg.Pub.Topic
 		uaRefresh = true
 
 	case msg.Sub != nil:
-		handler = checkVers(msg, checkUser(msg, s.subscribe))
+		handler = checkVers(msg, checkUser(msg, checkScope(msg, requiredAPIScope(msg), s.subscribe)))
 		msg.Id = msg.Sub.Id
 		msg.Original = msg.Sub.Topic
 		uaRefresh = true
@@ -473,22 +492,22 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 		uaRefresh = true
 
 	case msg.Set != nil:
-		handler = checkVers(msg, checkUser(msg, s.set))
+		handler = checkVers(msg, checkUser(msg, checkScope(msg, requiredAPIScope(msg), s.set)))
 		msg.Id = msg.Set.Id
 		msg.Original = msg.Set.Topic
 		uaRefresh = true
 
 	case msg.Del != nil:
-		handler = checkVers(msg, checkUser(msg, s.del))
+		handler = checkVers(msg, checkUser(msg, checkScope(msg, requiredAPIScope(msg), s.del)))
 		msg.Id = msg.Del.Id
 		msg.Original = msg.Del.Topic
 
 	case msg.Acc != nil:
-		handler = checkVers(msg, s.acc)
+		handler = checkVers(msg, checkScope(msg, requiredAPIScope(msg), s.acc))
 		msg.Id = msg.Acc.Id
 
 	case msg.Note != nil:
-		handler = s.note
+		handler = checkScope(msg, requiredAPIScope(msg), s.note)
 		msg.Original = msg.Note.Topic
 		uaRefresh = true
 
@@ -693,7 +712,7 @@ func (s *Session) hello(msg *ClientComMessage) {
 				deviceIDUpdate = true
 				err = store.Devices.Update(s.uid, s.deviceID, &types.DeviceDef{
 					DeviceId: msg.Hi.DeviceID,
-					Platform: s.platf,
+					Platform: devicePlatform(msg.Hi.DeviceID, s.platf),
 					LastSeen: msg.Timestamp,
 					Lang:     msg.Hi.Lang,
 				})
@@ -765,7 +784,7 @@ func (s *Session) acc(msg *ClientComMessage) {
 		}
 
 		var err error
-		rec, _, err = store.GetLogicalAuthHandler("token").Authenticate(msg.Acc.Token)
+		rec, _, err = store.GetLogicalAuthHandler("token").Authenticate(msg.Acc.Token, s.remoteAddr)
 		if err != nil {
 			s.queueOut(decodeStoreError(err, msg.Acc.Id, "", msg.Timestamp,
 				map[string]interface{}{"what": "auth"}))
@@ -806,17 +825,21 @@ func (s *Session) login(msg *ClientComMessage) {
 	handler := store.GetLogicalAuthHandler(msg.Login.Scheme)
 	if handler == nil {
 		log.Println("s.login: unknown authentication scheme", msg.Login.Scheme, s.sid)
+		auditEvent(s, audit.ActLogin, types.ZeroUid, msg.Login.Scheme, types.ErrUnsupported,
+			auditLoginParams(msg.Login.Scheme, msg.Login.Secret))
 		s.queueOut(ErrAuthUnknownScheme(msg.Id, "", msg.Timestamp))
 		return
 	}
 
-	rec, challenge, err := handler.Authenticate(msg.Login.Secret)
+	rec, challenge, err := handler.Authenticate(msg.Login.Secret, s.remoteAddr)
 	if err != nil {
 		resp := decodeStoreError(err, msg.Id, "", msg.Timestamp, nil)
 		if resp.Ctrl.Code >= 500 {
 			// Log internal errors
 			log.Println("s.login: internal", err, s.sid)
 		}
+		auditEvent(s, audit.ActLogin, types.ZeroUid, msg.Login.Scheme, err,
+			auditLoginParams(msg.Login.Scheme, msg.Login.Secret))
 		s.queueOut(resp)
 		return
 	}
@@ -831,6 +854,8 @@ func (s *Session) login(msg *ClientComMessage) {
 
 	if err != nil {
 		log.Println("s.login: user state check failed", rec.Uid, err, s.sid)
+		auditEvent(s, audit.ActLogin, rec.Uid, msg.Login.Scheme, err,
+			auditLoginParams(msg.Login.Scheme, msg.Login.Secret))
 		s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp, nil))
 		return
 	}
@@ -845,7 +870,7 @@ func (s *Session) login(msg *ClientComMessage) {
 	if rec.Features&auth.FeatureValidated == 0 && len(globals.authValidators[rec.AuthLevel]) > 0 {
 		var validated []string
 		// Check responses. Ignore invalid responses, just keep cred unvalidated.
-		if validated, _, err = validatedCreds(rec.Uid, rec.AuthLevel, msg.Login.Cred, false); err == nil {
+		if validated, _, err = validatedCreds(s, rec.Uid, rec.AuthLevel, msg.Login.Cred, false); err == nil {
 			// Get a list of credentials which have not been validated.
 			_, missing = stringSliceDelta(globals.authValidators[rec.AuthLevel], validated)
 		}
@@ -856,11 +881,17 @@ func (s *Session) login(msg *ClientComMessage) {
 	} else {
 		s.queueOut(s.onLogin(msg.Id, msg.Timestamp, rec, missing))
 	}
+
+	var params map[string]string
+	if len(missing) > 0 {
+		params = map[string]string{"missing": strings.Join(missing, ",")}
+	}
+	auditEvent(s, audit.ActLogin, rec.Uid, msg.Login.Scheme, err, params)
 }
 
 // authSecretReset resets an authentication secret;
 //  params: "auth-method-to-reset:credential-method:credential-value".
-func (s *Session) authSecretReset(params []byte) error {
+func (s *Session) authSecretReset(params []byte) (err error) {
 	var authScheme, credMethod, credValue string
 	if parts := strings.Split(string(params), ":"); len(parts) == 3 {
 		authScheme, credMethod, credValue = parts[0], parts[1], parts[2]
@@ -868,6 +899,11 @@ func (s *Session) authSecretReset(params []byte) error {
 		return types.ErrMalformed
 	}
 
+	var uid types.Uid
+	defer func() {
+		auditEvent(s, audit.ActReset, uid, authScheme, err, map[string]string{"method": credMethod})
+	}()
+
 	// Technically we don't need to check it here, but we are going to mail the 'authName' string to the user.
 	// We have to make sure it does not contain any exploits. This is the simplest check.
 	hdl := store.GetLogicalAuthHandler(authScheme)
@@ -878,7 +914,7 @@ func (s *Session) authSecretReset(params []byte) error {
 	if validator == nil {
 		return types.ErrUnsupported
 	}
-	uid, err := store.Users.GetByCred(credMethod, credValue)
+	uid, err = store.Users.GetByCred(credMethod, credValue)
 	if err != nil {
 		return err
 	}
@@ -901,7 +937,7 @@ func (s *Session) authSecretReset(params []byte) error {
 		return err
 	}
 
-	return validator.ResetSecret(credValue, authScheme, s.lang, token, resetParams)
+	return validator.ResetSecret(credValue, authScheme, s.lang, token, resetParams, s.remoteAddr)
 }
 
 // onLogin performs steps after successful authentication.
@@ -939,7 +975,7 @@ func (s *Session) onLogin(msgID string, timestamp time.Time, rec *auth.Rec, miss
 		if s.deviceID != "" {
 			if err := store.Devices.Update(rec.Uid, "", &types.DeviceDef{
 				DeviceId: s.deviceID,
-				Platform: s.platf,
+				Platform: devicePlatform(s.deviceID, s.platf),
 				LastSeen: timestamp,
 				Lang:     s.lang,
 			}); err != nil {
@@ -67,6 +67,9 @@ func (ss *SessionStore) NewSession(conn interface{}, sid string) (*Session, int)
 		log.Panicln("session: unknown connection type", conn)
 	}
 
+	// Sessions which were not established by a client with an API key are not restricted.
+	s.apiScopes = apiScopeAll
+
 	s.subs = make(map[string]*Subscription)
 	s.send = make(chan interface{}, sendQueueLimit+32) // buffered
 	s.stop = make(chan interface{}, 1)                 // Buffered by 1 just to make it non-blocking
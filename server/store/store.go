@@ -23,6 +23,10 @@ var mediaHandler media.Handler
 // Unique ID generator
 var uGen types.UidGenerator
 
+// Maximum number of attempts to update a record of failed authentication attempts which is
+// being changed concurrently.
+const maxLockoutUpdateAttempts = 10
+
 type configType struct {
 	// 16-byte key for XTEA. Used to initialize types.UidGenerator.
 	UidKey []byte `json:"uid_key"`
@@ -259,8 +263,10 @@ func (UsersObjMapper) Create(user *types.User, private interface{}) (*types.User
 func (UsersObjMapper) GetAuthRecord(user types.Uid, scheme string) (string, auth.Level, []byte, time.Time, error) {
 	unique, authLvl, secret, expires, err := adp.AuthGetRecord(user, scheme)
 	if err == nil {
-		parts := strings.Split(unique, ":")
-		unique = parts[1]
+		// Unique is empty if the record is not found.
+		if parts := strings.SplitN(unique, ":", 2); len(parts) == 2 {
+			unique = parts[1]
+		}
 	}
 	return unique, authLvl, secret, expires, err
 }
@@ -290,6 +296,68 @@ func (UsersObjMapper) DelAuthRecords(uid types.Uid, scheme string) error {
 	return adp.AuthDelScheme(uid, scheme)
 }
 
+// GetAuthLockout returns a record of failed authentication attempts for the given scheme and key
+// or nil if there were no recent failures.
+func (UsersObjMapper) GetAuthLockout(scheme, key string) (*types.AuthLockout, error) {
+	return adp.AuthLockoutGet(scheme + ":" + key)
+}
+
+// UpsertAuthLockout saves a record of failed authentication attempts for the given scheme.
+// The lockout.Id is expected to be set to a scheme-specific key.
+func (UsersObjMapper) UpsertAuthLockout(scheme string, lockout *types.AuthLockout) error {
+	saved := *lockout
+	saved.Id = scheme + ":" + lockout.Id
+	return adp.AuthLockoutUpsert(&saved)
+}
+
+// UpdateAuthLockout atomically changes the record of failed authentication attempts for the given scheme
+// and key. The update function receives a copy of the current record or nil if there is none, and returns
+// the record to save or nil to leave the record unchanged. The function is called again if the record was
+// changed concurrently, so it must not have side effects. Returns the saved record.
+func (UsersObjMapper) UpdateAuthLockout(scheme, key string,
+	update func(*types.AuthLockout) (*types.AuthLockout, error)) (*types.AuthLockout, error) {
+
+	id := scheme + ":" + key
+	for i := 0; i < maxLockoutUpdateAttempts; i++ {
+		old, err := adp.AuthLockoutGet(id)
+		if err != nil {
+			return nil, err
+		}
+		var current *types.AuthLockout
+		if old != nil {
+			copied := *old
+			copied.Id = key
+			current = &copied
+		}
+
+		lockout, err := update(current)
+		if err != nil || lockout == nil {
+			return nil, err
+		}
+
+		saved := *lockout
+		saved.Id = id
+		if ok, err := adp.AuthLockoutReplace(old, &saved); err != nil {
+			return nil, err
+		} else if ok {
+			lockout.Id = key
+			return lockout, nil
+		}
+	}
+	return nil, types.ErrInternal
+}
+
+// DelAuthLockout clears the record of failed authentication attempts for the given scheme and key.
+func (UsersObjMapper) DelAuthLockout(scheme, key string) error {
+	return adp.AuthLockoutDel(scheme + ":" + key)
+}
+
+// DelExpiredAuthLockouts deletes records of failed authentication attempts of all schemes which
+// were not updated since olderThan and are not locked.
+func (UsersObjMapper) DelExpiredAuthLockouts(olderThan time.Time) error {
+	return adp.AuthLockoutDelExpired(olderThan)
+}
+
 // Get returns a user object for the given user id
 func (UsersObjMapper) Get(uid types.Uid) (*types.User, error) {
 	return adp.UserGet(uid)
@@ -888,6 +956,18 @@ func (FileMapper) FinishUpload(fid string, success bool, size int64) (*types.Fil
 	return adp.FileFinishUpload(fid, status, size)
 }
 
+// KeepUpload updates the record of a resumable upload which is still in progress
+// to protect it from garbage collection.
+func (FileMapper) KeepUpload(fid string, size int64) (*types.FileDef, error) {
+	return adp.FileFinishUpload(fid, types.UploadStarted, size)
+}
+
+// Update updates fields of a file record, i.e. the MimeType of a resumable upload once the content is known.
+func (FileMapper) Update(fid string, update map[string]interface{}) error {
+	update["UpdatedAt"] = types.TimeNow()
+	return adp.FileUpdate(fid, update)
+}
+
 // Get fetches a file record for a unique file id.
 func (FileMapper) Get(fid string) (*types.FileDef, error) {
 	return adp.FileGet(fid)
@@ -904,3 +984,110 @@ func (FileMapper) DeleteUnused(olderThan time.Time, limit int) error {
 	}
 	return nil
 }
+
+// UsageByUser returns the total size of files uploaded by the user.
+func (FileMapper) UsageByUser(uid types.Uid) (int64, error) {
+	return adp.FileUsageByUser(uid)
+}
+
+// UsageByTopic returns the total size of files attached to messages in the topic.
+func (FileMapper) UsageByTopic(topic string) (int64, error) {
+	return adp.FileUsageByTopic(topic)
+}
+
+// GetQuota returns the quota of a user or a topic set by an administrator or nil if it's not set.
+func (FileMapper) GetQuota(id string) (*types.Quota, error) {
+	return adp.QuotaGet(id)
+}
+
+// SetQuota sets the quota of a user or a topic.
+func (FileMapper) SetQuota(id string, limit int64) error {
+	quota := &types.Quota{Limit: limit}
+	quota.Id = id
+	quota.InitTimes()
+	return adp.QuotaUpsert(quota)
+}
+
+// DelQuota deletes the quota of a user or a topic: the default applies.
+func (FileMapper) DelQuota(id string) error {
+	return adp.QuotaDel(id)
+}
+
+// AuditMapper is a struct to map methods used for the audit log.
+type AuditMapper struct{}
+
+// Audit is an instance of AuditMapper to be used for saving and retrieving audit events.
+var Audit AuditMapper
+
+// Add saves an audit event.
+func (AuditMapper) Add(ev *types.AuditEvent) error {
+	ev.Id = GetUidString()
+	if ev.CreatedAt.IsZero() {
+		ev.CreatedAt = types.TimeNow()
+	}
+	return adp.AuditAdd(ev)
+}
+
+// GetAll returns audit events matching the query, newest first.
+func (AuditMapper) GetAll(query *types.AuditQuery) ([]types.AuditEvent, error) {
+	return adp.AuditGetAll(query)
+}
+
+// OutboxMapper is a struct to map methods used for queueing messages to external services.
+type OutboxMapper struct{}
+
+// Outbox is an instance of OutboxMapper to be used for queueing messages to external services.
+var Outbox OutboxMapper
+
+// Maximum length of the error message saved with the message.
+const maxOutboxErrorLength = 255
+
+// Add queues a message for delivery. The message is due immediately unless NextAttemptAt is set.
+func (OutboxMapper) Add(msg *types.OutboxMessage) error {
+	msg.Id = GetUidString()
+	msg.InitTimes()
+	if msg.NextAttemptAt.IsZero() {
+		msg.NextAttemptAt = msg.CreatedAt
+	}
+	return adp.OutboxAdd(msg)
+}
+
+// GetDue returns up to limit messages of the given channel which are due for delivery.
+func (OutboxMapper) GetDue(channel string, limit int) ([]types.OutboxMessage, error) {
+	return adp.OutboxGetDue(channel, types.TimeNow(), limit)
+}
+
+// Claim postpones the next delivery attempt to 'until' so other processes don't attempt to
+// deliver the same message. Returns false if the message is already claimed by another process.
+func (OutboxMapper) Claim(msg *types.OutboxMessage, until time.Time) (bool, error) {
+	return adp.OutboxClaim(msg, until)
+}
+
+// Fail saves the outcome of a failed delivery attempt. The content of a dead message is discarded,
+// its NextAttemptAt is set to the time the message was given up on.
+func (OutboxMapper) Fail(msg *types.OutboxMessage) error {
+	msg.UpdatedAt = types.TimeNow()
+	if msg.Dead {
+		msg.Content = []byte{}
+		msg.NextAttemptAt = msg.UpdatedAt
+	}
+	if len(msg.LastError) > maxOutboxErrorLength {
+		msg.LastError = msg.LastError[:maxOutboxErrorLength]
+	}
+	return adp.OutboxUpdate(msg)
+}
+
+// Delete deletes a delivered message.
+func (OutboxMapper) Delete(id string) error {
+	return adp.OutboxDelete(id)
+}
+
+// Count returns the number of messages of the given channel pending delivery.
+func (OutboxMapper) Count(channel string) (int, error) {
+	return adp.OutboxCount(channel)
+}
+
+// DelDead deletes dead messages of the given channel which were given up on before olderThan.
+func (OutboxMapper) DelDead(channel string, olderThan time.Time) error {
+	return adp.OutboxDelDead(channel, olderThan)
+}
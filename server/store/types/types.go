@@ -10,6 +10,7 @@ import (
 	"errors"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -51,8 +52,31 @@ const (
 	ErrInvalidResponse = StoreError("invalid response")
 	// ErrRedirected means the subscription request was redirected to another topic.
 	ErrRedirected = StoreError("redirected")
+	// ErrLockedOut means authentication is temporarily disabled after too many failed attempts.
+	ErrLockedOut = StoreError("locked out")
+	// ErrRateLimited means the operation was attempted too frequently.
+	ErrRateLimited = StoreError("rate limited")
+	// ErrDailyLimit means the operation was attempted too many times today.
+	ErrDailyLimit = StoreError("daily limit exceeded")
+	// ErrCodeExpired means the validation code has expired and a new one must be requested.
+	ErrCodeExpired = StoreError("code expired")
+	// ErrQuotaExceeded means the storage quota of the user or the topic is exhausted.
+	ErrQuotaExceeded = StoreError("quota exceeded")
 )
 
+// PolicyError is a policy violation which identifies the violated rule.
+type PolicyError struct {
+	// What is being checked, e.g. "password".
+	What string
+	// Rule which was violated, e.g. "min_length".
+	Rule string
+}
+
+// Error is required by error interface.
+func (e *PolicyError) Error() string {
+	return string(ErrPolicy) + ": " + e.What + " " + e.Rule
+}
+
 // Uid is a database-specific record id, suitable to be used as a primary key.
 type Uid uint64
 
@@ -387,6 +411,23 @@ func (ss StringSlice) Value() (driver.Value, error) {
 	return json.Marshal(ss)
 }
 
+// IntSlice is defined so Scanner and Valuer can be attached to it.
+type IntSlice []int
+
+// Scan implements sql.Scanner interface.
+func (is *IntSlice) Scan(val interface{}) error {
+	if val == nil {
+		*is = nil
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), is)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (is IntSlice) Value() (driver.Value, error) {
+	return json.Marshal(is)
+}
+
 // ObjState represents information on objects state,
 // such as an indication that User or Topic is suspended/soft-deleted.
 type ObjState int
@@ -826,6 +867,82 @@ func (da DefaultAccess) Value() (driver.Value, error) {
 	return json.Marshal(da)
 }
 
+// NotifyPrefs is a per-subscription set of preferences for push notifications.
+type NotifyPrefs struct {
+	// Pushes are suppressed until this time.
+	MutedUntil *time.Time `json:"MutedUntil,omitempty" bson:",omitempty"`
+	// Only messages which mention the user generate visible pushes.
+	MentionsOnly bool `json:"MentionsOnly,omitempty" bson:",omitempty"`
+	// Daily period when pushes are delivered silently.
+	Quiet *QuietHours `json:"Quiet,omitempty" bson:",omitempty"`
+}
+
+// QuietHours is a daily period of time expressed as minutes since midnight in the given time zone.
+// The period wraps around midnight if From > To.
+type QuietHours struct {
+	From int
+	To   int
+	// IANA time zone name like "Europe/Berlin". Empty means UTC.
+	TZ string `json:"TZ,omitempty" bson:",omitempty"`
+}
+
+// IsEmpty checks if the preferences are all defaults.
+func (np *NotifyPrefs) IsEmpty() bool {
+	return np == nil || (np.MutedUntil == nil && !np.MentionsOnly && np.Quiet == nil)
+}
+
+// IsMuted checks if notifications are muted at the given time.
+func (np *NotifyPrefs) IsMuted(now time.Time) bool {
+	return np != nil && np.MutedUntil != nil && now.Before(*np.MutedUntil)
+}
+
+// Time zones of quiet hours keyed by IANA name. Loading a time zone reads the zoneinfo file,
+// too slow to do for every notification.
+var quietZones sync.Map
+
+// LoadQuietZone returns the time zone by IANA name. The empty name means UTC.
+func LoadQuietZone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	if loc, ok := quietZones.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	quietZones.Store(name, loc)
+	return loc, nil
+}
+
+// IsQuiet checks if the given time falls within quiet hours.
+func (np *NotifyPrefs) IsQuiet(now time.Time) bool {
+	if np == nil || np.Quiet == nil || np.Quiet.From == np.Quiet.To {
+		return false
+	}
+	loc, err := LoadQuietZone(np.Quiet.TZ)
+	if err != nil {
+		loc = time.UTC
+	}
+	now = now.In(loc)
+	min := now.Hour()*60 + now.Minute()
+	if np.Quiet.From < np.Quiet.To {
+		return min >= np.Quiet.From && min < np.Quiet.To
+	}
+	return min >= np.Quiet.From || min < np.Quiet.To
+}
+
+// Scan implements sql.Scanner interface.
+func (np *NotifyPrefs) Scan(val interface{}) error {
+	return json.Unmarshal(val.([]byte), np)
+}
+
+// Value implements sql's driver.Valuer interface.
+func (np NotifyPrefs) Value() (driver.Value, error) {
+	return json.Marshal(np)
+}
+
 // Credential hold data needed to validate and check validity of a credential like email or phone.
 type Credential struct {
 	ObjHeader `bson:",inline"`
@@ -867,6 +984,10 @@ type Subscription struct {
 	ModeGiven AccessMode
 	// User's private data associated with the subscription to topic
 	Private interface{}
+	// User's push notification preferences for the topic
+	Notify *NotifyPrefs `bson:",omitempty"`
+	// SeqIDs of the most recent unread messages which mention the user
+	Mentions IntSlice `bson:",omitempty"`
 
 	// Deserialized ephemeral values
 
@@ -1271,10 +1392,86 @@ type FileDef struct {
 	MimeType string
 	// Size of the file in bytes.
 	Size int64
+	// Total size of derived versions of the file, such as thumbnails, in bytes.
+	VariantSize int64
 	// Internal file location, i.e. path on disk or an S3 blob address.
 	Location string
 }
 
+// Quota is a limit on the total size of uploaded files of a user or a topic set by an administrator.
+// It overrides the default limit from the config.
+type Quota struct {
+	// Id is the ID of the user or the topic, i.e. "usrRkDVe0PYDOo" or "grpTkO8jXVUV6Y".
+	ObjHeader `bson:",inline"`
+	// Maximum total size of files in bytes, 0 means unlimited.
+	Limit int64
+}
+
+// AuthLockout is a record of failed authentication attempts made with the same login
+// or from the same IP address.
+type AuthLockout struct {
+	// Id is the key being tracked, i.e. "basic:login:alice" or "basic:ip:203.0.113.7".
+	// UpdatedAt is the time of the last failed attempt.
+	ObjHeader `bson:",inline"`
+	// Number of failed attempts since the last successful one.
+	Failures int
+	// Authentication attempts are rejected until this time.
+	LockedUntil time.Time
+	// Address of the client which made the last attempt to log in. Used by login records only.
+	Addr string
+}
+
+// AuditEvent is a record of a security-related event, such as a login, a password reset or a change
+// of account state.
+type AuditEvent struct {
+	Id        string `bson:"_id"`
+	CreatedAt time.Time
+	// Action being audited, e.g. "login".
+	Action string
+	// ID of the affected user, if known.
+	User string
+	// Authentication scheme or credential method used in the action.
+	Scheme string
+	// IP address and the user agent of the client.
+	RemoteAddr string
+	UserAgent  string
+	// "ok" or the reason why the action has failed.
+	Outcome string
+	// Optional action-specific details.
+	Params map[string]string
+}
+
+// AuditQuery is a filter for selecting audit events. Zero values do not restrict the selection.
+type AuditQuery struct {
+	User   string
+	Action string
+	// Events at or after this time.
+	Since time.Time
+	// Events before this time.
+	Before time.Time
+	// Maximum number of events to return.
+	Limit int
+}
+
+// OutboxMessage is a message queued for delivery to an external service, such as an email.
+type OutboxMessage struct {
+	ObjHeader `bson:",inline"`
+	// Delivery channel, e.g. "email".
+	Channel string
+	// Address of the recipient.
+	To string
+	// Serialized message ready to be sent.
+	Content []byte
+	// Number of failed delivery attempts.
+	Attempts int
+	// The next delivery attempt should be made at or after this time.
+	NextAttemptAt time.Time
+	// The message could not be delivered after all attempts.
+	Dead bool
+	// Error returned by the last failed attempt.
+	LastError string
+}
+
 // FlattenDoubleSlice turns 2d slice into a 1d slice.
 func FlattenDoubleSlice(data [][]string) []string {
 	var result []string
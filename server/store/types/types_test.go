@@ -0,0 +1,88 @@
+package types
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsMuted(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	later := now.Add(time.Hour)
+	earlier := now.Add(-time.Hour)
+
+	cases := []struct {
+		np    *NotifyPrefs
+		muted bool
+	}{
+		{nil, false},
+		{&NotifyPrefs{}, false},
+		{&NotifyPrefs{MutedUntil: &later}, true},
+		{&NotifyPrefs{MutedUntil: &now}, false},
+		{&NotifyPrefs{MutedUntil: &earlier}, false},
+	}
+	for i, tc := range cases {
+		if got := tc.np.IsMuted(now); got != tc.muted {
+			t.Errorf("%d: IsMuted=%v, expected %v", i, got, tc.muted)
+		}
+	}
+}
+
+func TestIsQuiet(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2020, 1, 15, hour, min, 0, 0, time.UTC)
+	}
+	quiet := func(from, to int, tz string) *NotifyPrefs {
+		return &NotifyPrefs{Quiet: &QuietHours{From: from, To: to, TZ: tz}}
+	}
+
+	cases := []struct {
+		np    *NotifyPrefs
+		now   time.Time
+		quiet bool
+	}{
+		{nil, at(12, 0), false},
+		{&NotifyPrefs{}, at(12, 0), false},
+		// Empty period.
+		{quiet(600, 600, ""), at(10, 0), false},
+		// Daytime period [09:00, 17:30).
+		{quiet(540, 1050, ""), at(8, 59), false},
+		{quiet(540, 1050, ""), at(9, 0), true},
+		{quiet(540, 1050, ""), at(17, 29), true},
+		{quiet(540, 1050, ""), at(17, 30), false},
+		// Period wraps around midnight [22:00, 07:00).
+		{quiet(1320, 420, ""), at(21, 59), false},
+		{quiet(1320, 420, ""), at(22, 0), true},
+		{quiet(1320, 420, ""), at(0, 0), true},
+		{quiet(1320, 420, ""), at(6, 59), true},
+		{quiet(1320, 420, ""), at(7, 0), false},
+		{quiet(1320, 420, ""), at(12, 0), false},
+		// Time zone: 22:00-07:00 in Tokyo (UTC+9) is 13:00-22:00 UTC.
+		{quiet(1320, 420, "Asia/Tokyo"), at(12, 59), false},
+		{quiet(1320, 420, "Asia/Tokyo"), at(13, 0), true},
+		{quiet(1320, 420, "Asia/Tokyo"), at(21, 59), true},
+		{quiet(1320, 420, "Asia/Tokyo"), at(23, 0), false},
+		// Invalid time zone is treated as UTC.
+		{quiet(1320, 420, "Invalid/Zone"), at(23, 0), true},
+	}
+	for i, tc := range cases {
+		if got := tc.np.IsQuiet(tc.now); got != tc.quiet {
+			t.Errorf("%d: IsQuiet(%s)=%v, expected %v", i, tc.now.Format("15:04"), got, tc.quiet)
+		}
+	}
+}
+
+func TestLoadQuietZone(t *testing.T) {
+	if loc, err := LoadQuietZone(""); err != nil || loc != time.UTC {
+		t.Errorf("expected UTC for empty zone, got %v, %v", loc, err)
+	}
+	first, err := LoadQuietZone("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, _ := LoadQuietZone("Europe/Berlin"); second != first {
+		t.Error("expected the time zone to be cached")
+	}
+	if _, err := LoadQuietZone("Invalid/Zone"); err == nil {
+		t.Error("expected an error for invalid zone")
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"time"
 
 	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/drafty"
 	"github.com/tinode/chat/server/push"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
@@ -143,6 +144,10 @@ type perUserData struct {
 	delID int
 
 	private interface{}
+	// Push notification preferences
+	notify *types.NotifyPrefs
+	// SeqIDs of unread messages which mention the user
+	mentions []int
 
 	modeWant  types.AccessMode
 	modeGiven types.AccessMode
@@ -377,6 +382,11 @@ func (t *Topic) runLocal(hub *Hub) {
 						log.Printf("topic[%s] meta.Get.Creds failed: %s", t.name, err)
 					}
 				}
+				if meta.pkt.MetaWhat&constMsgMetaQuota != 0 {
+					if err := t.replyGetQuota(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Quota failed: %s", t.name, err)
+					}
+				}
 
 			case meta.pkt.Set != nil:
 				// Set request
@@ -464,6 +474,11 @@ func (t *Topic) runLocal(hub *Hub) {
 			if sd.reason == StopDeleted {
 				if t.cat == types.TopicCatGrp {
 					t.presSubsOffline("gone", nilPresParams, nilPresFilters, nilPresFilters, "", false)
+					if !t.isProxy {
+						for _, rcpt := range t.pushForDelTopic() {
+							usersPush(rcpt)
+						}
+					}
 				}
 				// P2P users get "off+remove" earlier in the process
 
@@ -535,6 +550,13 @@ func (t *Topic) handleSubscription(h *Hub, join *sessionJoin) error {
 		}
 	}
 
+	if getWhat&constMsgMetaQuota != 0 {
+		// Send get.quota response as a separate {meta} packet
+		if err := t.replyGetQuota(join.sess, asUid, join.pkt); err != nil {
+			log.Printf("topic[%s] handleSubscription Get.Quota failed: %v sid=%s", t.name, err, join.sess.sid)
+		}
+	}
+
 	if getWhat&constMsgMetaData != 0 {
 		// Send get.data response as {data} packets
 		if err := t.replyGetData(join.sess, asUid, msgsub.Get.Data, join.pkt); err != nil {
@@ -856,6 +878,14 @@ func (t *Topic) handleBroadcast(msg *ServerComMessage) {
 		if t.isProxy {
 			t.lastID = msg.Data.SeqId
 		} else {
+			if t.cat == types.TopicCatGrp {
+				// Files attached to messages count towards the quota of the topic.
+				if params, err := checkAttachmentsQuota(t.name, msg.Data.Head); err != nil {
+					msg.sess.queueOut(decodeStoreError(err, msg.Id, t.original(asUid), msg.Timestamp, params))
+					return
+				}
+			}
+
 			// Save to DB at master topic.
 			if err := store.Messages.Save(&types.Message{
 				ObjHeader: types.ObjHeader{CreatedAt: msg.Data.Timestamp},
@@ -889,7 +919,9 @@ func (t *Topic) handleBroadcast(msg *ServerComMessage) {
 		}
 
 		if !t.isProxy {
-			pushRcpt = t.pushForData(asUser, msg.Data)
+			mentioned := t.mentionedUsers(asUser, msg.Data.Content)
+			t.saveMentions(mentioned, msg.Data.SeqId)
+			pushRcpt = t.pushForData(asUser, msg.Data, mentioned)
 
 			// Message sent: notify offline 'R' subscrbers on 'me'.
 			t.presSubsOffline("msg", &presParams{seqID: t.lastID, actor: msg.Data.From},
@@ -961,18 +993,28 @@ func (t *Topic) handleBroadcast(msg *ServerComMessage) {
 				if err := store.Subs.Update(t.name, asUser,
 					map[string]interface{}{
 						"RecvSeqId": pud.recvID,
-						"ReadSeqId": pud.readID},
-					false); err != nil {
+						"ReadSeqId": pud.readID}, false); err != nil {
 
 					log.Printf("topic[%s]: failed to update SeqRead/Recv counter: %v", t.name, err)
 					return
 				}
+				if mentions := trimMentions(pud.mentions, pud.readID); len(mentions) != len(pud.mentions) {
+					pud.mentions = mentions
+					t.persistMentions(map[types.Uid][]int{asUser: mentions})
+				}
 
 				// Read/recv updated: notify user's other sessions of the change
 				t.presPubMessageCount(asUser, mode, recv, read, msg.SkipSid)
 
 				// Update cached count of unread messages
 				usersUpdateUnread(asUser, unread, true)
+
+				if read > 0 {
+					// Let user's other devices retract notifications for the messages which were read.
+					for _, rcpt := range t.pushForRead(asUser, read, msg.sess) {
+						usersPush(rcpt)
+					}
+				}
 			}
 			t.perUser[asUser] = pud
 		}
@@ -1284,6 +1326,12 @@ func (t *Topic) thisUserSub(h *Hub, sess *Session, pkt *ClientComMessage, asUid
 
 		// Add subscription to database, if missing.
 		if sub == nil {
+			if sess.apiScopes&apiScopeWrite == 0 {
+				// API key without the write scope cannot create subscriptions.
+				sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+				return nil, errors.New("subscription not permitted by API key")
+			}
+
 			sub = &types.Subscription{
 				User:      asUid.String(),
 				Topic:     tname,
@@ -2207,6 +2255,9 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 				if isReader && !banned {
 					mts.ReadSeqId = sub.ReadSeqId
 					mts.RecvSeqId = sub.RecvSeqId
+					if uid == asUid {
+						mts.Mentions = len(trimMentions(sub.Mentions, sub.ReadSeqId))
+					}
 				}
 
 				if t.cat != types.TopicCatFnd {
@@ -2239,6 +2290,7 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 					// Reporting 'private' only if it's user's own subscription.
 					if uid == asUid {
 						mts.Private = sub.Private
+						mts.Notify = storeNotify2msgNotify(sub.Notify)
 					}
 				}
 
@@ -2287,6 +2339,19 @@ func (t *Topic) replySetSub(h *Hub, sess *Session, pkt *ClientComMessage) error
 	}
 
 	var err error
+	var notify *types.NotifyPrefs
+	if set.Sub.Notify != nil {
+		if target != asUid {
+			// Notification preferences of other users cannot be changed.
+			sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+			return types.ErrPermissionDenied
+		}
+		if notify, err = msgNotify2storeNotify(set.Sub.Notify); err != nil {
+			sess.queueOut(ErrMalformedReply(pkt, now))
+			return err
+		}
+	}
+
 	var modeChanged *MsgAccessMode
 	if target == asUid {
 		// Request new subscription or modify own subscription
@@ -2299,6 +2364,14 @@ func (t *Topic) replySetSub(h *Hub, sess *Session, pkt *ClientComMessage) error
 		return err
 	}
 
+	var notifyChanged bool
+	if set.Sub.Notify != nil {
+		if notifyChanged, err = t.updateNotifyPrefs(asUid, notify); err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, pkt.Id, pkt.Original, now, pkt.Timestamp, nil))
+			return err
+		}
+	}
+
 	var resp *ServerComMessage
 	if modeChanged != nil {
 		// Report resulting access mode.
@@ -2307,6 +2380,8 @@ func (t *Topic) replySetSub(h *Hub, sess *Session, pkt *ClientComMessage) error
 			params["user"] = target.UserId()
 		}
 		resp = NoErrParamsReply(pkt, now, params)
+	} else if notifyChanged {
+		resp = NoErrReply(pkt, now)
 	} else {
 		resp = InfoNotModifiedReply(pkt, now)
 	}
@@ -2316,6 +2391,23 @@ func (t *Topic) replySetSub(h *Hub, sess *Session, pkt *ClientComMessage) error
 	return nil
 }
 
+// updateNotifyPrefs saves user's push notification preferences and updates the cache.
+func (t *Topic) updateNotifyPrefs(uid types.Uid, notify *types.NotifyPrefs) (bool, error) {
+	pud, ok := t.perUser[uid]
+	if !ok || pud.deleted {
+		return false, types.ErrNotFound
+	}
+	if reflect.DeepEqual(pud.notify, notify) {
+		return false, nil
+	}
+	if err := store.Subs.Update(t.name, uid, map[string]interface{}{"Notify": notify}, true); err != nil {
+		return false, err
+	}
+	pud.notify = notify
+	t.perUser[uid] = pud
+	return true, nil
+}
+
 // replyGetData is a response to a get.data request - load a list of stored messages, send them to session as {data}
 // response goes to a single session rather than all sessions in a topic
 func (t *Topic) replyGetData(sess *Session, asUid types.Uid, req *MsgGetOpts, msg *ClientComMessage) error {
@@ -2406,6 +2498,37 @@ func (t *Topic) replyGetTags(sess *Session, asUid types.Uid, msg *ClientComMessa
 	return nil
 }
 
+// replyGetQuota returns usage of storage by files uploaded by the user ('me' topic) or
+// attached to messages in the group topic.
+func (t *Topic) replyGetQuota(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	var quota *MsgQuota
+	var err error
+	switch t.cat {
+	case types.TopicCatMe:
+		quota, err = userStorageQuota(asUid)
+	case types.TopicCatGrp:
+		if isChannel(msg.Original) {
+			// Channel readers cannot see the quota.
+			sess.queueOut(ErrPermissionDeniedReply(msg, now))
+			return errors.New("request for quota from channel reader")
+		}
+		quota, err = topicStorageQuota(t.name)
+	default:
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for getting quota")
+	}
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now, Quota: quota}})
+	return nil
+}
+
 // replySetTags updates topic's tags - tokens used for discovery.
 func (t *Topic) replySetTags(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
 	var resp *ServerComMessage
@@ -2518,7 +2641,7 @@ func (t *Topic) replySetCred(sess *Session, asUid types.Uid, authLevel auth.Leve
 	creds := []MsgCredClient{*set.Cred}
 	if set.Cred.Response != "" {
 		// Credential is being validated. Return an arror if response is invalid.
-		_, tags, err = validatedCreds(asUid, authLevel, creds, true)
+		_, tags, err = validatedCreds(sess, asUid, authLevel, creds, true)
 	} else {
 		// Credential is being added or updated.
 		tmpToken, _, _ := store.GetLogicalAuthHandler("token").GenSecret(&auth.Rec{
@@ -2526,7 +2649,9 @@ func (t *Topic) replySetCred(sess *Session, asUid types.Uid, authLevel auth.Leve
 			AuthLevel: auth.LevelNone,
 			Lifetime:  time.Hour * 24,
 			Features:  auth.FeatureNoLogin})
-		_, tags, err = addCreds(asUid, creds, nil, sess.lang, tmpToken)
+		if _, err = preCheckCreds(creds); err == nil {
+			_, tags, err = addCreds(asUid, creds, nil, sess.lang, sess.remoteAddr, tmpToken)
+		}
 	}
 
 	if tags != nil {
@@ -2699,6 +2824,10 @@ func (t *Topic) replyDelMsg(sess *Session, asUid types.Uid, msg *ClientComMessag
 
 	sess.queueOut(NoErrParamsReply(msg, now, map[string]int{"del": t.delID}))
 
+	for _, rcpt := range t.pushForDelMsg(asUid, ranges, del.Hard, now) {
+		usersPush(rcpt)
+	}
+
 	return nil
 }
 
@@ -3070,8 +3199,94 @@ func (t *Topic) notifySubChange(uid, actor types.Uid, isChan bool,
 	}
 }
 
+// mentionedUsers returns subscribers with read access mentioned in the message content, except the sender.
+func (t *Topic) mentionedUsers(fromUid types.Uid, content interface{}) map[types.Uid]bool {
+	var mentioned map[types.Uid]bool
+	for _, usr := range drafty.Mentions(content) {
+		uid := types.ParseUserId(usr)
+		if uid.IsZero() || uid == fromUid {
+			continue
+		}
+		if pud, ok := t.perUser[uid]; !ok || pud.deleted || !(pud.modeGiven & pud.modeWant).IsReader() {
+			continue
+		}
+		if mentioned == nil {
+			mentioned = make(map[types.Uid]bool)
+		}
+		mentioned[uid] = true
+	}
+	return mentioned
+}
+
+// saveMentions records the message as an unread mention for each of the mentioned users.
+func (t *Topic) saveMentions(mentioned map[types.Uid]bool, seqID int) {
+	if len(mentioned) == 0 {
+		return
+	}
+	updated := make(map[types.Uid][]int, len(mentioned))
+	for uid := range mentioned {
+		pud := t.perUser[uid]
+		pud.mentions = append(pud.mentions, seqID)
+		if len(pud.mentions) > maxUnreadMentions {
+			pud.mentions = pud.mentions[len(pud.mentions)-maxUnreadMentions:]
+		}
+		t.perUser[uid] = pud
+		updated[uid] = pud.mentions
+	}
+	t.persistMentions(updated)
+}
+
+// mentionsUpdate is a request to save lists of unread mentions of topic's subscribers.
+type mentionsUpdate struct {
+	topic    string
+	mentions map[types.Uid]types.IntSlice
+}
+
+// persistMentions saves unread mentions of subscribers in the background so the topic is not blocked
+// by the database. The cached mentions are the source of truth while the topic is loaded.
+func (t *Topic) persistMentions(mentions map[types.Uid][]int) {
+	if globals.mentionsUpdate == nil {
+		return
+	}
+	upd := &mentionsUpdate{topic: t.name, mentions: make(map[types.Uid]types.IntSlice, len(mentions))}
+	for uid, list := range mentions {
+		// Copy the list: the cached one will be changed by the topic.
+		upd.mentions[uid] = append(types.IntSlice{}, list...)
+	}
+	globals.mentionsUpdate <- upd
+}
+
+// Initialize the writer of unread mentions.
+func mentionsInit() {
+	globals.mentionsUpdate = make(chan *mentionsUpdate, 1024)
+
+	go mentionsUpdater()
+}
+
+// mentionsUpdater saves unread mentions in the order they were updated by topics.
+func mentionsUpdater() {
+	for upd := range globals.mentionsUpdate {
+		for uid, mentions := range upd.mentions {
+			if err := store.Subs.Update(upd.topic, uid,
+				map[string]interface{}{"Mentions": mentions}, false); err != nil {
+				log.Printf("topic[%s]: failed to save mentions: %v", upd.topic, err)
+			}
+		}
+	}
+}
+
+// trimMentions removes messages which have been read from the list of unread mentions.
+func trimMentions(mentions []int, readID int) []int {
+	for i, seq := range mentions {
+		if seq > readID {
+			return mentions[i:]
+		}
+	}
+	return nil
+}
+
 // Prepares a payload to be delivered to a mobile device as a push notification in response to a {data} message.
-func (t *Topic) pushForData(fromUid types.Uid, data *MsgServerData) *push.Receipt {
+func (t *Topic) pushForData(fromUid types.Uid, data *MsgServerData, mentioned map[types.Uid]bool) *push.Receipt {
 	// The `Topic` in the push receipt is `t.xoriginal` for group topics, `fromUid` for p2p topics,
 	// not the t.original(fromUid) because it's the topic name as seen by the recipient, not by the sender.
 	topic := t.xoriginal
@@ -3097,6 +3312,12 @@ func (t *Topic) pushForData(fromUid types.Uid, data *MsgServerData) *push.Receip
 		receipt.Channel = types.GrpToChn(t.xoriginal)
 	}
 
+	for uid := range mentioned {
+		receipt.Payload.Mentions = append(receipt.Payload.Mentions, uid.UserId())
+	}
+
+	now := types.TimeNow()
+	allSilent := true
 	for uid, pud := range t.perUser {
 		// Send only to those who have notifications enabled, exclude the originating user.
 		if uid == fromUid {
@@ -3104,14 +3325,22 @@ func (t *Topic) pushForData(fromUid types.Uid, data *MsgServerData) *push.Receip
 		}
 		mode := pud.modeWant & pud.modeGiven
 		if mode.IsPresencer() && mode.IsReader() && !pud.deleted {
+			// Users who muted the topic, are in quiet hours, or want only mentions still receive
+			// silent pushes to keep the unread counters current. Mentions override the mute.
+			silent := pud.notify.IsQuiet(now) || (!mentioned[uid] &&
+				(pud.notify.IsMuted(now) || (pud.notify != nil && pud.notify.MentionsOnly)))
 			receipt.To[uid] = push.Recipient{
 				// Number of sessions this data message will be delivered to.
 				// Push notifications sent to users with non-zero online sessions will be marked silent.
 				Delivered: pud.online,
+				Silent:    silent,
 			}
+			allSilent = allSilent && silent
 		}
 	}
 	if len(receipt.To) > 0 || receipt.Channel != "" {
+		// Channel subscribers have no individual preferences.
+		receipt.Payload.Silent = allSilent && len(receipt.To) > 0 && receipt.Channel == ""
 		return &receipt
 	}
 	// If there are no recipient there is no need to send the push notification.
@@ -3145,6 +3374,85 @@ func (t *Topic) pushForSub(fromUid, toUid types.Uid, want, given types.AccessMod
 	return &receipt
 }
 
+// Prepares silent push notifications which let users' devices update their state: retract displayed
+// notifications and update badges. One receipt is created for each topic name as seen by the recipients.
+func (t *Topic) pushForSilent(pl push.Payload, to map[types.Uid]push.Recipient) []*push.Receipt {
+	receipts := make(map[string]*push.Receipt)
+	for uid, rcptTo := range to {
+		topic := t.original(uid)
+		receipt := receipts[topic]
+		if receipt == nil {
+			receipt = &push.Receipt{To: make(map[types.Uid]push.Recipient), Payload: pl}
+			receipt.Payload.Silent = true
+			receipt.Payload.Topic = topic
+			receipts[topic] = receipt
+		}
+		receipt.To[uid] = rcptTo
+	}
+
+	var result []*push.Receipt
+	for _, receipt := range receipts {
+		result = append(result, receipt)
+	}
+	return result
+}
+
+// Prepares a push notification to the user's devices that the messages up to seqID were read.
+// The device which reported the read status is skipped.
+func (t *Topic) pushForRead(uid types.Uid, seqID int, sess *Session) []*push.Receipt {
+	var rcptTo push.Recipient
+	if sess != nil && sess.deviceID != "" {
+		rcptTo.Devices = []string{sess.deviceID}
+	}
+	return t.pushForSilent(push.Payload{
+		What:      push.ActRead,
+		From:      uid.UserId(),
+		Timestamp: types.TimeNow(),
+		SeqId:     seqID,
+	}, map[types.Uid]push.Recipient{uid: rcptTo})
+}
+
+// Prepares a push notification that messages were deleted. Soft deletion is reported to
+// the deleting user only, hard deletion to all readers.
+func (t *Topic) pushForDelMsg(fromUid types.Uid, ranges []types.Range, hard bool, now time.Time) []*push.Receipt {
+	to := make(map[types.Uid]push.Recipient)
+	if hard {
+		for uid, pud := range t.perUser {
+			if (pud.modeGiven&pud.modeWant).IsReader() && !pud.deleted {
+				to[uid] = push.Recipient{}
+			}
+		}
+	} else {
+		to[fromUid] = push.Recipient{}
+	}
+
+	var delSeq []push.DelRange
+	for _, r := range ranges {
+		delSeq = append(delSeq, push.DelRange{LowId: r.Low, HiId: r.Hi})
+	}
+	return t.pushForSilent(push.Payload{
+		What:      push.ActDelMsg,
+		From:      fromUid.UserId(),
+		Timestamp: now,
+		SeqId:     t.lastID,
+		DelSeq:    delSeq,
+	}, to)
+}
+
+// Prepares a push notification to all subscribers that the topic was deleted.
+func (t *Topic) pushForDelTopic() []*push.Receipt {
+	to := make(map[types.Uid]push.Recipient)
+	for uid, pud := range t.perUser {
+		if !pud.deleted {
+			to[uid] = push.Recipient{}
+		}
+	}
+	return t.pushForSilent(push.Payload{
+		What:      push.ActDelTopic,
+		Timestamp: types.TimeNow(),
+	}, to)
+}
+
 // FIXME: this won't work correctly with multiplexing sessions.
 func (t *Topic) mostRecentSession() *Session {
 	var sess *Session
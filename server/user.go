@@ -4,6 +4,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/tinode/chat/server/audit"
 	"github.com/tinode/chat/server/auth"
 	"github.com/tinode/chat/server/push"
 	"github.com/tinode/chat/server/store"
@@ -73,15 +74,11 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 	// Pre-check credentials for validity. We don't know user's access level
 	// consequently cannot check presence of required credentials. Must do that later.
 	creds := normalizeCredentials(msg.Acc.Cred, true)
-	for i := range creds {
-		cr := &creds[i]
-		vld := store.GetValidator(cr.Method)
-		if _, err := vld.PreCheck(cr.Value, cr.Params); err != nil {
-			log.Println("create user: failed credential pre-check", cr, err, s.sid)
-			s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp,
-				map[string]interface{}{"what": cr.Method}))
-			return
-		}
+	if method, err := preCheckCreds(creds); err != nil {
+		log.Println("create user: failed credential pre-check", method, err, s.sid)
+		s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp,
+			map[string]interface{}{"what": method}))
+		return
 	}
 
 	// Assign default access values in case the acc creator has not provided them
@@ -119,6 +116,7 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 	// Create user record in the database.
 	if _, err := store.Users.Create(&user, private); err != nil {
 		log.Println("create user: failed to create user", err, s.sid)
+		auditEvent(s, audit.ActCreate, types.ZeroUid, msg.Acc.Scheme, err, nil)
 		s.queueOut(ErrUnknown(msg.Id, "", msg.Timestamp))
 		return
 	}
@@ -129,6 +127,7 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 		log.Println("create user: add auth record failed", err, s.sid)
 		// Attempt to delete incomplete user record
 		store.Users.Delete(user.Uid(), false)
+		auditEvent(s, audit.ActCreate, user.Uid(), msg.Acc.Scheme, err, nil)
 		s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp, nil))
 		return
 	}
@@ -140,6 +139,7 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 		// Attempt to delete incomplete user record
 		store.Users.Delete(user.Uid(), false)
 		_, missing := stringSliceDelta(globals.authValidators[rec.AuthLevel], credentialMethods(creds))
+		auditEvent(s, audit.ActCreate, user.Uid(), msg.Acc.Scheme, types.ErrPolicy, nil)
 		s.queueOut(decodeStoreError(types.ErrPolicy, msg.Id, "", msg.Timestamp,
 			map[string]interface{}{"creds": missing}))
 		return
@@ -151,11 +151,12 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 		AuthLevel: auth.LevelNone,
 		Lifetime:  time.Hour * 24,
 		Features:  auth.FeatureNoLogin})
-	validated, _, err := addCreds(user.Uid(), creds, rec.Tags, s.lang, tmpToken)
+	validated, _, err := addCreds(user.Uid(), creds, rec.Tags, s.lang, s.remoteAddr, tmpToken)
 	if err != nil {
 		// Delete incomplete user record.
 		store.Users.Delete(user.Uid(), false)
 		log.Println("create user: failed to save or validate credential", err, s.sid)
+		auditEvent(s, audit.ActCreate, user.Uid(), msg.Acc.Scheme, err, nil)
 		s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp, nil))
 		return
 	}
@@ -185,6 +186,7 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 
 	s.queueOut(reply)
 
+	auditEvent(s, audit.ActCreate, user.Uid(), msg.Acc.Scheme, nil, nil)
 	pluginAccount(&user, plgActCreate)
 }
 
@@ -263,7 +265,9 @@ func replyUpdateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 			AuthLevel: auth.LevelNone,
 			Lifetime:  time.Hour * 24,
 			Features:  auth.FeatureNoLogin})
-		_, _, err := addCreds(uid, msg.Acc.Cred, nil, s.lang, tmpToken)
+		if _, err = preCheckCreds(msg.Acc.Cred); err == nil {
+			_, _, err = addCreds(uid, msg.Acc.Cred, nil, s.lang, s.remoteAddr, tmpToken)
+		}
 		if err == nil {
 			if allCreds, err := store.Users.GetAllCreds(uid, "", true); err != nil {
 				var validated []string
@@ -324,10 +328,28 @@ func updateUserAuth(msg *ClientComMessage, user *types.User, rec *auth.Rec) erro
 	return types.ErrMalformed
 }
 
+// preCheckCreds checks credentials for validity before they are added to the account.
+// Returns the method of the first invalid credential with the error.
+func preCheckCreds(creds []MsgCredClient) (string, error) {
+	for i := range creds {
+		cr := &creds[i]
+		vld := store.GetValidator(cr.Method)
+		if vld == nil {
+			// Unknown validators are ignored by addCreds.
+			continue
+		}
+		if _, err := vld.PreCheck(cr.Value, cr.Params); err != nil {
+			return cr.Method, err
+		}
+	}
+	return "", nil
+}
+
 // addCreds adds new credentials and re-send validation request for existing ones. It also adds credential-defined
 // tags if necessary.
 // Returns methods validated in this call only. Returns either a full set of tags or nil for tags when tags are unchanged.
-func addCreds(uid types.Uid, creds []MsgCredClient, extraTags []string, lang string, tmpToken []byte) ([]string, []string, error) {
+func addCreds(uid types.Uid, creds []MsgCredClient, extraTags []string, lang, remoteAddr string,
+	tmpToken []byte) ([]string, []string, error) {
 	var validated []string
 	for i := range creds {
 		cr := &creds[i]
@@ -337,7 +359,7 @@ func addCreds(uid types.Uid, creds []MsgCredClient, extraTags []string, lang str
 			continue
 		}
 
-		isNew, err := vld.Request(uid, cr.Value, lang, cr.Response, tmpToken)
+		isNew, err := vld.Request(uid, cr.Value, lang, cr.Response, tmpToken, remoteAddr)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -370,7 +392,7 @@ func addCreds(uid types.Uid, creds []MsgCredClient, extraTags []string, lang str
 // validatedCreds returns the list of validated credentials including those validated in this call.
 // Returns all validated methods including those validated earlier and now.
 // Returns either a full set of tags or nil for tags if tags are unchanged.
-func validatedCreds(uid types.Uid, authLvl auth.Level, creds []MsgCredClient, errorOnFail bool) ([]string, []string, error) {
+func validatedCreds(s *Session, uid types.Uid, authLvl auth.Level, creds []MsgCredClient, errorOnFail bool) ([]string, []string, error) {
 
 	// Check if credential validation is required.
 	if len(globals.authValidators[authLvl]) == 0 {
@@ -401,10 +423,16 @@ func validatedCreds(uid types.Uid, authLvl auth.Level, creds []MsgCredClient, er
 
 		vld := store.GetValidator(cr.Method) // No need to check for nil, unknown methods are removed earlier.
 		value, err := vld.Check(uid, cr.Response)
+		auditEvent(s, audit.ActCred, uid, cr.Method, err, nil)
 		if err != nil {
 			// Check failed.
-			if storeErr, ok := err.(types.StoreError); ok && storeErr == types.ErrCredentials {
+			if storeErr, ok := err.(types.StoreError); ok &&
+				(storeErr == types.ErrCredentials || storeErr == types.ErrCodeExpired) {
 				if errorOnFail {
+					if storeErr == types.ErrCodeExpired {
+						// Report that a new code must be requested.
+						return nil, nil, err
+					}
 					// Report invalid response.
 					return nil, nil, types.ErrInvalidResponse
 				}
@@ -522,16 +550,35 @@ func deleteCred(uid types.Uid, authLvl auth.Level, cred *MsgCredClient) ([]strin
 // 3. Suspend/activate p2p with the user.
 // 4. Suspend/activate grp topics where the user is the owner.
 // 5. Update user's DB record.
-func changeUserState(s *Session, uid types.Uid, user *types.User, msg *ClientComMessage) (bool, error) {
+// Setting state to normal (ok) also clears lockouts caused by failed login attempts.
+func changeUserState(s *Session, uid types.Uid, user *types.User, msg *ClientComMessage) (changed bool, err error) {
 	state, err := types.NewObjState(msg.Acc.State)
 	if err != nil || state == types.StateUndefined {
 		log.Println("replyUpdateUser: invalid account state", s.sid)
 		return false, types.ErrMalformed
 	}
 
+	defer func() {
+		if changed || err != nil {
+			auditEvent(s, audit.ActState, uid, "", err,
+				map[string]string{"state": state.String(), "by": s.uid.UserId()})
+		}
+	}()
+
+	var unlocked bool
+	if state == types.StateOK {
+		for _, name := range store.GetAuthNames() {
+			ok, err := store.GetAuthHandler(name).UnlockRecords(uid)
+			if err != nil {
+				return false, err
+			}
+			unlocked = unlocked || ok
+		}
+	}
+
 	// State unchanged.
 	if user.State == state {
-		return false, nil
+		return unlocked, nil
 	}
 
 	if state != types.StateOK {
@@ -891,9 +938,15 @@ func userUpdater() {
 
 		// Request to send push notifications.
 		if upd.PushRcpt != nil {
+			// Silent updates report the current count without changing it.
+			inc := 1
+			switch upd.PushRcpt.Payload.What {
+			case push.ActRead, push.ActDelMsg, push.ActDelTopic:
+				inc = 0
+			}
 			for uid, rcptTo := range upd.PushRcpt.To {
 				// Handle update
-				unread := unreadUpdater(uid, 1, true)
+				unread := unreadUpdater(uid, inc, true)
 				if unread >= 0 {
 					rcptTo.Unread = unread
 					upd.PushRcpt.To[uid] = rcptTo
@@ -943,3 +996,31 @@ func userUpdater() {
 
 	log.Println("users: shutdown")
 }
+
+const (
+	// Records of failed authentication attempts are deleted when they have not been updated for this long.
+	authLockoutLifetime = 7 * 24 * time.Hour
+	// How often expired records of failed authentication attempts are deleted.
+	authLockoutGcPeriod = time.Hour
+)
+
+// authLockoutRunGarbageCollection periodically deletes expired records of failed authentication attempts.
+func authLockoutRunGarbageCollection(period time.Duration) chan<- bool {
+	// Unbuffered stop channel. Whoever stops it must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		gcTimer := time.Tick(period)
+		for {
+			select {
+			case <-gcTimer:
+				if err := store.Users.DelExpiredAuthLockouts(time.Now().Add(-authLockoutLifetime)); err != nil {
+					log.Println("lockouts gc:", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
@@ -20,12 +20,16 @@ import (
 	"unicode/utf8"
 
 	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/push"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 
 	"golang.org/x/crypto/acme/autocert"
 )
 
+// APNs device token: hex-encoded bytes. FCM tokens are never pure hex.
+var apnsTokenRegexp = regexp.MustCompile(`^[0-9a-fA-F]{64,200}$`)
+
 // Tag with prefix:
 // * prefix starts with an ASCII letter, contains ASCII letters, numbers, from 2 to 16 chars
 // * tag body may contain Unicode letters and numbers, as well as the following symbols: +-.!?#@_
@@ -217,6 +221,61 @@ func msgOpts2storeOpts(req *MsgGetOpts) *types.QueryOpt {
 	return opts
 }
 
+// Converts push notification preferences from the client to the database format.
+// Empty preferences are returned as nil.
+func msgNotify2storeNotify(src *MsgNotifyPrefs) (*types.NotifyPrefs, error) {
+	dst := &types.NotifyPrefs{MentionsOnly: src.MentionsOnly}
+	if src.MutedUntil != nil && src.MutedUntil.After(types.TimeNow()) {
+		mutedUntil := src.MutedUntil.UTC().Round(time.Millisecond)
+		dst.MutedUntil = &mutedUntil
+	}
+	if src.Quiet != nil {
+		from, err := parseClockTime(src.Quiet.From)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseClockTime(src.Quiet.To)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := types.LoadQuietZone(src.Quiet.TZ); err != nil {
+			return nil, err
+		}
+		if from != to {
+			dst.Quiet = &types.QuietHours{From: from, To: to, TZ: src.Quiet.TZ}
+		}
+	}
+	if dst.IsEmpty() {
+		return nil, nil
+	}
+	return dst, nil
+}
+
+// Converts push notification preferences from the database to the client format.
+func storeNotify2msgNotify(src *types.NotifyPrefs) *MsgNotifyPrefs {
+	if src.IsEmpty() {
+		return nil
+	}
+	dst := &MsgNotifyPrefs{MutedUntil: src.MutedUntil, MentionsOnly: src.MentionsOnly}
+	if src.Quiet != nil {
+		dst.Quiet = &MsgQuietHours{
+			From: fmt.Sprintf("%02d:%02d", src.Quiet.From/60, src.Quiet.From%60),
+			To:   fmt.Sprintf("%02d:%02d", src.Quiet.To/60, src.Quiet.To%60),
+			TZ:   src.Quiet.TZ,
+		}
+	}
+	return dst
+}
+
+// Parses time of day "HH:MM" into minutes since midnight.
+func parseClockTime(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
 // Check if the interface contains a string with a single Unicode Del control character.
 func isNullValue(i interface{}) bool {
 	if str, ok := i.(string); ok {
@@ -237,6 +296,13 @@ func decodeStoreErrorExplicitTs(err error, id, topic string, serverTs, incomingR
 
 	if err == nil {
 		errmsg = NoErrExplicitTs(id, topic, serverTs, incomingReqTs)
+	} else if policyErr, ok := err.(*types.PolicyError); ok {
+		errmsg = ErrPolicyExplicitTs(id, topic, serverTs, incomingReqTs)
+		if params == nil {
+			params = make(map[string]interface{})
+		}
+		params["what"] = policyErr.What
+		params["rule"] = policyErr.Rule
 	} else if storeErr, ok := err.(types.StoreError); !ok {
 		errmsg = ErrUnknownExplicitTs(id, topic, serverTs, incomingReqTs)
 	} else {
@@ -255,6 +321,16 @@ func decodeStoreErrorExplicitTs(err error, id, topic string, serverTs, incomingR
 			errmsg = ErrNotImplemented(id, topic, serverTs, incomingReqTs)
 		case types.ErrExpired:
 			errmsg = ErrAuthFailed(id, topic, serverTs, incomingReqTs)
+		case types.ErrLockedOut:
+			errmsg = ErrAuthLockedOut(id, topic, serverTs, incomingReqTs)
+		case types.ErrRateLimited:
+			errmsg = ErrTooManyRequests(id, topic, serverTs, incomingReqTs)
+		case types.ErrDailyLimit:
+			errmsg = ErrDailyLimitExceeded(id, topic, serverTs, incomingReqTs)
+		case types.ErrCodeExpired:
+			errmsg = ErrCodeExpired(id, topic, serverTs, incomingReqTs)
+		case types.ErrQuotaExceeded:
+			errmsg = ErrQuotaExceeded(id, topic, serverTs, incomingReqTs)
 		case types.ErrPolicy:
 			errmsg = ErrPolicyExplicitTs(id, topic, serverTs, incomingReqTs)
 		case types.ErrCredentials:
@@ -432,7 +508,7 @@ func rewriteTag(orig, countryCode string, withLogin bool) string {
 	}
 
 	// Check if token can be rewritten by any of the validators
-	param := map[string]interface{}{"countryCode": countryCode}
+	param := map[string]interface{}{"countryCode": countryCode, "tagOnly": true}
 	for name, conf := range globals.validators {
 		if conf.addToTags {
 			val := store.GetValidator(name)
@@ -690,6 +766,16 @@ func platformFromUA(ua string) string {
 	return ""
 }
 
+// devicePlatform returns the platform to save with the device ID. Browsers which use Web Push
+// subscriptions as device IDs declare the "webpush" platform explicitly, iOS devices may use hex-encoded
+// APNs tokens instead of FCM tokens. They are saved with distinct platforms.
+func devicePlatform(deviceID, platf string) string {
+	if platf == "ios" && apnsTokenRegexp.MatchString(deviceID) {
+		return push.PlatformAPNs
+	}
+	return platf
+}
+
 func parseTLSConfig(tlsEnabled bool, jsconfig json.RawMessage) (*tls.Config, error) {
 	type tlsAutocertConfig struct {
 		// Domains to support by autocert
@@ -0,0 +1,227 @@
+// Package captcha is a credential validator which verifies reCAPTCHA or hCaptcha tokens.
+package captcha
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// Validator configuration.
+type validator struct {
+	// URL of the verification endpoint. Any endpoint compatible with reCAPTCHA siteverify API
+	// can be used, e.g. "https://hcaptcha.com/siteverify". Defaults to reCAPTCHA.
+	VerifyUrl string `json:"verify_url"`
+	// Secret key shared between the site and the captcha service.
+	Secret string `json:"secret"`
+	// Minimum acceptable score for score-based captchas like reCAPTCHA v3, 0 to disable the check.
+	MinScore float64 `json:"min_score"`
+	// Optional expected action for reCAPTCHA v3.
+	Action string `json:"action"`
+	// Optional list of site host names where the captcha is expected to be solved.
+	Hostnames []string `json:"hostnames"`
+	// Request timeout in seconds.
+	Timeout int `json:"timeout"`
+	// Optional response which bypasses the validation.
+	DebugResponse string `json:"debug_response"`
+
+	client *http.Client
+}
+
+const (
+	validatorName = "captcha"
+
+	defaultVerifyUrl = "https://www.google.com/recaptcha/api/siteverify"
+	// Default timeout of requests to the verification endpoint.
+	defaultTimeout = 10 * time.Second
+	// Maximum size of the verification response to read.
+	maxResponseSize = 4096
+	// Captcha tokens are rather long, but not longer than that.
+	maxTokenLength = 8192
+)
+
+// Response of the verification endpoint.
+type verifyResponse struct {
+	Success    bool     `json:"success"`
+	Score      *float64 `json:"score"`
+	Action     string   `json:"action"`
+	Hostname   string   `json:"hostname"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+// Init initializes the validator.
+func (v *validator) Init(jsonconf string) error {
+	if err := json.Unmarshal([]byte(jsonconf), v); err != nil {
+		return err
+	}
+
+	if v.Secret == "" {
+		return errors.New("captcha secret not specified")
+	}
+	if v.VerifyUrl == "" {
+		v.VerifyUrl = defaultVerifyUrl
+	}
+	if verifyUrl, err := url.Parse(v.VerifyUrl); err != nil {
+		return err
+	} else if !verifyUrl.IsAbs() || verifyUrl.Hostname() == "" {
+		return errors.New("invalid verify_url")
+	}
+
+	timeout := time.Duration(v.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	v.client = &http.Client{Timeout: timeout}
+
+	return nil
+}
+
+// PreCheck accepts any value: the captcha is verified in Request when the response is available.
+// Captcha is not a tag.
+func (*validator) PreCheck(cred string, params map[string]interface{}) (string, error) {
+	return "", nil
+}
+
+// Request verifies the captcha token passed as the response. The captcha must be solved
+// immediately, so the request fails if the response is missing or invalid.
+func (v *validator) Request(user t.Uid, cred, lang, resp string, tmpToken []byte, remoteAddr string) (bool, error) {
+	if err := v.verify(resp, remoteAddr); err != nil {
+		return false, err
+	}
+	return v.confirm(user)
+}
+
+// ResetSecret is not supported: captcha cannot be used to deliver messages.
+func (*validator) ResetSecret(cred, scheme, lang string, tmpToken []byte, params map[string]interface{}, remoteAddr string) error {
+	return t.ErrUnsupported
+}
+
+// Check verifies the captcha token for an existing user, e.g. at login.
+func (v *validator) Check(user t.Uid, resp string) (string, error) {
+	if err := v.verify(resp, ""); err != nil {
+		if err == t.ErrInvalidResponse {
+			err = t.ErrCredentials
+		}
+		return "", err
+	}
+	if _, err := v.confirm(user); err != nil {
+		return "", err
+	}
+	return user.UserId(), nil
+}
+
+// Delete deletes user's records.
+func (*validator) Delete(user t.Uid) error {
+	return store.Users.DelCred(user, validatorName, "")
+}
+
+// Remove deletes user's captcha record.
+func (*validator) Remove(user t.Uid, value string) error {
+	return store.Users.DelCred(user, validatorName, value)
+}
+
+// confirm saves a confirmed credential. The value is the user ID because confirmed
+// values must be unique across users.
+func (*validator) confirm(user t.Uid) (bool, error) {
+	isNew, err := store.Users.UpsertCred(&t.Credential{
+		User:   user.String(),
+		Method: validatorName,
+		Value:  user.UserId(),
+		Done:   true})
+	if err == t.ErrDuplicate {
+		// Already confirmed.
+		return false, nil
+	}
+	return isNew, err
+}
+
+// verify checks the token with the verification endpoint. Returns types.ErrInvalidResponse if
+// the token is rejected.
+func (v *validator) verify(token, remoteAddr string) error {
+	if token == "" || len(token) > maxTokenLength {
+		return t.ErrInvalidResponse
+	}
+	if v.DebugResponse != "" && token == v.DebugResponse {
+		return nil
+	}
+
+	form := url.Values{}
+	form.Set("secret", v.Secret)
+	form.Set("response", token)
+	if remoteAddr != "" {
+		if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+			remoteAddr = host
+		}
+		form.Set("remoteip", remoteAddr)
+	}
+
+	resp, err := v.client.PostForm(v.VerifyUrl, form)
+	if err != nil {
+		log.Println("captcha: verification request failed", err)
+		return t.ErrInternal
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		log.Println("captcha: failed to read verification response", err)
+		return t.ErrInternal
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Println("captcha: verification endpoint responded", resp.StatusCode, string(body))
+		return t.ErrInternal
+	}
+
+	var result verifyResponse
+	if err = json.Unmarshal(body, &result); err != nil {
+		log.Println("captcha: invalid verification response", err)
+		return t.ErrInternal
+	}
+
+	if err = v.checkResult(&result); err != nil {
+		log.Println("captcha: token rejected:", err)
+		return t.ErrInvalidResponse
+	}
+	return nil
+}
+
+// checkResult applies the configured requirements to the verification result.
+func (v *validator) checkResult(result *verifyResponse) error {
+	if !result.Success {
+		return fmt.Errorf("verification failed %v", result.ErrorCodes)
+	}
+	if v.MinScore > 0 && result.Score != nil && *result.Score < v.MinScore {
+		return fmt.Errorf("score %.2f is too low", *result.Score)
+	}
+	if v.Action != "" && result.Action != v.Action {
+		return fmt.Errorf("unexpected action '%s'", result.Action)
+	}
+	if len(v.Hostnames) > 0 {
+		var found bool
+		for _, host := range v.Hostnames {
+			if strings.EqualFold(host, result.Hostname) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unexpected hostname '%s'", result.Hostname)
+		}
+	}
+	return nil
+}
+
+func init() {
+	store.RegisterValidator(validatorName, &validator{})
+}
@@ -0,0 +1,202 @@
+package captcha
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	adapter "github.com/tinode/chat/server/db"
+	"github.com/tinode/chat/server/store"
+	types "github.com/tinode/chat/server/store/types"
+)
+
+// memAdapter keeps credentials in memory. Methods which are not used by the validator are not implemented.
+type memAdapter struct {
+	adapter.Adapter
+	open  bool
+	creds map[string]*types.Credential
+}
+
+func (a *memAdapter) GetName() string                   { return "mem" }
+func (a *memAdapter) IsOpen() bool                      { return a.open }
+func (a *memAdapter) SetMaxResults(val int) error       { return nil }
+func (a *memAdapter) Open(config json.RawMessage) error { a.open = true; return nil }
+func (a *memAdapter) CheckDbVersion() error             { return nil }
+
+func (a *memAdapter) CredUpsert(cred *types.Credential) (bool, error) {
+	key := cred.User + ":" + cred.Method
+	_, found := a.creds[key]
+	saved := *cred
+	a.creds[key] = &saved
+	return !found, nil
+}
+
+var mem = &memAdapter{creds: make(map[string]*types.Credential)}
+
+func TestMain(m *testing.M) {
+	store.RegisterAdapter(mem)
+	if err := store.Open(1, json.RawMessage(`{"uid_key":"la6YsO+bNX/+XIkOqc5Svw=="}`)); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestValidator creates a validator which verifies tokens with a fake endpoint. The endpoint
+// responds with the result of respond for the submitted form.
+func newTestValidator(t *testing.T, config map[string]interface{},
+	respond func(w http.ResponseWriter, form url.Values)) *validator {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		r.ParseForm()
+		respond(w, r.PostForm)
+	}))
+	t.Cleanup(srv.Close)
+
+	config["verify_url"] = srv.URL
+	config["secret"] = "test-secret"
+	conf, _ := json.Marshal(config)
+	v := &validator{}
+	if err := v.Init(string(conf)); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// respondJSON returns a handler which writes the verification result.
+func respondJSON(result string) func(w http.ResponseWriter, form url.Values) {
+	return func(w http.ResponseWriter, form url.Values) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(result))
+	}
+}
+
+func TestVerifySuccess(t *testing.T) {
+	var received url.Values
+	v := newTestValidator(t, map[string]interface{}{"hostnames": []string{"example.com"}},
+		func(w http.ResponseWriter, form url.Values) {
+			received = form
+			respondJSON(`{"success":true,"hostname":"Example.com"}`)(w, form)
+		})
+
+	user := types.Uid(1001)
+	isNew, err := v.Request(user, "", "", "token-1", nil, "203.0.113.7:45678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isNew {
+		t.Error("credential not created")
+	}
+	for key, expected := range map[string]string{
+		"secret":   "test-secret",
+		"response": "token-1",
+		"remoteip": "203.0.113.7",
+	} {
+		if got := received.Get(key); got != expected {
+			t.Errorf("form %s: '%s', expected '%s'", key, got, expected)
+		}
+	}
+	if cred := mem.creds[user.String()+":"+validatorName]; cred == nil || !cred.Done || cred.Value != user.UserId() {
+		t.Error("credential", cred)
+	}
+
+	// Checking at login confirms the same credential again.
+	value, err := v.Check(user, "token-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != user.UserId() {
+		t.Error("checked value", value)
+	}
+	if received.Get("remoteip") != "" {
+		t.Error("remoteip sent at login", received.Get("remoteip"))
+	}
+}
+
+func TestVerifyFailure(t *testing.T) {
+	user := types.Uid(1002)
+	config := map[string]interface{}{"min_score": 0.5, "action": "signup", "hostnames": []string{"example.com"}}
+	cases := []struct {
+		name   string
+		result string
+	}{
+		{"rejected", `{"success":false,"error-codes":["invalid-input-response"]}`},
+		{"low score", `{"success":true,"score":0.1,"action":"signup","hostname":"example.com"}`},
+		{"wrong action", `{"success":true,"score":0.9,"action":"login","hostname":"example.com"}`},
+		{"wrong hostname", `{"success":true,"score":0.9,"action":"signup","hostname":"evil.com"}`},
+	}
+	for _, tc := range cases {
+		v := newTestValidator(t, config, respondJSON(tc.result))
+		if _, err := v.Request(user, "", "", "token", nil, ""); err != types.ErrInvalidResponse {
+			t.Error(tc.name, "request:", err)
+		}
+		if _, err := v.Check(user, "token"); err != types.ErrCredentials {
+			t.Error(tc.name, "check:", err)
+		}
+	}
+	if cred := mem.creds[user.String()+":"+validatorName]; cred != nil {
+		t.Error("credential saved for rejected token", cred)
+	}
+
+	// Missing token is rejected without calling the endpoint.
+	calls := 0
+	v := newTestValidator(t, map[string]interface{}{"debug_response": "debug-token"},
+		func(w http.ResponseWriter, form url.Values) {
+			calls++
+			respondJSON(`{"success":true}`)(w, form)
+		})
+	if _, err := v.Request(user, "", "", "", nil, ""); err != types.ErrInvalidResponse {
+		t.Error("empty token:", err)
+	}
+	// Debug response bypasses the endpoint too.
+	if _, err := v.Request(user, "", "", "debug-token", nil, ""); err != nil {
+		t.Error("debug token:", err)
+	}
+	if calls != 0 {
+		t.Error("endpoint called", calls, "times")
+	}
+}
+
+func TestVerifyEndpointError(t *testing.T) {
+	user := types.Uid(1003)
+	cases := []struct {
+		name    string
+		respond func(w http.ResponseWriter, form url.Values)
+	}{
+		{"server error", func(w http.ResponseWriter, form url.Values) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}},
+		{"invalid response", respondJSON(`<html>`)},
+	}
+	for _, tc := range cases {
+		v := newTestValidator(t, map[string]interface{}{}, tc.respond)
+		if _, err := v.Request(user, "", "", "token", nil, ""); err != types.ErrInternal {
+			t.Error(tc.name, "request:", err)
+		}
+		// Failure of the endpoint is not reported as invalid credentials.
+		if _, err := v.Check(user, "token"); err != types.ErrInternal {
+			t.Error(tc.name, "check:", err)
+		}
+	}
+}
+
+func TestVerifyTimeout(t *testing.T) {
+	release := make(chan struct{})
+	v := newTestValidator(t, map[string]interface{}{"timeout": 1},
+		func(w http.ResponseWriter, form url.Values) {
+			<-release
+		})
+	// Unblock the handler before the server is closed.
+	t.Cleanup(func() { close(release) })
+
+	if _, err := v.Request(types.Uid(1004), "", "", "token", nil, ""); err != types.ErrInternal {
+		t.Error("expected internal error, got", err)
+	}
+}
@@ -0,0 +1,203 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers signed by default, if present in the message.
+var defaultDKIMHeaders = []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version",
+	"Content-Type", "Content-Transfer-Encoding"}
+
+// DKIM signing configuration.
+type dkimConfig struct {
+	// Signing domain, e.g. "example.com". Defaults to the domain of the sender.
+	Domain string `json:"domain"`
+	// Selector of the public key published in DNS as <selector>._domainkey.<domain>.
+	Selector string `json:"selector"`
+	// Path to PEM-encoded RSA private key, PKCS#1 or PKCS#8.
+	PrivateKeyFile string `json:"private_key_file"`
+	// Optional list of headers to sign.
+	Headers []string `json:"headers"`
+}
+
+// dkimSigner signs messages with rsa-sha256 using relaxed/relaxed canonicalization (RFC 6376).
+type dkimSigner struct {
+	domain   string
+	selector string
+	key      *rsa.PrivateKey
+	headers  []string
+}
+
+func newDKIMSigner(config *dkimConfig, senderDomain string) (*dkimSigner, error) {
+	if config.Selector == "" {
+		return nil, errors.New("dkim: selector not specified")
+	}
+	if config.PrivateKeyFile == "" {
+		return nil, errors.New("dkim: private_key_file not specified")
+	}
+
+	data, err := ioutil.ReadFile(resolveTemplatePath(config.PrivateKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("dkim: no PEM data found in " + config.PrivateKeyFile)
+	}
+	var key *rsa.PrivateKey
+	if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.New("dkim: failed to parse private key: " + err.Error())
+		}
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); !ok {
+			return nil, errors.New("dkim: private key is not RSA")
+		}
+	}
+
+	signer := &dkimSigner{
+		domain:   config.Domain,
+		selector: config.Selector,
+		key:      key,
+		headers:  config.Headers,
+	}
+	if signer.domain == "" {
+		signer.domain = senderDomain
+	}
+	if len(signer.headers) == 0 {
+		signer.headers = defaultDKIMHeaders
+	}
+	return signer, nil
+}
+
+// Replace runs of spaces and tabs with a single space.
+func compressWSP(s string) string {
+	var b strings.Builder
+	wsp := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			wsp = true
+			continue
+		}
+		if wsp {
+			b.WriteByte(' ')
+			wsp = false
+		}
+		b.WriteByte(s[i])
+	}
+	if wsp {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// relaxedHeader canonicalizes a header field using the "relaxed" algorithm.
+func relaxedHeader(field string) string {
+	idx := strings.IndexByte(field, ':')
+	if idx < 0 {
+		return ""
+	}
+	name := strings.ToLower(strings.TrimRight(field[:idx], " \t"))
+	value := strings.NewReplacer("\r\n", "", "\n", "").Replace(field[idx+1:])
+	value = strings.TrimSpace(compressWSP(value))
+	return name + ":" + value
+}
+
+// relaxedBody canonicalizes the message body using the "relaxed" algorithm.
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(compressWSP(line), " ")
+	}
+	// Remove empty lines at the end of the body.
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// splitHeaders splits the header section into fields, keeping folded lines with their fields.
+func splitHeaders(header string) []string {
+	var fields []string
+	for _, line := range strings.Split(header, "\r\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(fields) > 0 {
+			fields[len(fields)-1] += "\r\n" + line
+		} else if line != "" {
+			fields = append(fields, line)
+		}
+	}
+	return fields
+}
+
+// sign returns the message with the DKIM-Signature header prepended.
+func (d *dkimSigner) sign(message []byte) ([]byte, error) {
+	var header string
+	var body []byte
+	if idx := bytes.Index(message, []byte("\r\n\r\n")); idx >= 0 {
+		header = string(message[:idx])
+		body = message[idx+4:]
+	} else {
+		header = string(message)
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	// Find the headers to sign. If a header is repeated, the last instance is signed.
+	fields := splitHeaders(header)
+	var signedNames []string
+	var canonical strings.Builder
+	for _, name := range d.headers {
+		for i := len(fields) - 1; i >= 0; i-- {
+			idx := strings.IndexByte(fields[i], ':')
+			if idx > 0 && strings.EqualFold(strings.TrimSpace(fields[i][:idx]), name) {
+				signedNames = append(signedNames, strings.ToLower(name))
+				canonical.WriteString(relaxedHeader(fields[i]) + "\r\n")
+				break
+			}
+		}
+	}
+
+	tags := []string{
+		"v=1",
+		"a=rsa-sha256",
+		"c=relaxed/relaxed",
+		"d=" + d.domain,
+		"s=" + d.selector,
+		"t=" + strconv.FormatInt(time.Now().Unix(), 10),
+		"h=" + strings.Join(signedNames, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=",
+	}
+	value := strings.Join(tags, "; ")
+
+	// The signature header itself is signed without the trailing CRLF and with an empty b= tag.
+	canonical.WriteString(relaxedHeader("DKIM-Signature: " + value))
+	hashed := sha256.Sum256([]byte(canonical.String()))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, d.key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Fold the header between tags to keep lines short. Relaxed canonicalization ignores folding.
+	signed := &bytes.Buffer{}
+	signed.WriteString("DKIM-Signature: " + strings.Join(tags, ";\r\n\t") +
+		base64.StdEncoding.EncodeToString(sig) + "\r\n")
+	signed.Write(message)
+	return signed.Bytes(), nil
+}
@@ -0,0 +1,126 @@
+package email
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Message from RFC 8463, Appendix A.
+const dkimTestMessage = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+// Body hash of the message above, as given in RFC 8463.
+const dkimTestBodyHash = "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8="
+
+func TestRelaxedCanonicalization(t *testing.T) {
+	// Example from RFC 6376, Section 3.4.5.
+	fields := splitHeaders("A: X\r\nB : Y\t\r\n\tZ  ")
+	if len(fields) != 2 {
+		t.Fatalf("expected 2 header fields, got %q", fields)
+	}
+	if got := relaxedHeader(fields[0]) + "\r\n" + relaxedHeader(fields[1]) + "\r\n"; got != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("unexpected canonical header %q", got)
+	}
+	if got := string(relaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n"))); got != " C\r\nD E\r\n" {
+		t.Errorf("unexpected canonical body %q", got)
+	}
+	if got := relaxedBody([]byte("\r\n\r\n")); got != nil {
+		t.Errorf("expected empty canonical body, got %q", got)
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key is loaded from a PKCS#8 PEM file.
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ioutil.TempFile("", "dkim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	file.Close()
+
+	signer, err := newDKIMSigner(&dkimConfig{Selector: "test", PrivateKeyFile: file.Name()}, "football.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := signer.sign([]byte(dkimTestMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(signed), dkimTestMessage) {
+		t.Fatal("the message was altered by signing")
+	}
+
+	// Unfold the DKIM-Signature header and parse the tags.
+	fields := splitHeaders(string(signed[:len(signed)-len(dkimTestMessage)]))
+	if len(fields) != 1 || !strings.HasPrefix(fields[0], "DKIM-Signature: ") {
+		t.Fatalf("expected a single DKIM-Signature header, got %q", fields)
+	}
+	value := strings.NewReplacer("\r\n", "", "\t", "").Replace(fields[0][len("DKIM-Signature: "):])
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		parts := strings.SplitN(strings.TrimSpace(tag), "=", 2)
+		tags[parts[0]] = parts[1]
+	}
+
+	expected := map[string]string{
+		"v":  "1",
+		"a":  "rsa-sha256",
+		"c":  "relaxed/relaxed",
+		"d":  "football.example.com",
+		"s":  "test",
+		"h":  "from:to:subject:date:message-id",
+		"bh": dkimTestBodyHash,
+	}
+	for name, val := range expected {
+		if tags[name] != val {
+			t.Errorf("tag %s=%q, expected %q", name, tags[name], val)
+		}
+	}
+
+	// Verify the signature as a receiver would: canonical signed headers followed by
+	// the DKIM-Signature header with the empty b= tag and without the trailing CRLF.
+	canonical := "from:Joe SixPack <joe@football.example.com>\r\n" +
+		"to:Suzie Q <suzie@shopping.example.net>\r\n" +
+		"subject:Is dinner ready?\r\n" +
+		"date:Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"message-id:<20030712040037.46341.5F8J@football.example.com>\r\n" +
+		"dkim-signature:v=1; a=rsa-sha256; c=relaxed/relaxed; d=football.example.com; s=test; t=" + tags["t"] +
+		"; h=from:to:subject:date:message-id; bh=" + dkimTestBodyHash + "; b="
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := sha256.Sum256([]byte(canonical))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hashed[:], sig); err != nil {
+		t.Errorf("signature verification failed: %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	t "github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// How often to check the list of disposable domains for changes.
+	defaultDisposableReloadInterval = time.Hour
+	// Timeout of MX lookups.
+	defaultMXTimeout = 5 * time.Second
+)
+
+// Configuration of filtering out disposable email domains.
+type disposableConfig struct {
+	// Reject emails from disposable domains.
+	Enabled bool `json:"enabled"`
+	// Optional path to a file with disposable domains, one per line. Lines starting with '#' are ignored.
+	// If provided, the file replaces the bundled list. The file is reloaded when it's modified.
+	File string `json:"file"`
+	// How often to check the file for changes, in seconds.
+	ReloadInterval int `json:"reload_interval"`
+}
+
+// Configuration of the MX record presence check.
+type mxConfig struct {
+	// Reject emails from domains without MX records.
+	Enabled bool `json:"enabled"`
+	// Optional address of the DNS server to query as host:port. The system resolver is used by default.
+	Resolver string `json:"resolver"`
+	// Lookup timeout in seconds.
+	Timeout int `json:"timeout"`
+}
+
+// domainSet is a set of domains which also matches subdomains of its members.
+type domainSet map[string]bool
+
+func newDomainSet(domains []string) domainSet {
+	set := domainSet{}
+	for _, d := range domains {
+		d = strings.Trim(strings.ToLower(strings.TrimSpace(d)), ".")
+		if d != "" {
+			set[d] = true
+		}
+	}
+	return set
+}
+
+// contains checks if the domain or any of its parent domains is in the set.
+func (ds domainSet) contains(domain string) bool {
+	for {
+		if ds[domain] {
+			return true
+		}
+		idx := strings.IndexByte(domain, '.')
+		if idx < 0 {
+			return false
+		}
+		domain = domain[idx+1:]
+	}
+}
+
+// disposableList is a reloadable list of disposable domains.
+type disposableList struct {
+	sync.RWMutex
+	domains domainSet
+	path    string
+	modTime time.Time
+}
+
+func newDisposableList(config *disposableConfig) (*disposableList, error) {
+	dl := &disposableList{}
+	if config.File == "" {
+		dl.domains = newDomainSet(bundledDisposableDomains)
+		return dl, nil
+	}
+
+	dl.path = resolveTemplatePath(config.File)
+	if err := dl.reload(); err != nil {
+		return nil, err
+	}
+
+	interval := time.Duration(config.ReloadInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultDisposableReloadInterval
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := dl.reload(); err != nil {
+				log.Println("email: failed to reload disposable domains", dl.path, err)
+			}
+		}
+	}()
+
+	return dl, nil
+}
+
+// reload reads the file if it has changed since the last read.
+func (dl *disposableList) reload() error {
+	info, err := os.Stat(dl.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(dl.modTime) {
+		return nil
+	}
+
+	file, err := os.Open(dl.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var domains []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains = append(domains, line)
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	set := newDomainSet(domains)
+	dl.Lock()
+	dl.domains = set
+	dl.modTime = info.ModTime()
+	dl.Unlock()
+	log.Printf("email: loaded %d disposable domains from %s", len(set), dl.path)
+
+	return nil
+}
+
+func (dl *disposableList) contains(domain string) bool {
+	dl.RLock()
+	defer dl.RUnlock()
+	return dl.domains.contains(domain)
+}
+
+// mxChecker verifies that the domain accepts email.
+type mxChecker struct {
+	resolver *net.Resolver
+	timeout  time.Duration
+}
+
+func newMXChecker(config *mxConfig) *mxChecker {
+	mc := &mxChecker{
+		resolver: net.DefaultResolver,
+		timeout:  time.Duration(config.Timeout) * time.Second,
+	}
+	if mc.timeout <= 0 {
+		mc.timeout = defaultMXTimeout
+	}
+	if config.Resolver != "" {
+		addr := config.Resolver
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		mc.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+	}
+	return mc
+}
+
+// check returns an error if the domain has no usable MX records. Temporary DNS failures are
+// logged and ignored so that a DNS outage does not prevent registrations.
+func (mc *mxChecker) check(domain string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mc.timeout)
+	defer cancel()
+
+	records, err := mc.resolver.LookupMX(ctx, domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return &t.PolicyError{What: "email", Rule: "no_mx"}
+		}
+		log.Println("email: MX lookup failed", domain, err)
+		return nil
+	}
+
+	// Null MX record (RFC 7505) means the domain does not accept email.
+	if len(records) == 0 || (len(records) == 1 && records[0].Host == ".") {
+		return &t.PolicyError{What: "email", Rule: "no_mx"}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package email
+
+import (
+	"log"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+	"github.com/tinode/chat/server/validate"
+)
+
+const (
+	// Name of the outbox channel for emails.
+	outboxChannel = "email"
+
+	// Give up on delivering the message after this many attempts.
+	defaultOutboxMaxAttempts = 8
+	// Delay before the first retry. Each subsequent retry doubles it.
+	defaultOutboxInitialBackoff = 30 * time.Second
+	// Maximum delay between retries.
+	defaultOutboxMaxBackoff = time.Hour
+	// How often to check the outbox for messages due for delivery.
+	defaultOutboxPollInterval = 10 * time.Second
+	// How many messages to read from the outbox at once.
+	defaultOutboxBatchSize = 16
+	// Dead messages are deleted after this long.
+	defaultOutboxDeadTTL = 7 * 24 * time.Hour
+	// How often to delete expired dead messages.
+	outboxPurgePeriod = time.Hour
+)
+
+// Metrics.
+const (
+	statEmailQueued      = "EmailQueued"
+	statEmailSent        = "EmailSent"
+	statEmailRetries     = "EmailRetries"
+	statEmailDeadLetters = "EmailDeadLetters"
+)
+
+// Configuration of the outbox.
+type outboxConfig struct {
+	// Send emails directly without saving them to the database first.
+	Disabled bool `json:"disabled"`
+	// Give up on delivering the message after this many attempts.
+	MaxAttempts int `json:"max_attempts"`
+	// Delay before the first retry in seconds. Each subsequent retry doubles it.
+	InitialBackoff int `json:"initial_backoff"`
+	// Maximum delay between retries in seconds.
+	MaxBackoff int `json:"max_backoff"`
+	// How often to check the outbox for messages due for delivery, in seconds.
+	PollInterval int `json:"poll_interval"`
+	// Delete dead messages after this many seconds.
+	DeadTTL int `json:"dead_ttl"`
+}
+
+// outbox is a durable queue of emails. Emails are saved to the database and delivered by a background
+// worker which retries failed deliveries with exponential backoff. Emails which could not be delivered
+// after all attempts are kept in the database marked as dead without the content, then deleted.
+type outbox struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	pollInterval   time.Duration
+	deadTTL        time.Duration
+	// Function which actually delivers the message.
+	deliver func(to string, message []byte) error
+	// Signal to check the outbox right away.
+	wake chan struct{}
+}
+
+// newOutbox creates the outbox and starts the delivery worker. Returns nil if the outbox is disabled.
+func newOutbox(config *outboxConfig, deliver func(to string, message []byte) error) *outbox {
+	if config == nil {
+		config = &outboxConfig{}
+	}
+	if config.Disabled {
+		return nil
+	}
+
+	ob := &outbox{
+		maxAttempts:    config.MaxAttempts,
+		initialBackoff: time.Duration(config.InitialBackoff) * time.Second,
+		maxBackoff:     time.Duration(config.MaxBackoff) * time.Second,
+		pollInterval:   time.Duration(config.PollInterval) * time.Second,
+		deadTTL:        time.Duration(config.DeadTTL) * time.Second,
+		deliver:        deliver,
+		wake:           make(chan struct{}, 1),
+	}
+	if ob.maxAttempts <= 0 {
+		ob.maxAttempts = defaultOutboxMaxAttempts
+	}
+	if ob.initialBackoff <= 0 {
+		ob.initialBackoff = defaultOutboxInitialBackoff
+	}
+	if ob.maxBackoff <= 0 {
+		ob.maxBackoff = defaultOutboxMaxBackoff
+	}
+	if ob.maxBackoff < ob.initialBackoff {
+		ob.maxBackoff = ob.initialBackoff
+	}
+	if ob.pollInterval <= 0 {
+		ob.pollInterval = defaultOutboxPollInterval
+	}
+	if ob.deadTTL <= 0 {
+		ob.deadTTL = defaultOutboxDeadTTL
+	}
+
+	go ob.run()
+
+	return ob
+}
+
+// enqueue saves the message to the database and wakes up the worker.
+func (ob *outbox) enqueue(to string, message []byte) error {
+	if err := store.Outbox.Add(&t.OutboxMessage{
+		Channel: outboxChannel,
+		To:      to,
+		Content: message,
+	}); err != nil {
+		return err
+	}
+	validate.StatsInc(statEmailQueued, 1)
+
+	select {
+	case ob.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// backoff calculates the delay before the next attempt after the given number of failed attempts.
+func (ob *outbox) backoff(attempts int) time.Duration {
+	delay := ob.initialBackoff
+	for i := 1; i < attempts && delay < ob.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > ob.maxBackoff {
+		delay = ob.maxBackoff
+	}
+	return delay
+}
+
+func (ob *outbox) run() {
+	ticker := time.NewTicker(ob.pollInterval)
+	defer ticker.Stop()
+	purge := time.NewTicker(outboxPurgePeriod)
+	defer purge.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ob.wake:
+		case <-purge.C:
+			if err := store.Outbox.DelDead(outboxChannel, t.TimeNow().Add(-ob.deadTTL)); err != nil {
+				log.Println("email outbox: failed to delete dead messages", err)
+			}
+			continue
+		}
+		ob.processDue()
+	}
+}
+
+// processDue delivers all messages which are due for delivery.
+func (ob *outbox) processDue() {
+	for {
+		msgs, err := store.Outbox.GetDue(outboxChannel, defaultOutboxBatchSize)
+		if err != nil {
+			log.Println("email outbox: failed to read messages", err)
+			return
+		}
+
+		for i := range msgs {
+			ob.process(&msgs[i])
+		}
+
+		if len(msgs) < defaultOutboxBatchSize {
+			return
+		}
+	}
+}
+
+// process makes one attempt to deliver the message.
+func (ob *outbox) process(msg *t.OutboxMessage) {
+	// Claim the message so other cluster nodes don't deliver it too. If this node dies before
+	// the message is delivered, another node will pick it up after the backoff.
+	claimed, err := store.Outbox.Claim(msg, t.TimeNow().Add(ob.backoff(msg.Attempts+1)))
+	if err != nil {
+		log.Println("email outbox: failed to claim message", msg.Id, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	if err = ob.deliver(msg.To, msg.Content); err == nil {
+		validate.StatsInc(statEmailSent, 1)
+		if err = store.Outbox.Delete(msg.Id); err != nil {
+			log.Println("email outbox: failed to delete delivered message", msg.Id, err)
+		}
+		return
+	}
+
+	msg.Attempts++
+	msg.LastError = err.Error()
+	if msg.Attempts >= ob.maxAttempts {
+		// Dead letter: keep the record for inspection but stop retrying.
+		msg.Dead = true
+		validate.StatsInc(statEmailDeadLetters, 1)
+		log.Println("email outbox: giving up on message", msg.Id, "to", msg.To, "after", msg.Attempts,
+			"attempts:", msg.LastError)
+	} else {
+		validate.StatsInc(statEmailRetries, 1)
+	}
+	if err = store.Outbox.Fail(msg); err != nil {
+		log.Println("email outbox: failed to update message", msg.Id, err)
+	}
+}
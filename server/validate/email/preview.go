@@ -0,0 +1,139 @@
+package email
+
+import (
+	"encoding/json"
+	"errors"
+	"net/mail"
+	"path/filepath"
+	textt "text/template"
+)
+
+// TemplatePreview is an email template rendered with sample parameters.
+type TemplatePreview struct {
+	// Kind of the template: "validation", "reset" or "login".
+	Kind string
+	// Language of the template, empty if languages are not configured.
+	Language string
+	// Path to the template file.
+	Path string
+	// Parts of the template which are not defined.
+	Missing []string
+	// Rendered MIME message. Nil if the template could not be loaded or rendered.
+	Message []byte
+	// Error loading, validating or rendering the template.
+	Err error
+}
+
+// PreviewTemplates loads the email templates referenced by the validator config for every configured
+// language and renders them as MIME messages to the given address. The params override the default sample
+// values of template parameters. Relative paths are resolved against baseDir, or against the location
+// of the executable if baseDir is empty. The returned error is set if the config itself is invalid.
+func PreviewTemplates(jsonconf, baseDir, to string, params map[string]interface{}) ([]*TemplatePreview, error) {
+	v := &validator{}
+	if err := json.Unmarshal([]byte(jsonconf), v); err != nil {
+		return nil, err
+	}
+
+	if v.SendFrom == "" {
+		return nil, errors.New("sender not specified")
+	}
+	sender, err := mail.ParseAddress(v.SendFrom)
+	if err != nil {
+		return nil, err
+	}
+	v.senderEmail = sender.Address
+
+	sample := map[string]interface{}{
+		"Token":   "c2FtcGxlLXRva2Vu",
+		"Code":    "123456",
+		"HostUrl": v.HostUrl,
+		"Login":   "alice",
+		"Cred":    validatorName + ":" + to,
+		"Scheme":  "basic",
+	}
+	if v.HostUrl == "" {
+		sample["HostUrl"] = "http://localhost:6060/"
+	}
+	for key, val := range params {
+		sample[key] = val
+	}
+
+	resolve := func(path string) string {
+		if baseDir == "" || filepath.IsAbs(path) {
+			return resolveTemplatePath(path)
+		}
+		return filepath.Join(baseDir, path)
+	}
+
+	kinds := []struct {
+		kind string
+		path string
+	}{
+		{"validation", v.ValidationTemplFile},
+		{"reset", v.ResetTemplFile},
+		{"login", v.LoginTemplFile},
+	}
+
+	languages := v.Languages
+	if len(languages) == 0 {
+		// No i18n support.
+		languages = []string{""}
+	}
+
+	var previews []*TemplatePreview
+	for _, k := range kinds {
+		if k.path == "" {
+			if k.kind != "login" {
+				previews = append(previews, &TemplatePreview{Kind: k.kind,
+					Err: errors.New("template path not specified")})
+			}
+			continue
+		}
+
+		pathTempl, err := textt.New(k.kind).Parse(resolve(k.path))
+		if err != nil {
+			previews = append(previews, &TemplatePreview{Kind: k.kind, Path: k.path, Err: err})
+			continue
+		}
+
+		for _, lang := range languages {
+			previews = append(previews, v.previewTemplate(k.kind, lang, pathTempl, to, sample))
+		}
+	}
+
+	return previews, nil
+}
+
+// previewTemplate loads, validates and renders one template.
+func (v *validator) previewTemplate(kind, lang string, pathTempl *textt.Template, to string,
+	params map[string]interface{}) *TemplatePreview {
+
+	preview := &TemplatePreview{Kind: kind, Language: lang}
+
+	var templ *textt.Template
+	templ, preview.Path, preview.Err = readTemplateFile(pathTempl, lang)
+	if preview.Err != nil {
+		return preview
+	}
+
+	for _, part := range []string{emailSubject, emailBodyPlain, emailBodyHTML} {
+		if templ.Lookup(part) == nil {
+			preview.Missing = append(preview.Missing, part)
+		}
+	}
+	if preview.Err = isTemplateValid(templ); preview.Err != nil {
+		return preview
+	}
+
+	// Report references to undefined parameters instead of rendering them as "<no value>".
+	templ.Option("missingkey=error")
+
+	content, err := executeTemplate(templ, params)
+	if err != nil {
+		preview.Err = err
+		return preview
+	}
+	preview.Message = v.compose(to, content)
+
+	return preview
+}
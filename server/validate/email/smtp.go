@@ -0,0 +1,160 @@
+package email
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// TLS modes of the connection to the SMTP server.
+const (
+	// Use STARTTLS if the server supports it, otherwise send in plain text. Default.
+	tlsModeOpportunistic = "opportunistic"
+	// Require STARTTLS, fail if the server does not support it.
+	tlsModeStartTLS = "starttls"
+	// Connect over TLS from the start (SMTPS), usually port 465.
+	tlsModeImplicit = "implicit"
+	// Never use TLS.
+	tlsModeNone = "none"
+
+	// Timeout for establishing a connection to the SMTP server.
+	smtpDialTimeout = 30 * time.Second
+)
+
+// TLS configuration of the connection to the SMTP server.
+type smtpTLSConfig struct {
+	// One of "opportunistic" (default), "starttls", "implicit", "none".
+	Mode string `json:"mode"`
+	// Optional path to a PEM file with CA certificates to trust instead of the system ones.
+	CAFile string `json:"ca_file"`
+	// Server name to verify the certificate against, if different from the smtp_server.
+	ServerName string `json:"server_name"`
+	// Do not verify server certificate. Insecure, for testing only.
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+}
+
+// smtpSender delivers messages to the SMTP server.
+type smtpSender struct {
+	host     string
+	addr     string
+	heloHost string
+	auth     smtp.Auth
+	tlsMode  string
+	tlsConf  *tls.Config
+}
+
+// newSMTPSender creates a sender from the config. The config may be nil.
+func newSMTPSender(host, port, heloHost string, auth smtp.Auth, config *smtpTLSConfig) (*smtpSender, error) {
+	if config == nil {
+		config = &smtpTLSConfig{}
+	}
+
+	sender := &smtpSender{
+		host:     host,
+		addr:     net.JoinHostPort(host, port),
+		heloHost: heloHost,
+		auth:     auth,
+		tlsMode:  config.Mode,
+	}
+
+	switch sender.tlsMode {
+	case "":
+		sender.tlsMode = tlsModeOpportunistic
+	case tlsModeOpportunistic, tlsModeStartTLS, tlsModeImplicit, tlsModeNone:
+	default:
+		return nil, errors.New("invalid smtp_tls mode '" + config.Mode + "'")
+	}
+
+	sender.tlsConf = &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.ServerName != "" {
+		sender.tlsConf.ServerName = config.ServerName
+	}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(resolveTemplatePath(config.CAFile))
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + config.CAFile)
+		}
+		sender.tlsConf.RootCAs = pool
+	}
+
+	return sender, nil
+}
+
+// send delivers the message to a single recipient. It's similar to smtp.SendMail
+// but applies the TLS policy.
+func (s *smtpSender) send(from, to string, message []byte) error {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+	if s.tlsMode == tlsModeImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, s.tlsConf)
+	} else {
+		conn, err = dialer.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if s.heloHost != "" {
+		if err = c.Hello(s.heloHost); err != nil {
+			return err
+		}
+	}
+
+	if s.tlsMode == tlsModeStartTLS || s.tlsMode == tlsModeOpportunistic {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err = c.StartTLS(s.tlsConf); err != nil {
+				return err
+			}
+		} else if s.tlsMode == tlsModeStartTLS {
+			return errors.New("smtp: server does not support STARTTLS")
+		}
+	}
+
+	if s.auth != nil {
+		// Do not send the message unauthenticated when credentials are configured: the server
+		// would likely reject or spam-flag it.
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server does not support AUTH")
+		}
+		if err = c.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	if err = c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(message); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,103 @@
+package email
+
+import (
+	"bufio"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+)
+
+// fakeSMTPServer accepts a single connection and responds to commands. It advertises AUTH PLAIN
+// if withAuth is true. Received commands are sent to the returned channel.
+func fakeSMTPServer(t *testing.T, withAuth bool) (string, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := make(chan string, 32)
+	go func() {
+		defer ln.Close()
+		defer close(commands)
+
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 localhost ESMTP\r\n"))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			commands <- verb
+			switch verb {
+			case "EHLO":
+				if withAuth {
+					conn.Write([]byte("250-localhost\r\n250 AUTH PLAIN\r\n"))
+				} else {
+					conn.Write([]byte("250-localhost\r\n250 8BITMIME\r\n"))
+				}
+			case "AUTH":
+				conn.Write([]byte("235 Authentication successful\r\n"))
+			case "DATA":
+				conn.Write([]byte("354 Go ahead\r\n"))
+				for {
+					if line, err = r.ReadString('\n'); err != nil || line == ".\r\n" {
+						break
+					}
+				}
+				conn.Write([]byte("250 OK\r\n"))
+			case "QUIT":
+				conn.Write([]byte("221 Bye\r\n"))
+				return
+			default:
+				conn.Write([]byte("250 OK\r\n"))
+			}
+		}
+	}()
+	return ln.Addr().String(), commands
+}
+
+func testSMTPSend(t *testing.T, withAuth bool) ([]string, error) {
+	addr, commands := fakeSMTPServer(t, withAuth)
+	host, port, _ := net.SplitHostPort(addr)
+	sender, err := newSMTPSender(host, port, "", smtp.PlainAuth("", "user", "secret", host),
+		&smtpTLSConfig{Mode: tlsModeNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sender.send("from@example.com", "to@example.com", []byte("Subject: test\r\n\r\nbody\r\n"))
+	var received []string
+	for cmd := range commands {
+		received = append(received, cmd)
+	}
+	return received, err
+}
+
+func TestSMTPSendAuth(t *testing.T) {
+	received, err := testSMTPSend(t, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(received, " "); got != "EHLO AUTH MAIL RCPT DATA QUIT" {
+		t.Errorf("unexpected commands %q", got)
+	}
+}
+
+func TestSMTPSendAuthUnavailable(t *testing.T) {
+	received, err := testSMTPSend(t, false)
+	if err == nil {
+		t.Fatal("expected an error when the server does not support AUTH")
+	}
+	for _, cmd := range received {
+		if cmd == "MAIL" || cmd == "DATA" {
+			t.Fatalf("message sent without authentication: %q", received)
+		}
+	}
+}
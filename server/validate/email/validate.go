@@ -22,6 +22,8 @@ import (
 
 	"github.com/tinode/chat/server/store"
 	t "github.com/tinode/chat/server/store/types"
+	"github.com/tinode/chat/server/validate"
+	"github.com/tinode/chat/server/validate/throttle"
 	i18n "golang.org/x/text/language"
 )
 
@@ -35,6 +37,8 @@ type validator struct {
 	ValidationTemplFile string `json:"validation_templ"`
 	// Path to templates for resetting the authentication secret.
 	ResetTemplFile string `json:"reset_secret_templ"`
+	// Optional path to templates for passwordless login by a single-use code.
+	LoginTemplFile string `json:"login_templ"`
 	// Sender RFC 5322 email address.
 	SendFrom string `json:"sender"`
 	// Login to use for SMTP authentication.
@@ -49,16 +53,43 @@ type validator struct {
 	SMTPAddr string `json:"smtp_server"`
 	// Port of the SMTP server.
 	SMTPPort string `json:"smtp_port"`
+	// Optional host name to use in SMTP HELO/EHLO.
+	SMTPHeloHost string `json:"smtp_helo_host"`
+	// TLS policy of the connection to the SMTP server.
+	SMTPTLS *smtpTLSConfig `json:"smtp_tls"`
+	// Optional DKIM signing of outgoing emails.
+	DKIM *dkimConfig `json:"dkim"`
 	// Optional whitelist of email domains accepted for registration.
 	Domains []string `json:"domains"`
+	// Optional list of email domains rejected at registration. Subdomains are rejected too.
+	Denylist []string `json:"denylist"`
+	// Rejection of disposable email domains.
+	Disposable *disposableConfig `json:"disposable"`
+	// Check that the email domain has MX records.
+	MXCheck *mxConfig `json:"mx_check"`
+	// Lifetime of validation codes in seconds.
+	CodeExpireIn int `json:"code_expire_in"`
+	// Limits on how often emails can be sent.
+	Throttle *throttle.Config `json:"throttle"`
+	// Durable queue of outgoing emails.
+	Outbox *outboxConfig `json:"outbox"`
 
 	// Must use index into language array instead of language tags because language.Matcher is brain damaged:
 	// https://github.com/golang/go/issues/24211
 	validationTempl []*textt.Template
 	resetTempl      []*textt.Template
+	loginTempl      []*textt.Template
 	auth            smtp.Auth
 	senderEmail     string
+	sender          *smtpSender
+	dkim            *dkimSigner
+	denylist        domainSet
+	disposable      *disposableList
+	mxChecker       *mxChecker
 	langMatcher     i18n.Matcher
+	codeLifetime    time.Duration
+	throttle        *throttle.Throttle
+	outbox          *outbox
 }
 
 const (
@@ -66,6 +97,8 @@ const (
 
 	maxRetries  = 4
 	defaultPort = "25"
+	// Validation codes expire after this time.
+	defaultCodeLifetime = 24 * time.Hour
 
 	// Technically email could be up to 255 bytes long but practically 128 is enough.
 	maxEmailLength = 128
@@ -174,9 +207,12 @@ func (v *validator) Init(jsonconf string) error {
 	// Optionally resolve paths against the location of this executable file.
 	v.ValidationTemplFile = resolveTemplatePath(v.ValidationTemplFile)
 	v.ResetTemplFile = resolveTemplatePath(v.ResetTemplFile)
+	if v.LoginTemplFile != "" {
+		v.LoginTemplFile = resolveTemplatePath(v.LoginTemplFile)
+	}
 
 	// Paths to templates could be templates themselves: they may be language-dependent.
-	var validationPathTempl, resetPathTempl *textt.Template
+	var validationPathTempl, resetPathTempl, loginPathTempl *textt.Template
 	validationPathTempl, err = textt.New("validation").Parse(v.ValidationTemplFile)
 	if err != nil {
 		return err
@@ -185,11 +221,20 @@ func (v *validator) Init(jsonconf string) error {
 	if err != nil {
 		return err
 	}
+	if v.LoginTemplFile != "" {
+		loginPathTempl, err = textt.New("login").Parse(v.LoginTemplFile)
+		if err != nil {
+			return err
+		}
+	}
 
 	var path string
 	if len(v.Languages) > 0 {
 		v.validationTempl = make([]*textt.Template, len(v.Languages))
 		v.resetTempl = make([]*textt.Template, len(v.Languages))
+		if loginPathTempl != nil {
+			v.loginTempl = make([]*textt.Template, len(v.Languages))
+		}
 		var langTags []i18n.Tag
 		// Find actual content templates for each defined language.
 		for idx, lang := range v.Languages {
@@ -211,6 +256,15 @@ func (v *validator) Init(jsonconf string) error {
 			if err = isTemplateValid(v.resetTempl[idx]); err != nil {
 				return fmt.Errorf("parsing %s: %w", path, err)
 			}
+
+			if loginPathTempl != nil {
+				if v.loginTempl[idx], path, err = readTemplateFile(loginPathTempl, lang); err != nil {
+					return err
+				}
+				if err = isTemplateValid(v.loginTempl[idx]); err != nil {
+					return fmt.Errorf("parsing %s: %w", path, err)
+				}
+			}
 		}
 		v.langMatcher = i18n.NewMatcher(langTags)
 	} else {
@@ -232,6 +286,17 @@ func (v *validator) Init(jsonconf string) error {
 		if err = isTemplateValid(v.resetTempl[0]); err != nil {
 			return fmt.Errorf("parsing %s: %w", path, err)
 		}
+
+		if loginPathTempl != nil {
+			v.loginTempl = make([]*textt.Template, 1)
+			v.loginTempl[0], path, err = readTemplateFile(loginPathTempl, "")
+			if err != nil {
+				return err
+			}
+			if err = isTemplateValid(v.loginTempl[0]); err != nil {
+				return fmt.Errorf("parsing %s: %w", path, err)
+			}
+		}
 	}
 
 	// Initialize random number generator.
@@ -261,13 +326,44 @@ func (v *validator) Init(jsonconf string) error {
 	if v.SMTPPort == "" {
 		v.SMTPPort = defaultPort
 	}
+	v.codeLifetime = time.Duration(v.CodeExpireIn) * time.Second
+	if v.codeLifetime <= 0 {
+		v.codeLifetime = defaultCodeLifetime
+	}
+	v.throttle = throttle.New(validatorName, v.Throttle)
+
+	v.denylist = newDomainSet(v.Denylist)
+	if v.Disposable != nil && v.Disposable.Enabled {
+		if v.disposable, err = newDisposableList(v.Disposable); err != nil {
+			return err
+		}
+	}
+	if v.MXCheck != nil && v.MXCheck.Enabled {
+		v.mxChecker = newMXChecker(v.MXCheck)
+	}
+
+	if v.sender, err = newSMTPSender(v.SMTPAddr, v.SMTPPort, v.SMTPHeloHost, v.auth, v.SMTPTLS); err != nil {
+		return err
+	}
+	if v.DKIM != nil {
+		domain := v.senderEmail[strings.LastIndexByte(v.senderEmail, '@')+1:]
+		if v.dkim, err = newDKIMSigner(v.DKIM, domain); err != nil {
+			return err
+		}
+	}
+
+	validate.StatsRegisterInt(statEmailQueued)
+	validate.StatsRegisterInt(statEmailSent)
+	validate.StatsRegisterInt(statEmailRetries)
+	validate.StatsRegisterInt(statEmailDeadLetters)
+	v.outbox = newOutbox(v.Outbox, v.deliver)
 
 	return nil
 }
 
 // PreCheck validates the credential and parameters without sending an email.
 // If the credential is valid, it's returned with an appropriate prefix.
-func (v *validator) PreCheck(cred string, _ map[string]interface{}) (string, error) {
+func (v *validator) PreCheck(cred string, params map[string]interface{}) (string, error) {
 	if len(cred) > maxEmailLength {
 		return "", t.ErrMalformed
 	}
@@ -281,24 +377,44 @@ func (v *validator) PreCheck(cred string, _ map[string]interface{}) (string, err
 	// Normalize email to make sure Unicode case collisions don't lead to security problems.
 	addr.Address = strings.ToLower(addr.Address)
 
+	// Parse email into user and domain parts.
+	parts := strings.Split(addr.Address, "@")
+	if len(parts) != 2 {
+		return "", t.ErrMalformed
+	}
+	domain := parts[1]
+
 	// If a whitelist of domains is provided, make sure the email belongs to the list.
 	if len(v.Domains) > 0 {
-		// Parse email into user and domain parts.
-		parts := strings.Split(addr.Address, "@")
-		if len(parts) != 2 {
-			return "", t.ErrMalformed
-		}
-
 		var found bool
-		for _, domain := range v.Domains {
-			if domain == parts[1] {
+		for _, allowed := range v.Domains {
+			if allowed == domain {
 				found = true
 				break
 			}
 		}
 
 		if !found {
-			return "", t.ErrPolicy
+			return "", &t.PolicyError{What: "email", Rule: "domain"}
+		}
+	}
+
+	// Don't reject existing emails when they are used as tags.
+	if tagOnly, _ := params["tagOnly"].(bool); tagOnly {
+		return validatorName + ":" + addr.Address, nil
+	}
+
+	if v.denylist.contains(domain) {
+		return "", &t.PolicyError{What: "email", Rule: "denylist"}
+	}
+
+	if v.disposable != nil && v.disposable.contains(domain) {
+		return "", &t.PolicyError{What: "email", Rule: "disposable"}
+	}
+
+	if v.mxChecker != nil {
+		if err := v.mxChecker.check(domain); err != nil {
+			return "", err
 		}
 	}
 
@@ -306,7 +422,7 @@ func (v *validator) PreCheck(cred string, _ map[string]interface{}) (string, err
 }
 
 // Send a request for confirmation to the user: makes a record in DB  and nothing else.
-func (v *validator) Request(user t.Uid, email, lang, resp string, tmpToken []byte) (bool, error) {
+func (v *validator) Request(user t.Uid, email, lang, resp string, tmpToken []byte, remoteAddr string) (bool, error) {
 	// Email validator cannot accept an immediate response.
 	if resp != "" {
 		return false, t.ErrFailed
@@ -315,6 +431,10 @@ func (v *validator) Request(user t.Uid, email, lang, resp string, tmpToken []byt
 	// Normalize email to make sure Unicode case collisions don't lead to security problems.
 	email = strings.ToLower(email)
 
+	if err := v.throttle.Allow(email, remoteAddr); err != nil {
+		return false, err
+	}
+
 	token := make([]byte, base64.URLEncoding.EncodedLen(len(tmpToken)))
 	base64.URLEncoding.Encode(token, tmpToken)
 
@@ -347,37 +467,57 @@ func (v *validator) Request(user t.Uid, email, lang, resp string, tmpToken []byt
 	if err != nil {
 		return false, err
 	}
+	if err = v.throttle.Issued(user); err != nil {
+		return false, err
+	}
 
-	// Send email without blocking. Email sending may take long time.
-	go v.send(email, content)
+	// Queue the email. Email sending may take long time.
+	v.send(email, content)
 
 	return isNew, nil
 }
 
 // ResetSecret sends a message with instructions for resetting an authentication secret.
-func (v *validator) ResetSecret(email, scheme, lang string, tmpToken []byte, params map[string]interface{}) error {
+// If params contain a "code", the message is a single-use code for passwordless login.
+func (v *validator) ResetSecret(email, scheme, lang string, tmpToken []byte, params map[string]interface{},
+	remoteAddr string) error {
 	// Normalize email to make sure Unicode case collisions don't lead to security problems.
 	email = strings.ToLower(email)
 
+	if err := v.throttle.Allow(email, remoteAddr); err != nil {
+		return err
+	}
+
 	token := make([]byte, base64.URLEncoding.EncodedLen(len(tmpToken)))
 	base64.URLEncoding.Encode(token, tmpToken)
 
+	var login, code string
+	if params != nil {
+		login, _ = params["login"].(string)
+		code, _ = params["code"].(string)
+	}
+
+	templates := v.resetTempl
+	if code != "" {
+		if v.loginTempl == nil {
+			// Login by code is not configured.
+			return t.ErrUnsupported
+		}
+		templates = v.loginTempl
+	}
+
 	var template *textt.Template
 	if v.langMatcher != nil {
 		_, idx := i18n.MatchStrings(v.langMatcher, lang)
-		template = v.resetTempl[idx]
+		template = templates[idx]
 	} else {
-		template = v.resetTempl[0]
-	}
-
-	var login string
-	if params != nil {
-		// Invariant: params["login"] is a string. Will panic if the invariant doesn't hold.
-		login = params["login"].(string)
+		template = templates[0]
 	}
 
 	content, err := executeTemplate(template, map[string]interface{}{
 		"Login":   login,
+		"Code":    code,
+		"Cred":    validatorName + ":" + email,
 		"Token":   string(token),
 		"Scheme":  scheme,
 		"HostUrl": v.HostUrl})
@@ -385,8 +525,8 @@ func (v *validator) ResetSecret(email, scheme, lang string, tmpToken []byte, par
 		return err
 	}
 
-	// Send email without blocking. Email sending may take long time.
-	go v.send(email, content)
+	// Queue the email. Email sending may take long time.
+	v.send(email, content)
 
 	return nil
 }
@@ -412,6 +552,18 @@ func (v *validator) Check(user t.Uid, resp string) (string, error) {
 		return "", t.ErrCredentials
 	}
 
+	issued, err := v.throttle.IssuedAt(user)
+	if err != nil {
+		return "", err
+	}
+	if issued.IsZero() {
+		// The code was issued before the time of issue was recorded.
+		issued = cred.UpdatedAt
+	}
+	if issued.Add(v.codeLifetime).Before(t.TimeNow()) {
+		return "", t.ErrCodeExpired
+	}
+
 	// Comparing with dummy response too.
 	if cred.Resp == resp || v.DebugResponse == resp {
 		// Valid response, save confirmation.
@@ -434,19 +586,31 @@ func (v *validator) Remove(user t.Uid, value string) error {
 	return store.Users.DelCred(user, validatorName, value)
 }
 
-// This is a basic SMTP sender which connects to a server using login/password.
-// -
-// See here how to send email from Amazon SES:
-// https://docs.aws.amazon.com/sdk-for-go/api/service/ses/#example_SES_SendEmail_shared00
-// -
-// Mailjet and SendGrid have some free email limits.
-func (v *validator) send(to string, content *emailContent) error {
+// send queues the email for delivery. If the outbox is disabled or unavailable, the email is
+// sent directly without blocking.
+func (v *validator) send(to string, content *emailContent) {
+	message := v.compose(to, content)
+	if v.outbox != nil {
+		err := v.outbox.enqueue(to, message)
+		if err == nil {
+			return
+		}
+		log.Println("email: failed to queue message, sending directly", to, err)
+	}
+	go v.deliver(to, message)
+}
+
+// compose formats the email as an RFC 5322 message and signs it with DKIM if configured.
+func (v *validator) compose(to string, content *emailContent) []byte {
 	message := &bytes.Buffer{}
 
 	// Common headers.
 	fmt.Fprintf(message, "From: %s\r\n", v.SendFrom)
 	fmt.Fprintf(message, "To: %s\r\n", to)
 	fmt.Fprintf(message, "Subject: %s\r\n", content.subject)
+	fmt.Fprintf(message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(message, "Message-ID: <%s@%s>\r\n", randomBoundary(),
+		v.senderEmail[strings.LastIndexByte(v.senderEmail, '@')+1:])
 	message.WriteString("MIME-version: 1.0;\r\n")
 
 	if content.html == "" {
@@ -488,7 +652,26 @@ func (v *validator) send(to string, content *emailContent) error {
 	}
 	message.WriteString("\r\n")
 
-	err := smtp.SendMail(v.SMTPAddr+":"+v.SMTPPort, v.auth, v.senderEmail, []string{to}, message.Bytes())
+	if v.dkim != nil {
+		signed, err := v.dkim.sign(message.Bytes())
+		if err == nil {
+			return signed
+		}
+		log.Println("email: failed to sign message", to, err)
+	}
+
+	return message.Bytes()
+}
+
+// deliver sends the message using an SMTP sender which connects to a server using login/password
+// and the configured TLS policy.
+// -
+// See here how to send email from Amazon SES:
+// https://docs.aws.amazon.com/sdk-for-go/api/service/ses/#example_SES_SendEmail_shared00
+// -
+// Mailjet and SendGrid have some free email limits.
+func (v *validator) deliver(to string, message []byte) error {
+	err := v.sender.send(v.senderEmail, to, message)
 	if err != nil {
 		log.Println("SMTP error", to, err)
 	}
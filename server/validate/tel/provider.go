@@ -0,0 +1,135 @@
+package tel
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Provider delivers text messages to phone numbers, either as SMS or as voice calls.
+type Provider interface {
+	// Init initializes the provider.
+	Init(jsonconf json.RawMessage) error
+	// Send delivers the message body to the phone number in E.164 format.
+	Send(to, body string) error
+}
+
+var providers map[string]Provider
+
+// RegisterProvider makes an SMS or voice provider available to the validator.
+func RegisterProvider(name string, p Provider) {
+	if providers == nil {
+		providers = make(map[string]Provider)
+	}
+
+	if p == nil {
+		panic("RegisterProvider: provider is nil")
+	}
+	if _, dup := providers[name]; dup {
+		panic("RegisterProvider: called twice for provider " + name)
+	}
+	providers[name] = p
+}
+
+const (
+	// Default timeout of requests to the HTTP gateway.
+	defaultHTTPTimeout = 10 * time.Second
+	// Maximum size of the gateway response to read.
+	maxResponseSize = 4096
+)
+
+// httpProvider is a generic provider which posts messages to an HTTP gateway as JSON:
+//
+//	{"from": "+15550000000", "to": "+15551234567", "body": "Confirmation code: 123456", "channel": "sms"}
+//
+// Any 2XX response status is treated as success.
+type httpProvider struct {
+	// URL of the gateway.
+	URL string `json:"url"`
+	// HTTP method to use, POST by default.
+	Method string `json:"method"`
+	// Extra HTTP headers to send, e.g. Authorization.
+	Headers map[string]string `json:"headers"`
+	// Sender ID or phone number.
+	Sender string `json:"sender"`
+	// Delivery channel passed to the gateway: "sms" (default) or "voice".
+	Channel string `json:"channel"`
+	// Request timeout in seconds.
+	Timeout int `json:"timeout"`
+
+	client *http.Client
+}
+
+// Init initializes the HTTP provider.
+func (p *httpProvider) Init(jsonconf json.RawMessage) error {
+	if err := json.Unmarshal(jsonconf, p); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if p.URL == "" {
+		return errors.New("gateway url not specified")
+	}
+	if p.Method == "" {
+		p.Method = http.MethodPost
+	}
+	if p.Channel == "" {
+		p.Channel = "sms"
+	}
+	if p.Channel != "sms" && p.Channel != "voice" {
+		return errors.New("unknown channel " + p.Channel)
+	}
+
+	timeout := time.Duration(p.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+	p.client = &http.Client{Timeout: timeout}
+
+	return nil
+}
+
+// Send posts the message to the gateway.
+func (p *httpProvider) Send(to, body string) error {
+	payload, err := json.Marshal(map[string]string{
+		"from":    p.Sender,
+		"to":      to,
+		"body":    body,
+		"channel": p.Channel,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(p.Method, p.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	for key, val := range p.Headers {
+		req.Header.Set(key, val)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+		return fmt.Errorf("gateway responded %d: %s", resp.StatusCode, string(msg))
+	}
+	// Drain the body to let the client reuse the connection.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxResponseSize))
+
+	return nil
+}
+
+func init() {
+	RegisterProvider("http", &httpProvider{})
+}
@@ -0,0 +1,90 @@
+package tel
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPProviderSend(t *testing.T) {
+	type request struct {
+		method string
+		header http.Header
+		body   map[string]string
+	}
+	requests := make(chan request, 1)
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		var body map[string]string
+		json.Unmarshal(data, &body)
+		code := status
+		requests <- request{method: r.Method, header: r.Header, body: body}
+		w.WriteHeader(code)
+		w.Write([]byte("quota exceeded"))
+	}))
+	defer srv.Close()
+
+	p := &httpProvider{}
+	err := p.Init(json.RawMessage(`{"url":"` + srv.URL + `","sender":"+15550000000","channel":"voice",` +
+		`"headers":{"Authorization":"Bearer secret"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = p.Send("+15551234567", "Confirmation code: 123456"); err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	if req.method != http.MethodPost {
+		t.Error("method", req.method)
+	}
+	if got := req.header.Get("Authorization"); got != "Bearer secret" {
+		t.Error("Authorization", got)
+	}
+	if got := req.header.Get("Content-Type"); !strings.HasPrefix(got, "application/json") {
+		t.Error("Content-Type", got)
+	}
+	want := map[string]string{
+		"from":    "+15550000000",
+		"to":      "+15551234567",
+		"body":    "Confirmation code: 123456",
+		"channel": "voice",
+	}
+	for key, val := range want {
+		if req.body[key] != val {
+			t.Errorf("%s = '%s', want '%s'", key, req.body[key], val)
+		}
+	}
+
+	// Non-2XX response is an error which includes the gateway's explanation.
+	status = http.StatusTooManyRequests
+	err = p.Send("+15551234567", "Confirmation code: 123456")
+	<-requests
+	if err == nil || !strings.Contains(err.Error(), "429") || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Error("expected gateway error, got", err)
+	}
+}
+
+func TestHTTPProviderInit(t *testing.T) {
+	p := &httpProvider{}
+	if err := p.Init(json.RawMessage(`{"url":"https://sms.example.com/send"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if p.Method != http.MethodPost || p.Channel != "sms" || p.client.Timeout != defaultHTTPTimeout {
+		t.Error("defaults not applied", p.Method, p.Channel, p.client.Timeout)
+	}
+
+	for _, conf := range []string{
+		`{}`,
+		`{"url":"https://sms.example.com/send","channel":"fax"}`,
+		`not json`,
+	} {
+		if err := (&httpProvider{}).Init(json.RawMessage(conf)); err == nil {
+			t.Error("accepted", conf)
+		}
+	}
+}
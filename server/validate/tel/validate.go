@@ -1,26 +1,196 @@
-// Package tel is an incomplete implementation of SMS or voice credential validator.
+// Package tel is a credential validator which sends a code by SMS or voice call through
+// a pluggable provider.
 package tel
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	textt "text/template"
+	"time"
+
 	"github.com/nyaruka/phonenumbers"
 	"github.com/tinode/chat/server/store"
 	t "github.com/tinode/chat/server/store/types"
+	"github.com/tinode/chat/server/validate/throttle"
+	i18n "golang.org/x/text/language"
 )
 
-const validatorName = "tel"
-
-// Empty placeholder struct.
+// Validator configuration.
 type validator struct {
+	// Base URL of the web client, used in password reset messages.
+	HostUrl string `json:"host_url"`
+	// List of languages supported by templates.
+	Languages []string `json:"languages"`
+	// Path to validation message templates, either a template itself or a literal string.
+	ValidationTemplFile string `json:"validation_templ"`
+	// Optional path to templates for resetting the authentication secret.
+	ResetTemplFile string `json:"reset_secret_templ"`
+	// Optional path to templates for passwordless login by a single-use code.
+	LoginTemplFile string `json:"login_templ"`
+	// Optional response which bypasses the validation.
 	DebugResponse string `json:"debug_response"`
-	MaxRetries    int    `json:"max_retries"`
+	// Number of validation attempts before the number is locked.
+	MaxRetries int `json:"max_retries"`
+	// Number of digits in the confirmation code.
+	CodeLength int `json:"code_length"`
+	// Lifetime of validation codes in seconds.
+	CodeExpireIn int `json:"code_expire_in"`
+	// Limits on how often messages can be sent.
+	Throttle *throttle.Config `json:"throttle"`
+	// Provider which delivers the messages.
+	Provider struct {
+		Name   string          `json:"name"`
+		Config json.RawMessage `json:"config"`
+	} `json:"provider"`
+
+	// Must use index into language array instead of language tags because language.Matcher is brain damaged:
+	// https://github.com/golang/go/issues/24211
+	validationTempl []*textt.Template
+	resetTempl      []*textt.Template
+	loginTempl      []*textt.Template
+	langMatcher     i18n.Matcher
+	provider        Provider
+	codeLifetime    time.Duration
+	throttle        *throttle.Throttle
+}
+
+const (
+	validatorName = "tel"
+
+	maxRetries        = 4
+	defaultCodeLength = 6
+	minCodeLength     = 4
+	maxCodeLength     = 10
+	// Validation codes expire after this time.
+	defaultCodeLifetime = 15 * time.Minute
+)
+
+func resolveTemplatePath(path string) string {
+	// If a relative path is provided, try to resolve it relative to the exec file location,
+	// not whatever directory the user is in.
+	if !filepath.IsAbs(path) {
+		basepath, err := os.Executable()
+		if err == nil {
+			path = filepath.Join(filepath.Dir(basepath), path)
+		}
+	}
+	return path
+}
+
+// loadTemplates reads content templates for each language. The path may be a template itself,
+// e.g. "./templ/sms-validation-{{.Language}}.templ".
+func loadTemplates(name, pathTempl string, languages []string) ([]*textt.Template, error) {
+	pt, err := textt.New(name).Parse(resolveTemplatePath(pathTempl))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(languages) == 0 {
+		// No i18n support. Use defaults.
+		languages = []string{""}
+	}
+
+	templs := make([]*textt.Template, len(languages))
+	buffer := bytes.Buffer{}
+	for idx, lang := range languages {
+		buffer.Reset()
+		if err = pt.Execute(&buffer, map[string]interface{}{"Language": lang}); err != nil {
+			return nil, err
+		}
+		path := buffer.String()
+		if templs[idx], err = textt.ParseFiles(path); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+	return templs, nil
 }
 
-// Init is a noop.
+// Init initializes the validator and the provider.
 func (v *validator) Init(jsonconf string) error {
-	// Implement: Parse config and initialize SMS service.
+	var err error
+	if err = json.Unmarshal([]byte(jsonconf), v); err != nil {
+		return err
+	}
+
+	if v.ValidationTemplFile == "" {
+		return errors.New("validation_templ not specified")
+	}
+	if v.validationTempl, err = loadTemplates("validation", v.ValidationTemplFile, v.Languages); err != nil {
+		return err
+	}
+	if v.ResetTemplFile != "" {
+		if v.resetTempl, err = loadTemplates("reset", v.ResetTemplFile, v.Languages); err != nil {
+			return err
+		}
+	}
+	if v.LoginTemplFile != "" {
+		if v.loginTempl, err = loadTemplates("login", v.LoginTemplFile, v.Languages); err != nil {
+			return err
+		}
+	}
+
+	if len(v.Languages) > 0 {
+		var langTags []i18n.Tag
+		for _, lang := range v.Languages {
+			tag, err := i18n.Parse(lang)
+			if err != nil {
+				return err
+			}
+			langTags = append(langTags, tag)
+		}
+		v.langMatcher = i18n.NewMatcher(langTags)
+	}
+
+	if v.HostUrl != "" {
+		hostUrl, err := url.Parse(v.HostUrl)
+		if err != nil {
+			return err
+		}
+		if !hostUrl.IsAbs() || hostUrl.Hostname() == "" {
+			return errors.New("invalid host_url")
+		}
+		if hostUrl.Path == "" {
+			hostUrl.Path = "/"
+		}
+		v.HostUrl = hostUrl.String()
+	}
+
+	if v.MaxRetries == 0 {
+		v.MaxRetries = maxRetries
+	}
+	if v.CodeLength == 0 {
+		v.CodeLength = defaultCodeLength
+	}
+	if v.CodeLength < minCodeLength || v.CodeLength > maxCodeLength {
+		return errors.New("invalid code_length")
+	}
+
+	v.codeLifetime = time.Duration(v.CodeExpireIn) * time.Second
+	if v.codeLifetime <= 0 {
+		v.codeLifetime = defaultCodeLifetime
+	}
+	v.throttle = throttle.New(validatorName, v.Throttle)
 
-	v.MaxRetries = 1000
-	v.DebugResponse = "123456"
+	if v.Provider.Name == "" {
+		return errors.New("provider not specified")
+	}
+	v.provider = providers[v.Provider.Name]
+	if v.provider == nil {
+		return errors.New("unknown provider " + v.Provider.Name)
+	}
+	if err = v.provider.Init(v.Provider.Config); err != nil {
+		return fmt.Errorf("provider %s: %w", v.Provider.Name, err)
+	}
 
 	return nil
 }
@@ -45,15 +215,88 @@ func (*validator) PreCheck(cred string, params map[string]interface{}) (string,
 	return "", t.ErrMalformed
 }
 
-// Request sends a request for confirmation to the user: makes a record in DB  and nothing else.
-func (*validator) Request(user t.Uid, cred, lang, resp string, tmpToken []byte) (bool, error) {
-	// TODO: actually send a validation SMS or make a call to the provided `cred` here.
-	return true, nil
+// Request sends a confirmation code to the user and saves the expected response.
+func (v *validator) Request(user t.Uid, phone, lang, resp string, tmpToken []byte, remoteAddr string) (bool, error) {
+	// Tel validator cannot accept an immediate response.
+	if resp != "" {
+		return false, t.ErrFailed
+	}
+
+	if err := v.throttle.Allow(phone, remoteAddr); err != nil {
+		return false, err
+	}
+
+	code, err := v.genCode()
+	if err != nil {
+		return false, err
+	}
+
+	body, err := executeTemplate(v.selectTemplate(v.validationTempl, lang), map[string]interface{}{
+		"Code":    code,
+		"HostUrl": v.HostUrl})
+	if err != nil {
+		return false, err
+	}
+
+	// Create or update validation record in DB.
+	isNew, err := store.Users.UpsertCred(&t.Credential{
+		User:   user.String(),
+		Method: validatorName,
+		Value:  phone,
+		Resp:   code})
+	if err != nil {
+		return false, err
+	}
+	if err = v.throttle.Issued(user); err != nil {
+		return false, err
+	}
+
+	// Send the message without blocking. The provider may take long time to respond.
+	go v.send(phone, body)
+
+	return isNew, nil
 }
 
 // ResetSecret sends a message with instructions for resetting an authentication secret.
-func (*validator) ResetSecret(cred, scheme, lang string, tmpToken []byte, params map[string]interface{}) error {
-	// TODO: send SMS with rest instructions.
+// If params contain a "code", the message is a single-use code for passwordless login.
+func (v *validator) ResetSecret(phone, scheme, lang string, tmpToken []byte, params map[string]interface{},
+	remoteAddr string) error {
+	var login, code string
+	if params != nil {
+		login, _ = params["login"].(string)
+		code, _ = params["code"].(string)
+	}
+
+	templates := v.resetTempl
+	if code != "" {
+		templates = v.loginTempl
+	}
+	if templates == nil {
+		// Not configured.
+		return t.ErrUnsupported
+	}
+
+	if err := v.throttle.Allow(phone, remoteAddr); err != nil {
+		return err
+	}
+
+	token := make([]byte, base64.URLEncoding.EncodedLen(len(tmpToken)))
+	base64.URLEncoding.Encode(token, tmpToken)
+
+	body, err := executeTemplate(v.selectTemplate(templates, lang), map[string]interface{}{
+		"Login":   login,
+		"Code":    code,
+		"Cred":    validatorName + ":" + phone,
+		"Token":   string(token),
+		"Scheme":  scheme,
+		"HostUrl": v.HostUrl})
+	if err != nil {
+		return err
+	}
+
+	// Send the message without blocking.
+	go v.send(phone, body)
+
 	return nil
 }
 
@@ -77,6 +320,18 @@ func (v *validator) Check(user t.Uid, resp string) (string, error) {
 		return "", t.ErrCredentials
 	}
 
+	issued, err := v.throttle.IssuedAt(user)
+	if err != nil {
+		return "", err
+	}
+	if issued.IsZero() {
+		// The code was issued before the time of issue was recorded.
+		issued = cred.UpdatedAt
+	}
+	if issued.Add(v.codeLifetime).Before(t.TimeNow()) {
+		return "", t.ErrCodeExpired
+	}
+
 	// Comparing with dummy response too.
 	if cred.Resp == resp || v.DebugResponse == resp {
 		// Valid response, save confirmation.
@@ -99,9 +354,45 @@ func (*validator) Remove(user t.Uid, value string) error {
 	return store.Users.DelCred(user, validatorName, value)
 }
 
-// Implement sending a text message
-func (*validator) send(to, body string) error {
-	return nil
+// selectTemplate picks the template which best matches the language.
+func (v *validator) selectTemplate(templates []*textt.Template, lang string) *textt.Template {
+	if v.langMatcher != nil {
+		_, idx := i18n.MatchStrings(v.langMatcher, lang)
+		return templates[idx]
+	}
+	return templates[0]
+}
+
+// executeTemplate renders the message body. Leading and trailing whitespace is removed.
+func executeTemplate(template *textt.Template, params map[string]interface{}) (string, error) {
+	buffer := new(bytes.Buffer)
+	if err := template.Execute(buffer, params); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buffer.String()), nil
+}
+
+// genCode generates a random numeric code.
+func (v *validator) genCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < v.CodeLength; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	num, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	code := num.String()
+	return strings.Repeat("0", v.CodeLength-len(code)) + code, nil
+}
+
+// send delivers the message through the configured provider.
+func (v *validator) send(to, body string) error {
+	err := v.provider.Send(to, body)
+	if err != nil {
+		log.Println("tel: failed to send message", to, err)
+	}
+	return err
 }
 
 func init() {
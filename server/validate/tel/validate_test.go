@@ -0,0 +1,239 @@
+package tel
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	adapter "github.com/tinode/chat/server/db"
+	"github.com/tinode/chat/server/store"
+	types "github.com/tinode/chat/server/store/types"
+)
+
+// memAdapter keeps credentials and throttle records in memory. Methods which are not used
+// by the validator are not implemented.
+type memAdapter struct {
+	adapter.Adapter
+	open     bool
+	creds    map[string]*types.Credential
+	lockouts map[string]*types.AuthLockout
+}
+
+func (a *memAdapter) GetName() string                   { return "mem" }
+func (a *memAdapter) IsOpen() bool                      { return a.open }
+func (a *memAdapter) SetMaxResults(val int) error       { return nil }
+func (a *memAdapter) Open(config json.RawMessage) error { a.open = true; return nil }
+func (a *memAdapter) CheckDbVersion() error             { return nil }
+
+func (a *memAdapter) CredUpsert(cred *types.Credential) (bool, error) {
+	key := cred.User + ":" + cred.Method
+	old, found := a.creds[key]
+	saved := *cred
+	if found {
+		saved.CreatedAt = old.CreatedAt
+	}
+	a.creds[key] = &saved
+	return !found, nil
+}
+
+func (a *memAdapter) CredGetActive(uid types.Uid, method string) (*types.Credential, error) {
+	cred := a.creds[uid.String()+":"+method]
+	if cred == nil || cred.Done {
+		return nil, nil
+	}
+	copied := *cred
+	return &copied, nil
+}
+
+func (a *memAdapter) CredConfirm(uid types.Uid, method string) error {
+	if cred := a.creds[uid.String()+":"+method]; cred != nil {
+		cred.Done = true
+	}
+	return nil
+}
+
+func (a *memAdapter) CredFail(uid types.Uid, method string) error {
+	if cred := a.creds[uid.String()+":"+method]; cred != nil {
+		cred.Retries++
+	}
+	return nil
+}
+
+func (a *memAdapter) AuthLockoutGet(key string) (*types.AuthLockout, error) {
+	if rec := a.lockouts[key]; rec != nil {
+		copied := *rec
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+func (a *memAdapter) AuthLockoutUpsert(lockout *types.AuthLockout) error {
+	saved := *lockout
+	a.lockouts[lockout.Id] = &saved
+	return nil
+}
+
+func (a *memAdapter) AuthLockoutReplace(old, lockout *types.AuthLockout) (bool, error) {
+	current := a.lockouts[lockout.Id]
+	if (old == nil) != (current == nil) ||
+		old != nil && (!old.UpdatedAt.Equal(current.UpdatedAt) || old.Failures != current.Failures) {
+		return false, nil
+	}
+	return true, a.AuthLockoutUpsert(lockout)
+}
+
+var mem = &memAdapter{
+	creds:    make(map[string]*types.Credential),
+	lockouts: make(map[string]*types.AuthLockout),
+}
+
+func TestMain(m *testing.M) {
+	store.RegisterAdapter(mem)
+	if err := store.Open(1, json.RawMessage(`{"uid_key":"la6YsO+bNX/+XIkOqc5Svw=="}`)); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestValidator creates a validator which sends messages to a fake gateway. Message bodies
+// received by the gateway are sent to the returned channel.
+func newTestValidator(t *testing.T) (*validator, <-chan string) {
+	messages := make(chan string, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		messages <- msg["to"] + " " + msg["body"]
+	}))
+	t.Cleanup(srv.Close)
+
+	templ, err := ioutil.TempFile("", "sms-validation-*.templ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(templ.Name()) })
+	templ.WriteString("Your code: {{.Code}}\n")
+	templ.Close()
+
+	conf, _ := json.Marshal(map[string]interface{}{
+		"validation_templ": templ.Name(),
+		"throttle":         map[string]interface{}{"disabled": true},
+		"provider": map[string]interface{}{
+			"name":   "http",
+			"config": map[string]interface{}{"url": srv.URL},
+		},
+	})
+	v := &validator{}
+	if err = v.Init(string(conf)); err != nil {
+		t.Fatal(err)
+	}
+	return v, messages
+}
+
+// requestCode asks the validator to send a code and returns the code received by the gateway.
+func requestCode(t *testing.T, v *validator, messages <-chan string, user types.Uid, phone string) string {
+	if _, err := v.Request(user, phone, "", "", nil, "203.0.113.7"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-messages:
+		prefix := phone + " Your code: "
+		if !strings.HasPrefix(msg, prefix) {
+			t.Fatal("unexpected message", msg)
+		}
+		code := strings.TrimPrefix(msg, prefix)
+		if len(code) != defaultCodeLength {
+			t.Fatal("unexpected code", code)
+		}
+		return code
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not sent")
+	}
+	return ""
+}
+
+func TestCheck(t *testing.T) {
+	v, messages := newTestValidator(t)
+	user := types.Uid(1001)
+	const phone = "+15551234567"
+
+	code := requestCode(t, v, messages, user, phone)
+
+	if _, err := v.Check(user, ""); err != types.ErrCredentials {
+		t.Error("empty response:", err)
+	}
+	if _, err := v.Check(user, "x"+code); err != types.ErrCredentials {
+		t.Error("wrong response:", err)
+	}
+	if got := mem.creds[user.String()+":tel"].Retries; got != 1 {
+		t.Error("retries", got)
+	}
+
+	value, err := v.Check(user, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != phone {
+		t.Error("confirmed", value)
+	}
+	if !mem.creds[user.String()+":tel"].Done {
+		t.Error("credential not confirmed")
+	}
+
+	// Nothing left to confirm.
+	if _, err := v.Check(user, code); err != types.ErrNotFound {
+		t.Error("confirmed twice:", err)
+	}
+}
+
+func TestCheckRetries(t *testing.T) {
+	v, messages := newTestValidator(t)
+	user := types.Uid(1002)
+
+	code := requestCode(t, v, messages, user, "+15551234568")
+	for i := 0; i <= v.MaxRetries; i++ {
+		if _, err := v.Check(user, "wrong"); err != types.ErrCredentials {
+			t.Fatal("attempt", i, err)
+		}
+	}
+	// Even the correct code is rejected after too many attempts.
+	if _, err := v.Check(user, code); err != types.ErrPolicy {
+		t.Error("expected policy error, got", err)
+	}
+}
+
+func TestCheckExpired(t *testing.T) {
+	v, messages := newTestValidator(t)
+	user := types.Uid(1003)
+
+	code := requestCode(t, v, messages, user, "+15551234569")
+
+	// Move the time of issue back past the lifetime of the code.
+	rec := mem.lockouts["tel:code:"+user.UserId()]
+	if rec == nil {
+		t.Fatal("time of issue not recorded")
+	}
+	rec.UpdatedAt = rec.UpdatedAt.Add(-v.codeLifetime - time.Second)
+	if _, err := v.Check(user, code); err != types.ErrCodeExpired {
+		t.Error("expected expired code, got", err)
+	}
+
+	// Codes issued before the time of issue was recorded expire based on the credential.
+	delete(mem.lockouts, "tel:code:"+user.UserId())
+	mem.creds[user.String()+":tel"].UpdatedAt = time.Now().Add(-v.codeLifetime - time.Second)
+	if _, err := v.Check(user, code); err != types.ErrCodeExpired {
+		t.Error("expected expired code, got", err)
+	}
+	mem.creds[user.String()+":tel"].UpdatedAt = time.Now()
+	if _, err := v.Check(user, code); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,160 @@
+// Package throttle limits how often credential validators send messages, so the server cannot be
+// used to flood someone's mailbox or phone.
+package throttle
+
+import (
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// A new message to the same credential cannot be sent sooner than this.
+	defaultResendAfter = time.Minute
+	// A new message requested from the same IP address cannot be sent sooner than this.
+	defaultIPResendAfter = 5 * time.Second
+	// Maximum number of messages sent to the same credential per day.
+	defaultDailyLimit = 10
+	// Maximum number of messages requested from the same IP address per day.
+	defaultIPDailyLimit = 100
+
+	day = 24 * time.Hour
+)
+
+// Config is the configuration of the throttle.
+type Config struct {
+	// Disable throttling.
+	Disabled bool `json:"disabled"`
+	// Minimum interval between messages sent to the same credential in seconds.
+	ResendAfter int `json:"resend_after"`
+	// Minimum interval between messages requested from the same IP address in seconds.
+	IPResendAfter int `json:"ip_resend_after"`
+	// Maximum number of messages sent to the same credential per day.
+	DailyLimit int `json:"daily_limit"`
+	// Maximum number of messages requested from the same IP address per day.
+	IPDailyLimit int `json:"ip_daily_limit"`
+}
+
+// Throttle keeps track of messages sent by a validator.
+type Throttle struct {
+	// Name of the validator, used as a namespace of the records.
+	method        string
+	disabled      bool
+	resendAfter   time.Duration
+	ipResendAfter time.Duration
+	dailyLimit    int
+	ipDailyLimit  int
+}
+
+// New creates a throttle for the given validator. The config may be nil.
+func New(method string, config *Config) *Throttle {
+	if config == nil {
+		config = &Config{}
+	}
+
+	th := &Throttle{method: method, disabled: config.Disabled}
+
+	th.resendAfter = time.Duration(config.ResendAfter) * time.Second
+	if th.resendAfter <= 0 {
+		th.resendAfter = defaultResendAfter
+	}
+	th.ipResendAfter = time.Duration(config.IPResendAfter) * time.Second
+	if th.ipResendAfter <= 0 {
+		th.ipResendAfter = defaultIPResendAfter
+	}
+	th.dailyLimit = config.DailyLimit
+	if th.dailyLimit <= 0 {
+		th.dailyLimit = defaultDailyLimit
+	}
+	th.ipDailyLimit = config.IPDailyLimit
+	if th.ipDailyLimit <= 0 {
+		th.ipDailyLimit = defaultIPDailyLimit
+	}
+
+	return th
+}
+
+// count verifies that one more message can be sent given the record of messages sent earlier,
+// which may be nil. Returns the updated record to save.
+func count(rec *t.AuthLockout, resendAfter time.Duration, dailyLimit int, now time.Time) (*t.AuthLockout, error) {
+	if rec == nil || now.Sub(rec.CreatedAt) >= day {
+		// First message or the daily window has passed: start counting anew.
+		rec = &t.AuthLockout{}
+		rec.CreatedAt = now
+	} else {
+		if now.Before(rec.UpdatedAt.Add(resendAfter)) {
+			return nil, t.ErrRateLimited
+		}
+		if rec.Failures >= dailyLimit {
+			return nil, t.ErrDailyLimit
+		}
+	}
+
+	rec.UpdatedAt = now
+	rec.Failures++
+	// The next message is allowed after this time.
+	rec.LockedUntil = now.Add(resendAfter)
+
+	return rec, nil
+}
+
+// check atomically counts the message under the given key if it can be sent.
+func (th *Throttle) check(key string, resendAfter time.Duration, dailyLimit int, now time.Time) error {
+	_, err := store.Users.UpdateAuthLockout(th.method, key, func(rec *t.AuthLockout) (*t.AuthLockout, error) {
+		return count(rec, resendAfter, dailyLimit, now)
+	})
+	return err
+}
+
+// Allow checks if a message can be sent to the credential value at the request of the client
+// with the given address, and if so, counts the message. Returns types.ErrRateLimited if the
+// previous message was sent too recently, types.ErrDailyLimit if too many messages were sent today.
+// The address is counted first: a request rejected because of the credential limits uses up
+// the requester's quota, not the credential's.
+func (th *Throttle) Allow(value, remoteAddr string) error {
+	if th.disabled {
+		return nil
+	}
+
+	now := t.TimeNow()
+
+	if ip := auth.RemoteIP(remoteAddr); ip != "" {
+		if err := th.check("ip:"+ip, th.ipResendAfter, th.ipDailyLimit, now); err != nil {
+			return err
+		}
+	}
+	return th.check("send:"+value, th.resendAfter, th.dailyLimit, now)
+}
+
+// Issued records the time when a new code was sent to the user.
+func (th *Throttle) Issued(user t.Uid) error {
+	now := t.TimeNow()
+	_, err := store.Users.UpdateAuthLockout(th.method, "code:"+user.UserId(),
+		func(rec *t.AuthLockout) (*t.AuthLockout, error) {
+			issued := &t.AuthLockout{}
+			issued.CreatedAt = now
+			issued.UpdatedAt = now
+			if rec != nil {
+				// Count of codes issued makes concurrent updates distinct even if the time is the same.
+				issued.Failures = rec.Failures + 1
+			}
+			return issued, nil
+		})
+	return err
+}
+
+// IssuedAt returns the time when the last code was sent to the user or zero time if unknown.
+func (th *Throttle) IssuedAt(user t.Uid) (time.Time, error) {
+	var issued time.Time
+	// The record is read through the same path it's updated by and is left unchanged.
+	_, err := store.Users.UpdateAuthLockout(th.method, "code:"+user.UserId(),
+		func(rec *t.AuthLockout) (*t.AuthLockout, error) {
+			if rec != nil {
+				issued = rec.UpdatedAt
+			}
+			return nil, nil
+		})
+	return issued, err
+}
@@ -0,0 +1,51 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+
+	t "github.com/tinode/chat/server/store/types"
+)
+
+func TestCount(test *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	record := func(created, updated time.Duration, sent int) *t.AuthLockout {
+		rec := &t.AuthLockout{Failures: sent}
+		rec.CreatedAt = now.Add(-created)
+		rec.UpdatedAt = now.Add(-updated)
+		return rec
+	}
+
+	cases := []struct {
+		name    string
+		rec     *t.AuthLockout
+		err     error
+		sent    int
+		created time.Time
+	}{
+		{"first message", nil, nil, 1, now},
+		{"after resend interval", record(time.Hour, time.Minute, 3), nil, 4, now.Add(-time.Hour)},
+		{"too soon", record(time.Hour, 59*time.Second, 3), t.ErrRateLimited, 0, time.Time{}},
+		{"daily limit", record(time.Hour, time.Hour, 10), t.ErrDailyLimit, 0, time.Time{}},
+		{"below daily limit", record(time.Hour, time.Hour, 9), nil, 10, now.Add(-time.Hour)},
+		{"window passed", record(day, time.Hour, 10), nil, 1, now},
+		{"window passed, recent message", record(day+time.Second, time.Second, 10), nil, 1, now},
+	}
+	for _, tc := range cases {
+		rec, err := count(tc.rec, time.Minute, 10, now)
+		if err != tc.err {
+			test.Errorf("%s: error %v, expected %v", tc.name, err, tc.err)
+			continue
+		}
+		if err != nil {
+			if rec != nil {
+				test.Errorf("%s: expected no record on error", tc.name)
+			}
+			continue
+		}
+		if rec.Failures != tc.sent || !rec.CreatedAt.Equal(tc.created) || !rec.UpdatedAt.Equal(now) ||
+			!rec.LockedUntil.Equal(now.Add(time.Minute)) {
+			test.Errorf("%s: unexpected record %+v", tc.name, rec)
+		}
+	}
+}
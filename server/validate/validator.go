@@ -13,6 +13,8 @@ type Validator interface {
 	// PreCheck pre-validates the credential without sending an actual request for validation:
 	// check uniqueness (if appropriate), format, etc
 	// Returns normalized credential prefixed with an appropriate namespace prefix.
+	// If params["tagOnly"] is true, the credential is only being converted to a tag, e.g. for search,
+	// and checks which reject otherwise valid credentials by policy should be skipped.
 	PreCheck(cred string, params map[string]interface{}) (string, error)
 
 	// Request sends a request for confirmation to the user. Returns true if it's a new credential,
@@ -22,7 +24,9 @@ type Validator interface {
 	//   lang: user's human language as repored in the session.
 	//   resp: optional response if user already has it (i.e. captcha/recaptcha).
 	//   tmpToken: temporary authentication token to include in the request.
-	Request(user t.Uid, cred, lang, resp string, tmpToken []byte) (bool, error)
+	//   remoteAddr: address of the client which made the request.
+	// Returns types.ErrRateLimited or types.ErrDailyLimit if messages are requested too often.
+	Request(user t.Uid, cred, lang, resp string, tmpToken []byte, remoteAddr string) (bool, error)
 
 	// ResetSecret sends a message with instructions for resetting an authentication secret.
 	//   cred: address to use for the message.
@@ -30,10 +34,11 @@ type Validator interface {
 	//   lang: human language as reported in the session.
 	//   tmpToken: temporary authentication token
 	//   params: authentication params.
-	ResetSecret(cred, scheme, lang string, tmpToken []byte, params map[string]interface{}) error
+	//   remoteAddr: address of the client which made the request.
+	ResetSecret(cred, scheme, lang string, tmpToken []byte, params map[string]interface{}, remoteAddr string) error
 
 	// Check checks validity of user's response.
-	// Returns the value of validated credential on success.
+	// Returns the value of validated credential on success, types.ErrCodeExpired if the code is too old.
 	Check(user t.Uid, resp string) (string, error)
 
 	// Remove deletes or deactivates user's given value.
@@ -42,3 +47,12 @@ type Validator interface {
 	// Delete deletes user's record.
 	Delete(user t.Uid) error
 }
+
+// Hooks for reporting metrics. The server replaces them with functions which publish
+// the metrics before the validators are initialized.
+var (
+	// StatsRegisterInt registers an integer metric.
+	StatsRegisterInt = func(name string) {}
+	// StatsInc increments an integer metric.
+	StatsInc = func(name string, val int) {}
+)
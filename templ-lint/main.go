@@ -0,0 +1,117 @@
+// Command-line utility to check and preview email templates of the Tinode server.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tinode/chat/server/validate/email"
+	jcr "github.com/tinode/jsonco"
+)
+
+// Subset of the server config needed to find the templates.
+type configType struct {
+	Validator map[string]struct {
+		Config json.RawMessage `json:"config"`
+	} `json:"acc_validation"`
+}
+
+func main() {
+	var conffile = flag.String("config", "./tinode.conf", "Tinode server config file")
+	var validator = flag.String("validator", "email", "Name of the email validator in 'acc_validation' section of the config")
+	var templRoot = flag.String("templ_root", "", "Directory to resolve relative template paths against; defaults to the directory of the config file")
+	var to = flag.String("to", "alice@example.com", "Recipient of the rendered messages")
+	var paramsJSON = flag.String("params", "", "JSON object with template parameters to override sample values, e.g. {\"Code\": \"000000\"}")
+	var outDir = flag.String("out", "", "Directory to write rendered messages to as <kind>-<language>.eml; messages are written to stdout if not set")
+	var quiet = flag.Bool("quiet", false, "Only check the templates, do not output rendered messages")
+
+	flag.Parse()
+
+	var config configType
+	if file, err := os.Open(*conffile); err != nil {
+		log.Fatalln("Failed to read config file:", err)
+	} else {
+		jr := jcr.New(file)
+		if err = json.NewDecoder(jr).Decode(&config); err != nil {
+			switch jerr := err.(type) {
+			case *json.SyntaxError:
+				lnum, cnum, _ := jr.LineAndChar(jerr.Offset)
+				log.Fatalf("Syntax error in config file at %d:%d (offset %d bytes): %s",
+					lnum, cnum, jerr.Offset, jerr.Error())
+			default:
+				log.Fatal("Failed to parse config file: ", err)
+			}
+		}
+		file.Close()
+	}
+
+	vconf, ok := config.Validator[*validator]
+	if !ok || len(vconf.Config) == 0 {
+		log.Fatalf("Validator '%s' is not configured in %s", *validator, *conffile)
+	}
+
+	var params map[string]interface{}
+	if *paramsJSON != "" {
+		if err := json.Unmarshal([]byte(*paramsJSON), &params); err != nil {
+			log.Fatalln("Invalid params:", err)
+		}
+	}
+
+	if *templRoot == "" {
+		if abs, err := filepath.Abs(*conffile); err == nil {
+			*templRoot = filepath.Dir(abs)
+		}
+	}
+
+	previews, err := email.PreviewTemplates(string(vconf.Config), *templRoot, *to, params)
+	if err != nil {
+		log.Fatalln("Invalid validator config:", err)
+	}
+
+	if *outDir != "" && !*quiet {
+		if err := os.MkdirAll(*outDir, 0755); err != nil {
+			log.Fatalln("Failed to create output directory:", err)
+		}
+	}
+
+	failed := 0
+	for _, p := range previews {
+		name := p.Kind
+		if p.Language != "" {
+			name += "-" + p.Language
+		}
+
+		status := "OK"
+		if p.Err != nil {
+			status = "ERROR: " + p.Err.Error()
+			failed++
+		}
+		if len(p.Missing) > 0 {
+			status += "; missing parts: " + strings.Join(p.Missing, ", ")
+		}
+		log.Printf("%s (%s): %s", name, p.Path, status)
+
+		if p.Message == nil || *quiet {
+			continue
+		}
+		if *outDir != "" {
+			path := filepath.Join(*outDir, name+".eml")
+			if err := ioutil.WriteFile(path, p.Message, 0644); err != nil {
+				log.Fatalln("Failed to write message:", err)
+			}
+		} else {
+			fmt.Printf("==== %s ====\n%s\n", name, p.Message)
+		}
+	}
+
+	if failed > 0 {
+		log.Printf("%d of %d templates failed", failed, len(previews))
+		os.Exit(1)
+	}
+}